@@ -0,0 +1,74 @@
+// genuserstore generates type-safe Go code from a tenant's userstore configuration. It is
+// intended to be run with go generate, e.g.
+//
+//	//go:generate go run userclouds.com/cmd/genuserstore -out userstore_generated.go
+//
+// By default it generates types for composite data types and helpers for composite and address
+// columns. With -client, it also generates a typed function for each accessor and mutator.
+//
+// The tenant and credentials are read from the USERCLOUDS_TENANT_URL, USERCLOUDS_CLIENT_ID and
+// USERCLOUDS_CLIENT_SECRET environment variables, which may also be set in a .env file.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/codegen"
+	"userclouds.com/infra/jsonclient"
+)
+
+func main() {
+	packageName := flag.String("package", os.Getenv("GOPACKAGE"), "package name for the generated file (defaults to $GOPACKAGE, which go generate sets)")
+	out := flag.String("out", "userstore_generated.go", "path of the generated file")
+	generateClient := flag.Bool("client", false, "also generate typed functions for executing accessors and mutators")
+	flag.Parse()
+
+	if *packageName == "" {
+		log.Fatal("-package must be specified when not run by go generate")
+	}
+
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("error loading .env file: %v", err)
+	}
+
+	tenantURL := os.Getenv("USERCLOUDS_TENANT_URL")
+	clientID := os.Getenv("USERCLOUDS_CLIENT_ID")
+	clientSecret := os.Getenv("USERCLOUDS_CLIENT_SECRET")
+	if tenantURL == "" || clientID == "" || clientSecret == "" {
+		log.Fatal("missing one or more required environment variables: USERCLOUDS_TENANT_URL, USERCLOUDS_CLIENT_ID, USERCLOUDS_CLIENT_SECRET")
+	}
+
+	ts, err := jsonclient.ClientCredentialsForURL(tenantURL, clientID, clientSecret, nil)
+	if err != nil {
+		log.Fatalf("error creating token source: %v", err)
+	}
+	client, err := idp.NewClient(tenantURL, idp.JSONClient(ts, jsonclient.StopLogging()))
+	if err != nil {
+		log.Fatalf("error creating client: %v", err)
+	}
+
+	ctx := context.Background()
+	schema, err := codegen.LoadSchema(ctx, client)
+	if err != nil {
+		log.Fatalf("error loading userstore schema: %v", err)
+	}
+
+	generate := codegen.GenerateComposites
+	if *generateClient {
+		generate = codegen.GenerateClient
+	}
+	src, err := generate(*packageName, *schema)
+	if err != nil {
+		log.Fatalf("error generating code: %v", err)
+	}
+
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		log.Fatalf("error writing %s: %v", *out, err)
+	}
+}
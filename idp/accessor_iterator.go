@@ -0,0 +1,219 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// TruncationHandler is invoked by an AccessorIterator when the server indicates that a page of
+// results was truncated. Returning nil continues iteration, while returning an error stops
+// iteration and surfaces the error via AccessorIterator.Err.
+type TruncationHandler func(ctx context.Context, resp *ExecuteAccessorResponse) error
+
+// OnTruncated returns an Option that will cause an AccessorIterator to call the specified handler,
+// rather than stopping with ErrAccessorResultsTruncated, when a page of results is truncated
+func OnTruncated(handler TruncationHandler) Option {
+	return optFunc(func(opts *options) {
+		opts.truncationHandler = handler
+	})
+}
+
+// AccessorIterator pages through all of the results of executing an accessor, following the
+// pagination cursors returned by the server. The iterator is not safe for concurrent use.
+type AccessorIterator struct {
+	client         *Client
+	accessorID     uuid.UUID
+	clientContext  policy.ClientContext
+	selectorValues userstore.UserSelectorValues
+	opts           []Option
+	handler        TruncationHandler
+
+	forward   bool
+	cursor    pagination.Cursor
+	started   bool
+	done      bool
+	truncated bool
+
+	page     []string
+	index    int
+	current  string
+	err      error
+	finalErr error
+}
+
+// NewAccessorIterator returns an iterator over all results of executing the specified accessor.
+// Pagination options (e.g. sort key, limit, starting cursor) are honored for the first page, and
+// subsequent pages are fetched in the same direction until the results are exhausted.
+func (c *Client) NewAccessorIterator(
+	accessorID uuid.UUID,
+	clientContext policy.ClientContext,
+	selectorValues userstore.UserSelectorValues,
+	opts ...Option,
+) *AccessorIterator {
+	options := c.options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	it := &AccessorIterator{
+		client:         c,
+		accessorID:     accessorID,
+		clientContext:  clientContext,
+		selectorValues: selectorValues,
+		opts:           opts,
+		handler:        options.truncationHandler,
+	}
+
+	pager, err := pagination.ApplyOptions(options.paginationOptions...)
+	if err != nil {
+		it.err = ucerr.Wrap(err)
+		return it
+	}
+	it.forward = pager.IsForward()
+	it.cursor = pager.GetCursor()
+
+	return it
+}
+
+// Next advances the iterator to the next result, fetching the next page from the server if
+// necessary. It returns false when there are no more results, the context is cancelled, or
+// an error occurs; Err should be checked once Next returns false.
+func (it *AccessorIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+
+	if err := ctx.Err(); err != nil {
+		it.err = ucerr.Wrap(err)
+		return false
+	}
+
+	for it.index >= len(it.page) {
+		if it.done {
+			it.err = it.finalErr
+			return false
+		}
+
+		if err := it.fetchPage(ctx); err != nil {
+			it.err = ucerr.Wrap(err)
+			return false
+		}
+	}
+
+	it.current = it.page[it.index]
+	it.index++
+	return true
+}
+
+func (it *AccessorIterator) fetchPage(ctx context.Context) error {
+	opts := it.opts
+	if it.started {
+		opts = append(append([]Option{}, it.opts...), it.cursorOption())
+	}
+	it.started = true
+
+	resp, err := it.client.ExecuteAccessor(ctx, it.accessorID, it.clientContext, it.selectorValues, opts...)
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	it.page = resp.Data
+	it.index = 0
+
+	if resp.Truncated {
+		it.truncated = true
+		if it.handler == nil {
+			// still return the rows we received, but stop once they have been consumed
+			it.done = true
+			it.finalErr = ucerr.Wrap(ErrAccessorResultsTruncated)
+			return nil
+		}
+		if err := it.handler(ctx, resp); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	if it.forward {
+		it.done = !resp.HasNext
+		it.cursor = resp.Next
+	} else {
+		it.done = !resp.HasPrev
+		it.cursor = resp.Prev
+	}
+
+	return nil
+}
+
+func (it *AccessorIterator) cursorOption() Option {
+	if it.forward {
+		return Pagination(pagination.StartingAfter(it.cursor))
+	}
+	return Pagination(pagination.EndingBefore(it.cursor))
+}
+
+// Value returns the raw JSON string for the current result
+func (it *AccessorIterator) Value() string {
+	return it.current
+}
+
+// Record decodes the current result into a userstore.Record
+func (it *AccessorIterator) Record() (userstore.Record, error) {
+	var r userstore.Record
+	if err := it.Decode(&r); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return r, nil
+}
+
+// Decode unmarshals the current result into v, which should be a pointer to a struct
+// with json tags matching the accessor's output column names
+func (it *AccessorIterator) Decode(v interface{}) error {
+	if err := json.Unmarshal([]byte(it.current), v); err != nil {
+		return ucerr.Wrap(err)
+	}
+	return nil
+}
+
+// Err returns the error, if any, that stopped iteration. It returns ErrAccessorResultsTruncated
+// if a truncated page was encountered and no TruncationHandler was specified.
+func (it *AccessorIterator) Err() error {
+	return it.err
+}
+
+// Truncated returns true if any page fetched so far was truncated by the server
+func (it *AccessorIterator) Truncated() bool {
+	return it.truncated
+}
+
+// ExecuteAccessorAll executes an accessor, paging through all results and decoding each one into a T
+func ExecuteAccessorAll[T any](
+	ctx context.Context,
+	c *Client,
+	accessorID uuid.UUID,
+	clientContext policy.ClientContext,
+	selectorValues userstore.UserSelectorValues,
+	opts ...Option,
+) ([]T, error) {
+	it := c.NewAccessorIterator(accessorID, clientContext, selectorValues, opts...)
+
+	var results []T
+	for it.Next(ctx) {
+		var result T
+		if err := it.Decode(&result); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		results = append(results, result)
+	}
+	if err := it.Err(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return results, nil
+}
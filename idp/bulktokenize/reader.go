@@ -0,0 +1,103 @@
+package bulktokenize
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Item is a single value to tokenize
+type Item struct {
+	// Index is the 0-based position of the item in the input, and is set by the Reader
+	Index int
+
+	Data         string
+	Transformer  userstore.ResourceID
+	AccessPolicy userstore.ResourceID
+}
+
+// Validate implements Validateable
+func (i Item) Validate() error {
+	if err := i.Transformer.Validate(); err != nil {
+		return ucerr.Wrap(err)
+	}
+	if err := i.AccessPolicy.Validate(); err != nil {
+		return ucerr.Wrap(err)
+	}
+	return nil
+}
+
+// Reader reads the items to tokenize, returning io.EOF once all items have been read. If a single
+// item can't be read, Read returns an Item with only its Index set along with the error, so that
+// the item can be reported as failed without stopping the job.
+type Reader interface {
+	Read() (*Item, error)
+}
+
+type sliceReader struct {
+	items []Item
+	next  int
+}
+
+// NewSliceReader returns a Reader for items that are already in memory, setting their indexes
+func NewSliceReader(items []Item) Reader {
+	return &sliceReader{items: items}
+}
+
+// Read implements Reader
+func (s *sliceReader) Read() (*Item, error) {
+	if s.next >= len(s.items) {
+		return nil, io.EOF
+	}
+	item := s.items[s.next]
+	item.Index = s.next
+	s.next++
+	return &item, nil
+}
+
+type lineReader struct {
+	scanner      *bufio.Scanner
+	transformer  userstore.ResourceID
+	accessPolicy userstore.ResourceID
+	count        int
+}
+
+// maxLineLength is the longest value NewLineReader accepts
+const maxLineLength = 1024 * 1024
+
+// NewLineReader returns a Reader that reads one value per line, tokenizing every value with the
+// same transformer and access policy. Every line is an item, so result indexes match line numbers
+// minus one, and empty lines are reported as failed.
+func NewLineReader(r io.Reader, transformer userstore.ResourceID, accessPolicy userstore.ResourceID) Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	return &lineReader{scanner: scanner, transformer: transformer, accessPolicy: accessPolicy}
+}
+
+// Read implements Reader
+func (l *lineReader) Read() (*Item, error) {
+	if !l.scanner.Scan() {
+		if err := l.scanner.Err(); err != nil {
+			return nil, ucerr.Errorf("could not read line %d: %v", l.count+1, err)
+		}
+		return nil, io.EOF
+	}
+
+	index := l.count
+	l.count++
+
+	data := strings.TrimSuffix(l.scanner.Text(), "\r")
+	if data == "" {
+		return &Item{Index: index}, ucerr.Friendlyf(nil, "line %d is empty", index+1)
+	}
+
+	return &Item{
+		Index:        index,
+		Data:         data,
+		Transformer:  l.transformer,
+		AccessPolicy: l.accessPolicy,
+	}, nil
+}
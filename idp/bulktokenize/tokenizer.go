@@ -0,0 +1,486 @@
+// Package bulktokenize tokenizes large numbers of values with LookupOrCreateTokens, splitting them
+// into chunks that are sent concurrently, retrying rate-limited requests, and reporting invalid
+// items per item rather than failing the whole job. Errors that would fail every request, like
+// authorization failures, stop the job instead. Results are produced in input order as chunks complete,
+// so inputs of millions of values can be streamed without holding them in memory.
+package bulktokenize
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+const (
+	defaultChunkSize     = 1000
+	defaultMaxChunkBytes = 1024 * 1024
+	defaultConcurrency   = 4
+	defaultMaxRetries    = 3
+	initialBackoff       = 500 * time.Millisecond
+	maxBackoff           = 30 * time.Second
+)
+
+// Result describes the outcome of tokenizing a single item
+type Result struct {
+	Index    int    `json:"index"`
+	Token    string `json:"token,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// Summary describes the outcome of a job
+type Summary struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Requests  int `json:"requests"`
+}
+
+type options struct {
+	chunkSize     int
+	maxChunkBytes int
+	concurrency   int
+	maxRetries    int
+	results       io.Writer
+}
+
+// Option makes Tokenizer extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// ChunkSize returns an Option that sets the maximum number of items sent in one request, which defaults to 1000
+func ChunkSize(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.chunkSize = n
+	})
+}
+
+// MaxChunkBytes returns an Option that sets the maximum total size of the values sent in one
+// request, which defaults to 1MB. A single larger value is still sent in a chunk of its own.
+func MaxChunkBytes(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.maxChunkBytes = n
+	})
+}
+
+// Concurrency returns an Option that sets the maximum number of chunks tokenized in parallel
+func Concurrency(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.concurrency = n
+	})
+}
+
+// MaxRetries returns an Option that sets how many times a chunk is retried after a rate limit or server error
+func MaxRetries(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.maxRetries = n
+	})
+}
+
+// Results returns an Option that will cause a JSON-encoded Result to be written to w for each item, in input order
+func Results(w io.Writer) Option {
+	return optFunc(func(opts *options) {
+		opts.results = w
+	})
+}
+
+// Tokenizer tokenizes values in bulk. Because it uses LookupOrCreateTokens, values whose transformer
+// has ReuseExistingToken set get their existing token rather than a new one, and identical items
+// within a chunk are only sent once.
+type Tokenizer struct {
+	client  *idp.TokenizerClient
+	options options
+}
+
+// NewTokenizer returns a Tokenizer that uses client to tokenize values
+func NewTokenizer(client *idp.TokenizerClient, opts ...Option) (*Tokenizer, error) {
+	options := options{
+		chunkSize:     defaultChunkSize,
+		maxChunkBytes: defaultMaxChunkBytes,
+		concurrency:   defaultConcurrency,
+		maxRetries:    defaultMaxRetries,
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if options.chunkSize < 1 {
+		return nil, ucerr.Errorf("chunk size must be at least 1 (got %d)", options.chunkSize)
+	}
+	if options.maxChunkBytes < 1 {
+		return nil, ucerr.Errorf("max chunk bytes must be at least 1 (got %d)", options.maxChunkBytes)
+	}
+	if options.concurrency < 1 {
+		return nil, ucerr.Errorf("concurrency must be at least 1 (got %d)", options.concurrency)
+	}
+	if options.maxRetries < 0 {
+		return nil, ucerr.Errorf("max retries can't be negative (got %d)", options.maxRetries)
+	}
+
+	return &Tokenizer{client: client, options: options}, nil
+}
+
+// entry is an item read for a chunk, or the error reading it
+type entry struct {
+	item Item
+	err  error
+}
+
+type chunk struct {
+	seq     int
+	entries []entry
+}
+
+type chunkResult struct {
+	seq      int
+	results  []Result
+	requests int
+	err      error
+}
+
+// Tokenize tokenizes items held in memory, returning a result for each item in the same order. If
+// the job stops early, the results of the items completed before it stopped are returned along
+// with the error.
+func (t *Tokenizer) Tokenize(ctx context.Context, items []Item) ([]Result, *Summary, error) {
+	results := make([]Result, 0, len(items))
+	summary, err := t.Stream(ctx, NewSliceReader(items), func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		return results, summary, ucerr.Wrap(err)
+	}
+	return results, summary, nil
+}
+
+// Stream tokenizes every item read from r, calling emit with each result in input order. Only a
+// bounded number of chunks are held in memory at once. If emit returns an error, or a request fails
+// for a reason that isn't specific to its items, the job stops and the error is returned.
+func (t *Tokenizer) Stream(ctx context.Context, r Reader, emit func(Result) error) (*Summary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var encoder *json.Encoder
+	if t.options.results != nil {
+		encoder = json.NewEncoder(t.options.results)
+	}
+
+	// chunks that have been read but not yet emitted, which bounds memory use
+	inflight := make(chan struct{}, 2*t.options.concurrency)
+	chunks := make(chan chunk)
+	completed := make(chan chunkResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < t.options.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				results, requests, err := t.tokenizeChunk(ctx, c.entries)
+				completed <- chunkResult{seq: c.seq, results: results, requests: requests, err: err}
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(chunks)
+		readErr = t.readChunks(ctx, r, inflight, chunks)
+	}()
+	go func() {
+		wg.Wait()
+		close(completed)
+	}()
+
+	var summary Summary
+	var emitErr, requestErr error
+	pending := map[int]chunkResult{}
+	next := 0
+	for cr := range completed {
+		if requestErr != nil {
+			// drain the workers, which stop as soon as they see the cancelled context
+			continue
+		}
+		if cr.err != nil {
+			requestErr = cr.err
+			cancel()
+			continue
+		}
+		pending[cr.seq] = cr
+		for {
+			ready, found := pending[next]
+			if !found {
+				break
+			}
+			delete(pending, next)
+			next++
+			summary.Requests += ready.requests
+
+			for _, res := range ready.results {
+				if emitErr != nil {
+					break
+				}
+				if res.Error == "" {
+					summary.Succeeded++
+				} else {
+					summary.Failed++
+				}
+				if encoder != nil {
+					if err := encoder.Encode(res); err != nil {
+						emitErr = ucerr.Wrap(err)
+						break
+					}
+				}
+				if err := emit(res); err != nil {
+					emitErr = ucerr.Wrap(err)
+				}
+			}
+			if emitErr != nil {
+				cancel()
+			}
+			<-inflight
+		}
+	}
+
+	if emitErr != nil {
+		return &summary, ucerr.Wrap(emitErr)
+	}
+	if requestErr != nil {
+		return &summary, ucerr.Wrap(requestErr)
+	}
+	if readErr != nil {
+		return &summary, ucerr.Wrap(readErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return &summary, ucerr.Wrap(err)
+	}
+	return &summary, nil
+}
+
+// readChunks reads items into chunks of at most chunkSize items and maxChunkBytes bytes, and sends
+// them to the workers, waiting for a free inflight slot before reading each chunk
+func (t *Tokenizer) readChunks(ctx context.Context, r Reader, inflight chan struct{}, chunks chan<- chunk) error {
+	seq := 0
+	var current []entry
+	size := 0
+
+	send := func() bool {
+		if len(current) == 0 {
+			return true
+		}
+		select {
+		case chunks <- chunk{seq: seq, entries: current}:
+		case <-ctx.Done():
+			return false
+		}
+		seq++
+		current = nil
+		size = 0
+		return true
+	}
+
+	for {
+		if len(current) == 0 {
+			select {
+			case inflight <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		item, err := r.Read()
+		if err == io.EOF {
+			if len(current) == 0 {
+				// the slot taken for this chunk won't be released by the emitter
+				<-inflight
+			}
+			send()
+			return nil
+		}
+		if err != nil && item == nil {
+			if len(current) == 0 {
+				<-inflight
+			}
+			send()
+			return ucerr.Wrap(err)
+		}
+
+		if len(current) > 0 && err == nil && size+len(item.Data) > t.options.maxChunkBytes {
+			if !send() {
+				return nil
+			}
+			select {
+			case inflight <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		current = append(current, entry{item: *item, err: err})
+		if err == nil {
+			size += len(item.Data)
+		}
+		if len(current) >= t.options.chunkSize {
+			if !send() {
+				return nil
+			}
+		}
+	}
+}
+
+// tokenizeChunk tokenizes the items of a chunk, returning their results in order and the number of
+// requests made, or an error if a request failed for a reason that isn't specific to its items
+func (t *Tokenizer) tokenizeChunk(ctx context.Context, entries []entry) ([]Result, int, error) {
+	results := make([]Result, len(entries))
+	var items []Item
+	var positions []int
+	for i, e := range entries {
+		results[i].Index = e.item.Index
+		err := e.err
+		if err == nil {
+			// invalid items would fail the whole request before it was sent
+			err = e.item.Validate()
+		}
+		if err != nil {
+			results[i].Error = ucerr.UserFriendlyMessage(err)
+			continue
+		}
+		items = append(items, e.item)
+		positions = append(positions, i)
+	}
+
+	requests := 0
+	if len(items) > 0 {
+		itemResults, err := t.tokenizeItems(ctx, items, &requests)
+		if err != nil {
+			return nil, requests, ucerr.Wrap(err)
+		}
+		for j, res := range itemResults {
+			results[positions[j]] = res
+		}
+	}
+	return results, requests, nil
+}
+
+// itemKey identifies identical items, which get the same token from LookupOrCreateTokens
+type itemKey struct {
+	data         string
+	transformer  userstore.ResourceID
+	accessPolicy userstore.ResourceID
+}
+
+// tokenizeItems tokenizes items in a single request, retrying rate limit and server errors with
+// backoff. If the request is rejected as invalid, or because an item refers to a transformer or
+// access policy that doesn't exist, the items are split in half and each half is tried separately,
+// so that a bad item only fails itself. Any other error, like an authorization failure, would fail
+// every request, so it's returned rather than being recorded against the items.
+func (t *Tokenizer) tokenizeItems(ctx context.Context, items []Item, requests *int) ([]Result, error) {
+	results := make([]Result, len(items))
+	for i, item := range items {
+		results[i].Index = item.Index
+	}
+
+	// send identical items once
+	var data []string
+	var transformers, accessPolicies []userstore.ResourceID
+	unique := map[itemKey]int{}
+	slots := make([]int, len(items))
+	for i, item := range items {
+		k := itemKey{data: item.Data, transformer: item.Transformer, accessPolicy: item.AccessPolicy}
+		slot, found := unique[k]
+		if !found {
+			slot = len(data)
+			unique[k] = slot
+			data = append(data, item.Data)
+			transformers = append(transformers, item.Transformer)
+			accessPolicies = append(accessPolicies, item.AccessPolicy)
+		}
+		slots[i] = slot
+	}
+
+	attempts := 0
+	backoff := initialBackoff
+	for {
+		attempts++
+		*requests++
+		tokens, err := t.client.LookupOrCreateTokens(ctx, data, transformers, accessPolicies)
+		if err == nil && len(tokens) != len(data) {
+			err = ucerr.Errorf("server returned %d tokens for %d values", len(tokens), len(data))
+		}
+		if err == nil {
+			for i := range results {
+				results[i].Token = tokens[slots[i]]
+				results[i].Attempts = attempts
+			}
+			return results, nil
+		}
+
+		if ctx.Err() != nil {
+			return failAll(results, ctx.Err(), attempts), nil
+		}
+
+		if code := jsonclient.GetHTTPStatusCode(err); code == http.StatusBadRequest || code == http.StatusNotFound {
+			if len(items) == 1 {
+				return failAll(results, err, attempts), nil
+			}
+			uclog.Debugf(ctx, "splitting chunk of %d items after error: %v", len(items), err)
+			half := len(items) / 2
+			first, err := t.tokenizeItems(ctx, items[:half], requests)
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			second, err := t.tokenizeItems(ctx, items[half:], requests)
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			return append(first, second...), nil
+		}
+
+		if !isRetryable(err) {
+			return nil, ucerr.Wrap(err)
+		}
+
+		if attempts > t.options.maxRetries {
+			return failAll(results, err, attempts), nil
+		}
+
+		uclog.Debugf(ctx, "retrying chunk of %d items after error: %v", len(items), err)
+		select {
+		case <-ctx.Done():
+			return failAll(results, ctx.Err(), attempts), nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func failAll(results []Result, err error, attempts int) []Result {
+	for i := range results {
+		results[i].Error = ucerr.UserFriendlyMessage(err)
+		results[i].Attempts = attempts
+	}
+	return results
+}
+
+func isRetryable(err error) bool {
+	code := jsonclient.GetHTTPStatusCode(err)
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
@@ -29,6 +29,11 @@ type options struct {
 	dataRegion        region.DataRegion
 	paginationOptions []pagination.Option
 	jsonclientOptions []jsonclient.Option
+	truncationHandler TruncationHandler
+
+	transformerParameterSchemas []transformerParameterSchema
+
+	resolvedTokenCache *resolvedTokenCache
 }
 
 // Option makes idp.Client extensible
@@ -111,7 +116,10 @@ func NewClient(url string, opts ...Option) (*Client, error) {
 		client:  sdkclient.New(url, "idp", options.jsonclientOptions...),
 		options: options,
 	}
-	tc := &TokenizerClient{client: c.client, options: options}
+	tc := newTokenizerClient(c.client, options)
+	if tc.resolvedTokenCacheErr != nil {
+		return nil, ucerr.Wrap(tc.resolvedTokenCacheErr)
+	}
 	c.TokenizerClient = tc
 
 	if err := c.client.ValidateBearerTokenHeader(); err != nil {
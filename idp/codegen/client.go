@@ -0,0 +1,424 @@
+package codegen
+
+import (
+	"fmt"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/ucerr"
+)
+
+// GenerateClient returns a Go source file for the specified package that declares everything
+// GenerateComposites does, plus a typed function for executing each of the schema's accessors and
+// mutators. Accessor functions take the selector values as named parameters, in placeholder order,
+// and return a struct per row with a typed field for each output column. Mutator functions take a
+// typed input struct that is validated client-side and converted to the mutator's row data.
+func GenerateClient(packageName string, schema Schema) ([]byte, error) {
+	f := newFile(packageName)
+	if err := writeComposites(f, schema, len(schema.Mutators) > 0); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	accessors := append([]userstore.Accessor{}, schema.Accessors...)
+	sort.Slice(accessors, func(i, j int) bool { return accessors[i].Name < accessors[j].Name })
+	for _, a := range accessors {
+		if err := writeAccessor(f, schema, a); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+	}
+
+	mutators := append([]userstore.Mutator{}, schema.Mutators...)
+	sort.Slice(mutators, func(i, j int) bool { return mutators[i].Name < mutators[j].Name })
+	for _, m := range mutators {
+		if err := writeMutator(f, schema, m); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+	}
+
+	src, err := f.source()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return src, nil
+}
+
+// reservedParams are the identifiers used by the generated functions themselves, which
+// selector parameters must not shadow
+var reservedParams = map[string]bool{
+	"append":        true,
+	"len":           true,
+	"make":          true,
+	"nil":           true,
+	"string":        true,
+	"client":        true,
+	"clientContext": true,
+	"ctx":           true,
+	"err":           true,
+	"in":            true,
+	"it":            true,
+	"opts":          true,
+	"resp":          true,
+	"row":           true,
+	"rowData":       true,
+	"rows":          true,
+	"value":         true,
+}
+
+// paramName converts a userstore name to an unexported Go identifier, e.g. "ID_Field_1" to "idField1"
+func paramName(name string) string {
+	runes := []rune(goName(name))
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+	if upper > 1 && upper < len(runes) && unicode.IsLower(runes[upper]) {
+		// leave the first letter of the next word capitalized, e.g. "IDField" becomes "idField"
+		upper--
+	}
+	for i := 0; i < upper; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// selectorParam is a generated function parameter for a selector placeholder
+type selectorParam struct {
+	name string
+	typ  string
+}
+
+// selectorParams returns the parameters for the placeholders of a selector, in order
+func (s Schema) selectorParams(f *file, selector userstore.UserSelectorConfig) []selectorParam {
+	if selector.MatchesAll() {
+		return nil
+	}
+
+	var params []selectorParam
+	used := map[string]bool{}
+	for i, p := range placeholders(selector.WhereClause) {
+		name := fmt.Sprintf("arg%d", i+1)
+		if p.Column != "" {
+			name = paramName(p.Column)
+			if p.JSONField != "" {
+				name = paramName(p.Column + "_" + p.JSONField)
+			}
+		}
+		if reservedParams[name] || token.IsKeyword(name) {
+			name += "Value"
+		}
+		base := name
+		for n := 2; used[name]; n++ {
+			name = base + strconv.Itoa(n)
+		}
+		used[name] = true
+
+		params = append(params, selectorParam{name: name, typ: s.placeholderType(f, p)})
+	}
+	return params
+}
+
+// placeholderType returns the Go type for a placeholder's value
+func (s Schema) placeholderType(f *file, p placeholder) string {
+	typ := "interface{}"
+	if p.IsPattern || p.JSONField != "" {
+		typ = "string"
+	} else if c, found := s.column(userstore.ResourceID{Name: p.Column}); found {
+		_, isComposite := s.compositeDataType(c.DataType)
+		if !isComposite && !datatype.Composite.EquivalentTo(c.DataType) && !datatype.CanonicalAddress.EquivalentTo(c.DataType) {
+			if t, err := s.valueType(f, c.DataType, false); err == nil {
+				typ = t
+			}
+		}
+	} else if p.Column == "id" || p.Column == "organization_id" {
+		f.use("github.com/gofrs/uuid")
+		typ = "uuid.UUID"
+	}
+
+	if p.IsList {
+		typ = "[]" + typ
+	}
+	return typ
+}
+
+func paramList(params []selectorParam) string {
+	var b strings.Builder
+	for _, p := range params {
+		fmt.Fprintf(&b, ", %s %s", p.name, p.typ)
+	}
+	return b.String()
+}
+
+func selectorValues(params []selectorParam) string {
+	names := make([]string, 0, len(params))
+	for _, p := range params {
+		names = append(names, p.name)
+	}
+	return "userstore.UserSelectorValues{" + strings.Join(names, ", ") + "}"
+}
+
+// resourceName returns the Go name for an accessor or mutator, dropping a redundant suffix
+func resourceName(name string, suffix string) string {
+	n := goName(name)
+	if trimmed := strings.TrimSuffix(n, suffix); trimmed != "" && trimmed != n {
+		return trimmed
+	}
+	return n
+}
+
+// outputType returns the Go type of an accessor output column, which depends on its transformer
+func (s Schema) outputType(f *file, c userstore.Column, transformer userstore.ResourceID) string {
+	if transformer.ID.IsNil() && transformer.Name == "" {
+		transformer = c.DefaultTransformer
+	}
+
+	dataType := c.DataType
+	if t, found := s.transformer(transformer); found {
+		switch t.TransformType {
+		case policy.TransformTypeTokenizeByValue, policy.TransformTypeTokenizeByReference:
+			dataType = datatype.String
+		case policy.TransformTypeTransform:
+			dataType = t.OutputDataType
+		}
+	}
+
+	typ, err := s.valueType(f, dataType, false)
+	if err != nil {
+		typ = "string"
+	}
+	if c.IsArray {
+		typ = "[]" + typ
+	}
+	return typ
+}
+
+func writeAccessor(f *file, schema Schema, a userstore.Accessor) error {
+	name := resourceName(a.Name, "Accessor")
+	description := "accessor '" + a.Name + "'"
+	rowType := name + "AccessorRow"
+	decodeFunc := "decode" + rowType
+	for _, identifier := range []string{name + "AccessorID", rowType, decodeFunc, "Execute" + name + "Accessor", "Execute" + name + "AccessorAll"} {
+		if err := f.declare(identifier, description); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	type outputField struct {
+		name   string
+		column string
+		typ    string
+	}
+	var fields []outputField
+	fieldNames := map[string]bool{}
+	for _, oc := range a.Columns {
+		c, found := schema.column(oc.Column)
+		if !found {
+			if oc.Column.Name == "" {
+				return ucerr.Friendlyf(nil, "accessor '%s' refers to unknown column %v", a.Name, oc.Column.ID)
+			}
+			c = userstore.Column{Name: oc.Column.Name, DataType: datatype.String}
+		}
+		fieldName := goName(c.Name)
+		if fieldNames[fieldName] {
+			return ucerr.Friendlyf(nil, "columns of accessor '%s' would both generate the field %s", a.Name, fieldName)
+		}
+		fieldNames[fieldName] = true
+		fields = append(fields, outputField{name: fieldName, column: c.Name, typ: schema.outputType(f, c, oc.Transformer)})
+	}
+
+	params := schema.selectorParams(f, a.SelectorConfig)
+
+	f.use("context")
+	f.use("encoding/json")
+	f.use("userclouds.com/idp")
+	f.use("userclouds.com/idp/policy")
+	f.use("userclouds.com/idp/userstore")
+	f.use("userclouds.com/idp/userstore/datatype")
+	f.use("userclouds.com/infra/ucerr")
+
+	f.printf("// %sAccessorID is the ID of the %q accessor\n", name, a.Name)
+	f.printf("var %sAccessorID = %s\n\n", name, f.uuidLiteral(a.ID))
+
+	f.printf("// %s is a result of the %q accessor\n", rowType, a.Name)
+	f.printf("type %s struct {\n", rowType)
+	for _, field := range fields {
+		f.printf("\t%s %s `json:%q`\n", field.name, field.typ, field.column)
+	}
+	f.printf("}\n\n")
+
+	f.printf("func %s(value string) (%s, error) {\n", decodeFunc, rowType)
+	f.printf("\tvar values map[string]interface{}\n")
+	f.printf("\tif err := json.Unmarshal([]byte(value), &values); err != nil {\n")
+	f.printf("\t\treturn %s{}, ucerr.Wrap(err)\n", rowType)
+	f.printf("\t}\n\n")
+	f.printf("\tvar row %s\n", rowType)
+	for _, field := range fields {
+		f.printf("\tif err := datatype.DecodeAccessorValue(values[%q], &row.%s); err != nil {\n", field.column, field.name)
+		f.printf("\t\treturn %s{}, ucerr.Wrap(err)\n", rowType)
+		f.printf("\t}\n")
+	}
+	f.printf("\treturn row, nil\n")
+	f.printf("}\n\n")
+
+	f.printf("// Execute%sAccessor executes the %q accessor and returns a page of results, along with the\n", name, a.Name)
+	f.printf("// response's pagination fields and truncation flag\n")
+	f.printf("func Execute%sAccessor(ctx context.Context, client *idp.Client, clientContext policy.ClientContext%s, opts ...idp.Option) ([]%s, *idp.ExecuteAccessorResponse, error) {\n",
+		name, paramList(params), rowType)
+	f.printf("\tresp, err := client.ExecuteAccessor(ctx, %sAccessorID, clientContext, %s, opts...)\n", name, selectorValues(params))
+	f.printf("\tif err != nil {\n")
+	f.printf("\t\treturn nil, nil, ucerr.Wrap(err)\n")
+	f.printf("\t}\n\n")
+	f.printf("\trows := make([]%s, 0, len(resp.Data))\n", rowType)
+	f.printf("\tfor _, value := range resp.Data {\n")
+	f.printf("\t\trow, err := %s(value)\n", decodeFunc)
+	f.printf("\t\tif err != nil {\n")
+	f.printf("\t\t\treturn nil, nil, ucerr.Wrap(err)\n")
+	f.printf("\t\t}\n")
+	f.printf("\t\trows = append(rows, row)\n")
+	f.printf("\t}\n")
+	f.printf("\treturn rows, resp, nil\n")
+	f.printf("}\n\n")
+
+	f.printf("// Execute%sAccessorAll executes the %q accessor, paging through all of its results\n", name, a.Name)
+	f.printf("func Execute%sAccessorAll(ctx context.Context, client *idp.Client, clientContext policy.ClientContext%s, opts ...idp.Option) ([]%s, error) {\n",
+		name, paramList(params), rowType)
+	f.printf("\tit := client.NewAccessorIterator(%sAccessorID, clientContext, %s, opts...)\n\n", name, selectorValues(params))
+	f.printf("\tvar rows []%s\n", rowType)
+	f.printf("\tfor it.Next(ctx) {\n")
+	f.printf("\t\trow, err := %s(it.Value())\n", decodeFunc)
+	f.printf("\t\tif err != nil {\n")
+	f.printf("\t\t\treturn nil, ucerr.Wrap(err)\n")
+	f.printf("\t\t}\n")
+	f.printf("\t\trows = append(rows, row)\n")
+	f.printf("\t}\n")
+	f.printf("\tif err := it.Err(); err != nil {\n")
+	f.printf("\t\treturn nil, ucerr.Wrap(err)\n")
+	f.printf("\t}\n")
+	f.printf("\treturn rows, nil\n")
+	f.printf("}\n\n")
+
+	return nil
+}
+
+// columnLiteral returns a Go expression for the parts of a column definition used for validation
+func (f *file) columnLiteral(c userstore.Column) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "userstore.Column{\n")
+	fmt.Fprintf(&b, "\tName: %s,\n", strconv.Quote(c.Name))
+	fmt.Fprintf(&b, "\tDataType: %s,\n", f.resourceIDLiteral(c.DataType))
+	fmt.Fprintf(&b, "\tIsArray: %v,\n", c.IsArray)
+	fmt.Fprintf(&b, "\tConstraints: userstore.ColumnConstraints{\n")
+	fmt.Fprintf(&b, "\t\tUniqueIDRequired: %v,\n", c.Constraints.UniqueIDRequired)
+	fmt.Fprintf(&b, "\t\tUniqueRequired: %v,\n", c.Constraints.UniqueRequired)
+	if len(c.Constraints.Fields) > 0 {
+		fmt.Fprintf(&b, "\t\tFields: []userstore.ColumnField{\n")
+		for _, field := range c.Constraints.Fields {
+			fmt.Fprintf(&b, "\t\t\t{Type: %s, Name: %s, CamelCaseName: %s, StructName: %s, Required: %v, IgnoreForUniqueness: %v},\n",
+				strconv.Quote(field.Type), strconv.Quote(field.Name), strconv.Quote(field.CamelCaseName), strconv.Quote(field.StructName),
+				field.Required, field.IgnoreForUniqueness)
+		}
+		fmt.Fprintf(&b, "\t\t},\n")
+	}
+	fmt.Fprintf(&b, "\t},\n")
+	fmt.Fprintf(&b, "}")
+	return b.String()
+}
+
+func writeMutator(f *file, schema Schema, m userstore.Mutator) error {
+	name := resourceName(m.Name, "Mutator")
+	description := "mutator '" + m.Name + "'"
+	inputType := name + "MutatorInput"
+	for _, identifier := range []string{name + "MutatorID", inputType, "Execute" + name + "Mutator"} {
+		if err := f.declare(identifier, description); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	type inputField struct {
+		name   string
+		column userstore.Column
+		typ    string
+	}
+	var fields []inputField
+	fieldNames := map[string]bool{"PurposeAdditions": true, "PurposeDeletions": true}
+	for _, ic := range m.Columns {
+		c, found := schema.column(ic.Column)
+		if !found {
+			return ucerr.Friendlyf(nil, "mutator '%s' refers to unknown column %v", m.Name, ic.Column)
+		}
+		fieldName := goName(c.Name)
+		if fieldNames[fieldName] {
+			return ucerr.Friendlyf(nil, "columns of mutator '%s' would generate the field %s more than once", m.Name, fieldName)
+		}
+		fieldNames[fieldName] = true
+
+		typ, err := schema.valueType(f, c.DataType, false)
+		if err != nil {
+			return ucerr.Friendlyf(err, "column '%s' of mutator '%s': %s", c.Name, m.Name, ucerr.UserFriendlyMessage(err))
+		}
+		if c.IsArray {
+			typ = "[]" + typ
+		}
+		fields = append(fields, inputField{name: fieldName, column: c, typ: typ})
+	}
+
+	params := schema.selectorParams(f, m.SelectorConfig)
+
+	f.use("context")
+	f.use("userclouds.com/idp")
+	f.use("userclouds.com/idp/policy")
+	f.use("userclouds.com/idp/userstore")
+	f.use("userclouds.com/infra/ucerr")
+
+	f.printf("// %sMutatorID is the ID of the %q mutator\n", name, m.Name)
+	f.printf("var %sMutatorID = %s\n\n", name, f.uuidLiteral(m.ID))
+
+	f.printf("// %s is the data written by the %q mutator. Columns whose field is nil keep\n", inputType, m.Name)
+	f.printf("// their current value.\n")
+	f.printf("type %s struct {\n", inputType)
+	for _, field := range fields {
+		f.printf("\t%s *%s\n", field.name, field.typ)
+	}
+	f.printf("\n\t// PurposeAdditions and PurposeDeletions are applied to each of the mutator's columns\n")
+	f.printf("\tPurposeAdditions []userstore.ResourceID\n")
+	f.printf("\tPurposeDeletions []userstore.ResourceID\n")
+	f.printf("}\n\n")
+
+	f.printf("// RowData validates and normalizes the input, and returns the row data for the mutator\n")
+	f.printf("func (in %s) RowData() (map[string]idp.ValueAndPurposes, error) {\n", inputType)
+	f.printf("\trowData := map[string]idp.ValueAndPurposes{}\n")
+	for _, field := range fields {
+		f.printf("\n\tif in.%s == nil {\n", field.name)
+		f.printf("\t\trowData[%q] = idp.ValueAndPurposes{Value: idp.MutatorColumnCurrentValue, PurposeAdditions: in.PurposeAdditions, PurposeDeletions: in.PurposeDeletions}\n", field.column.Name)
+		f.printf("\t} else {\n")
+		f.printf("\t\tvalue, err := %s.NormalizeValue(%s, *in.%s)\n", validatorName, f.columnLiteral(field.column), field.name)
+		f.printf("\t\tif err != nil {\n")
+		f.printf("\t\t\treturn nil, ucerr.Wrap(err)\n")
+		f.printf("\t\t}\n")
+		f.printf("\t\trowData[%q] = idp.ValueAndPurposes{Value: value, PurposeAdditions: in.PurposeAdditions, PurposeDeletions: in.PurposeDeletions}\n", field.column.Name)
+		f.printf("\t}\n")
+	}
+	f.printf("\treturn rowData, nil\n")
+	f.printf("}\n\n")
+
+	f.printf("// Execute%sMutator executes the %q mutator\n", name, m.Name)
+	f.printf("func Execute%sMutator(ctx context.Context, client *idp.Client, clientContext policy.ClientContext, in %s%s) (*idp.ExecuteMutatorResponse, error) {\n",
+		name, inputType, paramList(params))
+	f.printf("\trowData, err := in.RowData()\n")
+	f.printf("\tif err != nil {\n")
+	f.printf("\t\treturn nil, ucerr.Wrap(err)\n")
+	f.printf("\t}\n\n")
+	f.printf("\tresp, err := client.ExecuteMutator(ctx, %sMutatorID, clientContext, %s, rowData)\n", name, selectorValues(params))
+	f.printf("\tif err != nil {\n")
+	f.printf("\t\treturn nil, ucerr.Wrap(err)\n")
+	f.printf("\t}\n")
+	f.printf("\treturn resp, nil\n")
+	f.printf("}\n\n")
+
+	return nil
+}
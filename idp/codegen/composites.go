@@ -0,0 +1,284 @@
+package codegen
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/ucerr"
+)
+
+// validatorName is the package-level validator shared by the generated Validate methods and setters
+const validatorName = "generatedValidator"
+
+// GenerateComposites returns a Go source file for the specified package that declares a struct
+// for each of the schema's composite data types, with a Validate method that applies the
+// userstore's validation rules client-side. For each column of a composite or address data type,
+// it also declares helpers to decode the column's value from a userstore.Record and to validate
+// and store a value in one.
+func GenerateComposites(packageName string, schema Schema) ([]byte, error) {
+	f := newFile(packageName)
+	if err := writeComposites(f, schema, false); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	src, err := f.source()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return src, nil
+}
+
+// compositeDataTypes returns the schema's custom composite data types, sorted by name
+func (s Schema) compositeDataTypes() []userstore.ColumnDataType {
+	var dataTypes []userstore.ColumnDataType
+	for _, dt := range s.DataTypes {
+		if !dt.IsNative {
+			dataTypes = append(dataTypes, dt)
+		}
+	}
+	sort.Slice(dataTypes, func(i, j int) bool { return dataTypes[i].Name < dataTypes[j].Name })
+	return dataTypes
+}
+
+// valueType returns the Go type used for single values of a data type. Optional values of
+// types without a usable zero value are represented as pointers.
+func (s Schema) valueType(f *file, rid userstore.ResourceID, optional bool) (string, error) {
+	if native, found := resolveNative(rid); found {
+		switch native {
+		case datatype.Boolean:
+			return "bool", nil
+		case datatype.Integer:
+			return "int64", nil
+		case datatype.Timestamp:
+			f.use("time")
+			return pointerIf(optional, "time.Time"), nil
+		case datatype.UUID:
+			f.use("github.com/gofrs/uuid")
+			return pointerIf(optional, "uuid.UUID"), nil
+		case datatype.CanonicalAddress:
+			f.use("userclouds.com/idp/userstore")
+			return pointerIf(optional, "userstore.Address"), nil
+		case datatype.Composite:
+			f.use("userclouds.com/idp/userstore")
+			return "userstore.CompositeValue", nil
+		default:
+			return "string", nil
+		}
+	}
+
+	if dt, found := s.compositeDataType(rid); found {
+		return pointerIf(optional, goName(dt.Name)), nil
+	}
+
+	return "", ucerr.Friendlyf(nil, "unknown data type %v", rid)
+}
+
+func pointerIf(pointer bool, typ string) string {
+	if pointer {
+		return "*" + typ
+	}
+	return typ
+}
+
+func fieldStructName(f userstore.CompositeField) string {
+	if f.StructName != "" {
+		return f.StructName
+	}
+	return strings.ToLower(f.Name)
+}
+
+func fieldGoName(f userstore.CompositeField) string {
+	if f.CamelCaseName != "" {
+		return goName(f.CamelCaseName)
+	}
+	return goName(f.Name)
+}
+
+// columnValueType returns the Go type for values of a column, and false if the column's data
+// type isn't a composite or address type
+func (s Schema) columnValueType(f *file, c userstore.Column) (string, bool, error) {
+	_, isComposite := s.compositeDataType(c.DataType)
+	if !isComposite && !datatype.CanonicalAddress.EquivalentTo(c.DataType) {
+		return "", false, nil
+	}
+
+	typ, err := s.valueType(f, c.DataType, false)
+	if err != nil {
+		return "", false, ucerr.Wrap(err)
+	}
+	if c.IsArray {
+		typ = "[]" + typ
+	}
+	return typ, true, nil
+}
+
+// writeComposites writes the composite data types and column helpers. The generated validator is
+// declared if they need it, or if needValidator is set because other generated code uses it.
+func writeComposites(f *file, schema Schema, needValidator bool) error {
+	dataTypes := schema.compositeDataTypes()
+
+	var columns []userstore.Column
+	for _, c := range schema.Columns {
+		if _, isTyped, err := schema.columnValueType(f, c); err != nil {
+			return ucerr.Wrap(err)
+		} else if isTyped {
+			columns = append(columns, c)
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].Name < columns[j].Name })
+
+	if len(dataTypes) == 0 && len(columns) == 0 && !needValidator {
+		return nil
+	}
+
+	if err := f.declare(validatorName, "the generated validator"); err != nil {
+		return ucerr.Wrap(err)
+	}
+	f.use("userclouds.com/idp/userstore/datatype")
+	f.printf("// %s validates values of the generated types using the userstore's rules\n", validatorName)
+	f.printf("var %s = datatype.NewValidator(\n", validatorName)
+	for _, dt := range dataTypes {
+		f.printf("\t%sDataType,\n", goName(dt.Name))
+	}
+	f.printf(")\n\n")
+
+	for _, dt := range dataTypes {
+		if err := writeCompositeDataType(f, schema, dt); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	for _, c := range columns {
+		if err := writeColumnHelpers(f, schema, c); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+func writeCompositeDataType(f *file, schema Schema, dt userstore.ColumnDataType) error {
+	typeName := goName(dt.Name)
+	description := "data type '" + dt.Name + "'"
+	for _, name := range []string{typeName, typeName + "DataType"} {
+		if err := f.declare(name, description); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	f.use("userclouds.com/idp/userstore")
+	f.printf("// %sDataType is the definition of the %q composite data type\n", typeName, dt.Name)
+	f.printf("var %sDataType = userstore.ColumnDataType{\n", typeName)
+	f.printf("\tID: %s,\n", f.uuidLiteral(dt.ID))
+	f.printf("\tName: %s,\n", strconv.Quote(dt.Name))
+	f.printf("\tDescription: %s,\n", strconv.Quote(dt.Description))
+	f.printf("\tCompositeAttributes: userstore.CompositeAttributes{\n")
+	f.printf("\t\tIncludeID: %v,\n", dt.CompositeAttributes.IncludeID)
+	f.printf("\t\tFields: []userstore.CompositeField{\n")
+	for _, field := range dt.CompositeAttributes.Fields {
+		f.printf("\t\t\t{\n")
+		f.printf("\t\t\t\tDataType: %s,\n", f.resourceIDLiteral(field.DataType))
+		f.printf("\t\t\t\tName: %s,\n", strconv.Quote(field.Name))
+		f.printf("\t\t\t\tCamelCaseName: %s,\n", strconv.Quote(field.CamelCaseName))
+		f.printf("\t\t\t\tStructName: %s,\n", strconv.Quote(field.StructName))
+		f.printf("\t\t\t\tRequired: %v,\n", field.Required)
+		f.printf("\t\t\t\tIgnoreForUniqueness: %v,\n", field.IgnoreForUniqueness)
+		f.printf("\t\t\t},\n")
+	}
+	f.printf("\t\t},\n")
+	f.printf("\t},\n")
+	f.printf("}\n\n")
+
+	f.printf("// %s is a value of the %q composite data type\n", typeName, dt.Name)
+	f.printf("type %s struct {\n", typeName)
+	hasID := false
+	fieldNames := map[string]bool{}
+	for _, field := range dt.CompositeAttributes.Fields {
+		structName := fieldStructName(field)
+		goFieldName := fieldGoName(field)
+		if fieldNames[goFieldName] {
+			return ucerr.Friendlyf(nil, "fields of data type '%s' would both generate the field %s", dt.Name, goFieldName)
+		}
+		fieldNames[goFieldName] = true
+		hasID = hasID || structName == "id"
+
+		typ, err := schema.valueType(f, field.DataType, !field.Required)
+		if err != nil {
+			return ucerr.Friendlyf(err, "field '%s' of data type '%s': %s", field.Name, dt.Name, ucerr.UserFriendlyMessage(err))
+		}
+		tag := structName
+		if !field.Required {
+			tag += ",omitempty"
+		}
+		f.printf("\t%s %s `json:%q`\n", goFieldName, typ, tag)
+	}
+	if dt.CompositeAttributes.IncludeID && !hasID && !fieldNames["ID"] {
+		f.printf("\tID string `json:\"id,omitempty\"`\n")
+	}
+	f.printf("}\n\n")
+
+	f.use("userclouds.com/infra/ucerr")
+	f.printf("// Validate implements Validateable\n")
+	f.printf("func (o %s) Validate() error {\n", typeName)
+	f.printf("\treturn ucerr.Wrap(%s.ValidateValue(userstore.Column{Name: %s, DataType: userstore.ResourceID{ID: %sDataType.ID, Name: %sDataType.Name}}, o))\n",
+		validatorName, strconv.Quote(dt.Name), typeName, typeName)
+	f.printf("}\n\n")
+
+	return nil
+}
+
+func writeColumnHelpers(f *file, schema Schema, c userstore.Column) error {
+	typ, _, err := schema.columnValueType(f, c)
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	name := goName(c.Name)
+	description := "column '" + c.Name + "'"
+	for _, identifier := range []string{name + "Column", name + "FromRecord", "Set" + name} {
+		if err := f.declare(identifier, description); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	f.use("userclouds.com/idp/userstore")
+	f.use("userclouds.com/infra/ucerr")
+
+	f.printf("// %sColumn is the definition of the %q column\n", name, c.Name)
+	f.printf("var %sColumn = userstore.Column{\n", name)
+	f.printf("\tID: %s,\n", f.uuidLiteral(c.ID))
+	f.printf("\tName: %s,\n", strconv.Quote(c.Name))
+	f.printf("\tDataType: %s,\n", f.resourceIDLiteral(c.DataType))
+	f.printf("\tIsArray: %v,\n", c.IsArray)
+	f.printf("\tConstraints: userstore.ColumnConstraints{\n")
+	f.printf("\t\tUniqueIDRequired: %v,\n", c.Constraints.UniqueIDRequired)
+	f.printf("\t\tUniqueRequired: %v,\n", c.Constraints.UniqueRequired)
+	f.printf("\t},\n")
+	f.printf("}\n\n")
+
+	f.use("userclouds.com/idp/userstore/datatype")
+	f.printf("// %sFromRecord returns the value of the %q column in a record returned by an accessor, or false if it has no value\n", name, c.Name)
+	f.printf("func %sFromRecord(r userstore.Record) (%s, bool, error) {\n", name, typ)
+	f.printf("\tvar v %s\n", typ)
+	f.printf("\tif r[%sColumn.Name] == nil {\n", name)
+	f.printf("\t\treturn v, false, nil\n")
+	f.printf("\t}\n")
+	f.printf("\tif err := datatype.DecodeAccessorValue(r[%sColumn.Name], &v); err != nil {\n", name)
+	f.printf("\t\treturn v, false, ucerr.Wrap(err)\n")
+	f.printf("\t}\n")
+	f.printf("\treturn v, true, nil\n")
+	f.printf("}\n\n")
+
+	f.printf("// Set%s validates a value for the %q column and stores it in a record\n", name, c.Name)
+	f.printf("func Set%s(r userstore.Record, v %s) error {\n", name, typ)
+	f.printf("\tif err := %s.ValidateValue(%sColumn, v); err != nil {\n", validatorName, name)
+	f.printf("\t\treturn ucerr.Wrap(err)\n")
+	f.printf("\t}\n")
+	f.printf("\tr[%sColumn.Name] = v\n", name)
+	f.printf("\treturn nil\n")
+	f.printf("}\n\n")
+
+	return nil
+}
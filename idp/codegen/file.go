@@ -0,0 +1,147 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// file accumulates the body of a generated Go file along with the packages it imports
+type file struct {
+	packageName string
+	imports     map[string]bool
+	names       map[string]string
+	body        bytes.Buffer
+}
+
+func newFile(packageName string) *file {
+	return &file{
+		packageName: packageName,
+		imports:     map[string]bool{},
+		names:       map[string]string{},
+	}
+}
+
+// use records that the generated code refers to the specified package
+func (f *file) use(importPath string) {
+	f.imports[importPath] = true
+}
+
+func (f *file) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&f.body, format, args...)
+}
+
+// declare reserves an identifier for the described declaration, failing if two resources map to the same name
+func (f *file) declare(name string, description string) error {
+	if existing, found := f.names[name]; found {
+		return ucerr.Friendlyf(nil, "%s and %s would both generate the identifier %s", existing, description, name)
+	}
+	f.names[name] = description
+	return nil
+}
+
+// source returns the formatted file
+func (f *file) source() ([]byte, error) {
+	// imports are grouped as standard library, third party, then this module's packages
+	groups := make([][]string, 3)
+	for importPath := range f.imports {
+		switch {
+		case strings.HasPrefix(importPath, "userclouds.com/"):
+			groups[2] = append(groups[2], importPath)
+		case strings.Contains(strings.Split(importPath, "/")[0], "."):
+			groups[1] = append(groups[1], importPath)
+		default:
+			groups[0] = append(groups[0], importPath)
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// NOTE: automatically generated file -- DO NOT EDIT\n\npackage %s\n\n", f.packageName)
+	if len(f.imports) > 0 {
+		out.WriteString("import (\n")
+		first := true
+		for _, group := range groups {
+			if len(group) == 0 {
+				continue
+			}
+			if !first {
+				out.WriteString("\n")
+			}
+			first = false
+			sort.Strings(group)
+			for _, importPath := range group {
+				fmt.Fprintf(&out, "\t%q\n", importPath)
+			}
+		}
+		out.WriteString(")\n\n")
+	}
+	out.Write(f.body.Bytes())
+
+	formatted, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, ucerr.Errorf("generated code is not valid Go: %w", err)
+	}
+	return formatted, nil
+}
+
+// uuidLiteral returns a Go expression for a UUID
+func (f *file) uuidLiteral(id uuid.UUID) string {
+	f.use("github.com/gofrs/uuid")
+	if id.IsNil() {
+		return "uuid.Nil"
+	}
+	return fmt.Sprintf("uuid.Must(uuid.FromString(%q))", id.String())
+}
+
+// resourceIDLiteral returns a Go expression for a userstore.ResourceID
+func (f *file) resourceIDLiteral(rid userstore.ResourceID) string {
+	f.use("userclouds.com/idp/userstore")
+	return fmt.Sprintf("userstore.ResourceID{ID: %s, Name: %s}", f.uuidLiteral(rid.ID), strconv.Quote(rid.Name))
+}
+
+// initialisms are rendered in upper case in Go identifiers, per Go naming conventions
+var initialisms = map[string]bool{
+	"api":  true,
+	"http": true,
+	"id":   true,
+	"ip":   true,
+	"json": true,
+	"sql":  true,
+	"ssn":  true,
+	"url":  true,
+	"uuid": true,
+}
+
+// goName converts a userstore name such as "shipping_address" or "ID_Field_1" to an exported
+// Go identifier such as "ShippingAddress" or "IDField1"
+func goName(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+	for _, part := range parts {
+		if initialisms[strings.ToLower(part)] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		runes := []rune(part)
+		b.WriteRune(unicode.ToUpper(runes[0]))
+		b.WriteString(string(runes[1:]))
+	}
+
+	s := b.String()
+	if s == "" || unicode.IsDigit([]rune(s)[0]) {
+		s = "X" + s
+	}
+	return s
+}
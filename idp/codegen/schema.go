@@ -0,0 +1,120 @@
+// Package codegen generates type-safe Go code from a tenant's userstore configuration.
+package codegen
+
+import (
+	"context"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// Schema is the userstore configuration that code is generated from
+type Schema struct {
+	DataTypes    []userstore.ColumnDataType
+	Columns      []userstore.Column
+	Transformers []policy.Transformer
+	Accessors    []userstore.Accessor
+	Mutators     []userstore.Mutator
+}
+
+// LoadSchema reads the data types, columns, transformers, accessors and mutators of a tenant
+func LoadSchema(ctx context.Context, client *idp.Client) (*Schema, error) {
+	var schema Schema
+	var err error
+
+	if schema.DataTypes, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.ColumnDataType, pagination.ResponseFields, error) {
+		resp, err := client.ListDataTypes(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if schema.Columns, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Column, pagination.ResponseFields, error) {
+		resp, err := client.ListColumns(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if schema.Transformers, err = pagination.ListAll(func(cursor pagination.Cursor) ([]policy.Transformer, pagination.ResponseFields, error) {
+		resp, err := client.ListTransformers(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if schema.Accessors, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Accessor, pagination.ResponseFields, error) {
+		resp, err := client.ListAccessors(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if schema.Mutators, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Mutator, pagination.ResponseFields, error) {
+		resp, err := client.ListMutators(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &schema, nil
+}
+
+func resolveNative(rid userstore.ResourceID) (userstore.ResourceID, bool) {
+	for _, native := range datatype.Natives {
+		if native.EquivalentTo(rid) {
+			return native, true
+		}
+	}
+	return userstore.ResourceID{}, false
+}
+
+// compositeDataType returns the custom composite data type a resource ID refers to, if any
+func (s Schema) compositeDataType(rid userstore.ResourceID) (userstore.ColumnDataType, bool) {
+	if _, isNative := resolveNative(rid); isNative {
+		return userstore.ColumnDataType{}, false
+	}
+	for _, dt := range s.DataTypes {
+		if !dt.IsNative && (userstore.ResourceID{ID: dt.ID, Name: dt.Name}).EquivalentTo(rid) {
+			return dt, true
+		}
+	}
+	return userstore.ColumnDataType{}, false
+}
+
+func (s Schema) column(rid userstore.ResourceID) (userstore.Column, bool) {
+	for _, c := range s.Columns {
+		if (userstore.ResourceID{ID: c.ID, Name: c.Name}).EquivalentTo(rid) {
+			return c, true
+		}
+	}
+	return userstore.Column{}, false
+}
+
+func (s Schema) transformer(rid userstore.ResourceID) (policy.Transformer, bool) {
+	for _, t := range s.Transformers {
+		if (userstore.ResourceID{ID: t.ID, Name: t.Name}).EquivalentTo(rid) {
+			return t, true
+		}
+	}
+	return policy.Transformer{}, false
+}
@@ -0,0 +1,43 @@
+package codegen
+
+import (
+	"regexp"
+	"strings"
+)
+
+// placeholder describes a "?" in a selector where clause. Column is the column the value is
+// compared with, or empty if it couldn't be determined; JSONField is set if a field of a JSON
+// value is compared (e.g. {profile}->>'nickname'). IsList is set for comparisons with ANY.
+type placeholder struct {
+	Column    string
+	JSONField string
+	IsList    bool
+	IsPattern bool
+}
+
+// comparisonPattern matches a column compared with a placeholder, e.g. "{email} = ?",
+// "{id} = ANY (?)" or "{profile}->>'nickname' ILIKE ?"
+var comparisonPattern = regexp.MustCompile(`\{([^}]+)\}(?:\s*->>\s*'([^']*)')?\s*(=|!=|<>|<=|>=|<|>|(?i:(?:not\s+)?i?like))\s*((?i:any)\s*)?\(?\s*\?$`)
+
+// placeholders returns the placeholders in a where clause in order. Placeholders inside quoted
+// strings are ignored.
+func placeholders(whereClause string) []placeholder {
+	var result []placeholder
+	inQuote := false
+	for i, r := range whereClause {
+		switch {
+		case r == '\'':
+			inQuote = !inQuote
+		case r == '?' && !inQuote:
+			p := placeholder{}
+			if m := comparisonPattern.FindStringSubmatch(whereClause[:i+1]); m != nil {
+				p.Column = m[1]
+				p.JSONField = m[2]
+				p.IsPattern = strings.HasSuffix(strings.ToLower(m[3]), "like")
+				p.IsList = m[4] != ""
+			}
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,239 @@
+package consent
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// Action describes the consent operation recorded in a Receipt
+type Action string
+
+// Action values
+const (
+	ActionGrant    Action = "grant"
+	ActionWithdraw Action = "withdraw"
+)
+
+// Receipt records a consent operation and its effect, suitable for inclusion in records of processing
+type Receipt struct {
+	ID        uuid.UUID              `json:"id"`
+	UserID    uuid.UUID              `json:"user_id"`
+	Action    Action                 `json:"action"`
+	MutatorID uuid.UUID              `json:"mutator_id"`
+	Columns   []userstore.ResourceID `json:"columns"`
+	Purposes  []userstore.ResourceID `json:"purposes"`
+	IssuedAt  time.Time              `json:"issued_at"`
+	Before    *Snapshot              `json:"before"`
+	After     *Snapshot              `json:"after"`
+	Changes   []Change               `json:"changes"`
+}
+
+type options struct {
+	clientContext  policy.ClientContext
+	selectorValues func(userID uuid.UUID) userstore.UserSelectorValues
+}
+
+// Option makes Manager extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// ClientContext returns an Option that sets the client context passed to the mutator's access policy
+func ClientContext(clientContext policy.ClientContext) Option {
+	return optFunc(func(opts *options) {
+		opts.clientContext = clientContext
+	})
+}
+
+// SelectorValues returns an Option that builds the mutator's selector values for a user. By default,
+// the user ID is passed as the only selector value, matching a selector like "{id} = ?".
+func SelectorValues(f func(userID uuid.UUID) userstore.UserSelectorValues) Option {
+	return optFunc(func(opts *options) {
+		opts.selectorValues = f
+	})
+}
+
+// Manager grants and withdraws consent for a user's column values via a mutator, leaving the values themselves unchanged
+type Manager struct {
+	client    *idp.Client
+	mutatorID uuid.UUID
+	options   options
+}
+
+// NewManager returns a Manager that updates consent using the specified mutator, which must include
+// every column whose consent will be managed
+func NewManager(client *idp.Client, mutatorID uuid.UUID, opts ...Option) (*Manager, error) {
+	options := options{
+		selectorValues: func(userID uuid.UUID) userstore.UserSelectorValues {
+			return userstore.UserSelectorValues{userID}
+		},
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if mutatorID.IsNil() {
+		return nil, ucerr.New("mutator ID must be specified")
+	}
+
+	return &Manager{client: client, mutatorID: mutatorID, options: options}, nil
+}
+
+// ConsentSnapshot returns the purposes the user has currently consented to for each of the specified columns
+func (m *Manager) ConsentSnapshot(ctx context.Context, userID uuid.UUID, columns []userstore.ResourceID) (*Snapshot, error) {
+	resp, err := m.client.GetConsentedPurposesForUser(ctx, userID, columns)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &Snapshot{
+		UserID:  userID,
+		TakenAt: time.Now().UTC(),
+		Columns: resp.Data,
+	}, nil
+}
+
+// GrantConsent adds the specified purposes to each of the specified columns for the user
+func (m *Manager) GrantConsent(ctx context.Context, userID uuid.UUID, columns []userstore.ResourceID, purposes []userstore.ResourceID) (*Receipt, error) {
+	return m.update(ctx, ActionGrant, userID, columns, purposes)
+}
+
+// WithdrawConsent removes the specified purposes from each of the specified columns for the user
+func (m *Manager) WithdrawConsent(ctx context.Context, userID uuid.UUID, columns []userstore.ResourceID, purposes []userstore.ResourceID) (*Receipt, error) {
+	return m.update(ctx, ActionWithdraw, userID, columns, purposes)
+}
+
+func (m *Manager) update(ctx context.Context, action Action, userID uuid.UUID, columns []userstore.ResourceID, purposes []userstore.ResourceID) (*Receipt, error) {
+	if len(columns) == 0 {
+		return nil, ucerr.Friendlyf(nil, "at least one column must be specified")
+	}
+	if len(purposes) == 0 {
+		return nil, ucerr.Friendlyf(nil, "at least one purpose must be specified")
+	}
+
+	rowData, err := m.rowData(ctx, action, columns, purposes)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	before, err := m.ConsentSnapshot(ctx, userID, columns)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	resp, err := m.client.ExecuteMutator(ctx, m.mutatorID, m.options.clientContext, m.options.selectorValues(userID), rowData)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if len(resp.UserIDs) != 1 || resp.UserIDs[0] != userID {
+		return nil, ucerr.Errorf("mutator %v updated %d users, expected only user %v", m.mutatorID, len(resp.UserIDs), userID)
+	}
+
+	after, err := m.ConsentSnapshot(ctx, userID, columns)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &Receipt{
+		ID:        id,
+		UserID:    userID,
+		Action:    action,
+		MutatorID: m.mutatorID,
+		Columns:   columns,
+		Purposes:  purposes,
+		IssuedAt:  after.TakenAt,
+		Before:    before,
+		After:     after,
+		Changes:   Diff(before, after),
+	}, nil
+}
+
+// rowData builds mutator row data that keeps every column's current value, adding or
+// removing the purposes for the requested columns
+func (m *Manager) rowData(ctx context.Context, action Action, columns []userstore.ResourceID, purposes []userstore.ResourceID) (map[string]idp.ValueAndPurposes, error) {
+	mutator, err := m.client.GetMutator(ctx, m.mutatorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	var allColumns []userstore.Column
+	requested := make([]bool, len(columns))
+	rowData := map[string]idp.ValueAndPurposes{}
+	for _, mc := range mutator.Columns {
+		column := mc.Column
+		if column.Name == "" {
+			c, err := m.client.GetColumn(ctx, column.ID)
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			column = userstore.ResourceID{ID: c.ID, Name: c.Name}
+		} else if column.ID.IsNil() {
+			if allColumns == nil {
+				if allColumns, err = m.listColumns(ctx); err != nil {
+					return nil, ucerr.Wrap(err)
+				}
+			}
+			for _, c := range allColumns {
+				if strings.EqualFold(c.Name, column.Name) {
+					column.ID = c.ID
+					break
+				}
+			}
+			if column.ID.IsNil() {
+				return nil, ucerr.Friendlyf(nil, "column '%s' of mutator %v not found", column.Name, m.mutatorID)
+			}
+		}
+
+		vp := idp.ValueAndPurposes{Value: idp.MutatorColumnCurrentValue}
+		for i, c := range columns {
+			if c.EquivalentTo(column) {
+				requested[i] = true
+				if action == ActionGrant {
+					vp.PurposeAdditions = purposes
+				} else {
+					vp.PurposeDeletions = purposes
+				}
+			}
+		}
+		rowData[column.Name] = vp
+	}
+
+	for i, found := range requested {
+		if !found {
+			return nil, ucerr.Friendlyf(nil, "column %v is not one of the columns of mutator %v", columns[i], m.mutatorID)
+		}
+	}
+
+	return rowData, nil
+}
+
+func (m *Manager) listColumns(ctx context.Context) ([]userstore.Column, error) {
+	columns, err := pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Column, pagination.ResponseFields, error) {
+		resp, err := m.client.ListColumns(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	return columns, ucerr.Wrap(err)
+}
@@ -0,0 +1,105 @@
+package consent
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+)
+
+// Snapshot is the set of purposes a user has consented to for each of a set of columns at a point in time
+type Snapshot struct {
+	UserID  uuid.UUID                     `json:"user_id"`
+	TakenAt time.Time                     `json:"taken_at"`
+	Columns []idp.ColumnConsentedPurposes `json:"columns"`
+}
+
+// ChangeType describes whether consent was granted or withdrawn
+type ChangeType string
+
+// ChangeType values
+const (
+	ChangeGranted   ChangeType = "granted"
+	ChangeWithdrawn ChangeType = "withdrawn"
+)
+
+// Change is a single purpose whose consent changed for a column between two snapshots
+type Change struct {
+	Column  userstore.ResourceID `json:"column"`
+	Purpose userstore.ResourceID `json:"purpose"`
+	Type    ChangeType           `json:"type"`
+}
+
+// resourceKey returns a key identifying a resource, preferring its ID over its (case-insensitive) name
+func resourceKey(r userstore.ResourceID) string {
+	if !r.ID.IsNil() {
+		return r.ID.String()
+	}
+	return strings.ToLower(r.Name)
+}
+
+type consentState struct {
+	columns  map[string]userstore.ResourceID
+	purposes map[string]map[string]userstore.ResourceID
+}
+
+func (s *Snapshot) state() consentState {
+	cs := consentState{
+		columns:  map[string]userstore.ResourceID{},
+		purposes: map[string]map[string]userstore.ResourceID{},
+	}
+	if s == nil {
+		return cs
+	}
+
+	for _, c := range s.Columns {
+		ck := resourceKey(c.Column)
+		cs.columns[ck] = c.Column
+		if cs.purposes[ck] == nil {
+			cs.purposes[ck] = map[string]userstore.ResourceID{}
+		}
+		for _, p := range c.ConsentedPurposes {
+			cs.purposes[ck][resourceKey(p)] = p
+		}
+	}
+	return cs
+}
+
+// Diff returns the consent changes between two snapshots of the same user, sorted by column and purpose.
+// Either snapshot may be nil, in which case it is treated as having no consented purposes.
+func Diff(before *Snapshot, after *Snapshot) []Change {
+	b := before.state()
+	a := after.state()
+
+	var changes []Change
+	for ck, purposes := range a.purposes {
+		for pk, p := range purposes {
+			if _, found := b.purposes[ck][pk]; !found {
+				changes = append(changes, Change{Column: a.columns[ck], Purpose: p, Type: ChangeGranted})
+			}
+		}
+	}
+	for ck, purposes := range b.purposes {
+		for pk, p := range purposes {
+			if _, found := a.purposes[ck][pk]; !found {
+				changes = append(changes, Change{Column: b.columns[ck], Purpose: p, Type: ChangeWithdrawn})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if ci, cj := resourceKey(changes[i].Column), resourceKey(changes[j].Column); ci != cj {
+			return ci < cj
+		}
+		if pi, pj := resourceKey(changes[i].Purpose), resourceKey(changes[j].Purpose); pi != pj {
+			return pi < pj
+		}
+		return changes[i].Type < changes[j].Type
+	})
+
+	return changes
+}
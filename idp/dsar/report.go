@@ -0,0 +1,109 @@
+package dsar
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// StepStatus describes the outcome of a single step of a DSAR workflow
+type StepStatus string
+
+// StepStatus values
+const (
+	StepSucceeded StepStatus = "succeeded"
+	StepFailed    StepStatus = "failed"
+	StepSkipped   StepStatus = "skipped"
+)
+
+// Step actions recorded in a Report
+const (
+	ActionGetUser         = "get_user"
+	ActionListColumns     = "list_columns"
+	ActionGetConsents     = "get_consented_purposes"
+	ActionGetAccessor     = "get_accessor"
+	ActionGetTransformer  = "get_transformer"
+	ActionGetColumn       = "get_column"
+	ActionExecuteAccessor = "execute_accessor"
+	ActionDeleteToken     = "delete_token"
+	ActionDeleteUser      = "delete_user"
+)
+
+// Step is a single auditable action taken (or, in a dry run, planned) by a DSAR workflow
+type Step struct {
+	Action    string     `json:"action"`
+	Target    string     `json:"target,omitempty"`
+	Status    StepStatus `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// Report is an auditable record of every step taken while processing a DSAR
+type Report struct {
+	UserID      uuid.UUID `json:"user_id"`
+	Erasure     bool      `json:"erasure"`
+	DryRun      bool      `json:"dry_run"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	Steps       []Step    `json:"steps"`
+}
+
+func newReport(userID uuid.UUID, erasure bool, dryRun bool) *Report {
+	return &Report{
+		UserID:    userID,
+		Erasure:   erasure,
+		DryRun:    dryRun,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+// record appends a step to the report and returns err, so that callers can record and return in one statement
+func (r *Report) record(action string, target string, err error) error {
+	s := Step{Action: action, Target: target, Status: StepSucceeded, Timestamp: time.Now().UTC()}
+	if err != nil {
+		s.Status = StepFailed
+		s.Error = ucerr.UserFriendlyMessage(err)
+	}
+	r.Steps = append(r.Steps, s)
+	return err
+}
+
+func (r *Report) skip(action string, target string) {
+	r.Steps = append(r.Steps, Step{Action: action, Target: target, Status: StepSkipped, Timestamp: time.Now().UTC()})
+}
+
+func (r *Report) complete() {
+	r.CompletedAt = time.Now().UTC()
+}
+
+// Failed returns true if any step in the report failed
+func (r *Report) Failed() bool {
+	for _, s := range r.Steps {
+		if s.Status == StepFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenReference is a token, created by a tokenize-by-reference transformer, that refers to one of the user's column values
+type TokenReference struct {
+	Column string `json:"column"`
+	Token  string `json:"token"`
+}
+
+// Bundle is the machine-readable export of everything stored about a user
+type Bundle struct {
+	UserID         uuid.UUID                     `json:"user_id"`
+	OrganizationID uuid.UUID                     `json:"organization_id"`
+	UpdatedAt      int64                         `json:"updated_at"` // seconds since the Unix Epoch (UTC)
+	GeneratedAt    time.Time                     `json:"generated_at"`
+	Profile        userstore.Record              `json:"profile"`
+	Consents       []idp.ColumnConsentedPurposes `json:"consents"`
+	Records        []userstore.Record            `json:"records"`
+	Tokens         []TokenReference              `json:"tokens"`
+}
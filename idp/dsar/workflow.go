@@ -0,0 +1,291 @@
+package dsar
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+type options struct {
+	clientContext  policy.ClientContext
+	selectorValues func(userID uuid.UUID) userstore.UserSelectorValues
+	dryRun         bool
+}
+
+// Option makes Workflow extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// ClientContext returns an Option that sets the client context passed to the export accessor's access policy
+func ClientContext(clientContext policy.ClientContext) Option {
+	return optFunc(func(opts *options) {
+		opts.clientContext = clientContext
+	})
+}
+
+// SelectorValues returns an Option that builds the export accessor's selector values for a user.
+// By default, the user ID is passed as the only selector value, matching a selector like "{id} = ?".
+func SelectorValues(f func(userID uuid.UUID) userstore.UserSelectorValues) Option {
+	return optFunc(func(opts *options) {
+		opts.selectorValues = f
+	})
+}
+
+// DryRun returns an Option that causes Erase to record the deletions it would perform without performing them
+func DryRun() Option {
+	return optFunc(func(opts *options) {
+		opts.dryRun = true
+	})
+}
+
+// Workflow gathers (and optionally erases) everything stored about a user, using a configured
+// accessor to read the user's column values
+type Workflow struct {
+	client     *idp.Client
+	accessorID uuid.UUID
+	options    options
+}
+
+// NewWorkflow returns a Workflow that exports user data via the specified accessor
+func NewWorkflow(client *idp.Client, accessorID uuid.UUID, opts ...Option) (*Workflow, error) {
+	options := options{
+		selectorValues: func(userID uuid.UUID) userstore.UserSelectorValues {
+			return userstore.UserSelectorValues{userID}
+		},
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if accessorID.IsNil() {
+		return nil, ucerr.New("accessor ID must be specified")
+	}
+
+	return &Workflow{client: client, accessorID: accessorID, options: options}, nil
+}
+
+// Export returns a bundle containing the user's profile, consented purposes for every column,
+// the records returned by the export accessor, and any tokens that refer to the user's data.
+// The returned report records every step taken, and is returned even if the export fails.
+func (w *Workflow) Export(ctx context.Context, userID uuid.UUID) (*Bundle, *Report, error) {
+	report := newReport(userID, false, w.options.dryRun)
+	defer report.complete()
+
+	bundle, err := w.export(ctx, userID, report)
+	if err != nil {
+		return nil, report, ucerr.Wrap(err)
+	}
+	return bundle, report, nil
+}
+
+// Erase exports the user's data to discover any tokens created by reference to it, deletes those
+// tokens, and then deletes the user. If any token can't be deleted, the user is not deleted, so
+// that the erasure can be retried without losing track of the remaining tokens. Tokens that have
+// already been deleted are treated as successfully deleted.
+func (w *Workflow) Erase(ctx context.Context, userID uuid.UUID) (*Bundle, *Report, error) {
+	report := newReport(userID, true, w.options.dryRun)
+	defer report.complete()
+
+	bundle, err := w.export(ctx, userID, report)
+	if err != nil {
+		return nil, report, ucerr.Wrap(err)
+	}
+
+	var tokenErr error
+	for _, tr := range bundle.Tokens {
+		if w.options.dryRun {
+			report.skip(ActionDeleteToken, tr.Token)
+			continue
+		}
+
+		err := w.client.DeleteToken(ctx, tr.Token)
+		if jsonclient.IsHTTPNotFound(err) {
+			err = nil
+		}
+		if err := report.record(ActionDeleteToken, tr.Token, err); err != nil && tokenErr == nil {
+			tokenErr = err
+		}
+	}
+
+	if tokenErr != nil {
+		report.skip(ActionDeleteUser, userID.String())
+		return bundle, report, ucerr.Errorf("user %v was not deleted because a token could not be deleted: %w", userID, tokenErr)
+	}
+
+	if w.options.dryRun {
+		report.skip(ActionDeleteUser, userID.String())
+		return bundle, report, nil
+	}
+
+	if err := report.record(ActionDeleteUser, userID.String(), w.client.DeleteUser(ctx, userID)); err != nil {
+		return bundle, report, ucerr.Wrap(err)
+	}
+
+	return bundle, report, nil
+}
+
+func (w *Workflow) export(ctx context.Context, userID uuid.UUID, report *Report) (*Bundle, error) {
+	user, err := w.client.GetUser(ctx, userID)
+	if err := report.record(ActionGetUser, userID.String(), err); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	bundle := &Bundle{
+		UserID:         user.ID,
+		OrganizationID: user.OrganizationID,
+		UpdatedAt:      user.UpdatedAt,
+		GeneratedAt:    time.Now().UTC(),
+		Profile:        user.Profile,
+	}
+
+	columns, err := w.listColumns(ctx)
+	if err := report.record(ActionListColumns, "", err); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if len(columns) > 0 {
+		consents, err := w.client.GetConsentedPurposesForUser(ctx, userID, columns)
+		if err := report.record(ActionGetConsents, userID.String(), err); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		bundle.Consents = consents.Data
+	}
+
+	tokenColumns, err := w.tokenizedByReferenceColumns(ctx, report)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	it := w.client.NewAccessorIterator(w.accessorID, w.options.clientContext, w.options.selectorValues(userID))
+	for it.Next(ctx) {
+		record, err := it.Record()
+		if err != nil {
+			return nil, ucerr.Wrap(report.record(ActionExecuteAccessor, w.accessorID.String(), err))
+		}
+		bundle.Records = append(bundle.Records, record)
+
+		for _, column := range tokenColumns {
+			tokens, err := columnTokens(record[column])
+			if err != nil {
+				return nil, ucerr.Friendlyf(err, "could not read tokens from column '%s'", column)
+			}
+			for _, token := range tokens {
+				bundle.Tokens = append(bundle.Tokens, TokenReference{Column: column, Token: token})
+			}
+		}
+	}
+	if err := report.record(ActionExecuteAccessor, w.accessorID.String(), it.Err()); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return bundle, nil
+}
+
+func (w *Workflow) listColumns(ctx context.Context) ([]userstore.ResourceID, error) {
+	all, err := pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Column, pagination.ResponseFields, error) {
+		resp, err := w.client.ListColumns(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	columns := make([]userstore.ResourceID, 0, len(all))
+	for _, c := range all {
+		columns = append(columns, userstore.ResourceID{ID: c.ID})
+	}
+	return columns, nil
+}
+
+// columnTokens returns the tokens in an accessor value, which is either a single token or, for
+// array columns, an array of tokens that may be JSON-encoded as a string
+func columnTokens(value interface{}) ([]string, error) {
+	if s, ok := value.(string); ok && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+		if s == "" {
+			return nil, nil
+		}
+		return []string{s}, nil
+	}
+
+	var values []string
+	if err := datatype.DecodeAccessorValue(value, &values); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	var tokens []string
+	for _, v := range values {
+		if v != "" {
+			tokens = append(tokens, v)
+		}
+	}
+	return tokens, nil
+}
+
+// tokenizedByReferenceColumns returns the names of the export accessor's output columns whose
+// transformer tokenizes by reference, since the values of those columns are tokens that must be
+// deleted when the user is erased
+func (w *Workflow) tokenizedByReferenceColumns(ctx context.Context, report *Report) ([]string, error) {
+	accessor, err := w.client.GetAccessor(ctx, w.accessorID)
+	if err := report.record(ActionGetAccessor, w.accessorID.String(), err); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	// accessor columns may reference transformers by ID or by name, so they're cached by the
+	// reference as written
+	transformers := map[userstore.ResourceID]*policy.Transformer{}
+	var columns []string
+	for _, oc := range accessor.Columns {
+		transformer, found := transformers[oc.Transformer]
+		if !found {
+			transformer, err = w.client.GetTransformer(ctx, oc.Transformer)
+			if err := report.record(ActionGetTransformer, resourceTarget(oc.Transformer), err); err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			transformers[oc.Transformer] = transformer
+		}
+
+		if transformer.TransformType != policy.TransformTypeTokenizeByReference {
+			continue
+		}
+
+		name := oc.Column.Name
+		if name == "" {
+			column, err := w.client.GetColumn(ctx, oc.Column.ID)
+			if err := report.record(ActionGetColumn, oc.Column.ID.String(), err); err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			name = column.Name
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, nil
+}
+
+// resourceTarget returns the report target for a resource reference, which is its ID if it has
+// one and its name otherwise
+func resourceTarget(rid userstore.ResourceID) string {
+	if !rid.ID.IsNil() {
+		return rid.ID.String()
+	}
+	return rid.Name
+}
@@ -0,0 +1,7 @@
+package idp
+
+import "userclouds.com/infra/ucerr"
+
+// ErrAccessorResultsTruncated is returned by an AccessorIterator if the server indicated
+// that an incomplete set of results was returned for a page and no TruncationHandler was specified.
+var ErrAccessorResultsTruncated = ucerr.Friendlyf(nil, "accessor results were truncated")
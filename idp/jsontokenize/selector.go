@@ -0,0 +1,214 @@
+package jsontokenize
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"userclouds.com/infra/ucerr"
+)
+
+type segmentKind int
+
+const (
+	segmentName segmentKind = iota
+	segmentIndex
+	segmentWildcard
+)
+
+// segment is one step of a selector; recursive segments match at any depth below the current node
+type segment struct {
+	kind      segmentKind
+	name      string
+	index     int
+	recursive bool
+}
+
+// Selector is a compiled JSONPath-like expression. It supports the root $, child names (.name or
+// ['name']), array indexes ([0]), wildcards (.* or [*]) and recursive descent (..name or ..*).
+type Selector struct {
+	expr     string
+	segments []segment
+}
+
+// String returns the expression the selector was compiled from
+func (s Selector) String() string {
+	return s.expr
+}
+
+// ParseSelector compiles a selector expression like $.users[*].email
+func ParseSelector(expr string) (*Selector, error) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(expr), "$")
+	if !found {
+		return nil, ucerr.Friendlyf(nil, "selector '%s' must start with $", expr)
+	}
+
+	var segments []segment
+	for rest != "" {
+		recursive := false
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			seg, remaining, err := parseDotted(expr, rest)
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			seg.recursive = true
+			segments = append(segments, seg)
+			rest = remaining
+			continue
+		case strings.HasPrefix(rest, "."):
+			seg, remaining, err := parseDotted(expr, rest[1:])
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			segments = append(segments, seg)
+			rest = remaining
+			continue
+		}
+
+		if !strings.HasPrefix(rest, "[") {
+			return nil, ucerr.Friendlyf(nil, "selector '%s' has unexpected '%s'", expr, rest)
+		}
+		seg, remaining, err := parseBracketed(expr, rest)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		seg.recursive = recursive
+		segments = append(segments, seg)
+		rest = remaining
+	}
+
+	if len(segments) == 0 {
+		return nil, ucerr.Friendlyf(nil, "selector '%s' must select a field below the root", expr)
+	}
+	return &Selector{expr: expr, segments: segments}, nil
+}
+
+// parseDotted parses a name or wildcard following a dot
+func parseDotted(expr string, rest string) (segment, string, error) {
+	end := strings.IndexAny(rest, ".[")
+	if end < 0 {
+		end = len(rest)
+	}
+	name := rest[:end]
+	if name == "" {
+		return segment{}, "", ucerr.Friendlyf(nil, "selector '%s' has an empty field name", expr)
+	}
+	if name == "*" {
+		return segment{kind: segmentWildcard}, rest[end:], nil
+	}
+	return segment{kind: segmentName, name: name}, rest[end:], nil
+}
+
+// parseBracketed parses an index, wildcard or quoted name in brackets
+func parseBracketed(expr string, rest string) (segment, string, error) {
+	if len(rest) > 2 && (rest[1] == '\'' || rest[1] == '"') {
+		quote := rest[1]
+		end := strings.IndexByte(rest[2:], quote)
+		if end < 0 || !strings.HasPrefix(rest[2+end+1:], "]") {
+			return segment{}, "", ucerr.Friendlyf(nil, "selector '%s' has an unterminated quoted name", expr)
+		}
+		return segment{kind: segmentName, name: rest[2 : 2+end]}, rest[2+end+2:], nil
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return segment{}, "", ucerr.Friendlyf(nil, "selector '%s' is missing ]", expr)
+	}
+	inner := strings.TrimSpace(rest[1:end])
+	if inner == "*" {
+		return segment{kind: segmentWildcard}, rest[end+1:], nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil || index < 0 {
+		return segment{}, "", ucerr.Friendlyf(nil, "selector '%s' has invalid index '%s'", expr, inner)
+	}
+	return segment{kind: segmentIndex, index: index}, rest[end+1:], nil
+}
+
+// match is a value selected in a document, along with a function that replaces it
+type match struct {
+	path  string
+	value interface{}
+	set   func(interface{})
+}
+
+// find returns the values in doc, decoded with encoding/json, that the selector matches, in
+// document order with object keys sorted
+func (s Selector) find(doc interface{}) []match {
+	var matches []match
+	seen := map[string]bool{}
+	var walk func(node interface{}, path string, set func(interface{}), segments []segment)
+	walk = func(node interface{}, path string, set func(interface{}), segments []segment) {
+		if len(segments) == 0 {
+			// recursive descent can reach the same node more than once
+			if !seen[path] {
+				seen[path] = true
+				matches = append(matches, match{path: path, value: node, set: set})
+			}
+			return
+		}
+
+		seg := segments[0]
+		forEachChild(node, path, func(key interface{}, child interface{}, childPath string, setChild func(interface{})) {
+			if seg.matches(key) {
+				walk(child, childPath, setChild, segments[1:])
+			}
+			if seg.recursive {
+				walk(child, childPath, setChild, segments)
+			}
+		})
+	}
+	walk(doc, "$", nil, s.segments)
+	return matches
+}
+
+func (seg segment) matches(key interface{}) bool {
+	switch seg.kind {
+	case segmentWildcard:
+		return true
+	case segmentName:
+		name, ok := key.(string)
+		return ok && name == seg.name
+	case segmentIndex:
+		index, ok := key.(int)
+		return ok && index == seg.index
+	}
+	return false
+}
+
+// forEachChild calls fn for each element of an array or field of an object
+func forEachChild(node interface{}, path string, fn func(key interface{}, child interface{}, childPath string, set func(interface{}))) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			k := k
+			fn(k, n[k], childPath(path, k), func(v interface{}) { n[k] = v })
+		}
+	case []interface{}:
+		for i := range n {
+			i := i
+			fn(i, n[i], fmt.Sprintf("%s[%d]", path, i), func(v interface{}) { n[i] = v })
+		}
+	}
+}
+
+func childPath(path string, name string) string {
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Sprintf("%s[%s]", path, strconv.Quote(name))
+		}
+	}
+	return path + "." + name
+}
@@ -0,0 +1,408 @@
+// Package jsontokenize tokenizes and detokenizes fields of JSON documents. Fields are chosen with
+// JSONPath-like selectors, each mapped to the transformer and access policy its values are
+// tokenized with, and all the values of a document are sent to the tokenizer in bulk.
+package jsontokenize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/bulktokenize"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+const (
+	defaultChunkSize = 1000
+	maxRetries       = 3
+	initialBackoff   = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+)
+
+// ValueType is the JSON type of the values selected by a rule. Tokens are always strings, so the
+// type is what lets Detokenize restore numbers and booleans.
+type ValueType string
+
+// ValueType values
+const (
+	ValueTypeString  ValueType = "string"
+	ValueTypeNumber  ValueType = "number"
+	ValueTypeBoolean ValueType = "boolean"
+)
+
+// Rule maps the fields matched by a selector to the transformer and access policy that their values are tokenized with
+type Rule struct {
+	Selector     string               `json:"selector"`
+	Transformer  userstore.ResourceID `json:"transformer"`
+	AccessPolicy userstore.ResourceID `json:"access_policy"`
+
+	// Type is the type of the selected values, which defaults to ValueTypeString
+	Type ValueType `json:"type,omitempty"`
+}
+
+// valueType returns the rule's type, applying the default
+func (r Rule) valueType() ValueType {
+	if r.Type == "" {
+		return ValueTypeString
+	}
+	return r.Type
+}
+
+// decode converts a resolved value back to the rule's type
+func (r Rule) decode(value string) (interface{}, error) {
+	switch r.valueType() {
+	case ValueTypeNumber:
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err == nil && !decoder.More() {
+			if n, ok := v.(json.Number); ok {
+				return n, nil
+			}
+		}
+		return nil, ucerr.Friendlyf(nil, "resolved value is not a number")
+	case ValueTypeBoolean:
+		switch value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, ucerr.Friendlyf(nil, "resolved value is not a boolean")
+	}
+	return value, nil
+}
+
+// Detector returns true if a value is already a token
+type Detector func(value string) bool
+
+// IsUUIDToken is a Detector for tokens in UUID format, which are produced by TransformerUUID and
+// by tokenize-by-reference transformers
+func IsUUIDToken(value string) bool {
+	_, err := uuid.FromString(value)
+	return err == nil && len(value) == 36
+}
+
+// Unresolved describes a selected field that Detokenize left unchanged
+type Unresolved struct {
+	Path   string `json:"path"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+type options struct {
+	chunkSize int
+	detector  Detector
+}
+
+// Option makes Tokenizer extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// ChunkSize returns an Option that sets the maximum number of values sent in one request, which defaults to 1000
+func ChunkSize(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.chunkSize = n
+	})
+}
+
+// TokenFormat returns an Option that sets how tokens are recognized. Tokenize leaves values that
+// are already tokens unchanged, so documents can be tokenized more than once, and Detokenize only
+// resolves values that are tokens, reporting the others as unresolved.
+func TokenFormat(detector Detector) Option {
+	return optFunc(func(opts *options) {
+		opts.detector = detector
+	})
+}
+
+type compiledRule struct {
+	Rule
+	selector *Selector
+}
+
+// Tokenizer tokenizes and detokenizes the fields of JSON documents according to a set of rules
+type Tokenizer struct {
+	client  *idp.TokenizerClient
+	rules   []compiledRule
+	options options
+}
+
+// NewTokenizer returns a Tokenizer for rules, compiling their selectors
+func NewTokenizer(client *idp.TokenizerClient, rules []Rule, opts ...Option) (*Tokenizer, error) {
+	options := options{chunkSize: defaultChunkSize}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+	if options.chunkSize < 1 {
+		return nil, ucerr.Errorf("chunk size must be at least 1 (got %d)", options.chunkSize)
+	}
+
+	if len(rules) == 0 {
+		return nil, ucerr.Friendlyf(nil, "at least one rule must be specified")
+	}
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		if err := r.Transformer.Validate(); err != nil {
+			return nil, ucerr.Friendlyf(err, "rule '%s' has an invalid transformer", r.Selector)
+		}
+		if err := r.AccessPolicy.Validate(); err != nil {
+			return nil, ucerr.Friendlyf(err, "rule '%s' has an invalid access policy", r.Selector)
+		}
+		switch r.valueType() {
+		case ValueTypeString, ValueTypeNumber, ValueTypeBoolean:
+		default:
+			return nil, ucerr.Friendlyf(nil, "rule '%s' has invalid type '%s'", r.Selector, r.Type)
+		}
+		s, err := ParseSelector(r.Selector)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		compiled = append(compiled, compiledRule{Rule: r, selector: s})
+	}
+
+	return &Tokenizer{client: client, rules: compiled, options: options}, nil
+}
+
+// field is a selected value in a document along with the rule that selected it
+type field struct {
+	match
+	rule      *compiledRule
+	value     string
+	valueType ValueType
+}
+
+// selectFields decodes doc and returns the fields selected by the rules. A field may only be
+// selected by one rule, and must be a string, number or boolean; null fields are ignored.
+func (t *Tokenizer) selectFields(doc []byte) (interface{}, []field, error) {
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, nil, ucerr.Friendlyf(err, "document is not valid JSON")
+	}
+
+	var fields []field
+	selectedBy := map[string]string{}
+	for i := range t.rules {
+		rule := &t.rules[i]
+		for _, m := range rule.selector.find(root) {
+			if other, found := selectedBy[m.path]; found {
+				return nil, nil, ucerr.Friendlyf(nil, "field %s is selected by both '%s' and '%s'", m.path, other, rule.Selector)
+			}
+			selectedBy[m.path] = rule.Selector
+
+			f := field{match: m, rule: rule}
+			switch v := m.value.(type) {
+			case nil:
+				continue
+			case string:
+				f.value, f.valueType = v, ValueTypeString
+			case json.Number:
+				f.value, f.valueType = v.String(), ValueTypeNumber
+			case bool:
+				f.value, f.valueType = "false", ValueTypeBoolean
+				if v {
+					f.value = "true"
+				}
+			default:
+				return nil, nil, ucerr.Friendlyf(nil, "field %s selected by '%s' is an object or array, not a value", m.path, rule.Selector)
+			}
+			fields = append(fields, f)
+		}
+	}
+	return root, fields, nil
+}
+
+func encode(root interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(root); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Tokenize replaces the value of each selected field with a token, using LookupOrCreateTokens so
+// that values are only tokenized once per transformer and access policy. Each value must have its
+// rule's type, so that Detokenize can restore it; numbers and booleans are tokenized as their JSON
+// text. The document is returned re-encoded, with object keys sorted. If any value can't be
+// tokenized, Tokenize returns an error and no document.
+func (t *Tokenizer) Tokenize(ctx context.Context, doc []byte) ([]byte, error) {
+	root, fields, err := t.selectFields(doc)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	var items []bulktokenize.Item
+	var targets []field
+	for _, f := range fields {
+		if f.valueType == ValueTypeString && t.options.detector != nil && t.options.detector(f.value) {
+			continue
+		}
+		if f.valueType != f.rule.valueType() {
+			return nil, ucerr.Friendlyf(nil, "field %s selected by '%s' is a %s, not a %s", f.path, f.rule.Selector, f.valueType, f.rule.valueType())
+		}
+		items = append(items, bulktokenize.Item{Data: f.value, Transformer: f.rule.Transformer, AccessPolicy: f.rule.AccessPolicy})
+		targets = append(targets, f)
+	}
+
+	if len(items) > 0 {
+		bt, err := bulktokenize.NewTokenizer(t.client, bulktokenize.ChunkSize(t.options.chunkSize), bulktokenize.Concurrency(1))
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		results, _, err := bt.Tokenize(ctx, items)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		for i, res := range results {
+			if res.Error != "" {
+				return nil, ucerr.Friendlyf(nil, "could not tokenize field %s: %s", targets[i].path, res.Error)
+			}
+		}
+		for i, res := range results {
+			targets[i].set(res.Token)
+		}
+	}
+
+	out, err := encode(root)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return out, nil
+}
+
+// Detokenize replaces the token in each selected field with the value it resolves to for
+// clientContext and purposes, converted back to its rule's type. Fields that can't be resolved,
+// because access is denied, the tokenizer rejects the token, the value isn't a token or the
+// resolved value doesn't have the rule's type, are left unchanged and reported as unresolved
+// rather than failing the document. Rate limit and server errors are retried; any other error,
+// like an authorization failure, fails the document.
+func (t *Tokenizer) Detokenize(ctx context.Context, doc []byte, clientContext policy.ClientContext, purposes []userstore.ResourceID) ([]byte, []Unresolved, error) {
+	root, fields, err := t.selectFields(doc)
+	if err != nil {
+		return nil, nil, ucerr.Wrap(err)
+	}
+
+	var unresolved []Unresolved
+	var tokens []string
+	byToken := map[string][]field{}
+	for _, f := range fields {
+		if f.valueType != ValueTypeString || (t.options.detector != nil && !t.options.detector(f.value)) {
+			unresolved = append(unresolved, Unresolved{Path: f.path, Value: f.value, Reason: "value is not a token"})
+			continue
+		}
+		if _, found := byToken[f.value]; !found {
+			tokens = append(tokens, f.value)
+		}
+		byToken[f.value] = append(byToken[f.value], f)
+	}
+
+	values := map[string]string{}
+	reasons := map[string]string{}
+	for start := 0; start < len(tokens); start += t.options.chunkSize {
+		end := start + t.options.chunkSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		if err := t.resolve(ctx, tokens[start:end], clientContext, purposes, values, reasons); err != nil {
+			return nil, nil, ucerr.Wrap(err)
+		}
+	}
+
+	for _, token := range tokens {
+		for _, f := range byToken[token] {
+			if reason, found := reasons[token]; found {
+				unresolved = append(unresolved, Unresolved{Path: f.path, Value: token, Reason: reason})
+				continue
+			}
+			v, err := f.rule.decode(values[token])
+			if err != nil {
+				unresolved = append(unresolved, Unresolved{Path: f.path, Value: token, Reason: ucerr.UserFriendlyMessage(err)})
+				continue
+			}
+			f.set(v)
+		}
+	}
+
+	out, err := encode(root)
+	if err != nil {
+		return nil, nil, ucerr.Wrap(err)
+	}
+	return out, unresolved, nil
+}
+
+// resolve resolves tokens in one request, recording the values of the tokens that resolve and why
+// the others don't. Rate limit and server errors are retried with backoff. If the request is
+// rejected as invalid, the tokens are split in half and each half is tried separately, so that one
+// bad token only fails itself. Any other error is returned, since it would fail every request.
+func (t *Tokenizer) resolve(ctx context.Context, tokens []string, clientContext policy.ClientContext, purposes []userstore.ResourceID, values map[string]string, reasons map[string]string) error {
+	backoff := initialBackoff
+	for attempts := 1; ; attempts++ {
+		resolved, err := t.client.ResolveTokens(ctx, tokens, clientContext, purposes)
+		if err == nil && len(resolved) != len(tokens) {
+			return ucerr.Errorf("server returned %d values for %d tokens", len(resolved), len(tokens))
+		}
+		if err == nil {
+			for i, token := range tokens {
+				// the tokenizer returns an empty value when the access policy denies access
+				if resolved[i] == "" {
+					reasons[token] = "access denied"
+					continue
+				}
+				values[token] = resolved[i]
+			}
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ucerr.Wrap(ctx.Err())
+		}
+
+		code := jsonclient.GetHTTPStatusCode(err)
+		if code == http.StatusBadRequest {
+			if len(tokens) == 1 {
+				reasons[tokens[0]] = strings.TrimSpace(ucerr.UserFriendlyMessage(err))
+				return nil
+			}
+			half := len(tokens) / 2
+			if err := t.resolve(ctx, tokens[:half], clientContext, purposes, values, reasons); err != nil {
+				return ucerr.Wrap(err)
+			}
+			return ucerr.Wrap(t.resolve(ctx, tokens[half:], clientContext, purposes, values, reasons))
+		}
+
+		if (code != http.StatusTooManyRequests && code < http.StatusInternalServerError) || attempts > maxRetries {
+			return ucerr.Wrap(err)
+		}
+
+		uclog.Debugf(ctx, "retrying resolution of %d tokens after error: %v", len(tokens), err)
+		select {
+		case <-ctx.Done():
+			return ucerr.Wrap(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Params are the parameters of a template component, e.g. Params{"attribute": "_editor"}
+type Params map[string]interface{}
+
+// TemplateSpec identifies a template along with the parameters it accepts
+type TemplateSpec struct {
+	Template   userstore.ResourceID
+	Parameters ParameterSchema
+}
+
+// AllowAll is the system template that allows everything
+var AllowAll = TemplateSpec{
+	Template:   userstore.ResourceID{ID: AccessPolicyTemplateAllowAll.ID},
+	Parameters: ParameterSchema{},
+}
+
+// DenyAll is the system template that denies everything
+var DenyAll = TemplateSpec{
+	Template:   userstore.ResourceID{ID: AccessPolicyTemplateDenyAll.ID},
+	Parameters: ParameterSchema{},
+}
+
+// CheckAttribute is the system template that checks an authz attribute between two objects, whose
+// IDs are found at the context paths listed in userIDUsage
+var CheckAttribute = TemplateSpec{
+	Template: userstore.ResourceID{ID: AccessPolicyTemplateCheckAttribute.ID},
+	Parameters: ParameterSchema{
+		{Name: "attribute", Type: ParameterTypeString, Required: true, Description: "the attribute to check"},
+		{Name: "userIDUsage", Type: ParameterTypeStringArray, Required: true, Length: 2, Description: "context paths of the source and target object IDs"},
+	},
+}
+
+// systemTemplateNames are the names Format uses for the system templates
+var systemTemplateNames = map[userstore.ResourceID]string{
+	AllowAll.Template:       "AllowAll",
+	DenyAll.Template:        "DenyAll",
+	CheckAttribute.Template: "CheckAttribute",
+}
+
+// Node is part of an access policy built with AllOf, AnyOf, Template and PolicyRef
+type Node interface {
+	node()
+}
+
+type compositeNode struct {
+	policyType PolicyType
+	children   []Node
+}
+
+type templateNode struct {
+	spec   TemplateSpec
+	params Params
+}
+
+type policyNode struct {
+	rid userstore.ResourceID
+}
+
+func (compositeNode) node() {}
+func (templateNode) node()  {}
+func (policyNode) node()    {}
+
+// AllOf returns a node that grants access if all of nodes do
+func AllOf(nodes ...Node) Node {
+	return compositeNode{policyType: PolicyTypeCompositeAnd, children: nodes}
+}
+
+// AnyOf returns a node that grants access if any of nodes does
+func AnyOf(nodes ...Node) Node {
+	return compositeNode{policyType: PolicyTypeCompositeOr, children: nodes}
+}
+
+// Template returns a node that runs a template with params, which are checked against the
+// template's parameter schema when the policy is built
+func Template(spec TemplateSpec, params ...Params) Node {
+	merged := Params{}
+	for _, p := range params {
+		for k, v := range p {
+			merged[k] = v
+		}
+	}
+	return templateNode{spec: spec, params: merged}
+}
+
+// PolicyRef returns a node that runs an existing access policy, identified by ID or name
+func PolicyRef(rid userstore.ResourceID) Node {
+	return policyNode{rid: rid}
+}
+
+// Build turns a tree of nodes into access policies ready for CreateAccessPolicy. A component can
+// only reference a policy or a template, so nested AllOf and AnyOf nodes that can't be flattened
+// into their parent become policies of their own, named name_1, name_2 and so on and referenced by
+// name. The policies are returned in the order they must be created, with the policy called name
+// last; callers can set its Description and Thresholds before creating it.
+func Build(name string, root Node) ([]AccessPolicy, error) {
+	composite, ok := root.(compositeNode)
+	if !ok {
+		composite = compositeNode{policyType: PolicyTypeCompositeAnd, children: []Node{root}}
+	}
+
+	b := builder{name: name}
+	if _, err := b.build(name, composite); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return b.policies, nil
+}
+
+type builder struct {
+	name     string
+	nested   int
+	policies []AccessPolicy
+}
+
+func (b *builder) build(name string, composite compositeNode) (*AccessPolicy, error) {
+	ap := AccessPolicy{Name: name, PolicyType: composite.policyType}
+	if err := b.addComponents(&ap, composite.children); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if err := ap.Validate(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	b.policies = append(b.policies, ap)
+	return &ap, nil
+}
+
+func (b *builder) addComponents(ap *AccessPolicy, nodes []Node) error {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case compositeNode:
+			// a composite of the same type, or with a single child, is equivalent to its children
+			if n.policyType == ap.PolicyType || len(n.children) == 1 {
+				if len(n.children) == 0 {
+					return ucerr.Friendlyf(nil, "AllOf and AnyOf must have at least one component")
+				}
+				if err := b.addComponents(ap, n.children); err != nil {
+					return ucerr.Wrap(err)
+				}
+				continue
+			}
+
+			b.nested++
+			nested, err := b.build(fmt.Sprintf("%s_%d", b.name, b.nested), n)
+			if err != nil {
+				return ucerr.Wrap(err)
+			}
+			ap.Components = append(ap.Components, AccessPolicyComponent{Policy: &userstore.ResourceID{Name: nested.Name}})
+
+		case templateNode:
+			if n.spec.Template.ID.IsNil() && n.spec.Template.Name == "" {
+				return ucerr.Friendlyf(nil, "template must have an ID or name")
+			}
+
+			// round trip the parameters through JSON so they're checked as the server will see them
+			var params string
+			if len(n.params) > 0 {
+				encoded, err := json.Marshal(n.params)
+				if err != nil {
+					return ucerr.Friendlyf(err, "template parameters can't be encoded as JSON")
+				}
+				params = string(encoded)
+			}
+			if err := n.spec.Parameters.ValidateJSON(params); err != nil {
+				return ucerr.Friendlyf(err, "invalid parameters for template %s: %s", templateName(n.spec.Template), ucerr.UserFriendlyMessage(err))
+			}
+
+			rid := n.spec.Template
+			ap.Components = append(ap.Components, AccessPolicyComponent{Template: &rid, TemplateParameters: params})
+
+		case policyNode:
+			if n.rid.ID.IsNil() && n.rid.Name == "" {
+				return ucerr.Friendlyf(nil, "policy reference must have an ID or name")
+			}
+			rid := n.rid
+			ap.Components = append(ap.Components, AccessPolicyComponent{Policy: &rid})
+
+		default:
+			return ucerr.Errorf("unknown node type %T", n)
+		}
+	}
+
+	if len(ap.Components) == 0 {
+		return ucerr.Friendlyf(nil, "AllOf and AnyOf must have at least one component")
+	}
+	return nil
+}
+
+// NameResolver looks up access policies and templates by ID or name. *idp.TokenizerClient
+// implements NameResolver.
+type NameResolver interface {
+	GetAccessPolicy(ctx context.Context, accessPolicyRID userstore.ResourceID) (*AccessPolicy, error)
+	GetAccessPolicyTemplate(ctx context.Context, accessPolicyTemplateRID userstore.ResourceID) (*AccessPolicyTemplate, error)
+}
+
+// ResolveNames fills in the IDs of the policies and templates that policies reference by name
+// only, so that typos are caught before anything is created. References to policies in the set
+// itself, like the nested policies returned by Build, are left as names since they don't exist yet.
+func ResolveNames(ctx context.Context, r NameResolver, policies []AccessPolicy) error {
+	local := map[string]bool{}
+	for _, ap := range policies {
+		local[strings.ToLower(ap.Name)] = true
+	}
+
+	for i := range policies {
+		for j, c := range policies[i].Components {
+			if c.Policy != nil && c.Policy.ID.IsNil() && !local[strings.ToLower(c.Policy.Name)] {
+				ap, err := r.GetAccessPolicy(ctx, *c.Policy)
+				if err != nil {
+					return ucerr.Friendlyf(err, "could not resolve access policy %s", describeResource(*c.Policy))
+				}
+				policies[i].Components[j].Policy = &userstore.ResourceID{ID: ap.ID, Name: ap.Name}
+			}
+			if c.Template != nil && c.Template.ID.IsNil() {
+				apt, err := r.GetAccessPolicyTemplate(ctx, *c.Template)
+				if err != nil {
+					return ucerr.Friendlyf(err, "could not resolve access policy template %s", describeResource(*c.Template))
+				}
+				policies[i].Components[j].Template = &userstore.ResourceID{ID: apt.ID, Name: apt.Name}
+			}
+		}
+	}
+	return nil
+}
+
+// Format renders an access policy in the notation of AllOf, AnyOf, Template and PolicyRef.
+// Referenced policies that are passed as nested, e.g. the other policies returned by Build, are
+// rendered inline rather than as PolicyRef.
+func Format(ap AccessPolicy, nested ...AccessPolicy) string {
+	var sb strings.Builder
+	formatPolicy(&sb, ap, nested, map[string]bool{}, 0)
+	return sb.String()
+}
+
+func formatPolicy(sb *strings.Builder, ap AccessPolicy, nested []AccessPolicy, visiting map[string]bool, depth int) {
+	key := strings.ToLower(ap.Name) + "/" + ap.ID.String()
+	visiting[key] = true
+	defer delete(visiting, key)
+
+	indent := strings.Repeat("\t", depth)
+	switch ap.PolicyType {
+	case PolicyTypeCompositeAnd:
+		sb.WriteString("AllOf(\n")
+	case PolicyTypeCompositeOr:
+		sb.WriteString("AnyOf(\n")
+	default:
+		fmt.Fprintf(sb, "%s(\n", ap.PolicyType)
+	}
+
+	for _, c := range ap.Components {
+		sb.WriteString(indent + "\t")
+		switch {
+		case c.Policy != nil:
+			if inline := findNested(*c.Policy, nested); inline != nil && !visiting[strings.ToLower(inline.Name)+"/"+inline.ID.String()] {
+				formatPolicy(sb, *inline, nested, visiting, depth+1)
+			} else {
+				fmt.Fprintf(sb, "PolicyRef(%s)", describeResource(*c.Policy))
+			}
+		case c.Template != nil:
+			sb.WriteString("Template(" + templateName(*c.Template))
+			if c.TemplateParameters != "" {
+				sb.WriteString(", " + formatParams(c.TemplateParameters))
+			}
+			sb.WriteString(")")
+		default:
+			sb.WriteString("<empty component>")
+		}
+		sb.WriteString(",\n")
+	}
+	sb.WriteString(indent + ")")
+}
+
+func findNested(rid userstore.ResourceID, nested []AccessPolicy) *AccessPolicy {
+	for i, ap := range nested {
+		if !rid.ID.IsNil() && rid.ID == ap.ID {
+			return &nested[i]
+		}
+		if rid.ID.IsNil() && rid.Name != "" && strings.EqualFold(rid.Name, ap.Name) {
+			return &nested[i]
+		}
+	}
+	return nil
+}
+
+// formatParams renders template parameters as Params with sorted keys, or as a quoted string if
+// they aren't a JSON object
+func formatParams(params string) string {
+	decoded := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(params), &decoded); err != nil {
+		return fmt.Sprintf("%q", params)
+	}
+
+	keys := make([]string, 0, len(decoded))
+	for k := range decoded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%q: %s", k, decoded[k]))
+	}
+	return "Params{" + strings.Join(parts, ", ") + "}"
+}
+
+// templateName returns the name of a system template, or a readable identifier for any other template
+func templateName(rid userstore.ResourceID) string {
+	if name, found := systemTemplateNames[userstore.ResourceID{ID: rid.ID}]; found {
+		return name
+	}
+	return describeResource(rid)
+}
+
+// describeResource returns a readable identifier for a resource ID
+func describeResource(rid userstore.ResourceID) string {
+	switch {
+	case rid.Name != "" && !rid.ID.IsNil():
+		return "'" + rid.Name + "' (" + rid.ID.String() + ")"
+	case rid.Name != "":
+		return "'" + rid.Name + "'"
+	default:
+		return rid.ID.String()
+	}
+}
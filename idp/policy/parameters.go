@@ -0,0 +1,164 @@
+package policy
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// ParameterType is the type of a template or transformer parameter
+type ParameterType string
+
+// ParameterType constants
+const (
+	ParameterTypeString      ParameterType = "string"
+	ParameterTypeNumber      ParameterType = "number"
+	ParameterTypeInteger     ParameterType = "integer"
+	ParameterTypeBoolean     ParameterType = "boolean"
+	ParameterTypeStringArray ParameterType = "string_array"
+	ParameterTypeObject      ParameterType = "object"
+	ParameterTypeAny         ParameterType = "any"
+)
+
+// ParameterSpec declares a single parameter
+type ParameterSpec struct {
+	Name        string        `json:"name"`
+	Type        ParameterType `json:"type"`
+	Required    bool          `json:"required"`
+	Description string        `json:"description,omitempty"`
+
+	// Length, if non-zero, is the exact number of elements of a ParameterTypeStringArray parameter
+	Length int `json:"length,omitempty"`
+
+	// Minimum and Maximum, if set, bound a ParameterTypeNumber or ParameterTypeInteger parameter
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	// Enum, if non-empty, lists the values a ParameterTypeString parameter may take
+	Enum []string `json:"enum,omitempty"`
+}
+
+// ParameterSchema declares the parameters a template or transformer accepts. A nil schema accepts
+// any parameters, while an empty one accepts none.
+type ParameterSchema []ParameterSpec
+
+// Validate checks parameters, in the form produced by decoding a JSON object, against the schema
+func (s ParameterSchema) Validate(params map[string]interface{}) error {
+	if s == nil {
+		return nil
+	}
+
+	var unknown []string
+	for name := range params {
+		if s.find(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return ucerr.Friendlyf(nil, "unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+
+	for _, spec := range s {
+		value, found := params[spec.Name]
+		if !found {
+			if spec.Required {
+				return ucerr.Friendlyf(nil, "parameter '%s' is required", spec.Name)
+			}
+			continue
+		}
+		if err := spec.check(value); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// ValidateJSON checks parameters encoded as a JSON object against the schema. An empty string is
+// treated as no parameters.
+func (s ParameterSchema) ValidateJSON(params string) error {
+	decoded := map[string]interface{}{}
+	if strings.TrimSpace(params) != "" {
+		if err := json.Unmarshal([]byte(params), &decoded); err != nil {
+			return ucerr.Friendlyf(err, "parameters must be a JSON object")
+		}
+	}
+	return ucerr.Wrap(s.Validate(decoded))
+}
+
+func (s ParameterSchema) find(name string) *ParameterSpec {
+	for i := range s {
+		if s[i].Name == name {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+func (p ParameterSpec) check(value interface{}) error {
+	ok := true
+	switch p.Type {
+	case ParameterTypeString:
+		var str string
+		str, ok = value.(string)
+		if ok && len(p.Enum) > 0 && !p.allows(str) {
+			return ucerr.Friendlyf(nil, "parameter '%s' must be one of %s (got '%s')", p.Name, strings.Join(p.Enum, ", "), str)
+		}
+	case ParameterTypeNumber, ParameterTypeInteger:
+		var n float64
+		n, ok = value.(float64)
+		if ok && p.Type == ParameterTypeInteger && n != math.Trunc(n) {
+			ok = false
+		}
+		if ok {
+			if err := p.checkRange(n); err != nil {
+				return ucerr.Wrap(err)
+			}
+		}
+	case ParameterTypeBoolean:
+		_, ok = value.(bool)
+	case ParameterTypeObject:
+		_, ok = value.(map[string]interface{})
+	case ParameterTypeStringArray:
+		var list []interface{}
+		list, ok = value.([]interface{})
+		for _, elem := range list {
+			if _, isString := elem.(string); !isString {
+				ok = false
+			}
+		}
+		if ok && p.Length != 0 && len(list) != p.Length {
+			return ucerr.Friendlyf(nil, "parameter '%s' must have %d elements (got %d)", p.Name, p.Length, len(list))
+		}
+	case ParameterTypeAny:
+	default:
+		return ucerr.Errorf("parameter '%s' has unknown type '%s'", p.Name, p.Type)
+	}
+
+	if !ok {
+		return ucerr.Friendlyf(nil, "parameter '%s' must be of type %s", p.Name, p.Type)
+	}
+	return nil
+}
+
+func (p ParameterSpec) allows(value string) bool {
+	for _, allowed := range p.Enum {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ParameterSpec) checkRange(n float64) error {
+	if p.Minimum != nil && n < *p.Minimum {
+		return ucerr.Friendlyf(nil, "parameter '%s' must be at least %v (got %v)", p.Name, *p.Minimum, n)
+	}
+	if p.Maximum != nil && n > *p.Maximum {
+		return ucerr.Friendlyf(nil, "parameter '%s' must be at most %v (got %v)", p.Name, *p.Maximum, n)
+	}
+	return nil
+}
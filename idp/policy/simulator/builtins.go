@@ -0,0 +1,110 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/infra/ucerr"
+)
+
+// TemplateFunc is a Go implementation of an access policy template's function. It's passed the
+// context the policy is evaluated against and the template parameters of the component being
+// evaluated, decoded from JSON, and returns whether access is allowed.
+type TemplateFunc func(ctx context.Context, apc policy.AccessPolicyContext, params map[string]interface{}) (bool, error)
+
+// AttributeChecker checks whether one authz object has an attribute on another, as the checkAttribute
+// function does for template functions on the server. It's used by the CheckAttribute built-in, and
+// can be implemented with authz.Client.CheckAttribute.
+type AttributeChecker func(ctx context.Context, sourceObjectID, targetObjectID uuid.UUID, attribute string) (bool, error)
+
+// AllowAll is the built-in implementation of policy.AccessPolicyTemplateAllowAll
+func AllowAll(ctx context.Context, apc policy.AccessPolicyContext, params map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
+// DenyAll is the built-in implementation of policy.AccessPolicyTemplateDenyAll
+func DenyAll(ctx context.Context, apc policy.AccessPolicyContext, params map[string]interface{}) (bool, error) {
+	return false, nil
+}
+
+// CheckAttribute returns the built-in implementation of policy.AccessPolicyTemplateCheckAttribute,
+// which uses checker to check attributes. Like the server's template, it expects an "attribute"
+// parameter, and a "userIDUsage" parameter with the paths of the source and target object IDs in the
+// context, e.g. ["server.claims.sub", "user.id"]. Access is denied if either ID or the attribute
+// is missing.
+func CheckAttribute(checker AttributeChecker) TemplateFunc {
+	return func(ctx context.Context, apc policy.AccessPolicyContext, params map[string]interface{}) (bool, error) {
+		if checker == nil {
+			return false, ucerr.New("CheckAttribute requires an AttributeChecker, which can be specified with the WithAttributeChecker option")
+		}
+
+		attribute, _ := params["attribute"].(string)
+		usage, _ := params["userIDUsage"].([]interface{})
+		if attribute == "" || len(usage) != 2 {
+			return false, nil
+		}
+
+		var ids [2]uuid.UUID
+		for i, u := range usage {
+			path, ok := u.(string)
+			if !ok {
+				return false, nil
+			}
+			value, err := LookupContext(apc, path)
+			if err != nil {
+				return false, ucerr.Wrap(err)
+			}
+			s, ok := value.(string)
+			if !ok {
+				return false, nil
+			}
+			id, err := uuid.FromString(s)
+			if err != nil {
+				return false, nil
+			}
+			ids[i] = id
+		}
+
+		allowed, err := checker(ctx, ids[0], ids[1], attribute)
+		if err != nil {
+			return false, ucerr.Wrap(err)
+		}
+		return allowed, nil
+	}
+}
+
+// LookupContext returns the value at a dotted path in the JSON representation of an access policy
+// context, e.g. "client.role" or "user.id", the way template functions see it. A leading "context."
+// is ignored. Nil is returned if there's no value at the path.
+func LookupContext(apc policy.AccessPolicyContext, path string) (interface{}, error) {
+	b, err := json.Marshal(apc)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	path = strings.TrimPrefix(path, "context.")
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, nil
+			}
+			value = v[i]
+		default:
+			return nil, nil
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,70 @@
+package simulator
+
+import (
+	"context"
+	"strings"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Resolver looks up the access policies and templates that are referenced by the components of a
+// composite policy. *idp.TokenizerClient implements Resolver, so policies can be simulated against
+// the configuration of a live tenant.
+type Resolver interface {
+	GetAccessPolicy(ctx context.Context, accessPolicyRID userstore.ResourceID) (*policy.AccessPolicy, error)
+	GetAccessPolicyTemplate(ctx context.Context, accessPolicyTemplateRID userstore.ResourceID) (*policy.AccessPolicyTemplate, error)
+}
+
+// StaticResolver is a Resolver for a fixed set of access policies and templates, e.g. ones that are
+// being developed locally before they're created in a tenant
+type StaticResolver struct {
+	policies  []policy.AccessPolicy
+	templates []policy.AccessPolicyTemplate
+}
+
+// NewStaticResolver returns a Resolver for the specified access policies and templates
+func NewStaticResolver(policies []policy.AccessPolicy, templates []policy.AccessPolicyTemplate) *StaticResolver {
+	return &StaticResolver{policies: policies, templates: templates}
+}
+
+// GetAccessPolicy implements Resolver
+func (r *StaticResolver) GetAccessPolicy(ctx context.Context, accessPolicyRID userstore.ResourceID) (*policy.AccessPolicy, error) {
+	for _, ap := range r.policies {
+		if matches(accessPolicyRID, userstore.ResourceID{ID: ap.ID, Name: ap.Name}) {
+			return &ap, nil
+		}
+	}
+	return nil, ucerr.Friendlyf(nil, "access policy %s not found", describe(accessPolicyRID))
+}
+
+// GetAccessPolicyTemplate implements Resolver
+func (r *StaticResolver) GetAccessPolicyTemplate(ctx context.Context, accessPolicyTemplateRID userstore.ResourceID) (*policy.AccessPolicyTemplate, error) {
+	for _, apt := range r.templates {
+		if matches(accessPolicyTemplateRID, userstore.ResourceID{ID: apt.ID, Name: apt.Name}) {
+			return &apt, nil
+		}
+	}
+	return nil, ucerr.Friendlyf(nil, "access policy template %s not found", describe(accessPolicyTemplateRID))
+}
+
+// matches returns true if a reference identifies a resource, by ID if it has one and otherwise by name
+func matches(ref userstore.ResourceID, resource userstore.ResourceID) bool {
+	if !ref.ID.IsNil() {
+		return ref.ID == resource.ID && (ref.Name == "" || strings.EqualFold(ref.Name, resource.Name))
+	}
+	return ref.Name != "" && strings.EqualFold(ref.Name, resource.Name)
+}
+
+// describe returns a readable identifier for a resource ID, for use in errors and traces
+func describe(rid userstore.ResourceID) string {
+	switch {
+	case rid.Name != "" && !rid.ID.IsNil():
+		return "'" + rid.Name + "' (" + rid.ID.String() + ")"
+	case rid.Name != "":
+		return "'" + rid.Name + "'"
+	default:
+		return rid.ID.String()
+	}
+}
@@ -0,0 +1,412 @@
+// Package simulator evaluates access policies locally, so that composite policies can be tested
+// without a live tenant. Template functions are supplied as Go implementations keyed by template ID,
+// and every evaluation returns a trace showing which components allowed or denied access.
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// defaultMaxDepth is the deepest nesting of policies that is evaluated before giving up
+const defaultMaxDepth = 32
+
+type options struct {
+	resolver         Resolver
+	templates        map[uuid.UUID]TemplateFunc
+	attributeChecker AttributeChecker
+	maxDepth         int
+	executions       int
+	results          int
+}
+
+// Option makes the simulator and its evaluations extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// WithResolver returns an Option that sets how policies and templates referenced by components are
+// looked up. Without a resolver, only the system policies and templates with built-in
+// implementations can be referenced.
+func WithResolver(resolver Resolver) Option {
+	return optFunc(func(opts *options) {
+		opts.resolver = resolver
+	})
+}
+
+// WithTemplate returns an Option that sets the Go implementation of a template, replacing the
+// built-in implementation if there is one
+func WithTemplate(templateID uuid.UUID, fn TemplateFunc) Option {
+	return optFunc(func(opts *options) {
+		opts.templates[templateID] = fn
+	})
+}
+
+// WithAttributeChecker returns an Option that sets how the CheckAttribute built-in checks attributes
+func WithAttributeChecker(checker AttributeChecker) Option {
+	return optFunc(func(opts *options) {
+		opts.attributeChecker = checker
+	})
+}
+
+// WithMaxDepth returns an Option that sets the deepest nesting of policies that is evaluated, which defaults to 32
+func WithMaxDepth(maxDepth int) Option {
+	return optFunc(func(opts *options) {
+		opts.maxDepth = maxDepth
+	})
+}
+
+// WithExecutions returns an Option that sets how many times the policy has been executed in its
+// threshold window, including the evaluation being simulated, for checking MaxExecutions
+func WithExecutions(executions int) Option {
+	return optFunc(func(opts *options) {
+		opts.executions = executions
+	})
+}
+
+// WithResults returns an Option that sets how many results the simulated action involves, for
+// checking MaxResultsPerExecution
+func WithResults(results int) Option {
+	return optFunc(func(opts *options) {
+		opts.results = results
+	})
+}
+
+// Simulator evaluates access policies locally
+type Simulator struct {
+	options options
+}
+
+// NewSimulator returns a Simulator with built-in implementations of the AllowAll, DenyAll and
+// CheckAttribute templates
+func NewSimulator(opts ...Option) *Simulator {
+	s := &Simulator{options: options{
+		templates: map[uuid.UUID]TemplateFunc{},
+		maxDepth:  defaultMaxDepth,
+	}}
+	for _, opt := range opts {
+		opt.apply(&s.options)
+	}
+	return s
+}
+
+// evaluationOptions returns the simulator's options with per-evaluation options applied, without
+// modifying the simulator's own template map
+func (s *Simulator) evaluationOptions(opts []Option) options {
+	options := s.options
+	options.templates = make(map[uuid.UUID]TemplateFunc, len(s.options.templates))
+	for id, fn := range s.options.templates {
+		options.templates[id] = fn
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+	return options
+}
+
+// Trace describes the evaluation of a policy, or of one of its components
+type Trace struct {
+	// exactly one of Policy and Template is set
+	Policy             *userstore.ResourceID `json:"policy,omitempty"`
+	PolicyType         policy.PolicyType     `json:"policy_type,omitempty"`
+	Template           *userstore.ResourceID `json:"template,omitempty"`
+	TemplateParameters string                `json:"template_parameters,omitempty"`
+
+	Allowed bool `json:"allowed"`
+
+	// Skipped is true if the component wasn't evaluated, because an earlier component already
+	// decided the outcome of its composite policy
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Reason explains the outcome when it wasn't decided by components alone, e.g. a threshold
+	Reason string `json:"reason,omitempty"`
+
+	Components []Trace `json:"components,omitempty"`
+}
+
+// String returns the trace as an indented tree, one line per policy or template
+func (t Trace) String() string {
+	var b strings.Builder
+	t.write(&b, 0)
+	return b.String()
+}
+
+func (t Trace) write(b *strings.Builder, depth int) {
+	outcome := "deny"
+	if t.Skipped {
+		outcome = "skipped"
+	} else if t.Allowed {
+		outcome = "allow"
+	}
+
+	b.WriteString(strings.Repeat("  ", depth))
+	if t.Policy != nil {
+		fmt.Fprintf(b, "policy %s", describe(*t.Policy))
+		if t.PolicyType != "" {
+			fmt.Fprintf(b, " [%s]", t.PolicyType)
+		}
+		fmt.Fprintf(b, ": %s", outcome)
+	} else if t.Template != nil {
+		fmt.Fprintf(b, "template %s", describe(*t.Template))
+		if t.TemplateParameters != "" {
+			fmt.Fprintf(b, " %s", t.TemplateParameters)
+		}
+		fmt.Fprintf(b, ": %s", outcome)
+	}
+	if t.Reason != "" {
+		fmt.Fprintf(b, " (%s)", t.Reason)
+	}
+	b.WriteString("\n")
+
+	for _, c := range t.Components {
+		c.write(b, depth+1)
+	}
+}
+
+// Decision is the outcome of evaluating an access policy
+type Decision struct {
+	Allowed bool `json:"allowed"`
+
+	// Announced is true if access is denied by a threshold whose failures are announced, in which
+	// case the server returns an error rather than silently denying access
+	Announced bool `json:"announced,omitempty"`
+
+	Trace Trace `json:"trace"`
+}
+
+// Evaluate evaluates an access policy against a context, resolving component policies and
+// templates recursively. Options passed to Evaluate apply to this evaluation only.
+func (s *Simulator) Evaluate(ctx context.Context, ap policy.AccessPolicy, apc policy.AccessPolicyContext, opts ...Option) (*Decision, error) {
+	e := &evaluator{options: s.evaluationOptions(opts)}
+	e.addBuiltins()
+
+	trace, err := e.evaluatePolicy(ctx, ap, apc, nil)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	decision := &Decision{Allowed: trace.Allowed, Trace: *trace}
+	if !decision.Allowed {
+		return decision, nil
+	}
+
+	t := ap.Thresholds
+	if t.MaxExecutions > 0 && e.options.executions > t.MaxExecutions {
+		decision.Allowed = false
+		decision.Announced = t.AnnounceMaxExecutionFailure
+		decision.Trace.Allowed = false
+		decision.Trace.Reason = fmt.Sprintf("%d executions exceeds the maximum of %d in %d seconds",
+			e.options.executions, t.MaxExecutions, t.MaxExecutionDurationSeconds)
+	} else if t.MaxResultsPerExecution > 0 && e.options.results > t.MaxResultsPerExecution {
+		decision.Allowed = false
+		decision.Announced = t.AnnounceMaxResultFailure
+		decision.Trace.Allowed = false
+		decision.Trace.Reason = fmt.Sprintf("%d results exceeds the maximum of %d per execution",
+			e.options.results, t.MaxResultsPerExecution)
+	}
+
+	return decision, nil
+}
+
+// EvaluateByID looks up an access policy with the simulator's Resolver and evaluates it
+func (s *Simulator) EvaluateByID(ctx context.Context, accessPolicyRID userstore.ResourceID, apc policy.AccessPolicyContext, opts ...Option) (*Decision, error) {
+	e := &evaluator{options: s.evaluationOptions(opts)}
+	ap, err := e.getPolicy(ctx, accessPolicyRID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	decision, err := s.Evaluate(ctx, *ap, apc, opts...)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return decision, nil
+}
+
+// EvaluateTemplate evaluates a single template with parameters against a context, as
+// TokenizerClient.TestAccessPolicyTemplate does on the server
+func (s *Simulator) EvaluateTemplate(ctx context.Context, templateRID userstore.ResourceID, params string, apc policy.AccessPolicyContext, opts ...Option) (*Decision, error) {
+	e := &evaluator{options: s.evaluationOptions(opts)}
+	e.addBuiltins()
+
+	trace, err := e.evaluateTemplate(ctx, templateRID, params, apc)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return &Decision{Allowed: trace.Allowed, Trace: *trace}, nil
+}
+
+// evaluator holds the state of a single evaluation
+type evaluator struct {
+	options options
+}
+
+// addBuiltins adds the built-in template implementations that haven't been replaced
+func (e *evaluator) addBuiltins() {
+	builtins := map[uuid.UUID]TemplateFunc{
+		policy.AccessPolicyTemplateAllowAll.ID:       AllowAll,
+		policy.AccessPolicyTemplateDenyAll.ID:        DenyAll,
+		policy.AccessPolicyTemplateCheckAttribute.ID: CheckAttribute(e.options.attributeChecker),
+	}
+	for id, fn := range builtins {
+		if _, found := e.options.templates[id]; !found {
+			e.options.templates[id] = fn
+		}
+	}
+}
+
+// getPolicy returns the policy a component refers to. The AllowAll and DenyAll system policies
+// don't need a resolver, since their definitions are fixed.
+func (e *evaluator) getPolicy(ctx context.Context, rid userstore.ResourceID) (*policy.AccessPolicy, error) {
+	systemTemplates := map[uuid.UUID]uuid.UUID{
+		policy.AccessPolicyAllowAll.ID: policy.AccessPolicyTemplateAllowAll.ID,
+		policy.AccessPolicyDenyAll.ID:  policy.AccessPolicyTemplateDenyAll.ID,
+	}
+	if templateID, found := systemTemplates[rid.ID]; found {
+		return &policy.AccessPolicy{
+			ID:         rid.ID,
+			Name:       rid.Name,
+			PolicyType: policy.PolicyTypeCompositeAnd,
+			IsSystem:   true,
+			Components: []policy.AccessPolicyComponent{{Template: &userstore.ResourceID{ID: templateID}}},
+		}, nil
+	}
+
+	if e.options.resolver == nil {
+		return nil, ucerr.Friendlyf(nil, "access policy %s can't be resolved without a Resolver", describe(rid))
+	}
+
+	ap, err := e.options.resolver.GetAccessPolicy(ctx, rid)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return ap, nil
+}
+
+func (e *evaluator) evaluatePolicy(ctx context.Context, ap policy.AccessPolicy, apc policy.AccessPolicyContext, ancestors []uuid.UUID) (*Trace, error) {
+	rid := userstore.ResourceID{ID: ap.ID, Name: ap.Name}
+
+	if len(ancestors) >= e.options.maxDepth {
+		return nil, ucerr.Friendlyf(nil, "access policy %s is nested more than %d policies deep", describe(rid), e.options.maxDepth)
+	}
+	if !ap.ID.IsNil() {
+		for _, id := range ancestors {
+			if id == ap.ID {
+				return nil, ucerr.Friendlyf(nil, "access policy %s includes itself", describe(rid))
+			}
+		}
+		ancestors = append(ancestors, ap.ID)
+	}
+
+	if ap.PolicyType != policy.PolicyTypeCompositeAnd && ap.PolicyType != policy.PolicyTypeCompositeOr {
+		return nil, ucerr.Friendlyf(nil, "access policy %s has unsupported policy type '%s'", describe(rid), ap.PolicyType)
+	}
+	if len(ap.Components) == 0 {
+		return nil, ucerr.Friendlyf(nil, "access policy %s has no components", describe(rid))
+	}
+
+	// an AND policy is allowed until a component denies, and an OR policy is denied until one
+	// allows, after which the remaining components aren't evaluated
+	decisive := ap.PolicyType == policy.PolicyTypeCompositeOr
+	trace := &Trace{
+		Policy:     &rid,
+		PolicyType: ap.PolicyType,
+		Allowed:    !decisive,
+	}
+
+	decided := false
+	for i, component := range ap.Components {
+		if (component.Policy == nil) == (component.Template == nil) {
+			return nil, ucerr.Friendlyf(nil, "access policy %s component %d must have either a policy or a template, but not both", describe(rid), i)
+		}
+
+		if decided {
+			trace.Components = append(trace.Components, skippedComponent(component))
+			continue
+		}
+
+		var child *Trace
+		if component.Policy != nil {
+			sub, err := e.getPolicy(ctx, *component.Policy)
+			if err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+			if child, err = e.evaluatePolicy(ctx, *sub, apc, ancestors); err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+		} else {
+			var err error
+			if child, err = e.evaluateTemplate(ctx, *component.Template, component.TemplateParameters, apc); err != nil {
+				return nil, ucerr.Wrap(err)
+			}
+		}
+
+		trace.Components = append(trace.Components, *child)
+		if child.Allowed == decisive {
+			trace.Allowed = decisive
+			decided = true
+		}
+	}
+
+	return trace, nil
+}
+
+// skippedComponent returns the trace of a component that wasn't evaluated
+func skippedComponent(component policy.AccessPolicyComponent) Trace {
+	return Trace{
+		Policy:             component.Policy,
+		Template:           component.Template,
+		TemplateParameters: component.TemplateParameters,
+		Skipped:            true,
+	}
+}
+
+func (e *evaluator) evaluateTemplate(ctx context.Context, rid userstore.ResourceID, params string, apc policy.AccessPolicyContext) (*Trace, error) {
+	fn, found := e.options.templates[rid.ID]
+	if !found {
+		// the component may refer to the template by name, so resolve its ID
+		if e.options.resolver == nil {
+			return nil, ucerr.Friendlyf(nil, "access policy template %s has no Go implementation", describe(rid))
+		}
+		apt, err := e.options.resolver.GetAccessPolicyTemplate(ctx, rid)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		rid = userstore.ResourceID{ID: apt.ID, Name: apt.Name}
+		if fn, found = e.options.templates[apt.ID]; !found {
+			return nil, ucerr.Friendlyf(nil, "access policy template %s has no Go implementation", describe(rid))
+		}
+	}
+
+	decoded := map[string]interface{}{}
+	if params != "" {
+		if err := json.Unmarshal([]byte(params), &decoded); err != nil {
+			return nil, ucerr.Friendlyf(err, "parameters for access policy template %s must be a JSON dictionary", describe(rid))
+		}
+	}
+
+	allowed, err := fn(ctx, apc, decoded)
+	if err != nil {
+		return nil, ucerr.Errorf("access policy template %s failed: %w", describe(rid), err)
+	}
+
+	return &Trace{
+		Template:           &rid,
+		TemplateParameters: params,
+		Allowed:            allowed,
+	}, nil
+}
@@ -0,0 +1,260 @@
+package policy
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// TransformStringParams controls how the system transformers transform a string, or a part of one
+// like the username of an email address. Letters and digits that aren't preserved are replaced with
+// random letters and digits by tokenizing transformers, and masked with '*' by other transformers.
+// Other characters, like the dashes in an SSN, are kept in place.
+type TransformStringParams struct {
+	// PreserveValue keeps the whole string unchanged
+	PreserveValue bool `json:"PreserveValue"`
+
+	// PreserveChars is the number of leading letters and digits to keep
+	PreserveChars int `json:"PreserveChars"`
+
+	// PreserveCharsTrailing is the number of trailing letters and digits to keep
+	PreserveCharsTrailing int `json:"PreserveCharsTrailing"`
+
+	// FinalLength, if non-zero, is the length of the result, which then consists of the preserved
+	// characters padded with replacement characters
+	FinalLength int `json:"FinalLength"`
+}
+
+// localTransform is the Go implementation of a system transformer
+type localTransform struct {
+	defaults []TransformStringParams
+	apply    func(data string, params []TransformStringParams, fill func() rune) (string, error)
+}
+
+// localTransforms are the Go implementations of the system transformers, keyed by transformer ID
+var localTransforms = map[uuid.UUID]localTransform{
+	TransformerEmail.ID: {
+		// username, domain name and domain extension
+		defaults: []TransformStringParams{{FinalLength: 12}, {PreserveValue: true}, {PreserveValue: true}},
+		apply:    transformEmail,
+	},
+	TransformerFullName.ID: {
+		defaults: []TransformStringParams{{PreserveChars: 1}},
+		apply:    transformFullName,
+	},
+	TransformerSSN.ID: {
+		defaults: []TransformStringParams{{PreserveCharsTrailing: 4}},
+		apply:    digitsTransform("SSN", 9, 9),
+	},
+	TransformerCreditCard.ID: {
+		defaults: []TransformStringParams{{PreserveCharsTrailing: 4}},
+		apply:    digitsTransform("credit card number", 12, 19),
+	},
+	TransformerUUID.ID: {
+		apply: func(string, []TransformStringParams, func() rune) (string, error) {
+			return uuid.Must(uuid.NewV4()).String(), nil
+		},
+	},
+}
+
+// HasLocalImplementation returns true if ApplyLocal can run the transformer
+func (g Transformer) HasLocalImplementation() bool {
+	if g.TransformType == TransformTypePassThrough {
+		return true
+	}
+	_, found := localTransforms[g.ID]
+	return found
+}
+
+// ApplyLocal runs a system transformer in Go, for previews and tests that can't reach a tenant.
+// The implementations follow the documented behavior of the system transformers rather than their
+// exact functions, so tokenizing transformers produce values of the same shape as the server's but
+// not the same values. params override the transformer's Parameters if specified, and are either a
+// TransformStringParams object or, for TransformerEmail, an array of them for the username, domain
+// name and domain extension.
+func (g Transformer) ApplyLocal(data string, params string) (string, error) {
+	if g.TransformType == TransformTypePassThrough {
+		return data, nil
+	}
+
+	lt, found := localTransforms[g.ID]
+	if !found {
+		return "", ucerr.Friendlyf(nil, "transformer '%s' (%v) has no local implementation", g.Name, g.ID)
+	}
+
+	if params == "" {
+		params = g.Parameters
+	}
+	parsed, err := parseTransformStringParams(params, lt.defaults)
+	if err != nil {
+		return "", ucerr.Wrap(err)
+	}
+
+	fill := maskRune
+	if g.TransformType == TransformTypeTokenizeByValue || g.TransformType == TransformTypeTokenizeByReference {
+		fill = randomRune
+	}
+
+	value, err := lt.apply(data, parsed, fill)
+	if err != nil {
+		return "", ucerr.Wrap(err)
+	}
+	return value, nil
+}
+
+// parseTransformStringParams parses a params object or array, replacing the defaults position by position
+func parseTransformStringParams(params string, defaults []TransformStringParams) ([]TransformStringParams, error) {
+	parsed := append([]TransformStringParams{}, defaults...)
+	if strings.TrimSpace(params) == "" {
+		return parsed, nil
+	}
+
+	var list []TransformStringParams
+	if err := json.Unmarshal([]byte(params), &list); err != nil {
+		var single TransformStringParams
+		if err := json.Unmarshal([]byte(params), &single); err != nil {
+			return nil, ucerr.Friendlyf(err, "transformer parameters must be a JSON object or array of objects")
+		}
+		list = []TransformStringParams{single}
+	}
+	for i, p := range list {
+		if p.PreserveChars < 0 || p.PreserveCharsTrailing < 0 || p.FinalLength < 0 {
+			return nil, ucerr.Friendlyf(nil, "transformer parameters PreserveChars, PreserveCharsTrailing and FinalLength can't be negative")
+		}
+		if i < len(parsed) {
+			parsed[i] = p
+		}
+	}
+	return parsed, nil
+}
+
+func maskRune() rune {
+	return '*'
+}
+
+const randomRunes = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func randomRune() rune {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(randomRunes))))
+	if err != nil {
+		// crypto/rand only fails if the OS can't provide randomness, which nothing can recover from
+		panic(err)
+	}
+	return rune(randomRunes[n.Int64()])
+}
+
+func isPreservable(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// transformString transforms a string according to params, replacing characters with fill
+func transformString(s string, p TransformStringParams, fill func() rune) string {
+	if p.PreserveValue {
+		return s
+	}
+
+	runes := []rune(s)
+	if p.FinalLength > 0 {
+		var preservable []rune
+		for _, r := range runes {
+			if isPreservable(r) {
+				preservable = append(preservable, r)
+			}
+		}
+		leading, trailing := p.PreserveChars, p.PreserveCharsTrailing
+		if leading > len(preservable) {
+			leading = len(preservable)
+		}
+		if trailing > len(preservable)-leading {
+			trailing = len(preservable) - leading
+		}
+		if leading+trailing > p.FinalLength {
+			trailing = 0
+			if leading > p.FinalLength {
+				leading = p.FinalLength
+			}
+		}
+
+		result := append([]rune{}, preservable[:leading]...)
+		for len(result) < p.FinalLength-trailing {
+			result = append(result, fill())
+		}
+		return string(append(result, preservable[len(preservable)-trailing:]...))
+	}
+
+	total := 0
+	for _, r := range runes {
+		if isPreservable(r) {
+			total++
+		}
+	}
+
+	result := make([]rune, len(runes))
+	seen := 0
+	for i, r := range runes {
+		if !isPreservable(r) {
+			result[i] = r
+			continue
+		}
+		if seen < p.PreserveChars || seen >= total-p.PreserveCharsTrailing {
+			result[i] = r
+		} else {
+			result[i] = fill()
+		}
+		seen++
+	}
+	return string(result)
+}
+
+func transformEmail(data string, params []TransformStringParams, fill func() rune) (string, error) {
+	username, domain, found := strings.Cut(data, "@")
+	if !found || username == "" || strings.Contains(domain, "@") {
+		return "", ucerr.Friendlyf(nil, "'%s' is not a valid email address", data)
+	}
+	i := strings.LastIndex(domain, ".")
+	if i <= 0 || i == len(domain)-1 {
+		return "", ucerr.Friendlyf(nil, "'%s' is not a valid email address", data)
+	}
+
+	return transformString(username, params[0], fill) + "@" +
+		transformString(domain[:i], params[1], fill) + "." +
+		transformString(domain[i+1:], params[2], fill), nil
+}
+
+func transformFullName(data string, params []TransformStringParams, fill func() rune) (string, error) {
+	parts := strings.Fields(data)
+	if len(parts) == 0 {
+		return "", ucerr.Friendlyf(nil, "a full name must not be empty")
+	}
+	for i, part := range parts {
+		parts[i] = transformString(part, params[0], fill)
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// digitsTransform returns a transform for numbers like SSNs and credit card numbers, which must
+// have between minDigits and maxDigits digits, optionally separated by spaces or dashes
+func digitsTransform(name string, minDigits int, maxDigits int) func(string, []TransformStringParams, func() rune) (string, error) {
+	return func(data string, params []TransformStringParams, fill func() rune) (string, error) {
+		digits := 0
+		for _, r := range data {
+			switch {
+			case r >= '0' && r <= '9':
+				digits++
+			case r == '-' || r == ' ':
+			default:
+				return "", ucerr.Friendlyf(nil, "'%s' is not a valid %s", data, name)
+			}
+		}
+		if digits < minDigits || digits > maxDigits {
+			return "", ucerr.Friendlyf(nil, "'%s' is not a valid %s", data, name)
+		}
+		return transformString(data, params[0], fill), nil
+	}
+}
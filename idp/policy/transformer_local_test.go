@@ -0,0 +1,129 @@
+package policy_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/infra/assert"
+)
+
+// masking returns a copy of a system transformer that masks rather than tokenizes, so that its
+// results are deterministic
+func masking(tf policy.Transformer) policy.Transformer {
+	tf.TransformType = policy.TransformTypeTransform
+	return tf
+}
+
+func TestApplyLocal(t *testing.T) {
+	testCases := []struct {
+		name        string
+		transformer policy.Transformer
+		data        string
+		params      string
+		want        string
+	}{
+		{"email default", masking(policy.TransformerEmail), "johnsmith@example.com", "", "************@example.com"},
+		{"email FinalLength", masking(policy.TransformerEmail), "johnsmith@example.com", `{"PreserveChars":2,"FinalLength":5}`, "jo***@example.com"},
+		{"email FinalLength too short for preserved chars", masking(policy.TransformerEmail), "johnsmith@example.com", `{"PreserveChars":3,"PreserveCharsTrailing":3,"FinalLength":4}`, "joh*@example.com"},
+		{"email FinalLength shorter than PreserveChars", masking(policy.TransformerEmail), "johnsmith@example.com", `{"PreserveChars":6,"FinalLength":4}`, "john@example.com"},
+		{"email parts", masking(policy.TransformerEmail), "johnsmith@example.com", `[{"PreserveChars":1},{"PreserveValue":false},{"PreserveValue":true}]`, "j********@*******.com"},
+		{"full name default", masking(policy.TransformerFullName), "John  Smith", "", "J*** S****"},
+		{"full name PreserveValue", masking(policy.TransformerFullName), "John Smith", `{"PreserveValue":true}`, "John Smith"},
+		{"full name PreserveChars longer than name", masking(policy.TransformerFullName), "Jo Smith", `{"PreserveChars":3}`, "Jo Smi**"},
+		{"SSN default", policy.TransformerSSN, "123-45-6789", "", "***-**-6789"},
+		{"SSN without dashes", policy.TransformerSSN, "123456789", "", "*****6789"},
+		{"SSN PreserveChars", policy.TransformerSSN, "123-45-6789", `{"PreserveChars":3,"PreserveCharsTrailing":0}`, "123-**-****"},
+		{"SSN leading and trailing overlap", policy.TransformerSSN, "123-45-6789", `{"PreserveChars":6,"PreserveCharsTrailing":6}`, "123-45-6789"},
+		{"credit card default", policy.TransformerCreditCard, "4111 1111 1111 1111", "", "**** **** **** 1111"},
+		{"credit card FinalLength", policy.TransformerCreditCard, "4111-1111-1111-1111", `{"PreserveCharsTrailing":4,"FinalLength":8}`, "****1111"},
+		{"passthrough", policy.TransformerPassthrough, "anything at all", "", "anything at all"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.transformer.ApplyLocal(tc.data, tc.params)
+			assert.NoErr(t, err)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
+
+func TestApplyLocalParametersFromTransformer(t *testing.T) {
+	tf := policy.TransformerSSN
+	tf.Parameters = `{"PreserveChars":3}`
+
+	got, err := tf.ApplyLocal("123-45-6789", "")
+	assert.NoErr(t, err)
+	assert.Equal(t, got, "123-**-****")
+
+	// explicit params override the transformer's
+	got, err = tf.ApplyLocal("123-45-6789", `{"PreserveCharsTrailing":2}`)
+	assert.NoErr(t, err)
+	assert.Equal(t, got, "***-**-**89")
+}
+
+func TestApplyLocalTokenizing(t *testing.T) {
+	got, err := policy.TransformerEmail.ApplyLocal("johnsmith@example.com", "")
+	assert.NoErr(t, err)
+	assert.True(t, regexp.MustCompile(`^[a-z0-9]{12}@example\.com$`).MatchString(got), assert.Errorf("got %s", got))
+
+	tf := policy.TransformerSSN
+	tf.TransformType = policy.TransformTypeTokenizeByValue
+	got, err = tf.ApplyLocal("123-45-6789", "")
+	assert.NoErr(t, err)
+	assert.True(t, regexp.MustCompile(`^[a-z0-9]{3}-[a-z0-9]{2}-6789$`).MatchString(got), assert.Errorf("got %s", got))
+
+	got, err = policy.TransformerUUID.ApplyLocal("anything", "")
+	assert.NoErr(t, err)
+	_, err = uuid.FromString(got)
+	assert.NoErr(t, err)
+
+	other, err := policy.TransformerUUID.ApplyLocal("anything", "")
+	assert.NoErr(t, err)
+	assert.NotEqual(t, got, other)
+}
+
+func TestApplyLocalInvalidInput(t *testing.T) {
+	testCases := []struct {
+		name        string
+		transformer policy.Transformer
+		data        string
+		params      string
+	}{
+		{"email without @", policy.TransformerEmail, "johnsmith", ""},
+		{"email without username", policy.TransformerEmail, "@example.com", ""},
+		{"email without domain extension", policy.TransformerEmail, "john@example", ""},
+		{"email with two @", policy.TransformerEmail, "john@smith@example.com", ""},
+		{"empty full name", policy.TransformerFullName, "   ", ""},
+		{"SSN too short", policy.TransformerSSN, "123-45-678", ""},
+		{"SSN with letters", policy.TransformerSSN, "123-45-678a", ""},
+		{"credit card too short", policy.TransformerCreditCard, "4111 1111 111", ""},
+		{"credit card too long", policy.TransformerCreditCard, "4111 1111 1111 1111 1111", ""},
+		{"invalid params", policy.TransformerSSN, "123-45-6789", "not json"},
+		{"negative PreserveChars", policy.TransformerSSN, "123-45-6789", `{"PreserveChars":-1,"FinalLength":5}`},
+		{"negative PreserveCharsTrailing", policy.TransformerSSN, "123-45-6789", `{"PreserveCharsTrailing":-2,"FinalLength":5}`},
+		{"negative FinalLength", policy.TransformerSSN, "123-45-6789", `{"FinalLength":-1}`},
+		{"negative parameters for a part", policy.TransformerEmail, "johnsmith@example.com", `[{},{"PreserveChars":-1}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.transformer.ApplyLocal(tc.data, tc.params)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestApplyLocalUnsupported(t *testing.T) {
+	custom := policy.Transformer{ID: uuid.Must(uuid.NewV4()), Name: "Custom", TransformType: policy.TransformTypeTransform}
+	assert.False(t, custom.HasLocalImplementation())
+	_, err := custom.ApplyLocal("data", "")
+	assert.NotNil(t, err)
+
+	for _, tf := range []policy.Transformer{policy.TransformerEmail, policy.TransformerFullName, policy.TransformerSSN, policy.TransformerCreditCard, policy.TransformerUUID, policy.TransformerPassthrough} {
+		assert.True(t, tf.HasLocalImplementation())
+	}
+}
@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// TransformerParameterSchema declares the Parameters a transformer accepts, so that they can be
+// validated before the transformer is created and tooling can render a form for them
+type TransformerParameterSchema struct {
+	// Fields are the fields of the parameters object
+	Fields ParameterSchema `json:"fields"`
+
+	// Parts, if non-empty, names the parts of the input that are transformed separately, like the
+	// username, domain name and domain extension of an email address. Parameters may then also be an
+	// array with one object per part; a single object applies to the first part.
+	Parts []string `json:"parts,omitempty"`
+}
+
+// Validate checks Parameters, as stored in Transformer.Parameters, against the schema. An empty
+// string is treated as no parameters.
+func (s TransformerParameterSchema) Validate(params string) error {
+	if strings.TrimSpace(params) == "" {
+		return ucerr.Wrap(s.Fields.Validate(map[string]interface{}{}))
+	}
+
+	var list []map[string]interface{}
+	if err := json.Unmarshal([]byte(params), &list); err != nil {
+		return ucerr.Wrap(s.Fields.ValidateJSON(params))
+	}
+
+	maxParts := len(s.Parts)
+	if maxParts == 0 {
+		maxParts = 1
+	}
+	if len(list) > maxParts {
+		return ucerr.Friendlyf(nil, "transformer parameters must have at most %d elements (got %d)", maxParts, len(list))
+	}
+	for i, elem := range list {
+		if err := s.Fields.Validate(elem); err != nil {
+			if i < len(s.Parts) {
+				return ucerr.Friendlyf(err, "invalid parameters for %s: %s", s.Parts[i], ucerr.UserFriendlyMessage(err))
+			}
+			return ucerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func nonNegative() *float64 {
+	zero := 0.0
+	return &zero
+}
+
+// TransformStringParamsSchema is the schema of TransformStringParams, which the system email, full
+// name, SSN and credit card transformers accept
+var TransformStringParamsSchema = ParameterSchema{
+	{Name: "PreserveValue", Type: ParameterTypeBoolean, Description: "keep the whole value unchanged"},
+	{Name: "PreserveChars", Type: ParameterTypeInteger, Minimum: nonNegative(), Description: "number of leading letters and digits to keep"},
+	{Name: "PreserveCharsTrailing", Type: ParameterTypeInteger, Minimum: nonNegative(), Description: "number of trailing letters and digits to keep"},
+	{Name: "FinalLength", Type: ParameterTypeInteger, Minimum: nonNegative(), Description: "length of the result, or 0 to keep the length of the value"},
+}
+
+// systemTransformerParameters are the parameter schemas of the system transformers, keyed by transformer ID
+var systemTransformerParameters = map[uuid.UUID]TransformerParameterSchema{
+	TransformerEmail.ID: {
+		Fields: TransformStringParamsSchema,
+		Parts:  []string{"username", "domain name", "domain extension"},
+	},
+	TransformerFullName.ID:    {Fields: TransformStringParamsSchema},
+	TransformerSSN.ID:         {Fields: TransformStringParamsSchema},
+	TransformerCreditCard.ID:  {Fields: TransformStringParamsSchema},
+	TransformerUUID.ID:        {Fields: ParameterSchema{}},
+	TransformerPassthrough.ID: {Fields: ParameterSchema{}},
+}
+
+// SystemParameterSchema returns the parameter schema of a system transformer, or false if g isn't
+// one whose parameters are known
+func (g Transformer) SystemParameterSchema() (TransformerParameterSchema, bool) {
+	schema, found := systemTransformerParameters[g.ID]
+	return schema, found
+}
+
+// ValidateParameters checks g.Parameters against schema, naming the transformer in the error
+func (g Transformer) ValidateParameters(schema TransformerParameterSchema) error {
+	if err := schema.Validate(g.Parameters); err != nil {
+		return ucerr.Friendlyf(err, "transformer '%s' has invalid parameters: %s", g.Name, ucerr.UserFriendlyMessage(err))
+	}
+	return nil
+}
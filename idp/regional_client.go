@@ -0,0 +1,485 @@
+package idp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/namespace/region"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// regionalCursorKey is the key of the single key:value pair in a RegionalClient ListUsers cursor
+const regionalCursorKey = "regions"
+
+// RegionalClient routes user requests to the regional endpoint that hosts each user's data. Users
+// are created in the region specified with the DataRegion option (or the client's default region),
+// and the region of each user that the client creates, lists or looks up is remembered so that later
+// requests for the user go straight to the right endpoint.
+type RegionalClient struct {
+	clients       map[region.DataRegion]*Client
+	regions       []region.DataRegion
+	defaultRegion region.DataRegion
+
+	mu          sync.RWMutex
+	userRegions map[uuid.UUID]region.DataRegion
+}
+
+// NewRegionalClient constructs a client for the specified regional endpoints, e.g. one URL for each
+// of region.DataRegionsForUniverse. If the DataRegion option is specified, it sets the default
+// region for new users, which is otherwise only implied if there's a single region.
+func NewRegionalClient(regionURLs map[region.DataRegion]string, opts ...Option) (*RegionalClient, error) {
+	if len(regionURLs) == 0 {
+		return nil, ucerr.New("at least one regional URL must be specified")
+	}
+
+	var options options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	rc := &RegionalClient{
+		clients:       map[region.DataRegion]*Client{},
+		defaultRegion: options.dataRegion,
+		userRegions:   map[uuid.UUID]region.DataRegion{},
+	}
+	for dataRegion, url := range regionURLs {
+		// each regional client creates users in its own region
+		c, err := NewClient(url, append(opts, DataRegion(dataRegion))...)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		rc.clients[dataRegion] = c
+		rc.regions = append(rc.regions, dataRegion)
+	}
+	sort.Slice(rc.regions, func(i, j int) bool { return rc.regions[i] < rc.regions[j] })
+
+	if rc.defaultRegion == "" && len(rc.regions) == 1 {
+		rc.defaultRegion = rc.regions[0]
+	}
+	if _, found := rc.clients[rc.defaultRegion]; rc.defaultRegion != "" && !found {
+		return nil, ucerr.Friendlyf(nil, "default data region '%s' has no regional URL", rc.defaultRegion)
+	}
+
+	return rc, nil
+}
+
+// Regions returns the client's data regions, sorted by name
+func (rc *RegionalClient) Regions() []region.DataRegion {
+	return append([]region.DataRegion{}, rc.regions...)
+}
+
+// ForRegion returns the client for a single region, for requests that the RegionalClient doesn't route
+func (rc *RegionalClient) ForRegion(dataRegion region.DataRegion) (*Client, error) {
+	c, found := rc.clients[dataRegion]
+	if !found {
+		return nil, ucerr.Friendlyf(nil, "no regional URL for data region '%s'", dataRegion)
+	}
+	return c, nil
+}
+
+// RememberUserRegion records the region of a user, e.g. one stored by the caller, so that requests
+// for the user don't need to search the regions
+func (rc *RegionalClient) RememberUserRegion(userID uuid.UUID, dataRegion region.DataRegion) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.userRegions[userID] = dataRegion
+}
+
+func (rc *RegionalClient) forgetUserRegion(userID uuid.UUID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.userRegions, userID)
+}
+
+func (rc *RegionalClient) rememberedRegion(userID uuid.UUID) (region.DataRegion, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	dataRegion, found := rc.userRegions[userID]
+	return dataRegion, found
+}
+
+// UserRegion returns the region that hosts a user. If the user's region isn't known yet, each region
+// is searched in turn, starting with the default region.
+func (rc *RegionalClient) UserRegion(ctx context.Context, userID uuid.UUID) (region.DataRegion, error) {
+	dataRegion, _, err := rc.findUser(ctx, userID)
+	if err != nil {
+		return "", ucerr.Wrap(err)
+	}
+	return dataRegion, nil
+}
+
+// findUser returns the region of a user, along with the user if it had to be fetched to find it
+func (rc *RegionalClient) findUser(ctx context.Context, userID uuid.UUID) (region.DataRegion, *UserResponse, error) {
+	if dataRegion, found := rc.rememberedRegion(userID); found {
+		return dataRegion, nil, nil
+	}
+
+	regions := rc.regions
+	if rc.defaultRegion != "" {
+		regions = []region.DataRegion{rc.defaultRegion}
+		for _, r := range rc.regions {
+			if r != rc.defaultRegion {
+				regions = append(regions, r)
+			}
+		}
+	}
+
+	var notFound error
+	for _, dataRegion := range regions {
+		user, err := rc.clients[dataRegion].GetUser(ctx, userID)
+		if jsonclient.IsHTTPNotFound(err) {
+			notFound = err
+			continue
+		} else if err != nil {
+			return "", nil, ucerr.Wrap(err)
+		}
+		rc.RememberUserRegion(userID, dataRegion)
+		return dataRegion, user, nil
+	}
+
+	// the error is the last region's, so that callers can still check for jsonclient.IsHTTPNotFound
+	return "", nil, ucerr.Errorf("user %v not found in any data region: %w", userID, notFound)
+}
+
+// creationRegion returns the region in which a user should be created
+func (rc *RegionalClient) creationRegion(opts []Option) (region.DataRegion, error) {
+	var options options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	dataRegion := options.dataRegion
+	if dataRegion == "" {
+		dataRegion = rc.defaultRegion
+	}
+	if dataRegion == "" {
+		return "", ucerr.Friendlyf(nil, "a data region must be specified, since the client has no default region")
+	}
+	if _, found := rc.clients[dataRegion]; !found {
+		return "", ucerr.Friendlyf(nil, "no regional URL for data region '%s'", dataRegion)
+	}
+	return dataRegion, nil
+}
+
+// CreateUser creates a user in the region specified by the DataRegion option, or the default region
+func (rc *RegionalClient) CreateUser(ctx context.Context, profile userstore.Record, opts ...Option) (uuid.UUID, error) {
+	dataRegion, err := rc.creationRegion(opts)
+	if err != nil {
+		return uuid.Nil, ucerr.Wrap(err)
+	}
+
+	userID, err := rc.clients[dataRegion].CreateUser(ctx, profile, append(opts, DataRegion(dataRegion))...)
+	if err != nil {
+		return uuid.Nil, ucerr.Wrap(err)
+	}
+	rc.RememberUserRegion(userID, dataRegion)
+	return userID, nil
+}
+
+// CreateUserWithMutator creates a user in the region specified by the DataRegion option, or the default region
+func (rc *RegionalClient) CreateUserWithMutator(ctx context.Context, mutatorID uuid.UUID, clientContext policy.ClientContext, rowData map[string]ValueAndPurposes, opts ...Option) (uuid.UUID, error) {
+	dataRegion, err := rc.creationRegion(opts)
+	if err != nil {
+		return uuid.Nil, ucerr.Wrap(err)
+	}
+
+	userID, err := rc.clients[dataRegion].CreateUserWithMutator(ctx, mutatorID, clientContext, rowData, append(opts, DataRegion(dataRegion))...)
+	if err != nil {
+		return uuid.Nil, ucerr.Wrap(err)
+	}
+	rc.RememberUserRegion(userID, dataRegion)
+	return userID, nil
+}
+
+// GetUser gets a user by ID from the region that hosts it
+func (rc *RegionalClient) GetUser(ctx context.Context, id uuid.UUID) (*UserResponse, error) {
+	dataRegion, user, err := rc.findUser(ctx, id)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if user != nil {
+		return user, nil
+	}
+
+	user, err = rc.clients[dataRegion].GetUser(ctx, id)
+	if err != nil {
+		if jsonclient.IsHTTPNotFound(err) {
+			rc.forgetUserRegion(id)
+		}
+		return nil, ucerr.Wrap(err)
+	}
+	return user, nil
+}
+
+// UpdateUser updates user profile data for a given user ID in the region that hosts it
+func (rc *RegionalClient) UpdateUser(ctx context.Context, id uuid.UUID, req UpdateUserRequest) (*UserResponse, error) {
+	dataRegion, _, err := rc.findUser(ctx, id)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	user, err := rc.clients[dataRegion].UpdateUser(ctx, id, req)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return user, nil
+}
+
+// DeleteUser deletes a user by ID from the region that hosts it
+func (rc *RegionalClient) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	dataRegion, _, err := rc.findUser(ctx, id)
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	if err := rc.clients[dataRegion].DeleteUser(ctx, id); err != nil {
+		return ucerr.Wrap(err)
+	}
+	rc.forgetUserRegion(id)
+	return nil
+}
+
+// mutatorRegions returns the regions of the users referred to by the selector values if they're all
+// known, or every region if any of them isn't, or if there are none
+func (rc *RegionalClient) mutatorRegions(selectorValues userstore.UserSelectorValues) []region.DataRegion {
+	var userIDs []uuid.UUID
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch v := value.(type) {
+		case uuid.UUID:
+			userIDs = append(userIDs, v)
+		case string:
+			if id, err := uuid.FromString(v); err == nil {
+				userIDs = append(userIDs, id)
+			}
+		case []uuid.UUID:
+			userIDs = append(userIDs, v...)
+		case []string:
+			for _, s := range v {
+				collect(s)
+			}
+		case []interface{}:
+			for _, e := range v {
+				collect(e)
+			}
+		}
+	}
+	for _, value := range selectorValues {
+		collect(value)
+	}
+
+	found := map[region.DataRegion]bool{}
+	for _, userID := range userIDs {
+		dataRegion, ok := rc.rememberedRegion(userID)
+		if !ok {
+			// the user could be in any region
+			return rc.regions
+		}
+		found[dataRegion] = true
+	}
+	if len(found) == 0 {
+		return rc.regions
+	}
+
+	var regions []region.DataRegion
+	for _, dataRegion := range rc.regions {
+		if found[dataRegion] {
+			regions = append(regions, dataRegion)
+		}
+	}
+	return regions
+}
+
+// ExecuteMutator executes a mutator in the regions of the users that the selector values refer to,
+// or in every region if the selector refers to a user whose region isn't known, or to no user. The IDs of the users updated
+// in each region are combined.
+func (rc *RegionalClient) ExecuteMutator(ctx context.Context, mutatorID uuid.UUID, clientContext policy.ClientContext, selectorValues userstore.UserSelectorValues, rowData map[string]ValueAndPurposes) (*ExecuteMutatorResponse, error) {
+	regions := rc.mutatorRegions(selectorValues)
+
+	responses := make([]*ExecuteMutatorResponse, len(regions))
+	errs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i, dataRegion := range regions {
+		wg.Add(1)
+		go func(i int, dataRegion region.DataRegion) {
+			defer wg.Done()
+			responses[i], errs[i] = rc.clients[dataRegion].ExecuteMutator(ctx, mutatorID, clientContext, selectorValues, rowData)
+		}(i, dataRegion)
+	}
+	wg.Wait()
+
+	combined := &ExecuteMutatorResponse{UserIDs: []uuid.UUID{}}
+	for i, dataRegion := range regions {
+		if errs[i] != nil {
+			return nil, ucerr.Errorf("executing mutator in data region '%s': %w", dataRegion, errs[i])
+		}
+		for _, userID := range responses[i].UserIDs {
+			rc.RememberUserRegion(userID, dataRegion)
+		}
+		combined.UserIDs = append(combined.UserIDs, responses[i].UserIDs...)
+	}
+	return combined, nil
+}
+
+// regionalPosition is the position of a ListUsers request in one region: the cursor the region
+// returned for its current page, and how many users of that page were already returned. Regions
+// only ever receive cursors they returned themselves.
+type regionalPosition struct {
+	Cursor pagination.Cursor `json:"cursor"`
+	Skip   int               `json:"skip,omitempty"`
+}
+
+// regionalCursor is the position of a ListUsers request in each region. Regions without an entry
+// haven't been started; exhausted regions have CursorEnd.
+type regionalCursor map[region.DataRegion]regionalPosition
+
+func (c regionalCursor) encode() pagination.Cursor {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// a map of strings and ints always marshals
+		panic(err)
+	}
+	return pagination.Cursor(regionalCursorKey + ":" + base64.RawURLEncoding.EncodeToString(b))
+}
+
+func decodeRegionalCursor(cursor pagination.Cursor) (regionalCursor, error) {
+	if cursor == pagination.CursorBegin {
+		return regionalCursor{}, nil
+	}
+
+	encoded, found := strings.CutPrefix(string(cursor), regionalCursorKey+":")
+	if !found {
+		return nil, ucerr.Friendlyf(nil, "'%s' is not a regional cursor", cursor)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ucerr.Friendlyf(err, "'%s' is not a regional cursor", cursor)
+	}
+	var c regionalCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ucerr.Friendlyf(err, "'%s' is not a regional cursor", cursor)
+	}
+	return c, nil
+}
+
+// ListUsers lists users across every region. Each page merges the users of each region in ID
+// order, and the returned Next cursor tracks the position in each region. Only forward pagination
+// sorted by ID is supported.
+func (rc *RegionalClient) ListUsers(ctx context.Context, opts ...Option) (*ListUsersResponse, error) {
+	var options options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	pager, err := pagination.ApplyOptions(options.paginationOptions...)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if !pager.IsForward() || pager.GetSortKey() != "id" {
+		return nil, ucerr.Friendlyf(nil, "listing users across regions only supports paging forward sorted by id")
+	}
+	descending := pager.Query().Get("sort_order") == string(pagination.OrderDescending)
+
+	cursor, err := decodeRegionalCursor(pager.GetCursor())
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	type regionalPage struct {
+		dataRegion region.DataRegion
+		resp       *ListUsersResponse
+		err        error
+	}
+	var pages []*regionalPage
+	for _, dataRegion := range rc.regions {
+		if cursor[dataRegion].Cursor != pagination.CursorEnd {
+			pages = append(pages, &regionalPage{dataRegion: dataRegion})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, page := range pages {
+		wg.Add(1)
+		go func(page *regionalPage) {
+			defer wg.Done()
+			regionalOpts := append(append([]Option{}, opts...),
+				Pagination(pagination.StartingAfter(cursor[page.dataRegion].Cursor), pagination.Limit(pager.GetLimit())))
+			page.resp, page.err = rc.clients[page.dataRegion].ListUsers(ctx, regionalOpts...)
+		}(page)
+	}
+	wg.Wait()
+
+	type regionalUser struct {
+		dataRegion region.DataRegion
+		user       UserResponse
+	}
+	var users []regionalUser
+	for _, page := range pages {
+		if page.err != nil {
+			return nil, ucerr.Errorf("listing users in data region '%s': %w", page.dataRegion, page.err)
+		}
+		skip := cursor[page.dataRegion].Skip
+		if skip > len(page.resp.Data) {
+			skip = len(page.resp.Data)
+		}
+		for _, user := range page.resp.Data[skip:] {
+			users = append(users, regionalUser{dataRegion: page.dataRegion, user: user})
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		if descending {
+			return users[i].user.ID.String() > users[j].user.ID.String()
+		}
+		return users[i].user.ID.String() < users[j].user.ID.String()
+	})
+	if len(users) > pager.GetLimit() {
+		users = users[:pager.GetLimit()]
+	}
+
+	// a region's position advances to its own next cursor if all of the users on its page were
+	// returned, and otherwise stays on the same page, skipping the users that were returned
+	used := map[region.DataRegion]int{}
+	next := regionalCursor{}
+	for dataRegion, c := range cursor {
+		next[dataRegion] = c
+	}
+	resp := &ListUsersResponse{Data: []UserResponse{}}
+	for _, u := range users {
+		used[u.dataRegion]++
+		resp.Data = append(resp.Data, u.user)
+		rc.RememberUserRegion(u.user.ID, u.dataRegion)
+	}
+	for _, page := range pages {
+		position := cursor[page.dataRegion]
+		position.Skip += used[page.dataRegion]
+		if position.Skip >= len(page.resp.Data) {
+			position.Skip = 0
+			if page.resp.HasNext {
+				position.Cursor = page.resp.Next
+			} else {
+				position.Cursor = pagination.CursorEnd
+			}
+		}
+		next[page.dataRegion] = position
+	}
+
+	for _, dataRegion := range rc.regions {
+		if next[dataRegion].Cursor != pagination.CursorEnd {
+			resp.HasNext = true
+			resp.Next = next.encode()
+			break
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,428 @@
+package resourcegraph
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Kind identifies the type of a userstore or tokenizer resource
+type Kind string
+
+// Kind values
+const (
+	KindDataType             Kind = "datatype"
+	KindColumn               Kind = "column"
+	KindPurpose              Kind = "purpose"
+	KindTransformer          Kind = "transformer"
+	KindAccessPolicy         Kind = "accesspolicy"
+	KindAccessPolicyTemplate Kind = "accesspolicytemplate"
+	KindAccessor             Kind = "accessor"
+	KindMutator              Kind = "mutator"
+)
+
+// Node is a resource in the graph
+type Node struct {
+	Kind     Kind                 `json:"kind"`
+	Resource userstore.ResourceID `json:"resource"`
+
+	// IsSystem is set for system and native resources, which can't be deleted
+	IsSystem bool `json:"is_system"`
+}
+
+// String implements fmt.Stringer
+func (n Node) String() string {
+	return fmt.Sprintf("%s '%s' (%v)", n.Kind, n.Resource.Name, n.Resource.ID)
+}
+
+// Edge is a reference from one resource (the dependent) to another (the dependency).
+// Field describes where the reference appears, e.g. "columns[2].transformer".
+type Edge struct {
+	From  Node   `json:"from"`
+	To    Node   `json:"to"`
+	Field string `json:"field"`
+}
+
+// UnresolvedReference is a reference to a resource that doesn't exist, or which matches
+// more than one resource
+type UnresolvedReference struct {
+	From      Node                 `json:"from"`
+	Kind      Kind                 `json:"kind"`
+	Reference userstore.ResourceID `json:"reference"`
+	Field     string               `json:"field"`
+}
+
+// Resources holds the resources the graph is built from
+type Resources struct {
+	DataTypes             []userstore.ColumnDataType
+	Columns               []userstore.Column
+	Purposes              []userstore.Purpose
+	Transformers          []policy.Transformer
+	AccessPolicies        []policy.AccessPolicy
+	AccessPolicyTemplates []policy.AccessPolicyTemplate
+	Accessors             []userstore.Accessor
+	Mutators              []userstore.Mutator
+}
+
+type nodeKey struct {
+	kind Kind
+	id   uuid.UUID
+}
+
+func (n Node) key() nodeKey {
+	return nodeKey{kind: n.Kind, id: n.Resource.ID}
+}
+
+// Graph is a graph of the references between resources
+type Graph struct {
+	// Unresolved lists references that couldn't be resolved to exactly one resource
+	Unresolved []UnresolvedReference
+
+	nodes        map[nodeKey]Node
+	nodesByKind  map[Kind][]Node
+	dependents   map[nodeKey][]Edge
+	dependencies map[nodeKey][]Edge
+}
+
+// Build returns the reference graph for the specified resources. References are resolved with
+// ResourceID.EquivalentTo, so they may specify a resource by ID, name or both.
+func Build(resources Resources) *Graph {
+	g := &Graph{
+		nodes:        map[nodeKey]Node{},
+		nodesByKind:  map[Kind][]Node{},
+		dependents:   map[nodeKey][]Edge{},
+		dependencies: map[nodeKey][]Edge{},
+	}
+
+	for _, dt := range resources.DataTypes {
+		g.addNode(KindDataType, dt.ID, dt.Name, dt.IsNative)
+	}
+	for _, c := range resources.Columns {
+		g.addNode(KindColumn, c.ID, c.Name, c.IsSystem)
+	}
+	for _, p := range resources.Purposes {
+		g.addNode(KindPurpose, p.ID, p.Name, p.IsSystem)
+	}
+	for _, t := range resources.Transformers {
+		g.addNode(KindTransformer, t.ID, t.Name, t.IsSystem)
+	}
+	for _, ap := range resources.AccessPolicies {
+		g.addNode(KindAccessPolicy, ap.ID, ap.Name, ap.IsSystem)
+	}
+	for _, apt := range resources.AccessPolicyTemplates {
+		g.addNode(KindAccessPolicyTemplate, apt.ID, apt.Name, apt.IsSystem)
+	}
+	for _, a := range resources.Accessors {
+		g.addNode(KindAccessor, a.ID, a.Name, a.IsSystem)
+	}
+	for _, m := range resources.Mutators {
+		g.addNode(KindMutator, m.ID, m.Name, m.IsSystem)
+	}
+
+	for _, dt := range resources.DataTypes {
+		from := g.nodes[nodeKey{KindDataType, dt.ID}]
+		for i, f := range dt.CompositeAttributes.Fields {
+			g.addEdge(from, KindDataType, f.DataType, fmt.Sprintf("composite_attributes.fields[%d].data_type", i))
+		}
+	}
+
+	for _, c := range resources.Columns {
+		from := g.nodes[nodeKey{KindColumn, c.ID}]
+		g.addEdge(from, KindDataType, c.DataType, "data_type")
+		g.addEdge(from, KindAccessPolicy, c.AccessPolicy, "access_policy")
+		g.addEdge(from, KindTransformer, c.DefaultTransformer, "default_transformer")
+		g.addEdge(from, KindAccessPolicy, c.DefaultTokenAccessPolicy, "default_token_access_policy")
+	}
+
+	for _, t := range resources.Transformers {
+		from := g.nodes[nodeKey{KindTransformer, t.ID}]
+		g.addEdge(from, KindDataType, t.InputDataType, "input_data_type")
+		g.addEdge(from, KindDataType, t.OutputDataType, "output_data_type")
+	}
+
+	for _, ap := range resources.AccessPolicies {
+		from := g.nodes[nodeKey{KindAccessPolicy, ap.ID}]
+		for i, apc := range ap.Components {
+			if apc.Policy != nil {
+				g.addEdge(from, KindAccessPolicy, *apc.Policy, fmt.Sprintf("components[%d].policy", i))
+			}
+			if apc.Template != nil {
+				g.addEdge(from, KindAccessPolicyTemplate, *apc.Template, fmt.Sprintf("components[%d].template", i))
+			}
+		}
+	}
+
+	for _, a := range resources.Accessors {
+		from := g.nodes[nodeKey{KindAccessor, a.ID}]
+		for i, cc := range a.Columns {
+			g.addEdge(from, KindColumn, cc.Column, fmt.Sprintf("columns[%d].column", i))
+			g.addEdge(from, KindTransformer, cc.Transformer, fmt.Sprintf("columns[%d].transformer", i))
+			g.addEdge(from, KindAccessPolicy, cc.TokenAccessPolicy, fmt.Sprintf("columns[%d].token_access_policy", i))
+		}
+		for i, p := range a.Purposes {
+			g.addEdge(from, KindPurpose, p, fmt.Sprintf("purposes[%d]", i))
+		}
+		g.addSelectorEdges(from, a.SelectorConfig)
+		g.addEdge(from, KindAccessPolicy, a.AccessPolicy, "access_policy")
+		g.addEdge(from, KindAccessPolicy, a.TokenAccessPolicy, "token_access_policy")
+	}
+
+	for _, m := range resources.Mutators {
+		from := g.nodes[nodeKey{KindMutator, m.ID}]
+		for i, cc := range m.Columns {
+			g.addEdge(from, KindColumn, cc.Column, fmt.Sprintf("columns[%d].column", i))
+			g.addEdge(from, KindTransformer, cc.Normalizer, fmt.Sprintf("columns[%d].normalizer", i))
+			g.addEdge(from, KindTransformer, cc.Validator, fmt.Sprintf("columns[%d].validator", i))
+		}
+		g.addSelectorEdges(from, m.SelectorConfig)
+		g.addEdge(from, KindAccessPolicy, m.AccessPolicy, "access_policy")
+	}
+
+	return g
+}
+
+// selectorColumnPattern matches a column reference like {email} in a selector's where clause
+var selectorColumnPattern = regexp.MustCompile(`\{([a-zA-Z0-9_-]+)\}`)
+
+// addSelectorEdges records a reference to each column used in a selector's where clause
+func (g *Graph) addSelectorEdges(from Node, sc userstore.UserSelectorConfig) {
+	seen := map[string]bool{}
+	for _, m := range selectorColumnPattern.FindAllStringSubmatch(sc.WhereClause, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		g.addEdge(from, KindColumn, userstore.ResourceID{Name: m[1]}, "selector_config.where_clause")
+	}
+}
+
+func (g *Graph) addNode(kind Kind, id uuid.UUID, name string, isSystem bool) {
+	n := Node{Kind: kind, Resource: userstore.ResourceID{ID: id, Name: name}, IsSystem: isSystem}
+	if _, found := g.nodes[n.key()]; found {
+		return
+	}
+	g.nodes[n.key()] = n
+	g.nodesByKind[kind] = append(g.nodesByKind[kind], n)
+}
+
+// addEdge records a reference from a resource, ignoring unset references
+func (g *Graph) addEdge(from Node, kind Kind, ref userstore.ResourceID, field string) {
+	if ref.ID.IsNil() && ref.Name == "" {
+		return
+	}
+
+	to, err := g.resolve(kind, ref)
+	if err != nil {
+		g.Unresolved = append(g.Unresolved, UnresolvedReference{From: from, Kind: kind, Reference: ref, Field: field})
+		return
+	}
+
+	e := Edge{From: from, To: to, Field: field}
+	g.dependents[to.key()] = append(g.dependents[to.key()], e)
+	g.dependencies[from.key()] = append(g.dependencies[from.key()], e)
+}
+
+func (g *Graph) resolve(kind Kind, ref userstore.ResourceID) (Node, error) {
+	if n, found := g.nodes[nodeKey{kind, ref.ID}]; found && n.Resource.EquivalentTo(ref) {
+		return n, nil
+	}
+
+	var matches []Node
+	for _, n := range g.nodesByKind[kind] {
+		if n.Resource.EquivalentTo(ref) {
+			matches = append(matches, n)
+		}
+	}
+	if len(matches) != 1 {
+		return Node{}, ucerr.Friendlyf(nil, "%s %v matches %d resources", kind, ref, len(matches))
+	}
+	return matches[0], nil
+}
+
+// Resolve returns the node for a resource specified by ID, name or both
+func (g *Graph) Resolve(kind Kind, ref userstore.ResourceID) (Node, error) {
+	n, err := g.resolve(kind, ref)
+	return n, ucerr.Wrap(err)
+}
+
+// Nodes returns all of the resources in the graph of the specified kinds, or of all kinds if none are specified
+func (g *Graph) Nodes(kinds ...Kind) []Node {
+	if len(kinds) == 0 {
+		kinds = []Kind{KindDataType, KindColumn, KindPurpose, KindTransformer, KindAccessPolicy, KindAccessPolicyTemplate, KindAccessor, KindMutator}
+	}
+
+	var nodes []Node
+	for _, kind := range kinds {
+		nodes = append(nodes, g.nodesByKind[kind]...)
+	}
+	sortNodes(nodes)
+	return nodes
+}
+
+// DependentsOf returns the references made directly to a resource
+func (g *Graph) DependentsOf(kind Kind, ref userstore.ResourceID) ([]Edge, error) {
+	n, err := g.resolve(kind, ref)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return g.dependents[n.key()], nil
+}
+
+// DependenciesOf returns the references made directly by a resource
+func (g *Graph) DependenciesOf(kind Kind, ref userstore.ResourceID) ([]Edge, error) {
+	n, err := g.resolve(kind, ref)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return g.dependencies[n.key()], nil
+}
+
+// TransitiveDependentsOf returns every resource that depends on a resource, directly or indirectly
+func (g *Graph) TransitiveDependentsOf(kind Kind, ref userstore.ResourceID) ([]Node, error) {
+	n, err := g.resolve(kind, ref)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	seen := map[nodeKey]bool{n.key(): true}
+	queue := []Node{n}
+	var dependents []Node
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, e := range g.dependents[current.key()] {
+			if !seen[e.From.key()] {
+				seen[e.From.key()] = true
+				dependents = append(dependents, e.From)
+				queue = append(queue, e.From)
+			}
+		}
+	}
+
+	sortNodes(dependents)
+	return dependents, nil
+}
+
+// Unused returns the non-system data types, columns, purposes, transformers, access policies and
+// access policy templates that nothing references. Accessors and mutators are never reported,
+// since they are used by callers of the API rather than by other resources.
+func (g *Graph) Unused() []Node {
+	var unused []Node
+	for _, n := range g.Nodes(KindDataType, KindColumn, KindPurpose, KindTransformer, KindAccessPolicy, KindAccessPolicyTemplate) {
+		if !n.IsSystem && len(g.dependents[n.key()]) == 0 {
+			unused = append(unused, n)
+		}
+	}
+	return unused
+}
+
+// DeletionOrder returns the order in which a resource and everything that depends on it can be
+// deleted without leaving dangling references: each resource appears before anything it
+// references. It fails if any of those resources is a system resource.
+func (g *Graph) DeletionOrder(kind Kind, ref userstore.ResourceID) ([]Node, error) {
+	n, err := g.resolve(kind, ref)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	dependents, err := g.TransitiveDependentsOf(kind, ref)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	targets := append([]Node{n}, dependents...)
+
+	if n.IsSystem {
+		return nil, ucerr.Friendlyf(nil, "%v is a system resource and can't be deleted", n)
+	}
+	for _, t := range dependents {
+		if t.IsSystem {
+			return nil, ucerr.Friendlyf(nil, "%v can't be deleted because %v depends on it and is a system resource", n, t)
+		}
+	}
+
+	order, err := g.topologicalOrder(targets)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return order, nil
+}
+
+// topologicalOrder orders the nodes so that dependents come before their dependencies, considering
+// only references between the specified nodes
+func (g *Graph) topologicalOrder(nodes []Node) ([]Node, error) {
+	inSet := map[nodeKey]bool{}
+	for _, n := range nodes {
+		inSet[n.key()] = true
+	}
+
+	// count the references to each node from other nodes in the set
+	remaining := map[nodeKey]int{}
+	for _, n := range nodes {
+		for _, e := range g.dependents[n.key()] {
+			if inSet[e.From.key()] && e.From.key() != n.key() {
+				remaining[n.key()]++
+			}
+		}
+	}
+
+	var ready []Node
+	for _, n := range nodes {
+		if remaining[n.key()] == 0 {
+			ready = append(ready, n)
+		}
+	}
+
+	var order []Node
+	for len(ready) > 0 {
+		sortNodes(ready)
+		n := ready[0]
+		ready = ready[1:]
+		order = append(order, n)
+
+		for _, e := range g.dependencies[n.key()] {
+			to := e.To.key()
+			if !inSet[to] || to == n.key() {
+				continue
+			}
+			remaining[to]--
+			if remaining[to] == 0 {
+				ready = append(ready, e.To)
+			}
+		}
+	}
+
+	if len(order) != len(nodes) {
+		return nil, ucerr.Friendlyf(nil, "resources reference each other in a cycle, so no deletion order exists")
+	}
+	return order, nil
+}
+
+// kindOrder is the order kinds are listed in, from most to least dependent
+var kindOrder = map[Kind]int{
+	KindAccessor:             0,
+	KindMutator:              1,
+	KindColumn:               2,
+	KindPurpose:              3,
+	KindTransformer:          4,
+	KindAccessPolicy:         5,
+	KindAccessPolicyTemplate: 6,
+	KindDataType:             7,
+}
+
+func sortNodes(nodes []Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Kind != nodes[j].Kind {
+			return kindOrder[nodes[i].Kind] < kindOrder[nodes[j].Kind]
+		}
+		if nodes[i].Resource.Name != nodes[j].Resource.Name {
+			return nodes[i].Resource.Name < nodes[j].Resource.Name
+		}
+		return nodes[i].Resource.ID.String() < nodes[j].Resource.ID.String()
+	})
+}
@@ -0,0 +1,108 @@
+package resourcegraph
+
+import (
+	"context"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// LoadResources reads the current version of every resource the graph covers
+func LoadResources(ctx context.Context, client *idp.Client) (*Resources, error) {
+	var resources Resources
+	var err error
+
+	if resources.DataTypes, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.ColumnDataType, pagination.ResponseFields, error) {
+		resp, err := client.ListDataTypes(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.Columns, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Column, pagination.ResponseFields, error) {
+		resp, err := client.ListColumns(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.Purposes, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Purpose, pagination.ResponseFields, error) {
+		resp, err := client.ListPurposes(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.Transformers, err = pagination.ListAll(func(cursor pagination.Cursor) ([]policy.Transformer, pagination.ResponseFields, error) {
+		resp, err := client.ListTransformers(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.AccessPolicies, err = pagination.ListAll(func(cursor pagination.Cursor) ([]policy.AccessPolicy, pagination.ResponseFields, error) {
+		resp, err := client.ListAccessPolicies(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.AccessPolicyTemplates, err = pagination.ListAll(func(cursor pagination.Cursor) ([]policy.AccessPolicyTemplate, pagination.ResponseFields, error) {
+		resp, err := client.ListAccessPolicyTemplates(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.Accessors, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Accessor, pagination.ResponseFields, error) {
+		resp, err := client.ListAccessors(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if resources.Mutators, err = pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Mutator, pagination.ResponseFields, error) {
+		resp, err := client.ListMutators(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	}); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &resources, nil
+}
+
+// Load reads every resource the graph covers and builds the reference graph between them
+func Load(ctx context.Context, client *idp.Client) (*Graph, error) {
+	resources, err := LoadResources(ctx, client)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return Build(*resources), nil
+}
@@ -0,0 +1,194 @@
+package retention
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// Source identifies the level at which an effective retention duration was configured
+type Source string
+
+// Source values, from most to least specific
+const (
+	SourceColumn  Source = "column"
+	SourcePurpose Source = "purpose"
+	SourceTenant  Source = "tenant"
+	SourceDefault Source = "default"
+)
+
+// EffectiveRetention is the retention duration that applies to values of a column retained for a purpose
+type EffectiveRetention struct {
+	ColumnID     uuid.UUID                    `json:"column_id"`
+	PurposeID    uuid.UUID                    `json:"purpose_id"`
+	DurationType userstore.DataLifeCycleState `json:"duration_type"`
+	Duration     idp.RetentionDuration        `json:"duration"`
+	Source       Source                       `json:"source"`
+}
+
+// Indefinite returns true if values are retained indefinitely
+func (er EffectiveRetention) Indefinite() bool {
+	return er.Duration.Unit == idp.DurationUnitIndefinite
+}
+
+// Table holds the retention durations explicitly configured at the tenant, purpose and column
+// levels for a single data life cycle state, and resolves the effective duration for any
+// (column, purpose) pair
+type Table struct {
+	DurationType userstore.DataLifeCycleState
+
+	tenant   *idp.RetentionDuration
+	fallback idp.RetentionDuration
+	purposes map[uuid.UUID]idp.RetentionDuration
+	columns  map[uuid.UUID]map[uuid.UUID]idp.RetentionDuration
+
+	columnIDs  []uuid.UUID
+	purposeIDs []uuid.UUID
+}
+
+// Effective returns the retention duration for values of the column retained for the purpose,
+// using the most specific configured duration: column and purpose, then purpose, then tenant,
+// and finally the server's default for the table's data life cycle state
+func (t *Table) Effective(columnID uuid.UUID, purposeID uuid.UUID) EffectiveRetention {
+	er := EffectiveRetention{
+		ColumnID:     columnID,
+		PurposeID:    purposeID,
+		DurationType: t.DurationType,
+	}
+
+	if d, found := t.columns[columnID][purposeID]; found {
+		er.Duration = d
+		er.Source = SourceColumn
+	} else if d, found := t.purposes[purposeID]; found {
+		er.Duration = d
+		er.Source = SourcePurpose
+	} else if t.tenant != nil {
+		er.Duration = *t.tenant
+		er.Source = SourceTenant
+	} else {
+		er.Duration = t.fallback
+		er.Source = SourceDefault
+	}
+
+	return er
+}
+
+// All returns the effective retention for every loaded (column, purpose) pair
+func (t *Table) All() []EffectiveRetention {
+	ers := make([]EffectiveRetention, 0, len(t.columnIDs)*len(t.purposeIDs))
+	for _, columnID := range t.columnIDs {
+		for _, purposeID := range t.purposeIDs {
+			ers = append(ers, t.Effective(columnID, purposeID))
+		}
+	}
+	return ers
+}
+
+// Resolver loads retention durations from the userstore
+type Resolver struct {
+	client *idp.Client
+}
+
+// NewResolver returns a Resolver that uses the specified client
+func NewResolver(client *idp.Client) *Resolver {
+	return &Resolver{client: client}
+}
+
+// Load fetches the tenant, purpose and column retention durations for the data life cycle state.
+// If purposeIDs is empty, durations are loaded for every purpose in the tenant.
+func (r *Resolver) Load(ctx context.Context, dlcs userstore.DataLifeCycleState, columnIDs []uuid.UUID, purposeIDs []uuid.UUID) (*Table, error) {
+	if err := dlcs.Validate(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if len(purposeIDs) == 0 {
+		var err error
+		if purposeIDs, err = r.listPurposeIDs(ctx); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+	}
+
+	t := &Table{
+		DurationType: dlcs.GetConcrete(),
+		purposes:     map[uuid.UUID]idp.RetentionDuration{},
+		columns:      map[uuid.UUID]map[uuid.UUID]idp.RetentionDuration{},
+		columnIDs:    columnIDs,
+		purposeIDs:   purposeIDs,
+	}
+
+	tenant, err := r.client.GetColumnRetentionDurationForTenant(ctx, dlcs)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if isConfigured(tenant.RetentionDuration) {
+		d := tenant.RetentionDuration.Duration
+		t.tenant = &d
+	}
+	t.fallback = inheritedDuration(tenant.RetentionDuration)
+
+	for _, purposeID := range purposeIDs {
+		resp, err := r.client.GetColumnRetentionDurationForPurpose(ctx, dlcs, purposeID)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if isConfigured(resp.RetentionDuration) {
+			t.purposes[purposeID] = resp.RetentionDuration.Duration
+		}
+	}
+
+	for _, columnID := range columnIDs {
+		resp, err := r.client.GetColumnRetentionDurationsForColumn(ctx, dlcs, columnID)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		durations := map[uuid.UUID]idp.RetentionDuration{}
+		for _, crd := range resp.RetentionDurations {
+			if isConfigured(crd) {
+				durations[crd.PurposeID] = crd.Duration
+			}
+		}
+		t.columns[columnID] = durations
+	}
+
+	return t, nil
+}
+
+// isConfigured returns true if the retention duration was explicitly saved at the level it was
+// requested for, rather than inherited from a less specific level
+func isConfigured(crd idp.ColumnRetentionDuration) bool {
+	return !crd.UseDefault && !crd.ID.IsNil()
+}
+
+// inheritedDuration returns the duration the server applies when a retention duration isn't
+// configured at the level it was requested for
+func inheritedDuration(crd idp.ColumnRetentionDuration) idp.RetentionDuration {
+	if crd.DefaultDuration != nil {
+		return *crd.DefaultDuration
+	}
+	// unsaved durations are returned with the inherited duration
+	return crd.Duration
+}
+
+func (r *Resolver) listPurposeIDs(ctx context.Context) ([]uuid.UUID, error) {
+	purposes, err := pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Purpose, pagination.ResponseFields, error) {
+		resp, err := r.client.ListPurposes(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	purposeIDs := make([]uuid.UUID, 0, len(purposes))
+	for _, p := range purposes {
+		purposeIDs = append(purposeIDs, p.ID)
+	}
+	return purposeIDs, nil
+}
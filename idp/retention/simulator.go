@@ -0,0 +1,67 @@
+package retention
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Event is the time at which retention started for a column value and purpose. For live
+// retention this is when consent for the purpose was given; for soft-deleted retention it
+// is when the value was deleted.
+type Event struct {
+	ColumnID  uuid.UUID `json:"column_id"`
+	PurposeID uuid.UUID `json:"purpose_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Projection is the projected deletion date for a column value retained for a purpose
+type Projection struct {
+	Event
+	Retention EffectiveRetention `json:"retention"`
+
+	// Indefinite is true if the value is retained indefinitely, in which case DeleteAt is the zero time
+	Indefinite bool      `json:"indefinite"`
+	DeleteAt   time.Time `json:"delete_at"`
+}
+
+// Simulate projects when each event's value will be deleted according to the table, sorted by deletion date
+// with indefinitely retained values last
+func Simulate(t *Table, events []Event) []Projection {
+	projections := make([]Projection, 0, len(events))
+	for _, e := range events {
+		p := Projection{Event: e, Retention: t.Effective(e.ColumnID, e.PurposeID)}
+		if p.Retention.Indefinite() {
+			p.Indefinite = true
+		} else {
+			p.DeleteAt = p.Retention.Duration.AddToTime(e.Timestamp)
+		}
+		projections = append(projections, p)
+	}
+
+	sort.SliceStable(projections, func(i, j int) bool {
+		return projections[i].before(projections[j])
+	})
+
+	return projections
+}
+
+func (p Projection) before(other Projection) bool {
+	if p.Indefinite != other.Indefinite {
+		return other.Indefinite
+	}
+	return p.DeleteAt.Before(other.DeleteAt)
+}
+
+// LatestByColumn returns, for each column, the projection with the latest deletion date. Since a value is
+// retained for as long as any of its purposes is, this is when the column value itself will be deleted.
+func LatestByColumn(projections []Projection) map[uuid.UUID]Projection {
+	latest := map[uuid.UUID]Projection{}
+	for _, p := range projections {
+		if current, found := latest[p.ColumnID]; !found || current.before(p) {
+			latest[p.ColumnID] = p
+		}
+	}
+	return latest
+}
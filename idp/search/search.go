@@ -0,0 +1,349 @@
+// Package search creates and executes accessors that use the userstore search index for prefix
+// and substring searches of a single column, e.g. for typeahead user search.
+package search
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// MatchMode describes where a search term must occur in a column value
+type MatchMode int
+
+// MatchMode values
+const (
+	MatchPrefix MatchMode = iota
+	MatchSubstring
+)
+
+type options struct {
+	name          string
+	purposes      []userstore.ResourceID
+	accessPolicy  userstore.ResourceID
+	outputColumns []userstore.ResourceID
+	caseSensitive bool
+	match         MatchMode
+	clientContext policy.ClientContext
+	maxResults    int
+}
+
+// Option makes search accessors and searches extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// Name returns an Option that sets the name of a created search accessor, which defaults to
+// Search_ followed by the column name
+func Name(name string) Option {
+	return optFunc(func(opts *options) {
+		opts.name = name
+	})
+}
+
+// Purposes returns an Option that sets the purposes of a created search accessor, which default to operational
+func Purposes(purposes ...userstore.ResourceID) Option {
+	return optFunc(func(opts *options) {
+		opts.purposes = purposes
+	})
+}
+
+// AccessPolicy returns an Option that sets the access policy of a created search accessor, which
+// defaults to allowing all access
+func AccessPolicy(accessPolicy userstore.ResourceID) Option {
+	return optFunc(func(opts *options) {
+		opts.accessPolicy = accessPolicy
+	})
+}
+
+// OutputColumns returns an Option that adds columns to the results of a created search accessor,
+// which always include the searched column
+func OutputColumns(columns ...userstore.ResourceID) Option {
+	return optFunc(func(opts *options) {
+		opts.outputColumns = append(opts.outputColumns, columns...)
+	})
+}
+
+// CaseSensitive returns an Option that makes a created search accessor use LIKE rather than ILIKE
+func CaseSensitive() Option {
+	return optFunc(func(opts *options) {
+		opts.caseSensitive = true
+	})
+}
+
+// Match returns an Option that sets where search terms must occur in column values, which defaults to MatchPrefix
+func Match(match MatchMode) Option {
+	return optFunc(func(opts *options) {
+		opts.match = match
+	})
+}
+
+// ClientContext returns an Option that sets the client context passed to the accessor's access policy
+func ClientContext(clientContext policy.ClientContext) Option {
+	return optFunc(func(opts *options) {
+		opts.clientContext = clientContext
+	})
+}
+
+// MaxResults returns an Option that stops a search once the specified number of results have been
+// returned, which is useful for typeahead. By default, every result is returned.
+func MaxResults(maxResults int) Option {
+	return optFunc(func(opts *options) {
+		opts.maxResults = maxResults
+	})
+}
+
+// searchablePattern matches the only selector that can use the search index, a single LIKE or ILIKE
+// comparison of a column with a placeholder
+var searchablePattern = regexp.MustCompile(`^\s*\{([a-zA-Z0-9_-]+)\}\s+((?i:i?like))\s+\?\s*$`)
+
+// ValidateColumn returns an error if a column can't be searched with the search index
+func ValidateColumn(column userstore.Column) error {
+	if !column.SearchIndexed {
+		return ucerr.Friendlyf(nil, "column '%s' is not search indexed", column.Name)
+	}
+	if column.IsArray {
+		return ucerr.Friendlyf(nil, "column '%s' is an array, which can't be searched", column.Name)
+	}
+	if !datatype.String.EquivalentTo(column.DataType) {
+		return ucerr.Friendlyf(nil, "column '%s' has data type '%s', but only string columns can be searched", column.Name, column.DataType.Name)
+	}
+	return nil
+}
+
+// ValidateAccessor returns an error if an accessor doesn't use the search index with a single LIKE
+// or ILIKE comparison, and otherwise returns the name of the searched column and whether the
+// comparison is case sensitive
+func ValidateAccessor(accessor userstore.Accessor) (string, bool, error) {
+	if !accessor.UseSearchIndex {
+		return "", false, ucerr.Friendlyf(nil, "accessor '%s' doesn't use the search index", accessor.Name)
+	}
+	m := searchablePattern.FindStringSubmatch(accessor.SelectorConfig.WhereClause)
+	if m == nil {
+		return "", false, ucerr.Friendlyf(nil, "accessor '%s' selector '%s' must be a single LIKE or ILIKE comparison, like \"{email} ILIKE ?\"",
+			accessor.Name, accessor.SelectorConfig.WhereClause)
+	}
+	return m[1], strings.EqualFold(m[2], "like"), nil
+}
+
+// NewAccessor returns the definition of a search accessor for a column, after checking that the
+// column can be searched. Its selector is "{column} ILIKE ?", or LIKE if CaseSensitive is specified.
+func NewAccessor(column userstore.Column, opts ...Option) (*userstore.Accessor, error) {
+	options := options{
+		purposes:     []userstore.ResourceID{{Name: "operational"}},
+		accessPolicy: userstore.ResourceID{ID: policy.AccessPolicyAllowAll.ID},
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if err := ValidateColumn(column); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	name := options.name
+	if name == "" {
+		name = "Search_" + column.Name
+	}
+
+	operator := "ILIKE"
+	if options.caseSensitive {
+		operator = "LIKE"
+	}
+
+	passthrough := userstore.ResourceID{ID: policy.TransformerPassthrough.ID}
+	columns := []userstore.ColumnOutputConfig{{Column: userstore.ResourceID{ID: column.ID, Name: column.Name}, Transformer: passthrough}}
+	for _, rid := range options.outputColumns {
+		if rid.EquivalentTo(userstore.ResourceID{ID: column.ID, Name: column.Name}) {
+			continue
+		}
+		columns = append(columns, userstore.ColumnOutputConfig{Column: rid, Transformer: passthrough})
+	}
+
+	return &userstore.Accessor{
+		Name:           name,
+		Description:    "Searches " + column.Name + " using the search index",
+		SelectorConfig: userstore.UserSelectorConfig{WhereClause: "{" + column.Name + "} " + operator + " ?"},
+		Purposes:       options.purposes,
+		Columns:        columns,
+		AccessPolicy:   options.accessPolicy,
+		UseSearchIndex: true,
+	}, nil
+}
+
+// EscapeLikePattern escapes the LIKE wildcards in a search term, so that it only matches itself
+func EscapeLikePattern(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+// Searcher executes searches with a search accessor
+type Searcher struct {
+	client     *idp.Client
+	accessorID uuid.UUID
+	columnName string
+	options    options
+}
+
+// CreateAccessor creates a search accessor for a column, or reuses an identical existing one, and
+// returns a Searcher for it
+func CreateAccessor(ctx context.Context, client *idp.Client, column userstore.ResourceID, opts ...Option) (*Searcher, error) {
+	c, err := getColumn(ctx, client, column)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	accessor, err := NewAccessor(*c, opts...)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	created, err := client.CreateAccessor(ctx, *accessor, idp.IfNotExists())
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return NewSearcher(ctx, client, created.ID, opts...)
+}
+
+// NewSearcher returns a Searcher for an existing accessor, after checking that it's a valid search accessor
+func NewSearcher(ctx context.Context, client *idp.Client, accessorID uuid.UUID, opts ...Option) (*Searcher, error) {
+	var options options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	accessor, err := client.GetAccessor(ctx, accessorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	columnName, _, err := ValidateAccessor(*accessor)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	column, err := getColumn(ctx, client, userstore.ResourceID{Name: columnName})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if err := ValidateColumn(*column); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &Searcher{
+		client:     client,
+		accessorID: accessorID,
+		columnName: columnName,
+		options:    options,
+	}, nil
+}
+
+// AccessorID returns the ID of the search accessor
+func (s *Searcher) AccessorID() uuid.UUID {
+	return s.accessorID
+}
+
+// Column returns the name of the searched column
+func (s *Searcher) Column() string {
+	return s.columnName
+}
+
+// Pattern returns the LIKE pattern used to search for a term
+func (s *Searcher) Pattern(term string, opts ...Option) string {
+	options := s.searchOptions(opts)
+	if options.match == MatchSubstring {
+		return "%" + EscapeLikePattern(term) + "%"
+	}
+	return EscapeLikePattern(term) + "%"
+}
+
+func (s *Searcher) searchOptions(opts []Option) options {
+	options := s.options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+	return options
+}
+
+// Search returns the records whose searched column matches a term. Wildcards in the term are
+// matched literally. An empty term matches nothing.
+func (s *Searcher) Search(ctx context.Context, term string, opts ...Option) ([]userstore.Record, error) {
+	return Search[userstore.Record](ctx, s, term, opts...)
+}
+
+// Search returns the results of a search decoded into a T, which should be a struct with json tags
+// matching the accessor's output column names
+func Search[T any](ctx context.Context, s *Searcher, term string, opts ...Option) ([]T, error) {
+	results := []T{}
+	if strings.TrimSpace(term) == "" {
+		return results, nil
+	}
+
+	options := s.searchOptions(opts)
+
+	var idpOpts []idp.Option
+	if options.maxResults > 0 && options.maxResults < pagination.MaxLimit {
+		idpOpts = append(idpOpts, idp.Pagination(pagination.Limit(options.maxResults)))
+	}
+
+	it := s.client.NewAccessorIterator(s.accessorID, options.clientContext, userstore.UserSelectorValues{s.Pattern(term, opts...)}, idpOpts...)
+	for it.Next(ctx) {
+		var result T
+		if err := it.Decode(&result); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		results = append(results, result)
+		if options.maxResults > 0 && len(results) >= options.maxResults {
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return results, nil
+}
+
+// getColumn returns a column by ID, or by name if no ID is specified
+func getColumn(ctx context.Context, client *idp.Client, rid userstore.ResourceID) (*userstore.Column, error) {
+	if !rid.ID.IsNil() {
+		column, err := client.GetColumn(ctx, rid.ID)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return column, nil
+	}
+
+	columns, err := pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Column, pagination.ResponseFields, error) {
+		resp, err := client.ListColumns(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	for i := range columns {
+		if strings.EqualFold(columns[i].Name, rid.Name) {
+			return &columns[i], nil
+		}
+	}
+
+	return nil, ucerr.Friendlyf(nil, "column '%s' not found", rid.Name)
+}
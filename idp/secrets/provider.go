@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"userclouds.com/idp"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+// Provider supplies secret values from outside the tenant, e.g. a directory of mounted files or
+// the environment, so that Sync can keep the tenant's secrets up to date
+type Provider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+type fileProvider struct {
+	dir string
+}
+
+// NewFileProvider returns a Provider that reads each secret from the file in dir with the same
+// name as the secret, ignoring a trailing newline
+func NewFileProvider(dir string) Provider {
+	return &fileProvider{dir: dir}
+}
+
+// GetSecret implements Provider
+func (f *fileProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", ucerr.Friendlyf(nil, "'%s' is not a valid secret file name", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return "", ucerr.Friendlyf(ErrSecretNotFound, "no file for secret '%s' in %s", name, f.dir)
+	}
+	if err != nil {
+		return "", ucerr.Wrap(err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+type envProvider struct {
+	prefix string
+}
+
+// NewEnvProvider returns a Provider that reads each secret from the environment variable named by
+// prefix followed by the secret name
+func NewEnvProvider(prefix string) Provider {
+	return &envProvider{prefix: prefix}
+}
+
+// GetSecret implements Provider
+func (e *envProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	value, found := os.LookupEnv(e.prefix + name)
+	if !found {
+		return "", ucerr.Friendlyf(ErrSecretNotFound, "environment variable %s%s is not set", e.prefix, name)
+	}
+	return value, nil
+}
+
+// Sync activates a rotation for each secret in names whose value from provider differs from the
+// newest version in the tenant, and returns the active rotations so they can be verified and
+// completed. Secrets that don't exist in the tenant are created. If the server doesn't return the
+// value of a secret's newest version, it can't be compared, so the secret is skipped rather than
+// rotated on every sync.
+func Sync(ctx context.Context, client *idp.TokenizerClient, provider Provider, names []string) ([]*Rotation, error) {
+	var rotations []*Rotation
+	for _, name := range names {
+		value, err := provider.GetSecret(ctx, name)
+		if err != nil {
+			return rotations, ucerr.Wrap(err)
+		}
+
+		rotation, err := PlanRotation(ctx, client, name, value)
+		if err != nil {
+			return rotations, ucerr.Wrap(err)
+		}
+		if n := len(rotation.Previous); n > 0 {
+			newest := rotation.Previous[n-1]
+			if newest.Value == "" {
+				uclog.Warningf(ctx, "skipping sync of secret '%s' because the server didn't return the value of version %d", name, newest.Number)
+				continue
+			}
+			if newest.Value == value {
+				continue
+			}
+		}
+
+		if err := rotation.Activate(ctx); err != nil {
+			return rotations, ucerr.Wrap(err)
+		}
+		rotations = append(rotations, rotation)
+	}
+	return rotations, nil
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/infra/ucerr"
+)
+
+// RotationState is the stage a Rotation has reached
+type RotationState string
+
+// RotationState values
+const (
+	RotationPlanned   RotationState = "planned"
+	RotationActive    RotationState = "active"
+	RotationCompleted RotationState = "completed"
+	RotationAborted   RotationState = "aborted"
+)
+
+// Rotation replaces the value of a secret in stages: Activate creates the new version, Verify checks
+// the resources that use it, and Complete deletes the previous versions, or Abort deletes the new
+// one so the previous value is used again. The server has no way to hold a version back, so the
+// new value is live as soon as Activate returns: Verify checks resources that are already using
+// it, and Abort is the way to roll back if they fail.
+type Rotation struct {
+	Name  string        `json:"name"`
+	State RotationState `json:"state"`
+
+	// Previous are the versions that existed when the rotation was planned, oldest first
+	Previous []Version `json:"previous"`
+
+	// Current is the new version, once the rotation is active
+	Current *Version `json:"current,omitempty"`
+
+	// Usages are the templates and transformers that reference the secret
+	Usages []Usage `json:"usages"`
+
+	client *idp.TokenizerClient
+	value  string
+}
+
+// PlanRotation prepares to rotate the secret called name to value, without changing anything. The
+// secret doesn't need to exist yet, in which case Activate creates its first version.
+func PlanRotation(ctx context.Context, client *idp.TokenizerClient, name string, value string) (*Rotation, error) {
+	if value == "" {
+		return nil, ucerr.Friendlyf(nil, "secret '%s' can't be rotated to an empty value", name)
+	}
+
+	previous, err := Versions(ctx, client, name)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	usages, err := FindUsages(ctx, client, name)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &Rotation{
+		Name:     name,
+		State:    RotationPlanned,
+		Previous: previous,
+		Usages:   usages,
+		client:   client,
+		value:    value,
+	}, nil
+}
+
+// Activate creates the new version of the secret, which the server uses from then on. It then
+// checks that the server kept the previous versions and ordered the new one after them, and
+// deletes the new version again if it didn't, since the server can't be relied on to resolve the
+// name to the new value.
+func (r *Rotation) Activate(ctx context.Context) error {
+	if r.State != RotationPlanned {
+		return ucerr.Friendlyf(nil, "rotation of secret '%s' is %s and can't be activated", r.Name, r.State)
+	}
+
+	secret, err := r.client.CreateSecret(ctx, policy.Secret{
+		ID:    uuid.Must(uuid.NewV4()),
+		Name:  r.Name,
+		Value: r.value,
+	})
+	if err != nil {
+		return ucerr.Friendlyf(err, "couldn't create a new version of secret '%s': %s", r.Name, ucerr.UserFriendlyMessage(err))
+	}
+
+	current, err := r.checkVersions(ctx, secret.ID)
+	if err != nil {
+		if deleteErr := r.client.DeleteSecret(ctx, secret.ID); deleteErr != nil {
+			return ucerr.Friendlyf(err, "%s, and deleting the new version %v failed: %s", ucerr.UserFriendlyMessage(err), secret.ID, ucerr.UserFriendlyMessage(deleteErr))
+		}
+		return ucerr.Wrap(err)
+	}
+
+	r.Current = current
+	r.State = RotationActive
+	return nil
+}
+
+// checkVersions returns the new version of the secret if it's the newest, and every previous
+// version still exists
+func (r *Rotation) checkVersions(ctx context.Context, id uuid.UUID) (*Version, error) {
+	versions, err := Versions(ctx, r.client, r.Name)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if len(versions) != len(r.Previous)+1 || versions[len(versions)-1].ID != id {
+		return nil, ucerr.Friendlyf(nil, "the server didn't add the new value of secret '%s' as its newest version", r.Name)
+	}
+	for i, v := range r.Previous {
+		if versions[i].ID != v.ID {
+			return nil, ucerr.Friendlyf(nil, "version %d (%v) of secret '%s' changed while it was being rotated", v.Number, v.ID, r.Name)
+		}
+	}
+
+	current := versions[len(versions)-1]
+	return &current, nil
+}
+
+// Verify calls check for each usage of the secret once the rotation is active, e.g. to run a
+// transformer with TestTransformer, and returns the first error
+func (r *Rotation) Verify(ctx context.Context, check func(ctx context.Context, usage Usage) error) error {
+	if r.State != RotationActive {
+		return ucerr.Friendlyf(nil, "rotation of secret '%s' is %s and can't be verified", r.Name, r.State)
+	}
+
+	for _, u := range r.Usages {
+		if err := check(ctx, u); err != nil {
+			return ucerr.Friendlyf(err, "%s '%s' failed verification with the new value of secret '%s': %s", u.Kind, u.Name, r.Name, ucerr.UserFriendlyMessage(err))
+		}
+	}
+	return nil
+}
+
+// Complete deletes the previous versions of the secret. If a deletion fails, Complete can be called again.
+func (r *Rotation) Complete(ctx context.Context) error {
+	if r.State != RotationActive {
+		return ucerr.Friendlyf(nil, "rotation of secret '%s' is %s and can't be completed", r.Name, r.State)
+	}
+
+	for len(r.Previous) > 0 {
+		if err := r.client.DeleteSecret(ctx, r.Previous[0].ID); err != nil {
+			return ucerr.Wrap(err)
+		}
+		r.Previous = r.Previous[1:]
+	}
+
+	r.State = RotationCompleted
+	return nil
+}
+
+// Abort deletes the new version of the secret if the rotation is active, so the previous version is used again
+func (r *Rotation) Abort(ctx context.Context) error {
+	switch r.State {
+	case RotationPlanned:
+	case RotationActive:
+		if err := r.client.DeleteSecret(ctx, r.Current.ID); err != nil {
+			return ucerr.Wrap(err)
+		}
+		r.Current = nil
+	default:
+		return ucerr.Friendlyf(nil, "rotation of secret '%s' is %s and can't be aborted", r.Name, r.State)
+	}
+
+	r.State = RotationAborted
+	return nil
+}
@@ -0,0 +1,147 @@
+// Package secrets manages the lifecycle of the secrets that access policy templates and transformers
+// use. The server has no versions of its own, so secrets are versioned by name: each value created
+// under a name is a new version, ordered by creation time, and templates and transformers see the
+// newest one. Rotation.Activate checks that the server kept the previous versions when the new one
+// was created, rather than assuming it. Rotating a secret creates a new version, finds the
+// templates and transformers that reference it so they can be checked, and then deletes the old
+// versions.
+package secrets
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// ErrSecretNotFound is returned when a secret has no versions, or a Provider has no value for it
+var ErrSecretNotFound = ucerr.Friendlyf(nil, "secret not found")
+
+// Version is a single value of a secret
+type Version struct {
+	policy.Secret
+
+	// Number is the 1-based position of the version, in order of creation
+	Number int `json:"number"`
+}
+
+// Versions returns the versions of the secret called name, oldest first
+func Versions(ctx context.Context, client *idp.TokenizerClient, name string) ([]Version, error) {
+	all, err := listSecrets(ctx, client)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	var versions []Version
+	for _, s := range all {
+		if strings.EqualFold(s.Name, name) {
+			versions = append(versions, Version{Secret: s})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Created != versions[j].Created {
+			return versions[i].Created < versions[j].Created
+		}
+		return versions[i].ID.String() < versions[j].ID.String()
+	})
+	for i := range versions {
+		versions[i].Number = i + 1
+	}
+	return versions, nil
+}
+
+func listSecrets(ctx context.Context, client *idp.TokenizerClient) ([]policy.Secret, error) {
+	secrets, err := pagination.ListAll(func(cursor pagination.Cursor) ([]policy.Secret, pagination.ResponseFields, error) {
+		resp, err := client.ListSecrets(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	return secrets, ucerr.Wrap(err)
+}
+
+// UsageKind identifies the type of resource that references a secret
+type UsageKind string
+
+// UsageKind values
+const (
+	UsageAccessPolicyTemplate UsageKind = "access_policy_template"
+	UsageTransformer          UsageKind = "transformer"
+)
+
+// Usage is a resource that references a secret
+type Usage struct {
+	Kind UsageKind `json:"kind"`
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+
+	// Fields are the fields of the resource that reference the secret, "function" and/or "parameters"
+	Fields []string `json:"fields"`
+}
+
+// referencePattern matches a secret name as a whole identifier, so that a secret called API_KEY
+// isn't found in OTHER_API_KEY
+func referencePattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^A-Za-z0-9_])` + regexp.QuoteMeta(name) + `($|[^A-Za-z0-9_])`)
+}
+
+func referencingFields(re *regexp.Regexp, function string, parameters string) []string {
+	var fields []string
+	if re.MatchString(function) {
+		fields = append(fields, "function")
+	}
+	if re.MatchString(parameters) {
+		fields = append(fields, "parameters")
+	}
+	return fields
+}
+
+// FindUsages returns the access policy templates and transformers whose function or parameters
+// reference the secret called name. References are found by scanning for the name, so a name that
+// appears in a comment or string for another reason is reported too.
+func FindUsages(ctx context.Context, client *idp.TokenizerClient, name string) ([]Usage, error) {
+	re := referencePattern(name)
+	var usages []Usage
+
+	templates, err := pagination.ListAll(func(cursor pagination.Cursor) ([]policy.AccessPolicyTemplate, pagination.ResponseFields, error) {
+		resp, err := client.ListAccessPolicyTemplates(ctx, false, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	for _, apt := range templates {
+		if fields := referencingFields(re, apt.Function, ""); len(fields) > 0 {
+			usages = append(usages, Usage{Kind: UsageAccessPolicyTemplate, ID: apt.ID, Name: apt.Name, Fields: fields})
+		}
+	}
+
+	transformers, err := pagination.ListAll(func(cursor pagination.Cursor) ([]policy.Transformer, pagination.ResponseFields, error) {
+		resp, err := client.ListTransformers(ctx, idp.Pagination(pagination.StartingAfter(cursor)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, ucerr.Wrap(err)
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	for _, tf := range transformers {
+		if fields := referencingFields(re, tf.Function, tf.Parameters); len(fields) > 0 {
+			usages = append(usages, Usage{Kind: UsageTransformer, ID: tf.ID, Name: tf.Name, Fields: fields})
+		}
+	}
+
+	return usages, nil
+}
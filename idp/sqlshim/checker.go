@@ -0,0 +1,293 @@
+// Package sqlshim checks SQL shim database settings before they're registered with the userstore.
+package sqlshim
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Database types supported by the checker
+const (
+	TypePostgres = "postgres"
+	TypeMySQL    = "mysql"
+)
+
+// systemSchemas are the schemas that databases use for their own catalogs, which are never proxied
+var systemSchemas = map[string]bool{
+	"information_schema": true,
+	"mysql":              true,
+	"performance_schema": true,
+	"pg_catalog":         true,
+	"pg_toast":           true,
+	"sys":                true,
+}
+
+type options struct {
+	drivers map[string]string
+	address string
+	sslMode string
+	timeout time.Duration
+}
+
+// Option configures a Checker
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// Driver returns an Option that sets the database/sql driver name used for a database type. The
+// driver itself must be registered by the caller, e.g. by importing github.com/lib/pq or
+// github.com/go-sql-driver/mysql. By default, the driver name is the database type.
+func Driver(databaseType string, driverName string) Option {
+	return optFunc(func(opts *options) {
+		opts.drivers[strings.ToLower(databaseType)] = driverName
+	})
+}
+
+// Address returns an Option that connects to the specified host:port instead of the database's
+// configured host and port, e.g. to check the settings against a local test container
+func Address(hostPort string) Option {
+	return optFunc(func(opts *options) {
+		opts.address = hostPort
+	})
+}
+
+// SSLMode returns an Option that sets the sslmode of Postgres connections, e.g. "disable" to check
+// the settings against a local test container without TLS. By default, the driver's default is used.
+func SSLMode(mode string) Option {
+	return optFunc(func(opts *options) {
+		opts.sslMode = mode
+	})
+}
+
+// Timeout returns an Option that limits how long a check may take, which defaults to 30 seconds
+func Timeout(timeout time.Duration) Option {
+	return optFunc(func(opts *options) {
+		opts.timeout = timeout
+	})
+}
+
+// Checker connects to SQL shim databases to verify their settings and introspect their schemas
+type Checker struct {
+	options options
+}
+
+// NewChecker returns a new Checker
+func NewChecker(opts ...Option) *Checker {
+	options := options{
+		drivers: map[string]string{},
+		timeout: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+	return &Checker{options: options}
+}
+
+// ForeignColumn is a column of a table in a shim database
+type ForeignColumn struct {
+	Name       string
+	DataType   string
+	IsNullable bool
+}
+
+// Table is a table in a shim database
+type Table struct {
+	Schema  string
+	Name    string
+	Columns []ForeignColumn
+}
+
+// QualifiedName returns the table's name qualified by its schema
+func (t Table) QualifiedName() string {
+	return t.Schema + "." + t.Name
+}
+
+// Report is the result of checking a shim database
+type Report struct {
+	// Schemas are the non-system schemas in the database
+	Schemas []string
+
+	// Tables are the tables in the configured schemas, or in every schema if none are configured
+	Tables []Table
+
+	// Problems describes settings that connected successfully but look wrong, e.g. configured
+	// schemas that don't exist
+	Problems []string
+}
+
+// OK returns true if the check found no problems
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// driverName returns the database/sql driver for a database's type
+func (c *Checker) driverName(db userstore.SQLShimDatabase) (string, error) {
+	databaseType := strings.ToLower(db.Type)
+	if driverName, found := c.options.drivers[databaseType]; found {
+		return driverName, nil
+	}
+	if databaseType != TypePostgres && databaseType != TypeMySQL {
+		return "", ucerr.Friendlyf(nil, "unsupported database type '%s'", db.Type)
+	}
+	return databaseType, nil
+}
+
+// dataSourceName returns the connection string for a database, in the format its driver expects
+func (c *Checker) dataSourceName(db userstore.SQLShimDatabase) string {
+	address := c.options.address
+	if address == "" {
+		address = net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+	}
+
+	if strings.EqualFold(db.Type, TypeMySQL) {
+		return fmt.Sprintf("%s:%s@tcp(%s)/", db.Username, db.Password, address)
+	}
+
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(db.Username, db.Password),
+		Host:   address,
+	}
+	if c.options.sslMode != "" {
+		u.RawQuery = url.Values{"sslmode": {c.options.sslMode}}.Encode()
+	}
+	return u.String()
+}
+
+// Check connects to a shim database with its configured credentials and lists its schemas and
+// tables. Settings that prevent connecting are returned as errors, while settings that connect
+// but look wrong are listed in the report's problems.
+func (c *Checker) Check(ctx context.Context, db userstore.SQLShimDatabase) (*Report, error) {
+	if err := db.Validate(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	driverName, err := c.driverName(db)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.options.timeout)
+	defer cancel()
+
+	conn, err := sql.Open(driverName, c.dataSourceName(db))
+	if err != nil {
+		return nil, ucerr.Friendlyf(err, "can't open a %s connection (is the driver registered?): %v", db.Type, err)
+	}
+	defer conn.Close()
+
+	if err := conn.PingContext(ctx); err != nil {
+		return nil, ucerr.Friendlyf(err, "can't connect to database '%s' as '%s': %v", db.Name, db.Username, err)
+	}
+
+	var report Report
+
+	allSchemas, err := listSchemas(ctx, conn)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	existing := map[string]bool{}
+	for _, schema := range allSchemas {
+		existing[schema] = true
+		if !systemSchemas[strings.ToLower(schema)] {
+			report.Schemas = append(report.Schemas, schema)
+		}
+	}
+
+	included := map[string]bool{}
+	for _, schema := range db.Schemas {
+		if !existing[schema] {
+			report.Problems = append(report.Problems, fmt.Sprintf("schema '%s' doesn't exist or isn't visible to '%s'", schema, db.Username))
+		}
+		included[schema] = true
+	}
+	if len(db.Schemas) == 0 {
+		for _, schema := range report.Schemas {
+			included[schema] = true
+		}
+	}
+
+	tables, err := listTables(ctx, conn)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	for _, t := range tables {
+		if included[t.Schema] {
+			report.Tables = append(report.Tables, t)
+		}
+	}
+	if len(report.Tables) == 0 {
+		report.Problems = append(report.Problems, fmt.Sprintf("'%s' can't see any tables in the configured schemas", db.Username))
+	}
+
+	return &report, nil
+}
+
+func listSchemas(ctx context.Context, conn *sql.DB) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT schema_name FROM information_schema.schemata")
+	if err != nil {
+		return nil, ucerr.Friendlyf(err, "can't list schemas: %v", err)
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		schemas = append(schemas, schema)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	sort.Strings(schemas)
+	return schemas, nil
+}
+
+func listTables(ctx context.Context, conn *sql.DB) ([]Table, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT table_schema, table_name, column_name, data_type, is_nullable
+FROM information_schema.columns
+ORDER BY table_schema, table_name, ordinal_position`)
+	if err != nil {
+		return nil, ucerr.Friendlyf(err, "can't list tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []Table
+	for rows.Next() {
+		var schema, table, isNullable string
+		var column ForeignColumn
+		if err := rows.Scan(&schema, &table, &column.Name, &column.DataType, &isNullable); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		column.IsNullable = strings.EqualFold(isNullable, "YES")
+
+		if n := len(tables); n == 0 || tables[n-1].Schema != schema || tables[n-1].Name != table {
+			tables = append(tables, Table{Schema: schema, Name: table})
+		}
+		tables[len(tables)-1].Columns = append(tables[len(tables)-1].Columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return tables, nil
+}
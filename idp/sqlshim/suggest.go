@@ -0,0 +1,105 @@
+package sqlshim
+
+import (
+	"regexp"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+)
+
+// invalidIdentifierChars are replaced when deriving userstore column names from foreign column names
+var invalidIdentifierChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// SuggestColumns returns a userstore column for each column of a foreign table, with a data type
+// inferred from the column's SQL type and name. The suggestions are a starting point for review,
+// and are not created in the userstore.
+func SuggestColumns(t Table) []userstore.Column {
+	columns := make([]userstore.Column, 0, len(t.Columns))
+	for _, fc := range t.Columns {
+		dataType, isArray := suggestDataType(fc)
+		columns = append(columns, userstore.Column{
+			Table:     t.QualifiedName(),
+			Name:      columnName(fc.Name),
+			DataType:  dataType,
+			IsArray:   isArray,
+			IndexType: userstore.ColumnIndexTypeNone,
+		})
+	}
+	return columns
+}
+
+// columnName converts a foreign column name to a valid userstore column name
+func columnName(name string) string {
+	n := invalidIdentifierChars.ReplaceAllString(name, "_")
+	if n == "" || (n[0] >= '0' && n[0] <= '9') || n[0] == '-' {
+		n = "_" + n
+	}
+	return n
+}
+
+// integerTypes are the SQL integer type names of the supported databases
+var integerTypes = map[string]bool{
+	"int":         true,
+	"integer":     true,
+	"smallint":    true,
+	"bigint":      true,
+	"tinyint":     true,
+	"mediumint":   true,
+	"int2":        true,
+	"int4":        true,
+	"int8":        true,
+	"serial":      true,
+	"smallserial": true,
+	"bigserial":   true,
+}
+
+// baseType strips the display width and modifiers from a SQL type, e.g. "int(11) unsigned" -> "int"
+func baseType(sqlType string) string {
+	if i := strings.IndexAny(sqlType, "( "); i >= 0 {
+		return sqlType[:i]
+	}
+	return sqlType
+}
+
+// suggestDataType infers a userstore data type from a foreign column's SQL type, refined by its
+// name for strings that are commonly PII with a dedicated data type
+func suggestDataType(fc ForeignColumn) (userstore.ResourceID, bool) {
+	sqlType := strings.ToLower(strings.TrimSpace(fc.DataType))
+
+	isArray := false
+	if sqlType == "array" || strings.HasSuffix(sqlType, "[]") {
+		// postgres reports arrays as ARRAY in information_schema, without the element type
+		isArray = true
+		sqlType = strings.TrimSuffix(sqlType, "[]")
+	}
+
+	name := strings.ToLower(fc.Name)
+	switch {
+	case strings.Contains(sqlType, "bool") || sqlType == "bit":
+		return datatype.Boolean, isArray
+	case integerTypes[baseType(sqlType)]:
+		return datatype.Integer, isArray
+	case strings.HasPrefix(sqlType, "timestamp") || strings.HasPrefix(sqlType, "datetime"):
+		return datatype.Timestamp, isArray
+	case sqlType == "date":
+		if strings.Contains(name, "birth") || name == "dob" {
+			return datatype.Birthdate, isArray
+		}
+		return datatype.Date, isArray
+	case sqlType == "uuid":
+		return datatype.UUID, isArray
+	case strings.Contains(sqlType, "char") || strings.Contains(sqlType, "text"):
+		switch {
+		case strings.Contains(name, "email"):
+			return datatype.Email, isArray
+		case strings.Contains(name, "phone"):
+			return datatype.PhoneNumber, isArray
+		case name == "ssn" || strings.Contains(name, "social_security"):
+			return datatype.SSN, isArray
+		}
+	}
+
+	// numeric, JSON and other types are proxied as strings
+	return datatype.String, isArray
+}
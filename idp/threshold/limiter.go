@@ -0,0 +1,376 @@
+// Package threshold enforces access policy thresholds on the client, using rate limit slots in a
+// shared cache, so that callers can back off before the server starts denying access or returning
+// 429 Too Many Requests.
+package threshold
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/cache"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+const (
+	// bucketDuration is the granularity of the sliding window used to count executions
+	bucketDuration = time.Second
+
+	defaultPolicyTTL = 5 * time.Minute
+	initialBackoff   = 250 * time.Millisecond
+	maxBackoff       = 5 * time.Second
+)
+
+// ErrMaxExecutionsExceeded is returned when executing a policy would exceed its MaxExecutions
+// threshold. The server denies access in this case, and returns 429 Too Many Requests if the policy
+// announces execution failures.
+var ErrMaxExecutionsExceeded = ucerr.Friendlyf(nil, "access policy execution threshold exceeded")
+
+// ErrMaxResultsExceeded is returned when an execution would involve more results than a policy's
+// MaxResultsPerExecution threshold allows
+var ErrMaxResultsExceeded = ucerr.Friendlyf(nil, "access policy results per execution threshold exceeded")
+
+type options struct {
+	maxWait   time.Duration
+	policyTTL time.Duration
+}
+
+// Option makes Limiter extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// Wait returns an Option that makes the limiter wait, backing off, for up to maxWait for an
+// execution slot to become available, rather than failing immediately
+func Wait(maxWait time.Duration) Option {
+	return optFunc(func(opts *options) {
+		opts.maxWait = maxWait
+	})
+}
+
+// PolicyTTL returns an Option that sets how long the thresholds of a policy are cached before
+// they're read from the tenant again, which defaults to 5 minutes
+func PolicyTTL(ttl time.Duration) Option {
+	return optFunc(func(opts *options) {
+		opts.policyTTL = ttl
+	})
+}
+
+// cachedPolicy is an access policy read from the tenant, and when it expires
+type cachedPolicy struct {
+	policy  policy.AccessPolicy
+	expires time.Time
+}
+
+// policyCache caches the access policies of accessors and tokens, so that their thresholds
+// don't have to be read before every execution
+type policyCache struct {
+	mu       sync.Mutex
+	policies map[string]cachedPolicy
+}
+
+// Limiter counts executions of access policies per caller in a shared cache, and checks them
+// against the policies' thresholds before requests are issued. Every process sharing the cache
+// sees the same counts, so the limits hold across a fleet of clients.
+type Limiter struct {
+	provider cache.Provider
+	prefix   string
+	caller   string
+	options  options
+	policies *policyCache
+}
+
+// NewLimiter returns a Limiter that stores execution counts in a cache provider that supports rate
+// limits, such as cache.RedisClientCacheProvider. Every key the limiter uses starts with keyPrefix,
+// which must match the provider's key prefix.
+func NewLimiter(ctx context.Context, provider cache.Provider, keyPrefix string, opts ...Option) (*Limiter, error) {
+	options := options{policyTTL: defaultPolicyTTL}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if !provider.SupportsRateLimits(ctx) {
+		return nil, ucerr.Friendlyf(nil, "cache provider '%s' doesn't support rate limits", provider.GetCacheName(ctx))
+	}
+
+	return &Limiter{
+		provider: provider,
+		prefix:   keyPrefix,
+		options:  options,
+		policies: &policyCache{policies: map[string]cachedPolicy{}},
+	}, nil
+}
+
+// ForCaller returns a Limiter that counts executions separately for a caller, e.g. a client ID or
+// user ID, sharing the cache and the policies that have already been read
+func (l *Limiter) ForCaller(caller string) *Limiter {
+	lc := *l
+	lc.caller = caller
+	return &lc
+}
+
+// rateLimitKeys returns the keys of the buckets making up a policy's execution window, oldest first,
+// so the final key is the bucket for the current second
+func (l *Limiter) rateLimitKeys(policyID uuid.UUID, window time.Duration, now time.Time) []cache.RateLimitKey {
+	caller := l.caller
+	if caller == "" {
+		caller = "_"
+	}
+
+	buckets := int(window / bucketDuration)
+	if buckets < 1 {
+		buckets = 1
+	}
+
+	current := now.Truncate(bucketDuration).Unix()
+	keys := make([]cache.RateLimitKey, 0, buckets)
+	for i := int64(buckets - 1); i >= 0; i-- {
+		keys = append(keys, cache.RateLimitKey(fmt.Sprintf("%s_APRL_%v_%s_%d", l.prefix, policyID, caller, current-i)))
+	}
+	return keys
+}
+
+func executionWindow(t policy.AccessPolicyThresholds) time.Duration {
+	return time.Duration(t.MaxExecutionDurationSeconds) * time.Second
+}
+
+// Budget describes how much of a policy's execution threshold a caller has used
+type Budget struct {
+	PolicyID uuid.UUID `json:"policy_id"`
+
+	// Limited is false if the policy has no MaxExecutions threshold, in which case Used and
+	// Remaining are zero
+	Limited   bool          `json:"limited"`
+	Used      int           `json:"used"`
+	Remaining int           `json:"remaining"`
+	Window    time.Duration `json:"window"`
+
+	MaxResultsPerExecution int `json:"max_results_per_execution"`
+}
+
+// Remaining returns the caller's remaining execution budget for a policy, without using any of it
+func (l *Limiter) Remaining(ctx context.Context, ap policy.AccessPolicy) (*Budget, error) {
+	t := ap.Thresholds
+	budget := &Budget{
+		PolicyID:               ap.ID,
+		Window:                 executionWindow(t),
+		MaxResultsPerExecution: t.MaxResultsPerExecution,
+	}
+	if t.MaxExecutions <= 0 {
+		return budget, nil
+	}
+
+	keys := l.rateLimitKeys(ap.ID, budget.Window, time.Now().UTC())
+	_, used, err := l.provider.ReserveRateLimitSlot(ctx, keys, int64(t.MaxExecutions), budget.Window, false)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	budget.Limited = true
+	budget.Used = int(used)
+	budget.Remaining = t.MaxExecutions - int(used)
+	if budget.Remaining < 0 {
+		budget.Remaining = 0
+	}
+	return budget, nil
+}
+
+// Reservation is an execution slot reserved by Reserve
+type Reservation struct {
+	limiter *Limiter
+	keys    []cache.RateLimitKey
+	once    sync.Once
+}
+
+// Release gives back an execution slot, for when the request it was reserved for never reached
+// the server. Releasing a reservation more than once, or one for an unlimited policy, does nothing.
+func (r *Reservation) Release(ctx context.Context) error {
+	if r == nil || len(r.keys) == 0 {
+		return nil
+	}
+
+	var err error
+	r.once.Do(func() {
+		_, err = r.limiter.provider.ReleaseRateLimitSlot(ctx, r.keys)
+	})
+	return ucerr.Wrap(err)
+}
+
+// Reserve checks an execution of a policy involving a number of results against the policy's
+// thresholds, and reserves an execution slot for it. If results is zero, the number of results is
+// treated as unknown and isn't checked. Unless the limiter was created with Wait, an
+// ErrMaxExecutionsExceeded error is returned as soon as the caller's budget is used up.
+func (l *Limiter) Reserve(ctx context.Context, ap policy.AccessPolicy, results int) (*Reservation, error) {
+	t := ap.Thresholds
+	if t.MaxResultsPerExecution > 0 && results > t.MaxResultsPerExecution {
+		return nil, ucerr.Wrap(ErrMaxResultsExceeded)
+	}
+	if t.MaxExecutions <= 0 {
+		return &Reservation{limiter: l}, nil
+	}
+
+	window := executionWindow(t)
+	deadline := time.Now().Add(l.options.maxWait)
+	backoff := initialBackoff
+	for {
+		keys := l.rateLimitKeys(ap.ID, window, time.Now().UTC())
+		reserved, _, err := l.provider.ReserveRateLimitSlot(ctx, keys, int64(t.MaxExecutions), window, true)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if reserved {
+			return &Reservation{limiter: l, keys: keys}, nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, ucerr.Wrap(ErrMaxExecutionsExceeded)
+		}
+		if wait > backoff {
+			wait = backoff
+		}
+
+		uclog.Debugf(ctx, "execution threshold of access policy %v reached, waiting %v", ap.ID, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ucerr.Wrap(ctx.Err())
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// getPolicy returns a cached access policy, reading it with get if it isn't cached or has expired
+func (l *Limiter) getPolicy(ctx context.Context, key string, get func() (*policy.AccessPolicy, error)) (*policy.AccessPolicy, error) {
+	l.policies.mu.Lock()
+	cached, found := l.policies.policies[key]
+	l.policies.mu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return &cached.policy, nil
+	}
+
+	ap, err := get()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	l.policies.mu.Lock()
+	l.policies.policies[key] = cachedPolicy{policy: *ap, expires: time.Now().Add(l.options.policyTTL)}
+	l.policies.mu.Unlock()
+	return ap, nil
+}
+
+// accessorPolicy returns the access policy of an accessor
+func (l *Limiter) accessorPolicy(ctx context.Context, client *idp.Client, accessorID uuid.UUID) (*policy.AccessPolicy, error) {
+	return l.getPolicy(ctx, "accessor:"+accessorID.String(), func() (*policy.AccessPolicy, error) {
+		accessor, err := client.GetAccessor(ctx, accessorID)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		ap, err := client.GetAccessPolicy(ctx, accessor.AccessPolicy)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return ap, nil
+	})
+}
+
+// accessPolicy returns an access policy by ID or name
+func (l *Limiter) accessPolicy(ctx context.Context, client *idp.TokenizerClient, accessPolicyRID userstore.ResourceID) (*policy.AccessPolicy, error) {
+	key := "policy:" + accessPolicyRID.ID.String()
+	if accessPolicyRID.ID.IsNil() {
+		key = "policy:" + strings.ToLower(accessPolicyRID.Name)
+	}
+	return l.getPolicy(ctx, key, func() (*policy.AccessPolicy, error) {
+		ap, err := client.GetAccessPolicy(ctx, accessPolicyRID)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return ap, nil
+	})
+}
+
+// AccessorBudget returns the caller's remaining execution budget for an accessor's access policy
+func (l *Limiter) AccessorBudget(ctx context.Context, client *idp.Client, accessorID uuid.UUID) (*Budget, error) {
+	ap, err := l.accessorPolicy(ctx, client, accessorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	budget, err := l.Remaining(ctx, *ap)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return budget, nil
+}
+
+// release gives back a reservation if a request failed for a reason other than the server's own
+// threshold, since the execution then wasn't counted by the server either
+func release(ctx context.Context, r *Reservation, requestErr error) {
+	if jsonclient.GetHTTPStatusCode(requestErr) == http.StatusTooManyRequests {
+		return
+	}
+	if err := r.Release(ctx); err != nil {
+		uclog.Warningf(ctx, "failed to release access policy execution slot: %v", err)
+	}
+}
+
+// ExecuteAccessor reserves an execution slot for an accessor's access policy, then executes the accessor
+func (l *Limiter) ExecuteAccessor(ctx context.Context, client *idp.Client, accessorID uuid.UUID, clientContext policy.ClientContext, selectorValues userstore.UserSelectorValues, opts ...idp.Option) (*idp.ExecuteAccessorResponse, error) {
+	ap, err := l.accessorPolicy(ctx, client, accessorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	r, err := l.Reserve(ctx, *ap, 0)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	resp, err := client.ExecuteAccessor(ctx, accessorID, clientContext, selectorValues, opts...)
+	if err != nil {
+		release(ctx, r, err)
+		return nil, ucerr.Wrap(err)
+	}
+	return resp, nil
+}
+
+// ResolveTokens reserves an execution slot for the access policy of a set of tokens, checking the
+// number of tokens against the policy's MaxResultsPerExecution, then resolves the tokens
+func (l *Limiter) ResolveTokens(ctx context.Context, client *idp.TokenizerClient, accessPolicyRID userstore.ResourceID, tokens []string, resolutionContext policy.ClientContext, purposes []userstore.ResourceID) ([]string, error) {
+	ap, err := l.accessPolicy(ctx, client, accessPolicyRID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	r, err := l.Reserve(ctx, *ap, len(tokens))
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	resolved, err := client.ResolveTokens(ctx, tokens, resolutionContext, purposes)
+	if err != nil {
+		release(ctx, r, err)
+		return nil, ucerr.Wrap(err)
+	}
+	return resolved, nil
+}
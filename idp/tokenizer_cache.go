@@ -0,0 +1,362 @@
+package idp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/cache"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+// tokenInfoTTL is how long the access policy and transformer of a token are cached. They never
+// change for a given token, but are dropped when the token, policy or transformer is changed
+// through the client.
+const tokenInfoTTL = time.Hour
+
+// ResolvedTokenCachePolicy describes how tokens protected by an access policy may be cached by
+// the client. Only cache tokens of policies whose decision depends on nothing but the purposes
+// and the listed client context keys, e.g. a policy that checks a role passed in the client
+// context. Policies are NOT safe to cache if they depend on the time, the caller's IP address or
+// claims, the token's creation time, or state outside the request such as authz edges
+// (CheckAttribute) or secrets, since a cached result won't reflect changes to those. Policies with
+// execution or result thresholds are never cached, since cached resolutions aren't counted.
+type ResolvedTokenCachePolicy struct {
+	AccessPolicyID uuid.UUID
+
+	// TTL bounds how long a resolved token is cached, and should be no longer than it's
+	// acceptable for a revoked permission to keep being honored
+	TTL time.Duration
+
+	// ContextKeys are the client context keys the policy reads. Only these are part of the cache
+	// key, so that unrelated context doesn't prevent cache hits. If empty, the whole client
+	// context is part of the cache key.
+	ContextKeys []string
+}
+
+// ResolvedTokenCache returns an Option that makes the client cache resolved tokens in a cache
+// provider, for tokens protected by the specified access policies. Every key the client uses starts
+// with keyPrefix, which must match the provider's key prefix. The cache is off by default.
+//
+// Cached values are keyed by token, purposes and a hash of the policy's client context keys, and are
+// invalidated when the token is deleted, any access policy or access policy template, or its
+// transformer is updated or deleted through a client sharing the cache. Changes made any other way
+// are only picked up once the TTL expires. The first time a token is resolved, it's also inspected
+// to find its access policy.
+func ResolvedTokenCache(cp cache.Provider, keyPrefix string, policies ...ResolvedTokenCachePolicy) Option {
+	return optFunc(func(opts *options) {
+		opts.resolvedTokenCache = &resolvedTokenCache{
+			provider: cp,
+			prefix:   keyPrefix,
+			policies: policies,
+		}
+	})
+}
+
+// resolvedTokenCache caches the results of ResolveTokens
+type resolvedTokenCache struct {
+	provider cache.Provider
+	prefix   string
+	policies []ResolvedTokenCachePolicy
+}
+
+// tokenInfo is what the cache remembers about a token between resolutions. It's shared by every
+// client using the cache, so it only records facts about the token, and each client decides
+// whether to cache the token's resolutions from its own policies.
+type tokenInfo struct {
+	AccessPolicyID uuid.UUID `json:"access_policy_id"`
+	TransformerID  uuid.UUID `json:"transformer_id"`
+	NoThresholds   bool      `json:"no_thresholds"`
+}
+
+func (rc *resolvedTokenCache) validate() error {
+	if rc.provider == nil {
+		return ucerr.New("a cache provider must be specified for the resolved token cache")
+	}
+	for _, p := range rc.policies {
+		if p.AccessPolicyID.IsNil() {
+			return ucerr.New("resolved token cache policies must specify an access policy ID")
+		}
+		if p.TTL <= 0 {
+			return ucerr.Errorf("resolved token cache TTL for access policy %v must be positive", p.AccessPolicyID)
+		}
+	}
+	return nil
+}
+
+func (rc *resolvedTokenCache) policy(accessPolicyID uuid.UUID) (ResolvedTokenCachePolicy, bool) {
+	for _, p := range rc.policies {
+		if p.AccessPolicyID == accessPolicyID {
+			return p, true
+		}
+	}
+	return ResolvedTokenCachePolicy{}, false
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (rc *resolvedTokenCache) key(parts ...string) cache.Key {
+	return cache.Key(rc.prefix + "_" + strings.Join(parts, "_"))
+}
+
+func (rc *resolvedTokenCache) infoKey(token string) cache.Key {
+	return rc.key("RTI", hashString(token))
+}
+
+func (rc *resolvedTokenCache) tokenDependencyKey(token string) cache.Key {
+	return rc.key("RTD", "T", hashString(token))
+}
+
+func (rc *resolvedTokenCache) policyDependencyKey(accessPolicyID uuid.UUID) cache.Key {
+	return rc.key("RTD", "P", accessPolicyID.String())
+}
+
+func (rc *resolvedTokenCache) transformerDependencyKey(transformerID uuid.UUID) cache.Key {
+	return rc.key("RTD", "X", transformerID.String())
+}
+
+// allDependencyKey is a dependency of every cached value, for changes that may affect any policy
+func (rc *resolvedTokenCache) allDependencyKey() cache.Key {
+	return rc.key("RTD", "ALL")
+}
+
+// valueKey returns the key of a resolved token, which covers the purposes and the parts of the
+// client context the token's access policy reads
+func (rc *resolvedTokenCache) valueKey(token string, p ResolvedTokenCachePolicy, resolutionContext policy.ClientContext, purposes []userstore.ResourceID) (cache.Key, error) {
+	relevant := resolutionContext
+	if len(p.ContextKeys) > 0 {
+		relevant = policy.ClientContext{}
+		for _, k := range p.ContextKeys {
+			if v, found := resolutionContext[k]; found {
+				relevant[k] = v
+			}
+		}
+	}
+	// maps are marshaled with sorted keys, so equal contexts hash equally
+	contextJSON, err := json.Marshal(relevant)
+	if err != nil {
+		return "", ucerr.Wrap(err)
+	}
+
+	purposeKeys := make([]string, 0, len(purposes))
+	for _, rid := range purposes {
+		if !rid.ID.IsNil() {
+			purposeKeys = append(purposeKeys, rid.ID.String())
+		} else {
+			purposeKeys = append(purposeKeys, strings.ToLower(rid.Name))
+		}
+	}
+	sort.Strings(purposeKeys)
+
+	return rc.key("RT", hashString(token+"\x00"+strings.Join(purposeKeys, ",")+"\x00"+string(contextJSON))), nil
+}
+
+// set stores a value that was read with a sentinel, making it depend on dependencyKeys first so that
+// an invalidation racing with the store wins
+func (rc *resolvedTokenCache) set(ctx context.Context, key cache.Key, value string, sentinel cache.Sentinel, ttl time.Duration, dependencyKeys []cache.Key) {
+	if sentinel == cache.NoLockSentinel {
+		return
+	}
+	if err := rc.provider.AddDependency(ctx, dependencyKeys, []cache.Key{key}, ttl); err != nil {
+		// a dependency was just invalidated, so the value may already be stale
+		uclog.Verbosef(ctx, "not caching %v: %v", key, err)
+		rc.provider.ReleaseSentinel(ctx, []cache.Key{key}, sentinel)
+		return
+	}
+	if _, _, err := rc.provider.SetValue(ctx, key, []cache.Key{key}, value, sentinel, ttl); err != nil {
+		uclog.Warningf(ctx, "failed to cache %v: %v", key, err)
+	}
+}
+
+// tokenInfos returns what's known about each token, inspecting tokens that haven't been seen before.
+// Tokens that can't be inspected get a zero tokenInfo, which is never cacheable.
+func (rc *resolvedTokenCache) tokenInfos(ctx context.Context, c *TokenizerClient, tokens []string) ([]tokenInfo, error) {
+	keys := make([]cache.Key, len(tokens))
+	lockOnMiss := make([]bool, len(tokens))
+	for i, token := range tokens {
+		keys[i] = rc.infoKey(token)
+		lockOnMiss[i] = true
+	}
+
+	values, _, sentinels, err := rc.provider.GetValues(ctx, keys, lockOnMiss)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	infos := make([]tokenInfo, len(tokens))
+	for i, token := range tokens {
+		if values[i] != nil {
+			if err := json.Unmarshal([]byte(*values[i]), &infos[i]); err == nil {
+				continue
+			}
+		}
+
+		resp, err := c.InspectToken(ctx, token)
+		if err != nil {
+			uclog.Verbosef(ctx, "not caching token that couldn't be inspected: %v", err)
+			rc.provider.ReleaseSentinel(ctx, []cache.Key{keys[i]}, sentinels[i])
+			continue
+		}
+
+		t := resp.AccessPolicy.Thresholds
+		infos[i] = tokenInfo{
+			AccessPolicyID: resp.AccessPolicy.ID,
+			TransformerID:  resp.Transformer.ID,
+			NoThresholds:   t.MaxExecutions == 0 && t.MaxResultsPerExecution == 0,
+		}
+
+		b, err := json.Marshal(infos[i])
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		rc.set(ctx, keys[i], string(b), sentinels[i], tokenInfoTTL, []cache.Key{
+			rc.tokenDependencyKey(token),
+			rc.policyDependencyKey(infos[i].AccessPolicyID),
+		})
+	}
+
+	return infos, nil
+}
+
+// resolveTokens resolves tokens, using cached values where possible and caching newly resolved
+// values for tokens whose access policies allow it
+func (rc *resolvedTokenCache) resolveTokens(ctx context.Context, c *TokenizerClient, tokens []string, resolutionContext policy.ClientContext, purposes []userstore.ResourceID) ([]string, error) {
+	infos, err := rc.tokenInfos(ctx, c, tokens)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	// look up the tokens that can be cached, which are those with no thresholds whose policy this
+	// client is configured to cache
+	var cachedIndexes []int
+	var keys []cache.Key
+	policies := map[int]ResolvedTokenCachePolicy{}
+	for i, info := range infos {
+		p, configured := rc.policy(info.AccessPolicyID)
+		if !configured || !info.NoThresholds {
+			continue
+		}
+		policies[i] = p
+		key, err := rc.valueKey(tokens[i], p, resolutionContext, purposes)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		cachedIndexes = append(cachedIndexes, i)
+		keys = append(keys, key)
+	}
+
+	results := make([]string, len(tokens))
+	hit := make([]bool, len(tokens))
+	sentinels := map[int]cache.Sentinel{}
+	valueKeys := map[int]cache.Key{}
+	if len(keys) > 0 {
+		lockOnMiss := make([]bool, len(keys))
+		for i := range lockOnMiss {
+			lockOnMiss[i] = true
+		}
+		values, _, s, err := rc.provider.GetValues(ctx, keys, lockOnMiss)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		for j, i := range cachedIndexes {
+			if values[j] != nil {
+				results[i] = *values[j]
+				hit[i] = true
+			} else {
+				sentinels[i] = s[j]
+				valueKeys[i] = keys[j]
+			}
+		}
+	}
+
+	// resolve everything that wasn't cached in a single request
+	var missIndexes []int
+	var missTokens []string
+	for i, token := range tokens {
+		if !hit[i] {
+			missIndexes = append(missIndexes, i)
+			missTokens = append(missTokens, token)
+		}
+	}
+	if len(missTokens) == 0 {
+		return results, nil
+	}
+
+	resolved, err := c.resolveTokens(ctx, missTokens, resolutionContext, purposes)
+	if err != nil {
+		for i, s := range sentinels {
+			rc.provider.ReleaseSentinel(ctx, []cache.Key{valueKeys[i]}, s)
+		}
+		return nil, ucerr.Wrap(err)
+	}
+
+	for j, i := range missIndexes {
+		results[i] = resolved[j]
+
+		s, locked := sentinels[i]
+		if !locked {
+			continue
+		}
+		// an empty result means access was denied, which isn't cached so that a grant takes effect immediately
+		if resolved[j] == "" {
+			rc.provider.ReleaseSentinel(ctx, []cache.Key{valueKeys[i]}, s)
+			continue
+		}
+		rc.set(ctx, valueKeys[i], resolved[j], s, policies[i].TTL, []cache.Key{
+			rc.tokenDependencyKey(tokens[i]),
+			rc.policyDependencyKey(infos[i].AccessPolicyID),
+			rc.transformerDependencyKey(infos[i].TransformerID),
+			rc.allDependencyKey(),
+		})
+	}
+
+	return results, nil
+}
+
+// invalidate drops every cached value that depends on a key. Failures are logged rather than
+// returned, since the change that prompted the invalidation has already been made.
+func (rc *resolvedTokenCache) invalidate(ctx context.Context, dependencyKey cache.Key) {
+	if err := rc.provider.ClearDependencies(ctx, dependencyKey, true); err != nil {
+		uclog.Errorf(ctx, "failed to invalidate resolved token cache key %v: %v", dependencyKey, err)
+	}
+}
+
+func (rc *resolvedTokenCache) invalidateToken(ctx context.Context, token string) {
+	if rc != nil {
+		rc.invalidate(ctx, rc.tokenDependencyKey(token))
+	}
+}
+
+// invalidateAccessPolicy drops the token infos of tokens protected by the policy, whose thresholds
+// may have changed, and every cached value, since the policy may be a component of the composite
+// policies of other tokens
+func (rc *resolvedTokenCache) invalidateAccessPolicy(ctx context.Context, accessPolicyID uuid.UUID) {
+	if rc != nil {
+		rc.invalidate(ctx, rc.policyDependencyKey(accessPolicyID))
+		rc.invalidate(ctx, rc.allDependencyKey())
+	}
+}
+
+func (rc *resolvedTokenCache) invalidateTransformer(ctx context.Context, transformerID uuid.UUID) {
+	if rc != nil {
+		rc.invalidate(ctx, rc.transformerDependencyKey(transformerID))
+	}
+}
+
+func (rc *resolvedTokenCache) invalidateAll(ctx context.Context) {
+	if rc != nil {
+		rc.invalidate(ctx, rc.allDependencyKey())
+	}
+}
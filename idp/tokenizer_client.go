@@ -21,6 +21,10 @@ import (
 type TokenizerClient struct {
 	client  *sdkclient.Client
 	options options
+
+	// resolvedTokenCacheErr is why the ResolvedTokenCache option is invalid, if it is, which
+	// ResolveTokens returns since NewTokenizerClient can't
+	resolvedTokenCacheErr error
 }
 
 // NewTokenizerClient creates a new tokenizer client
@@ -30,7 +34,15 @@ func NewTokenizerClient(url string, opts ...Option) *TokenizerClient {
 		opt.apply(&options)
 	}
 
-	return &TokenizerClient{client: sdkclient.New(url, "tokenizer", options.jsonclientOptions...), options: options}
+	return newTokenizerClient(sdkclient.New(url, "tokenizer", options.jsonclientOptions...), options)
+}
+
+func newTokenizerClient(client *sdkclient.Client, options options) *TokenizerClient {
+	tc := &TokenizerClient{client: client, options: options}
+	if rc := options.resolvedTokenCache; rc != nil {
+		tc.resolvedTokenCacheErr = rc.validate()
+	}
+	return tc
 }
 
 // CreateToken creates a token
@@ -62,7 +74,8 @@ func (c *TokenizerClient) ResolveToken(ctx context.Context, token string, resolu
 	return res[0], nil
 }
 
-// ResolveTokens resolves tokens
+// ResolveTokens resolves tokens, using the resolved token cache if the client was created with
+// the ResolvedTokenCache option
 func (c *TokenizerClient) ResolveTokens(ctx context.Context, tokens []string, resolutionContext policy.ClientContext, purposes []userstore.ResourceID) ([]string, error) {
 	req := tokenizer.ResolveTokensRequest{
 		Tokens:   tokens,
@@ -73,6 +86,32 @@ func (c *TokenizerClient) ResolveTokens(ctx context.Context, tokens []string, re
 		return nil, ucerr.Wrap(err)
 	}
 
+	if rc := c.options.resolvedTokenCache; rc != nil {
+		if c.resolvedTokenCacheErr != nil {
+			return nil, ucerr.Wrap(c.resolvedTokenCacheErr)
+		}
+		v, err := rc.resolveTokens(ctx, c, tokens, resolutionContext, purposes)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return v, nil
+	}
+
+	v, err := c.resolveTokens(ctx, tokens, resolutionContext, purposes)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return v, nil
+}
+
+// resolveTokens resolves tokens with the server
+func (c *TokenizerClient) resolveTokens(ctx context.Context, tokens []string, resolutionContext policy.ClientContext, purposes []userstore.ResourceID) ([]string, error) {
+	req := tokenizer.ResolveTokensRequest{
+		Tokens:   tokens,
+		Context:  resolutionContext,
+		Purposes: purposes,
+	}
+
 	var res []tokenizer.ResolveTokenResponse
 	if err := c.client.Post(ctx, paths.ResolveToken, req, &res); err != nil {
 		return nil, ucerr.Wrap(err)
@@ -158,6 +197,7 @@ func (c *TokenizerClient) DeleteToken(ctx context.Context, token string) error {
 	if err := c.client.Delete(ctx, requestURL.String(), nil); err != nil {
 		return ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateToken(ctx, token)
 
 	return nil
 }
@@ -339,6 +379,7 @@ func (c *TokenizerClient) UpdateAccessPolicy(ctx context.Context, ap policy.Acce
 	if err := c.client.Put(ctx, paths.UpdateAccessPolicy(ap.ID), req, &resp); err != nil {
 		return nil, ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateAccessPolicy(ctx, ap.ID)
 
 	return &resp, nil
 }
@@ -349,6 +390,7 @@ func (c *TokenizerClient) DeleteAccessPolicy(ctx context.Context, id uuid.UUID,
 	if err := c.client.Delete(ctx, paths.DeleteAccessPolicy(id, version), nil); err != nil {
 		return ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateAccessPolicy(ctx, id)
 
 	return nil
 }
@@ -477,6 +519,8 @@ func (c *TokenizerClient) UpdateAccessPolicyTemplate(ctx context.Context, apt po
 	if err := c.client.Put(ctx, paths.UpdateAccessPolicyTemplate(apt.ID), req, &resp); err != nil {
 		return nil, ucerr.Wrap(err)
 	}
+	// templates can be shared by any policy, so every cached resolution is dropped
+	c.options.resolvedTokenCache.invalidateAll(ctx)
 
 	return &resp, nil
 }
@@ -486,6 +530,7 @@ func (c *TokenizerClient) DeleteAccessPolicyTemplate(ctx context.Context, id uui
 	if err := c.client.Delete(ctx, paths.DeleteAccessPolicyTemplate(id, version), nil); err != nil {
 		return ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateAll(ctx)
 
 	return nil
 }
@@ -521,7 +566,7 @@ func (c *TokenizerClient) ListTransformers(ctx context.Context, opts ...Option)
 	return &res, nil
 }
 
-// CreateTransformer creates a transformer
+// CreateTransformer creates a transformer, after validating its parameters against its schema if it has one
 func (c *TokenizerClient) CreateTransformer(ctx context.Context, tp policy.Transformer, opts ...Option) (*policy.Transformer, error) {
 
 	var options options
@@ -529,6 +574,10 @@ func (c *TokenizerClient) CreateTransformer(ctx context.Context, tp policy.Trans
 		opt.apply(&options)
 	}
 
+	if err := c.validateTransformerParameters(tp, opts...); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
 	req := tokenizer.CreateTransformerRequest{
 		Transformer: tp,
 	}
@@ -600,8 +649,12 @@ func (c *TokenizerClient) GetTransformerByVersion(ctx context.Context, transform
 	return &res, nil
 }
 
-// UpdateTransformer updates a transformer
-func (c *TokenizerClient) UpdateTransformer(ctx context.Context, tf policy.Transformer) (*policy.Transformer, error) {
+// UpdateTransformer updates a transformer, after validating its parameters against its schema if it has one
+func (c *TokenizerClient) UpdateTransformer(ctx context.Context, tf policy.Transformer, opts ...Option) (*policy.Transformer, error) {
+	if err := c.validateTransformerParameters(tf, opts...); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
 	req := tokenizer.UpdateTransformerRequest{
 		Transformer: tf,
 	}
@@ -610,6 +663,7 @@ func (c *TokenizerClient) UpdateTransformer(ctx context.Context, tf policy.Trans
 	if err := c.client.Put(ctx, paths.UpdateTransformer(tf.ID), req, &resp); err != nil {
 		return nil, ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateTransformer(ctx, tf.ID)
 
 	return &resp, nil
 }
@@ -619,6 +673,7 @@ func (c *TokenizerClient) DeleteTransformer(ctx context.Context, id uuid.UUID) e
 	if err := c.client.Delete(ctx, paths.DeleteTransformer(id), nil); err != nil {
 		return ucerr.Wrap(err)
 	}
+	c.options.resolvedTokenCache.invalidateTransformer(ctx, id)
 
 	return nil
 }
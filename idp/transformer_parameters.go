@@ -0,0 +1,66 @@
+package idp
+
+import (
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// transformerParameterSchema attaches a parameter schema to a custom transformer
+type transformerParameterSchema struct {
+	transformer userstore.ResourceID
+	schema      policy.TransformerParameterSchema
+}
+
+// TransformerParameterSchema returns an Option that attaches a parameter schema to a custom
+// transformer, identified by ID or name, so that CreateTransformer and UpdateTransformer validate
+// its Parameters before sending it to the server. The schemas of the system transformers are
+// always known and don't need to be attached.
+func TransformerParameterSchema(transformerRID userstore.ResourceID, schema policy.TransformerParameterSchema) Option {
+	return optFunc(func(opts *options) {
+		opts.transformerParameterSchemas = append(opts.transformerParameterSchemas, transformerParameterSchema{transformer: transformerRID, schema: schema})
+	})
+}
+
+// findTransformerParameterSchema returns the last schema in schemas attached to tf
+func findTransformerParameterSchema(schemas []transformerParameterSchema, tf policy.Transformer) (policy.TransformerParameterSchema, bool) {
+	for i := len(schemas) - 1; i >= 0; i-- {
+		rid := schemas[i].transformer
+		if (rid.ID != uuid.Nil && rid.ID == tf.ID) || (rid.Name != "" && strings.EqualFold(rid.Name, tf.Name)) {
+			return schemas[i].schema, true
+		}
+	}
+	return policy.TransformerParameterSchema{}, false
+}
+
+// TransformerParameterSchemaFor returns the parameter schema of a transformer: the schema attached
+// with the TransformerParameterSchema option, if any, or else the schema of a system transformer.
+// It returns false if the transformer's parameters aren't known, e.g. for tooling that renders a
+// form for them and should fall back to a free-form JSON editor.
+func (c *TokenizerClient) TransformerParameterSchemaFor(tf policy.Transformer, opts ...Option) (policy.TransformerParameterSchema, bool) {
+	var options options
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if schema, found := findTransformerParameterSchema(options.transformerParameterSchemas, tf); found {
+		return schema, true
+	}
+	if schema, found := findTransformerParameterSchema(c.options.transformerParameterSchemas, tf); found {
+		return schema, true
+	}
+	return tf.SystemParameterSchema()
+}
+
+// validateTransformerParameters checks the parameters of a transformer against its schema, if it has one
+func (c *TokenizerClient) validateTransformerParameters(tf policy.Transformer, opts ...Option) error {
+	schema, found := c.TransformerParameterSchemaFor(tf, opts...)
+	if !found {
+		return nil
+	}
+	return ucerr.Wrap(tf.ValidateParameters(schema))
+}
@@ -0,0 +1,73 @@
+package idp
+
+import (
+	"context"
+	"unicode"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// TransformerParityResult compares the local and server results of a transformer for one input
+type TransformerParityResult struct {
+	Data   string `json:"data"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Match  bool   `json:"match"`
+}
+
+// transformShape returns a string with every letter and digit replaced by '#', so that tokenized
+// values, which are random, can be compared by their format
+func transformShape(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes[i] = '#'
+		}
+	}
+	return string(runes)
+}
+
+// CheckTransformerParity runs a transformer both locally, with policy.Transformer.ApplyLocal, and
+// on the server, with TestTransformer, and compares the results for each input. Results of
+// tokenizing transformers are random, so they match if they have the same format; other results
+// must be identical. If the transformer has no function, it's read from the server first, so
+// system transformer constants like policy.TransformerSSN can be passed directly.
+func (c *TokenizerClient) CheckTransformerParity(ctx context.Context, transformer policy.Transformer, data []string) ([]TransformerParityResult, error) {
+	if !transformer.HasLocalImplementation() {
+		return nil, ucerr.Friendlyf(nil, "transformer '%s' (%v) has no local implementation", transformer.Name, transformer.ID)
+	}
+
+	if transformer.Function == "" {
+		t, err := c.GetTransformer(ctx, userstore.ResourceID{ID: transformer.ID})
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		transformer = *t
+	}
+
+	tokenizing := transformer.TransformType == policy.TransformTypeTokenizeByValue ||
+		transformer.TransformType == policy.TransformTypeTokenizeByReference
+
+	results := make([]TransformerParityResult, 0, len(data))
+	for _, d := range data {
+		local, err := transformer.ApplyLocal(d, "")
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+
+		resp, err := c.TestTransformer(ctx, d, transformer)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+
+		match := local == resp.Value
+		if tokenizing {
+			match = transformShape(local) == transformShape(resp.Value)
+		}
+		results = append(results, TransformerParityResult{Data: d, Local: local, Remote: resp.Value, Match: match})
+	}
+
+	return results, nil
+}
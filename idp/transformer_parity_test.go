@@ -0,0 +1,70 @@
+package idp_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/tokenizer"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/assert"
+	"userclouds.com/infra/jsonclient"
+)
+
+func TestCheckTransformerParity(t *testing.T) {
+	ctx := context.Background()
+	remote := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != paths.TestTransformer {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		assert.NoErr(t, json.NewEncoder(w).Encode(tokenizer.TestTransformerResponse{Value: remote}))
+	}))
+	defer server.Close()
+	client := idp.NewTokenizerClient(server.URL, idp.JSONClient(jsonclient.HeaderAuth("AccessToken test")))
+
+	ssn := policy.TransformerSSN
+	ssn.Name = "SSNToID"
+	ssn.InputDataType = datatype.SSN
+	ssn.OutputDataType = datatype.SSN
+	ssn.Function = "function transform(data, params) {}"
+
+	remote = "***-**-6789"
+	results, err := client.CheckTransformerParity(ctx, ssn, []string{"123-45-6789"})
+	assert.NoErr(t, err)
+	assert.True(t, results[0].Match)
+
+	remote = "***-**-****"
+	results, err = client.CheckTransformerParity(ctx, ssn, []string{"123-45-6789"})
+	assert.NoErr(t, err)
+	assert.False(t, results[0].Match)
+
+	// tokenizing transformers match if their results have the same shape
+	email := policy.TransformerEmail
+	email.Name = "EmailToID"
+	email.InputDataType = datatype.Email
+	email.OutputDataType = datatype.Email
+	email.Function = "function transform(data, params) {}"
+
+	remote = "abcdefghijkl@example.com"
+	results, err = client.CheckTransformerParity(ctx, email, []string{"johnsmith@example.com"})
+	assert.NoErr(t, err)
+	assert.True(t, results[0].Match)
+
+	remote = "abc@example.com"
+	results, err = client.CheckTransformerParity(ctx, email, []string{"johnsmith@example.com"})
+	assert.NoErr(t, err)
+	assert.False(t, results[0].Match)
+
+	// transformers without a local implementation can't be checked
+	custom := policy.Transformer{Name: "Custom", TransformType: policy.TransformTypeTransform}
+	_, err = client.CheckTransformerParity(ctx, custom, []string{"data"})
+	assert.NotNil(t, err)
+}
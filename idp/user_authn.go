@@ -0,0 +1,101 @@
+package idp
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/paths"
+	"userclouds.com/infra/oidc"
+	"userclouds.com/infra/ucerr"
+)
+
+// validateUserAuthn checks that an authentication factor specifies everything needed to add it
+func validateUserAuthn(authn UserAuthn) error {
+	if err := authn.AuthnType.Validate(); err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	switch authn.AuthnType {
+	case AuthnTypePassword:
+		if authn.Username == "" {
+			return ucerr.Friendlyf(nil, "a username must be specified for a password authn")
+		}
+		if authn.OIDCSubject != "" || authn.OIDCIssuerURL != "" {
+			return ucerr.Friendlyf(nil, "OIDC fields can't be specified for a password authn")
+		}
+	case AuthnTypeOIDC:
+		if authn.OIDCProvider == oidc.ProviderTypeNone || authn.OIDCProvider == oidc.ProviderTypeUnsupported {
+			return ucerr.Friendlyf(nil, "an OIDC provider must be specified for a social authn")
+		}
+		if authn.OIDCProvider == oidc.ProviderTypeCustom && authn.OIDCIssuerURL == "" {
+			return ucerr.Friendlyf(nil, "an issuer URL must be specified for a custom OIDC provider")
+		}
+		if authn.OIDCSubject == "" {
+			return ucerr.Friendlyf(nil, "an OIDC subject must be specified for a social authn")
+		}
+		if authn.Username != "" || authn.Password != "" {
+			return ucerr.Friendlyf(nil, "a username and password can't be specified for a social authn")
+		}
+	default:
+		return ucerr.Friendlyf(nil, "authn type '%s' can't be added to a user", authn.AuthnType)
+	}
+
+	return nil
+}
+
+// AddAuthnToUserRequest is the request body for adding an authentication factor to a user
+type AddAuthnToUserRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+	UserAuthn
+}
+
+// AddAuthnToUser adds an authentication factor to a user
+func (c *Client) AddAuthnToUser(ctx context.Context, userID uuid.UUID, authn UserAuthn) (*UserResponse, error) {
+	if err := validateUserAuthn(authn); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if authn.AuthnType == AuthnTypePassword && authn.Password == "" {
+		return nil, ucerr.Friendlyf(nil, "a password must be specified to add a password authn")
+	}
+
+	req := AddAuthnToUserRequest{
+		UserID:    userID,
+		UserAuthn: authn,
+	}
+
+	var resp UserResponse
+	if err := c.client.Post(ctx, paths.AddAuthnToUser, req, &resp); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return &resp, nil
+}
+
+// AddPasswordAuthnToUser adds a username and password authentication factor to a user
+func (c *Client) AddPasswordAuthnToUser(ctx context.Context, userID uuid.UUID, username string, password string) (*UserResponse, error) {
+	resp, err := c.AddAuthnToUser(ctx, userID, UserAuthn{
+		AuthnType: AuthnTypePassword,
+		Username:  username,
+		Password:  password,
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return resp, nil
+}
+
+// LinkOIDCIdentityToUser links a social or custom OIDC provider identity to a user, so that the
+// user can sign in with it
+func (c *Client) LinkOIDCIdentityToUser(ctx context.Context, userID uuid.UUID, provider oidc.ProviderType, issuerURL string, subject string) (*UserResponse, error) {
+	resp, err := c.AddAuthnToUser(ctx, userID, UserAuthn{
+		AuthnType:     AuthnTypeOIDC,
+		OIDCProvider:  provider,
+		OIDCIssuerURL: issuerURL,
+		OIDCSubject:   subject,
+	})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,102 @@
+package userimport
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// checkpoint records the highest row number for which every row at or before it has been processed,
+// along with the rows after it that have also been processed
+type checkpoint struct {
+	CompletedRow   int   `json:"completed_row"`
+	CompletedAfter []int `json:"completed_after,omitempty"`
+}
+
+func loadCheckpoint(path string) (*progress, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newProgress(0), nil
+	}
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, ucerr.Errorf("could not parse checkpoint file %s: %v", path, err)
+	}
+	prog := newProgress(cp.CompletedRow)
+	for _, row := range cp.CompletedAfter {
+		prog.complete(row)
+	}
+	return prog, nil
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file and renames it into place,
+// so that an interrupted import never leaves a partially written checkpoint behind
+func saveCheckpoint(path string, cp checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return ucerr.Wrap(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return ucerr.Wrap(err)
+	}
+
+	return ucerr.Wrap(os.Rename(tmp.Name(), path))
+}
+
+// progress tracks completed rows, which may finish out of order, and computes the
+// low-water mark below which every row has been processed
+type progress struct {
+	completedRow int
+	pending      map[int]bool
+}
+
+func newProgress(completedRow int) *progress {
+	return &progress{completedRow: completedRow, pending: map[int]bool{}}
+}
+
+// complete marks the row as done, advancing the low-water mark if possible
+func (p *progress) complete(row int) {
+	if row <= p.completedRow {
+		return
+	}
+	p.pending[row] = true
+
+	for p.pending[p.completedRow+1] {
+		delete(p.pending, p.completedRow+1)
+		p.completedRow++
+	}
+}
+
+// isComplete returns true if the row has been processed
+func (p *progress) isComplete(row int) bool {
+	return row <= p.completedRow || p.pending[row]
+}
+
+func (p *progress) checkpoint() checkpoint {
+	cp := checkpoint{CompletedRow: p.completedRow}
+	for row := range p.pending {
+		cp.CompletedAfter = append(cp.CompletedAfter, row)
+	}
+	sort.Ints(cp.CompletedAfter)
+	return cp
+}
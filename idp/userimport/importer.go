@@ -0,0 +1,579 @@
+package userimport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/namespace/region"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/infra/uclog"
+)
+
+const (
+	defaultConcurrency = 4
+	defaultMaxRetries  = 3
+	initialBackoff     = 500 * time.Millisecond
+	maxBackoff         = 30 * time.Second
+
+	// the checkpoint file is saved once either this many rows or this much time has passed since
+	// it was last saved, and again when the import ends
+	checkpointRows     = 100
+	checkpointInterval = 5 * time.Second
+)
+
+// ColumnMapping maps a field in the import file to one of the mutator's columns
+type ColumnMapping struct {
+	Field  string               `json:"field"`
+	Column userstore.ResourceID `json:"column"`
+
+	// Purposes are added for the imported value; if empty, the importer's default purposes are used
+	Purposes []userstore.ResourceID `json:"purposes"`
+}
+
+// Result describes the outcome of importing a single row
+type Result struct {
+	Row      int       `json:"row"`
+	UserID   uuid.UUID `json:"user_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Attempts int       `json:"attempts"`
+}
+
+// Summary describes the outcome of an import
+type Summary struct {
+	Succeeded    int `json:"succeeded"`
+	Failed       int `json:"failed"`
+	Skipped      int `json:"skipped"`
+	CompletedRow int `json:"completed_row"`
+}
+
+type options struct {
+	concurrency       int
+	maxRetries        int
+	requestsPerSecond float64
+	clientContext     policy.ClientContext
+	purposes          []userstore.ResourceID
+	selectorFields    []string
+	userIDField       string
+	organizationID    uuid.UUID
+	dataRegion        region.DataRegion
+	results           io.Writer
+	checkpointPath    string
+}
+
+// Option makes Importer extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// Concurrency returns an Option that sets the maximum number of rows imported in parallel
+func Concurrency(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.concurrency = n
+	})
+}
+
+// MaxRetries returns an Option that sets how many times a row is retried after a rate limit or server error.
+// Creating a user is only retried after a server error if its ID comes from UserIDField, since the
+// server may have created the user before failing.
+func MaxRetries(n int) Option {
+	return optFunc(func(opts *options) {
+		opts.maxRetries = n
+	})
+}
+
+// RateLimit returns an Option that caps the number of mutator requests issued per second
+func RateLimit(requestsPerSecond float64) Option {
+	return optFunc(func(opts *options) {
+		opts.requestsPerSecond = requestsPerSecond
+	})
+}
+
+// ClientContext returns an Option that sets the client context passed to the mutator's access policy
+func ClientContext(clientContext policy.ClientContext) Option {
+	return optFunc(func(opts *options) {
+		opts.clientContext = clientContext
+	})
+}
+
+// DefaultPurposes returns an Option that sets the purposes added for columns whose mapping doesn't specify any
+func DefaultPurposes(purposes ...userstore.ResourceID) Option {
+	return optFunc(func(opts *options) {
+		opts.purposes = append(opts.purposes, purposes...)
+	})
+}
+
+// UpdateExisting returns an Option that will cause the importer to update existing users with ExecuteMutator,
+// using the values of the specified fields (in order) as the mutator's selector values, rather than creating users
+func UpdateExisting(selectorFields ...string) Option {
+	return optFunc(func(opts *options) {
+		opts.selectorFields = append(opts.selectorFields, selectorFields...)
+	})
+}
+
+// UserIDField returns an Option that will cause created users to use the ID contained in the specified field
+func UserIDField(field string) Option {
+	return optFunc(func(opts *options) {
+		opts.userIDField = field
+	})
+}
+
+// OrganizationID returns an Option that will cause created users to be placed in the specified organization
+func OrganizationID(organizationID uuid.UUID) Option {
+	return optFunc(func(opts *options) {
+		opts.organizationID = organizationID
+	})
+}
+
+// DataRegion returns an Option that will cause created users to be stored in the specified region
+func DataRegion(dataRegion region.DataRegion) Option {
+	return optFunc(func(opts *options) {
+		opts.dataRegion = dataRegion
+	})
+}
+
+// Results returns an Option that will cause a JSON-encoded Result to be written to w for each row
+func Results(w io.Writer) Option {
+	return optFunc(func(opts *options) {
+		opts.results = w
+	})
+}
+
+// Checkpoint returns an Option that persists import progress to the specified file, and skips rows
+// that were already processed according to that file when the import is restarted. A row is
+// processed once it succeeds or fails permanently; rows that ran out of retries or were interrupted
+// by the context being cancelled are imported again.
+func Checkpoint(path string) Option {
+	return optFunc(func(opts *options) {
+		opts.checkpointPath = path
+	})
+}
+
+// Importer loads users from an import file into the userstore via a mutator
+type Importer struct {
+	client    *idp.Client
+	mutatorID uuid.UUID
+	mappings  []ColumnMapping
+	options   options
+
+	// populated by prepare
+	columnNames    []string
+	mappedColumns  map[string]ColumnMapping
+	unmappedColumn string
+}
+
+// NewImporter returns an Importer that maps file fields to the columns of the specified mutator
+func NewImporter(client *idp.Client, mutatorID uuid.UUID, mappings []ColumnMapping, opts ...Option) (*Importer, error) {
+	options := options{
+		concurrency: defaultConcurrency,
+		maxRetries:  defaultMaxRetries,
+	}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	if mutatorID.IsNil() {
+		return nil, ucerr.New("mutator ID must be specified")
+	}
+	if len(mappings) == 0 {
+		return nil, ucerr.New("at least one column mapping must be specified")
+	}
+	if options.concurrency < 1 {
+		return nil, ucerr.Errorf("concurrency must be at least 1 (got %d)", options.concurrency)
+	}
+	if options.maxRetries < 0 {
+		return nil, ucerr.Errorf("max retries can't be negative (got %d)", options.maxRetries)
+	}
+	for _, m := range mappings {
+		if m.Field == "" {
+			return nil, ucerr.New("each column mapping must specify a field")
+		}
+		if err := m.Column.Validate(); err != nil {
+			return nil, ucerr.Friendlyf(err, "column mapping for field '%s' must have a column ID or name", m.Field)
+		}
+	}
+
+	return &Importer{
+		client:    client,
+		mutatorID: mutatorID,
+		mappings:  mappings,
+		options:   options,
+	}, nil
+}
+
+// prepare loads the mutator and resolves each mapping to the name of one of its columns
+func (im *Importer) prepare(ctx context.Context) error {
+	mutator, err := im.client.GetMutator(ctx, im.mutatorID)
+	if err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	im.columnNames = nil
+	im.mappedColumns = map[string]ColumnMapping{}
+	for _, mc := range mutator.Columns {
+		name := mc.Column.Name
+		if name == "" {
+			column, err := im.client.GetColumn(ctx, mc.Column.ID)
+			if err != nil {
+				return ucerr.Wrap(err)
+			}
+			name = column.Name
+		}
+		resolved := userstore.ResourceID{ID: mc.Column.ID, Name: name}
+		im.columnNames = append(im.columnNames, name)
+
+		for _, m := range im.mappings {
+			if m.Column.EquivalentTo(resolved) {
+				if _, found := im.mappedColumns[name]; found {
+					return ucerr.Friendlyf(nil, "column '%s' is mapped more than once", name)
+				}
+				im.mappedColumns[name] = m
+			}
+		}
+	}
+
+	for _, m := range im.mappings {
+		found := false
+		for _, mapped := range im.mappedColumns {
+			if mapped.Field == m.Field && mapped.Column == m.Column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ucerr.Friendlyf(nil, "column %v mapped from field '%s' is not one of the columns of mutator %v", m.Column, m.Field, im.mutatorID)
+		}
+	}
+
+	return nil
+}
+
+// rowData builds the mutator row data for a row. Columns that aren't mapped or have no value
+// in the row are set to their default value when creating users, and left unchanged when
+// updating existing users.
+func (im *Importer) rowData(row *Row) map[string]idp.ValueAndPurposes {
+	placeholder := idp.MutatorColumnDefaultValue
+	if im.updating() {
+		placeholder = idp.MutatorColumnCurrentValue
+	}
+
+	rowData := make(map[string]idp.ValueAndPurposes, len(im.columnNames))
+	for _, name := range im.columnNames {
+		m, mapped := im.mappedColumns[name]
+		if !mapped || isEmpty(row.Fields[m.Field]) {
+			rowData[name] = idp.ValueAndPurposes{Value: placeholder}
+			continue
+		}
+
+		purposes := m.Purposes
+		if len(purposes) == 0 {
+			purposes = im.options.purposes
+		}
+		rowData[name] = idp.ValueAndPurposes{
+			Value:            row.Fields[m.Field],
+			PurposeAdditions: purposes,
+		}
+	}
+
+	return rowData
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if s, ok := value.(string); ok {
+		return strings.TrimSpace(s) == ""
+	}
+	return false
+}
+
+func (im *Importer) updating() bool {
+	return len(im.options.selectorFields) > 0
+}
+
+// importRow creates or updates the user for a single row, retrying on rate limit and server errors.
+// It returns false if the row should be imported again when the import is resumed, because it
+// failed with an error that may not recur.
+func (im *Importer) importRow(ctx context.Context, limiter *rateLimiter, row *Row) (Result, bool) {
+	res := Result{Row: row.Number}
+
+	var selectorValues userstore.UserSelectorValues
+	for _, field := range im.options.selectorFields {
+		value, found := row.Fields[field]
+		if !found || isEmpty(value) {
+			res.Error = fmt.Sprintf("row is missing selector field '%s'", field)
+			return res, true
+		}
+		selectorValues = append(selectorValues, value)
+	}
+
+	// updates are idempotent, but creates are only if the user ID is specified
+	idempotent := im.updating()
+	var createOpts []idp.Option
+	if !im.updating() {
+		if im.options.userIDField != "" {
+			if value, found := row.Fields[im.options.userIDField]; found && !isEmpty(value) {
+				userID, err := uuid.FromString(fmt.Sprintf("%v", value))
+				if err != nil {
+					res.Error = fmt.Sprintf("invalid user ID in field '%s': %v", im.options.userIDField, err)
+					return res, true
+				}
+				createOpts = append(createOpts, idp.UserID(userID))
+				idempotent = true
+			}
+		}
+		if !im.options.organizationID.IsNil() {
+			createOpts = append(createOpts, idp.OrganizationID(im.options.organizationID))
+		}
+		if im.options.dataRegion != "" {
+			createOpts = append(createOpts, idp.DataRegion(im.options.dataRegion))
+		}
+	}
+
+	rowData := im.rowData(row)
+	backoff := initialBackoff
+	for {
+		res.Attempts++
+		if err := limiter.wait(ctx); err != nil {
+			res.Error = err.Error()
+			return res, false
+		}
+
+		var err error
+		if im.updating() {
+			var resp *idp.ExecuteMutatorResponse
+			resp, err = im.client.ExecuteMutator(ctx, im.mutatorID, im.options.clientContext, selectorValues, rowData)
+			if err == nil {
+				if len(resp.UserIDs) != 1 {
+					res.Error = fmt.Sprintf("mutator selector matched %d users, expected 1", len(resp.UserIDs))
+					return res, true
+				}
+				res.UserID = resp.UserIDs[0]
+			}
+		} else {
+			res.UserID, err = im.client.CreateUserWithMutator(ctx, im.mutatorID, im.options.clientContext, rowData, createOpts...)
+		}
+
+		if err == nil {
+			return res, true
+		}
+
+		if ctx.Err() != nil {
+			res.Error = ctx.Err().Error()
+			return res, false
+		}
+		if !isRetryable(err, idempotent) {
+			// a server error from a create that wasn't retried may still have created the user,
+			// so the row isn't imported again and must be checked by hand
+			res.Error = ucerr.UserFriendlyMessage(err)
+			return res, true
+		}
+		if res.Attempts > im.options.maxRetries {
+			res.Error = ucerr.UserFriendlyMessage(err)
+			return res, false
+		}
+
+		uclog.Debugf(ctx, "retrying import of row %d after error: %v", row.Number, err)
+		select {
+		case <-ctx.Done():
+			res.Error = ctx.Err().Error()
+			return res, false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// isRetryable returns true if a request can be retried after err. Rate limited requests were never
+// processed, so they can always be retried, but server errors only if the request is idempotent.
+func isRetryable(err error, idempotent bool) bool {
+	code := jsonclient.GetHTTPStatusCode(err)
+	return code == http.StatusTooManyRequests || (idempotent && code >= http.StatusInternalServerError)
+}
+
+// Import reads every row from r and creates (or updates) a user for each one, returning a summary
+// of the results. If a checkpoint file was specified, rows already processed according to that file
+// are skipped, and progress is saved as rows complete so that a failed import can be resumed.
+func (im *Importer) Import(ctx context.Context, r Reader) (*Summary, error) {
+	if err := im.prepare(ctx); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	prog := newProgress(0)
+	if im.options.checkpointPath != "" {
+		var err error
+		if prog, err = loadCheckpoint(im.options.checkpointPath); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+	}
+
+	var summary Summary
+	var mu sync.Mutex
+	var checkpointErr error
+	unsaved := 0
+	lastSaved := time.Now()
+	save := func() {
+		if err := saveCheckpoint(im.options.checkpointPath, prog.checkpoint()); err != nil && checkpointErr == nil {
+			checkpointErr = ucerr.Wrap(err)
+		}
+		unsaved = 0
+		lastSaved = time.Now()
+	}
+	encoder := (*json.Encoder)(nil)
+	if im.options.results != nil {
+		encoder = json.NewEncoder(im.options.results)
+	}
+
+	record := func(res Result, processed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if res.Error == "" {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+
+		if encoder != nil {
+			if err := encoder.Encode(res); err != nil && checkpointErr == nil {
+				checkpointErr = ucerr.Wrap(err)
+			}
+		}
+
+		if !processed {
+			return
+		}
+		prog.complete(res.Row)
+		if im.options.checkpointPath != "" {
+			unsaved++
+			if unsaved >= checkpointRows || time.Since(lastSaved) >= checkpointInterval {
+				save()
+			}
+		}
+	}
+
+	limiter := newRateLimiter(im.options.requestsPerSecond)
+	rows := make(chan *Row)
+	var wg sync.WaitGroup
+	for i := 0; i < im.options.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range rows {
+				res, processed := im.importRow(ctx, limiter, row)
+				record(res, processed)
+			}
+		}()
+	}
+
+	var readErr error
+	for ctx.Err() == nil {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && row == nil {
+			readErr = ucerr.Wrap(err)
+			break
+		}
+
+		// rows completed by a previous run are skipped before parse errors are recorded, so that
+		// rows that failed to parse aren't counted or written to the results again on resume
+		mu.Lock()
+		skip := prog.isComplete(row.Number)
+		if skip {
+			summary.Skipped++
+		}
+		mu.Unlock()
+		if skip {
+			continue
+		}
+
+		if err != nil {
+			record(Result{Row: row.Number, Error: ucerr.UserFriendlyMessage(err)}, true)
+			continue
+		}
+
+		select {
+		case rows <- row:
+		case <-ctx.Done():
+		}
+	}
+	close(rows)
+	wg.Wait()
+
+	if im.options.checkpointPath != "" && unsaved > 0 {
+		save()
+	}
+
+	summary.CompletedRow = prog.completedRow
+
+	if readErr != nil {
+		return &summary, ucerr.Wrap(readErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return &summary, ucerr.Wrap(err)
+	}
+	if checkpointErr != nil {
+		return &summary, ucerr.Wrap(checkpointErr)
+	}
+
+	return &summary, nil
+}
+
+// rateLimiter spaces requests evenly so that no more than the configured number are issued per second
+type rateLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	if requestsPerSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / requestsPerSecond)}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ucerr.Wrap(ctx.Err())
+	case <-time.After(time.Until(slot)):
+		return nil
+	}
+}
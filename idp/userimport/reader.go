@@ -0,0 +1,106 @@
+package userimport
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// Row is a single record read from an import file
+type Row struct {
+	// Number is the 1-based position of the row in the file, not counting a CSV header or blank JSONL lines
+	Number int
+	Fields map[string]interface{}
+}
+
+// Reader reads rows from an import file, returning io.EOF once all rows have been read. If a
+// single row cannot be parsed, Read returns a Row with only its Number set along with the error,
+// so that the row can be reported as failed without stopping the import.
+type Reader interface {
+	Read() (*Row, error)
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	header []string
+	count  int
+}
+
+// NewCSVReader returns a Reader for CSV input, using the first line of the input as the field names
+func NewCSVReader(r io.Reader) (Reader, error) {
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, ucerr.Errorf("could not read CSV header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	return &csvReader{r: cr, header: header}, nil
+}
+
+// Read implements Reader
+func (c *csvReader) Read() (*Row, error) {
+	record, err := c.r.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	c.count++
+	if err != nil {
+		return &Row{Number: c.count}, ucerr.Errorf("could not read CSV row %d: %v", c.count, err)
+	}
+
+	fields := make(map[string]interface{}, len(c.header))
+	for i, name := range c.header {
+		if i < len(record) {
+			fields[name] = record[i]
+		}
+	}
+
+	return &Row{Number: c.count, Fields: fields}, nil
+}
+
+type jsonlReader struct {
+	s     *bufio.Scanner
+	count int
+}
+
+// maxJSONLLineSize bounds the size of a single JSONL record
+const maxJSONLLineSize = 4 * 1024 * 1024
+
+// NewJSONLReader returns a Reader for newline-delimited JSON input, where each line is a JSON object
+func NewJSONLReader(r io.Reader) Reader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxJSONLLineSize)
+	return &jsonlReader{s: s}
+}
+
+// Read implements Reader
+func (j *jsonlReader) Read() (*Row, error) {
+	for j.s.Scan() {
+		line := strings.TrimSpace(j.s.Text())
+		if line == "" {
+			continue
+		}
+		j.count++
+
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return &Row{Number: j.count}, ucerr.Errorf("could not parse JSONL row %d: %v", j.count, err)
+		}
+
+		return &Row{Number: j.count, Fields: fields}, nil
+	}
+
+	if err := j.s.Err(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	return nil, io.EOF
+}
@@ -83,3 +83,20 @@ var UUID = userstore.ResourceID{
 	ID:   uuid.Must(uuid.FromString("d036bbba-6012-4d74-b7c4-9a2bbc09a749")),
 	Name: "uuid",
 }
+
+// Natives are the system data types, which every tenant has
+var Natives = []userstore.ResourceID{
+	Birthdate,
+	Boolean,
+	CanonicalAddress,
+	Composite,
+	Date,
+	E164PhoneNumber,
+	Email,
+	Integer,
+	PhoneNumber,
+	SSN,
+	String,
+	Timestamp,
+	UUID,
+}
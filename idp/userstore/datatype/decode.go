@@ -0,0 +1,70 @@
+package datatype
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// timestampLayouts are the formats accepted for timestamps returned by accessors
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	dateLayout,
+}
+
+// DecodeAccessorValue decodes a column value from an accessor result into v, which must be a
+// pointer. Accessors return scalar values as strings, and arrays, addresses and composite values
+// as JSON-encoded strings. A nil value, or an empty string for anything but a string, leaves v
+// unchanged.
+func DecodeAccessorValue(value interface{}, v interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	s, isString := value.(string)
+	if !isString {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return ucerr.Wrap(err)
+		}
+		return ucerr.Wrap(json.Unmarshal(b, v))
+	}
+
+	if p, ok := v.(*string); ok {
+		*p = s
+		return nil
+	}
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	switch p := v.(type) {
+	case *time.Time:
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+				*p = t
+				return nil
+			}
+		}
+		return ucerr.Friendlyf(nil, "'%s' is not a timestamp", s)
+	case *uuid.UUID:
+		id, err := uuid.FromString(s)
+		if err != nil {
+			return ucerr.Friendlyf(err, "'%s' is not a UUID", s)
+		}
+		*p = id
+	default:
+		if err := json.Unmarshal([]byte(s), v); err != nil {
+			return ucerr.Friendlyf(err, "'%s' can't be decoded as %T", s, v)
+		}
+	}
+
+	return nil
+}
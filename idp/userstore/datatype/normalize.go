@@ -0,0 +1,242 @@
+package datatype
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/uctypes/messaging/email/emailaddress"
+)
+
+const dateLayout = "2006-01-02"
+
+var (
+	e164Pattern           = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	phoneSeparatorPattern = regexp.MustCompile(`[\s\-().]`)
+	ssnPattern            = regexp.MustCompile(`^([0-9]{3})-?([0-9]{2})-?([0-9]{4})$`)
+)
+
+// addressFields are the JSON field names of userstore.Address
+var addressFields = map[string]bool{
+	"id":                    true,
+	"country":               true,
+	"name":                  true,
+	"organization":          true,
+	"street_address_line_1": true,
+	"street_address_line_2": true,
+	"dependent_locality":    true,
+	"locality":              true,
+	"administrative_area":   true,
+	"post_code":             true,
+	"sorting_code":          true,
+}
+
+// normalizeNative validates and normalizes a value of a non-composite system data type
+func normalizeNative(native userstore.ResourceID, path string, value interface{}, fes *FieldErrors) interface{} {
+	fail := func(format string, args ...interface{}) interface{} {
+		*fes = append(*fes, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+		return nil
+	}
+
+	switch native {
+	case Boolean:
+		switch b := value.(type) {
+		case bool:
+			return b
+		case string:
+			parsed, err := strconv.ParseBool(b)
+			if err != nil {
+				return fail("'%s' is not a boolean", b)
+			}
+			return parsed
+		}
+		return fail("value must be a boolean")
+
+	case Integer:
+		i, ok := asInteger(value)
+		if !ok {
+			return fail("'%v' is not an integer", value)
+		}
+		return i
+
+	case String, PhoneNumber:
+		s, ok := value.(string)
+		if !ok {
+			return fail("value must be a string")
+		}
+		return s
+
+	case Email:
+		s, ok := value.(string)
+		if !ok {
+			return fail("value must be a string")
+		}
+		parsed, err := emailaddress.Address(strings.TrimSpace(s)).Parse()
+		if err != nil {
+			return fail("'%s' is not a valid email address", s)
+		}
+		return parsed.Address
+
+	case E164PhoneNumber:
+		s, ok := value.(string)
+		if !ok {
+			return fail("value must be a string")
+		}
+		stripped := phoneSeparatorPattern.ReplaceAllString(s, "")
+		if !e164Pattern.MatchString(stripped) {
+			return fail("'%s' is not an E.164 phone number (+ followed by up to 15 digits)", s)
+		}
+		return stripped
+
+	case SSN:
+		s, ok := value.(string)
+		if !ok {
+			return fail("value must be a string")
+		}
+		parts := ssnPattern.FindStringSubmatch(strings.TrimSpace(s))
+		if parts == nil {
+			return fail("'%s' is not a social security number (AAA-GG-SSSS)", s)
+		}
+		if parts[1] == "000" || parts[1] == "666" || parts[1][0] == '9' || parts[2] == "00" || parts[3] == "0000" {
+			return fail("'%s' is not a valid social security number", s)
+		}
+		return fmt.Sprintf("%s-%s-%s", parts[1], parts[2], parts[3])
+
+	case UUID:
+		switch id := value.(type) {
+		case uuid.UUID:
+			return id.String()
+		case string:
+			parsed, err := uuid.FromString(id)
+			if err != nil {
+				return fail("'%s' is not a UUID", id)
+			}
+			return parsed.String()
+		}
+		return fail("value must be a UUID")
+
+	case Timestamp:
+		t, ok := asTime(value, time.RFC3339Nano)
+		if !ok {
+			return fail("'%v' is not an RFC 3339 timestamp", value)
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+
+	case Date, Birthdate:
+		t, ok := asTime(value, dateLayout)
+		if !ok {
+			return fail("'%v' is not a date (YYYY-MM-DD)", value)
+		}
+		if native == Birthdate && t.After(time.Now().UTC()) {
+			return fail("birthdate %s is in the future", t.Format(dateLayout))
+		}
+		return t.Format(dateLayout)
+	}
+
+	return fail("unsupported data type '%s'", native.Name)
+}
+
+// asInteger accepts Go integers, integral floats (as decoded from JSON), json.Number and numeric strings
+func asInteger(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float32:
+		return asInteger(float64(n))
+	case float64:
+		// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit in an int64
+		if n != math.Trunc(n) || n >= math.MaxInt64 || n < math.MinInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// asTime accepts a time.Time or a string in the specified layout. Dates may also be specified
+// as RFC 3339 timestamps, in which case the time of day is discarded.
+func asTime(value interface{}, layout string) (time.Time, bool) {
+	switch t := value.(type) {
+	case time.Time:
+		if layout == dateLayout {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), true
+		}
+		return t, true
+	case string:
+		s := strings.TrimSpace(t)
+		if parsed, err := time.Parse(layout, s); err == nil {
+			return parsed, true
+		}
+		if layout == dateLayout {
+			if parsed, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return asTime(parsed, layout)
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizeAddress validates a canonical address, which may be a userstore.Address or a map
+// using the same JSON field names. Empty fields are omitted.
+func normalizeAddress(path string, value interface{}, fes *FieldErrors) interface{} {
+	m, ok := asMap(value)
+	if !ok {
+		*fes = append(*fes, FieldError{Path: path, Message: "value must be an address object"})
+		return nil
+	}
+
+	normalized := map[string]interface{}{}
+	for k, fv := range m {
+		fieldPath := path + "." + k
+		if !addressFields[k] {
+			*fes = append(*fes, FieldError{Path: fieldPath, Message: "unknown address field"})
+			continue
+		}
+		s, ok := fv.(string)
+		if !ok {
+			*fes = append(*fes, FieldError{Path: fieldPath, Message: "value must be a string"})
+			continue
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			normalized[k] = s
+		}
+	}
+
+	return normalized
+}
+
+func sortFieldErrors(fes FieldErrors) {
+	sort.SliceStable(fes, func(i, j int) bool { return fes[i].Path < fes[j].Path })
+}
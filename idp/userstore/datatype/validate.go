@@ -0,0 +1,412 @@
+package datatype
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// FieldError describes a value that failed validation. Path identifies the value starting with
+// the column name, e.g. "email", "addresses[1].post_code" or "phone_numbers[0]".
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Error implements error
+func (fe FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", fe.Path, fe.Message)
+}
+
+// FieldErrors is the set of validation failures for one or more values
+type FieldErrors []FieldError
+
+// Error implements error
+func (fes FieldErrors) Error() string {
+	msgs := make([]string, 0, len(fes))
+	for _, fe := range fes {
+		msgs = append(msgs, fe.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// AsFieldErrors returns the field errors wrapped by err, if any
+func AsFieldErrors(err error) (FieldErrors, bool) {
+	var fes FieldErrors
+	if errors.As(err, &fes) {
+		return fes, true
+	}
+	return nil, false
+}
+
+// compositeField describes one field of a composite value, from either a composite data type
+// or the field constraints of a column
+type compositeField struct {
+	name       string
+	structName string
+	dataType   userstore.ResourceID
+	required   bool
+}
+
+// Validator validates and normalizes column values client-side, using the same rules as the
+// userstore, so that invalid mutator row data can be rejected before it is sent
+type Validator struct {
+	dataTypes []userstore.ColumnDataType
+}
+
+// NewValidator returns a Validator that resolves data types against the specified data types,
+// which should include any custom composite data types used by the columns being validated.
+// System data types are always known.
+func NewValidator(dataTypes ...userstore.ColumnDataType) *Validator {
+	return &Validator{dataTypes: dataTypes}
+}
+
+// ValidateValue returns an error wrapping FieldErrors if the value isn't valid for the column
+func (v *Validator) ValidateValue(column userstore.Column, value interface{}) error {
+	_, err := v.NormalizeValue(column, value)
+	return ucerr.Wrap(err)
+}
+
+// NormalizeValue validates a value for the column and returns it in the canonical form the
+// userstore stores: e.g. timestamps are formatted as RFC 3339 in UTC, SSNs as AAA-GG-SSSS and
+// composite values as maps keyed by field struct name. A nil value is valid for any column, and
+// clears it. If the value is invalid, the returned error wraps FieldErrors.
+func (v *Validator) NormalizeValue(column userstore.Column, value interface{}) (interface{}, error) {
+	var fes FieldErrors
+	normalized := v.normalizeColumnValue(column, value, &fes)
+	if len(fes) > 0 {
+		sortFieldErrors(fes)
+		return nil, ucerr.Friendlyf(fes, "%s", fes.Error())
+	}
+	return normalized, nil
+}
+
+// NormalizeRecord validates and normalizes each value in a record, keyed by column name, and
+// reports every invalid value rather than stopping at the first
+func (v *Validator) NormalizeRecord(columns []userstore.Column, record userstore.Record) (userstore.Record, error) {
+	var fes FieldErrors
+	normalized := userstore.Record{}
+	for name, value := range record {
+		column, found := findColumn(columns, name)
+		if !found {
+			fes = append(fes, FieldError{Path: name, Message: "unknown column"})
+			continue
+		}
+		normalized[name] = v.normalizeColumnValue(column, value, &fes)
+	}
+
+	if len(fes) > 0 {
+		sortFieldErrors(fes)
+		return nil, ucerr.Friendlyf(fes, "%s", fes.Error())
+	}
+	return normalized, nil
+}
+
+func findColumn(columns []userstore.Column, name string) (userstore.Column, bool) {
+	for _, c := range columns {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return userstore.Column{}, false
+}
+
+func (v *Validator) normalizeColumnValue(column userstore.Column, value interface{}, fes *FieldErrors) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	if !column.IsArray {
+		return v.normalizeElement(column, column.Name, value, fes)
+	}
+
+	elements, ok := asSlice(value)
+	if !ok {
+		*fes = append(*fes, FieldError{Path: column.Name, Message: "value must be an array"})
+		return nil
+	}
+
+	normalized := make([]interface{}, 0, len(elements))
+	seenValues := map[string]int{}
+	seenIDs := map[string]int{}
+	for i, element := range elements {
+		path := fmt.Sprintf("%s[%d]", column.Name, i)
+		n := v.normalizeElement(column, path, element, fes)
+		normalized = append(normalized, n)
+		if n == nil {
+			continue
+		}
+
+		if column.Constraints.UniqueRequired {
+			key := uniquenessKey(n, v.ignoredForUniqueness(column))
+			if j, found := seenValues[key]; found {
+				*fes = append(*fes, FieldError{Path: path, Message: fmt.Sprintf("duplicates the value at index %d", j)})
+			} else {
+				seenValues[key] = i
+			}
+		}
+
+		if column.Constraints.UniqueIDRequired {
+			if m, ok := n.(map[string]interface{}); ok {
+				if id, ok := m["id"].(string); ok && id != "" {
+					if j, found := seenIDs[id]; found {
+						*fes = append(*fes, FieldError{Path: path + ".id", Message: fmt.Sprintf("duplicates the ID of the value at index %d", j)})
+					} else {
+						seenIDs[id] = i
+					}
+				}
+			}
+		}
+	}
+	return normalized
+}
+
+func (v *Validator) normalizeElement(column userstore.Column, path string, value interface{}, fes *FieldErrors) interface{} {
+	if value == nil {
+		*fes = append(*fes, FieldError{Path: path, Message: "value must not be null"})
+		return nil
+	}
+
+	native, fields, err := v.resolve(column.DataType)
+	if err != nil {
+		*fes = append(*fes, FieldError{Path: path, Message: ucerr.UserFriendlyMessage(err)})
+		return nil
+	}
+
+	if native.EquivalentTo(Composite) {
+		if len(fields) == 0 {
+			fields = columnFields(column.Constraints.Fields)
+		}
+		return v.normalizeComposite(path, value, fields, column.Constraints.UniqueIDRequired, fes)
+	}
+	if native.EquivalentTo(CanonicalAddress) {
+		return normalizeAddress(path, value, fes)
+	}
+	return normalizeNative(native, path, value, fes)
+}
+
+// resolve returns the native data type for a data type, along with the fields of a composite data type
+func (v *Validator) resolve(dataType userstore.ResourceID) (userstore.ResourceID, []compositeField, error) {
+	for _, native := range Natives {
+		if native.EquivalentTo(dataType) {
+			return native, nil, nil
+		}
+	}
+
+	for _, dt := range v.dataTypes {
+		if !(userstore.ResourceID{ID: dt.ID, Name: dt.Name}).EquivalentTo(dataType) {
+			continue
+		}
+		if dt.IsNative {
+			break
+		}
+
+		var fields []compositeField
+		hasID := false
+		for _, f := range dt.CompositeAttributes.Fields {
+			fields = append(fields, compositeField{
+				name:       f.Name,
+				structName: f.StructName,
+				dataType:   f.DataType,
+				required:   f.Required,
+			})
+			hasID = hasID || fieldStructName(f.Name, f.StructName) == "id"
+		}
+		if dt.CompositeAttributes.IncludeID && !hasID {
+			fields = append(fields, compositeField{name: "ID", structName: "id", dataType: String})
+		}
+		return Composite, fields, nil
+	}
+
+	return userstore.ResourceID{}, nil, ucerr.Friendlyf(nil, "unknown data type %v", dataType)
+}
+
+// columnFields converts the composite field constraints of a column, which identify each
+// field's data type by name
+func columnFields(columnFields []userstore.ColumnField) []compositeField {
+	var fields []compositeField
+	for _, f := range columnFields {
+		fields = append(fields, compositeField{
+			name:       f.Name,
+			structName: f.StructName,
+			dataType:   userstore.ResourceID{Name: f.Type},
+			required:   f.Required,
+		})
+	}
+	return fields
+}
+
+func (v *Validator) ignoredForUniqueness(column userstore.Column) map[string]bool {
+	ignored := map[string]bool{"id": true}
+	for _, f := range column.Constraints.Fields {
+		if f.IgnoreForUniqueness {
+			ignored[fieldStructName(f.Name, f.StructName)] = true
+		}
+	}
+	for _, dt := range v.dataTypes {
+		if (userstore.ResourceID{ID: dt.ID, Name: dt.Name}).EquivalentTo(column.DataType) {
+			for _, f := range dt.CompositeAttributes.Fields {
+				if f.IgnoreForUniqueness {
+					ignored[fieldStructName(f.Name, f.StructName)] = true
+				}
+			}
+		}
+	}
+	return ignored
+}
+
+// uniquenessKey returns a comparable form of a normalized value, ignoring the ID and any fields
+// that are excluded from uniqueness checks
+func uniquenessKey(value interface{}, ignored map[string]bool) string {
+	if m, ok := value.(map[string]interface{}); ok {
+		compared := map[string]interface{}{}
+		for k, fv := range m {
+			if !ignored[k] {
+				compared[k] = fv
+			}
+		}
+		value = compared
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+func fieldStructName(name, structName string) string {
+	if structName != "" {
+		return structName
+	}
+	return strings.ToLower(name)
+}
+
+func (v *Validator) normalizeComposite(path string, value interface{}, fields []compositeField, uniqueIDRequired bool, fes *FieldErrors) interface{} {
+	m, ok := asMap(value)
+	if !ok {
+		*fes = append(*fes, FieldError{Path: path, Message: "value must be an object"})
+		return nil
+	}
+
+	normalized := map[string]interface{}{}
+	known := map[string]bool{}
+	for _, f := range fields {
+		key := fieldStructName(f.name, f.structName)
+		known[key] = true
+
+		fieldValue, found := lookupField(m, key, f.name)
+		fieldPath := path + "." + key
+		if !found || fieldValue == nil || fieldValue == "" {
+			// IDs may be generated by the userstore if unique IDs are required
+			if f.required && !(key == "id" && uniqueIDRequired) {
+				*fes = append(*fes, FieldError{Path: fieldPath, Message: "field is required"})
+			}
+			continue
+		}
+
+		native, nestedFields, err := v.resolve(f.dataType)
+		if err != nil {
+			*fes = append(*fes, FieldError{Path: fieldPath, Message: ucerr.UserFriendlyMessage(err)})
+			continue
+		}
+		if native.EquivalentTo(Composite) {
+			normalized[key] = v.normalizeComposite(fieldPath, fieldValue, nestedFields, false, fes)
+		} else {
+			normalized[key] = normalizeNative(native, fieldPath, fieldValue, fes)
+		}
+	}
+
+	// values of columns requiring unique IDs may carry an ID even if the data type doesn't define one
+	if uniqueIDRequired && !known["id"] {
+		if id, found := m["id"]; found {
+			known["id"] = true
+			if s, ok := id.(string); ok {
+				normalized["id"] = s
+			} else {
+				*fes = append(*fes, FieldError{Path: path + ".id", Message: "value must be a string"})
+			}
+		}
+	}
+
+	for k := range m {
+		if !known[strings.ToLower(k)] && !matchesFieldName(fields, k) {
+			*fes = append(*fes, FieldError{Path: path + "." + k, Message: "unknown field"})
+		}
+	}
+
+	return normalized
+}
+
+// lookupField finds a field by struct name, or case-insensitively by its display name
+func lookupField(m map[string]interface{}, structName, name string) (interface{}, bool) {
+	if fv, found := m[structName]; found {
+		return fv, true
+	}
+	for k, fv := range m {
+		if strings.EqualFold(k, name) || strings.EqualFold(k, structName) {
+			return fv, true
+		}
+	}
+	return nil, false
+}
+
+func matchesFieldName(fields []compositeField, key string) bool {
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// asSlice returns the elements of any slice or array value
+func asSlice(value interface{}) ([]interface{}, bool) {
+	if s, ok := value.([]interface{}); ok {
+		return s, true
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	elements := make([]interface{}, rv.Len())
+	for i := range elements {
+		elements[i] = rv.Index(i).Interface()
+	}
+	return elements, true
+}
+
+// asMap returns a composite or address value as a map, converting structs via their JSON form
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case userstore.CompositeValue:
+		return m, true
+	}
+
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map {
+		return nil, false
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, false
+	}
+	return m, true
+}
@@ -0,0 +1,259 @@
+package versionhistory
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// Change is a single field-level difference between two versions of a resource. Field is a
+// JSON path such as "selector_config.where_clause" or "columns[email].transformer", where
+// list elements are identified by the column, purpose or tag they refer to rather than their
+// position. Old is nil if the field was added, and New is nil if it was removed.
+type Change struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// String implements fmt.Stringer
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("%s: added %v", c.Field, c.New)
+	case c.New == nil:
+		return fmt.Sprintf("%s: removed %v", c.Field, c.Old)
+	default:
+		return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+	}
+}
+
+// Diff describes the changes between two versions of a resource
+type Diff struct {
+	ID          uuid.UUID `json:"id"`
+	FromVersion int       `json:"from_version"`
+	ToVersion   int       `json:"to_version"`
+	Changes     []Change  `json:"changes"`
+}
+
+// IsEmpty returns true if the two versions are equivalent
+func (d Diff) IsEmpty() bool {
+	return len(d.Changes) == 0
+}
+
+// keyFunc returns the identifier used for an element of a list in field paths
+type keyFunc func(element interface{}) string
+
+// diffConfig describes how a resource type is compared: which top-level fields are ignored,
+// which lists of objects are keyed by their contents rather than compared by position, and
+// which lists are sets whose elements are only reported as added or removed
+type diffConfig struct {
+	ignored map[string]bool
+	keys    map[string]keyFunc
+	sets    map[string]keyFunc
+}
+
+// resourceKey identifies a serialized userstore.ResourceID by name, falling back to ID
+func resourceKey(element interface{}) string {
+	m, ok := element.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", element)
+	}
+	if name, ok := m["name"].(string); ok && name != "" {
+		return strings.ToLower(name)
+	}
+	return fmt.Sprintf("%v", m["id"])
+}
+
+// isResourceID returns true if a serialized object looks like a userstore.ResourceID
+func isResourceID(m map[string]interface{}) bool {
+	if len(m) != 2 {
+		return false
+	}
+	_, hasID := m["id"]
+	_, hasName := m["name"]
+	return hasID && hasName
+}
+
+// fieldKey returns a keyFunc identifying an object element by the resource ID in one of its fields
+func fieldKey(field string) keyFunc {
+	return func(element interface{}) string {
+		m, ok := element.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("%v", element)
+		}
+		return resourceKey(m[field])
+	}
+}
+
+// valueKey identifies a scalar list element (e.g. a tag ID) by its value
+func valueKey(element interface{}) string {
+	return fmt.Sprintf("%v", element)
+}
+
+var (
+	// the ID and version differ between any two versions, so they're never reported
+	versionFields = map[string]bool{"id": true, "version": true}
+
+	accessorDiffConfig = diffConfig{
+		ignored: versionFields,
+		keys: map[string]keyFunc{
+			"columns": fieldKey("column"),
+		},
+		sets: map[string]keyFunc{
+			"purposes": resourceKey,
+		},
+	}
+
+	mutatorDiffConfig = diffConfig{
+		ignored: versionFields,
+		keys: map[string]keyFunc{
+			"columns": fieldKey("column"),
+		},
+	}
+
+	accessPolicyDiffConfig = diffConfig{
+		ignored: versionFields,
+		sets: map[string]keyFunc{
+			"tag_ids": valueKey,
+		},
+	}
+
+	transformerDiffConfig = diffConfig{
+		ignored: versionFields,
+		sets: map[string]keyFunc{
+			"tag_ids": valueKey,
+		},
+	}
+)
+
+// DiffAccessors returns the field-level changes between two versions of an accessor
+func DiffAccessors(from, to userstore.Accessor) ([]Change, error) {
+	changes, err := accessorDiffConfig.diff(from, to)
+	return changes, ucerr.Wrap(err)
+}
+
+// DiffMutators returns the field-level changes between two versions of a mutator
+func DiffMutators(from, to userstore.Mutator) ([]Change, error) {
+	changes, err := mutatorDiffConfig.diff(from, to)
+	return changes, ucerr.Wrap(err)
+}
+
+// DiffAccessPolicies returns the field-level changes between two versions of an access policy.
+// Components are compared by position, since their order is significant.
+func DiffAccessPolicies(from, to policy.AccessPolicy) ([]Change, error) {
+	changes, err := accessPolicyDiffConfig.diff(from, to)
+	return changes, ucerr.Wrap(err)
+}
+
+// DiffTransformers returns the field-level changes between two versions of a transformer
+func DiffTransformers(from, to policy.Transformer) ([]Change, error) {
+	changes, err := transformerDiffConfig.diff(from, to)
+	return changes, ucerr.Wrap(err)
+}
+
+func (dc diffConfig) diff(from, to interface{}) ([]Change, error) {
+	fromFields, err := dc.flatten(from)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	toFields, err := dc.flatten(to)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	changes := []Change{}
+	for field, oldValue := range fromFields {
+		newValue, found := toFields[field]
+		if !found {
+			changes = append(changes, Change{Field: field, Old: oldValue})
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, Change{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	for field, newValue := range toFields {
+		if _, found := fromFields[field]; !found {
+			changes = append(changes, Change{Field: field, New: newValue})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// flatten serializes a resource to JSON and returns its leaf values keyed by field path. Null
+// values and empty lists and objects produce no leaves, so nil and empty are treated alike.
+func (dc diffConfig) flatten(resource interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(resource)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	for name := range dc.ignored {
+		delete(fields, name)
+	}
+
+	leaves := map[string]interface{}{}
+	dc.addLeaves("", fields, leaves)
+	return leaves, nil
+}
+
+func (dc diffConfig) addLeaves(path string, value interface{}, leaves map[string]interface{}) {
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		if isResourceID(v) {
+			// report a referenced resource as a single value rather than its ID and name separately
+			if name, ok := v["name"].(string); ok && name != "" {
+				leaves[path] = name
+			} else {
+				leaves[path] = v["id"]
+			}
+			return
+		}
+		for name, child := range v {
+			childPath := name
+			if path != "" {
+				childPath = path + "." + name
+			}
+			dc.addLeaves(childPath, child, leaves)
+		}
+	case []interface{}:
+		if key, isSet := dc.sets[path]; isSet {
+			for _, element := range v {
+				elementKey := key(element)
+				leaves[fmt.Sprintf("%s[%s]", path, elementKey)] = elementKey
+			}
+			return
+		}
+
+		key, keyed := dc.keys[path]
+		seen := map[string]int{}
+		for i, element := range v {
+			elementKey := fmt.Sprintf("%d", i)
+			if keyed {
+				// disambiguate duplicate keys by occurrence, which is rare but possible
+				elementKey = key(element)
+				seen[elementKey]++
+				if n := seen[elementKey]; n > 1 {
+					elementKey = fmt.Sprintf("%s#%d", elementKey, n)
+				}
+			}
+			dc.addLeaves(fmt.Sprintf("%s[%s]", path, elementKey), element, leaves)
+		}
+	default:
+		leaves[path] = v
+	}
+}
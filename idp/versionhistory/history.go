@@ -0,0 +1,226 @@
+// Package versionhistory compares versions of accessors, mutators, access policies and
+// transformers, and rolls them back to earlier versions.
+package versionhistory
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// VersionHistory reads and restores versions of userstore and policy resources using an idp.Client
+type VersionHistory struct {
+	client *idp.Client
+}
+
+// New returns a VersionHistory that uses the specified client
+func New(client *idp.Client) *VersionHistory {
+	return &VersionHistory{client: client}
+}
+
+// AccessorDiff returns the changes made to an accessor between two versions
+func (vh *VersionHistory) AccessorDiff(ctx context.Context, accessorID uuid.UUID, fromVersion, toVersion int) (*Diff, error) {
+	from, err := vh.client.GetAccessorByVersion(ctx, accessorID, fromVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	to, err := vh.client.GetAccessorByVersion(ctx, accessorID, toVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	changes, err := DiffAccessors(*from, *to)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return &Diff{ID: accessorID, FromVersion: fromVersion, ToVersion: toVersion, Changes: changes}, nil
+}
+
+// MutatorDiff returns the changes made to a mutator between two versions
+func (vh *VersionHistory) MutatorDiff(ctx context.Context, mutatorID uuid.UUID, fromVersion, toVersion int) (*Diff, error) {
+	from, err := vh.client.GetMutatorByVersion(ctx, mutatorID, fromVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	to, err := vh.client.GetMutatorByVersion(ctx, mutatorID, toVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	changes, err := DiffMutators(*from, *to)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return &Diff{ID: mutatorID, FromVersion: fromVersion, ToVersion: toVersion, Changes: changes}, nil
+}
+
+// AccessPolicyDiff returns the changes made to an access policy between two versions
+func (vh *VersionHistory) AccessPolicyDiff(ctx context.Context, accessPolicyID uuid.UUID, fromVersion, toVersion int) (*Diff, error) {
+	from, err := vh.client.GetAccessPolicyByVersion(ctx, userstore.ResourceID{ID: accessPolicyID}, fromVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	to, err := vh.client.GetAccessPolicyByVersion(ctx, userstore.ResourceID{ID: accessPolicyID}, toVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	changes, err := DiffAccessPolicies(*from, *to)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return &Diff{ID: accessPolicyID, FromVersion: fromVersion, ToVersion: toVersion, Changes: changes}, nil
+}
+
+// TransformerDiff returns the changes made to a transformer between two versions
+func (vh *VersionHistory) TransformerDiff(ctx context.Context, transformerID uuid.UUID, fromVersion, toVersion int) (*Diff, error) {
+	from, err := vh.client.GetTransformerByVersion(ctx, userstore.ResourceID{ID: transformerID}, fromVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	to, err := vh.client.GetTransformerByVersion(ctx, userstore.ResourceID{ID: transformerID}, toVersion)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	changes, err := DiffTransformers(*from, *to)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return &Diff{ID: transformerID, FromVersion: fromVersion, ToVersion: toVersion, Changes: changes}, nil
+}
+
+// RollbackAccessor restores the definition of an accessor at the specified version by applying
+// it as an update, which creates a new version. If the current version is already equivalent,
+// no update is made and the current accessor is returned.
+func (vh *VersionHistory) RollbackAccessor(ctx context.Context, accessorID uuid.UUID, version int) (*userstore.Accessor, error) {
+	target, err := vh.client.GetAccessorByVersion(ctx, accessorID, version)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	current, err := vh.client.GetAccessor(ctx, accessorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	// system status can't be changed by an update, so keep the current value
+	target.ID = current.ID
+	target.Version = current.Version
+	target.IsSystem = current.IsSystem
+
+	changes, err := DiffAccessors(*current, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	updated, err := vh.client.UpdateAccessor(ctx, accessorID, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return updated, nil
+}
+
+// RollbackMutator restores the definition of a mutator at the specified version by applying
+// it as an update, which creates a new version. If the current version is already equivalent,
+// no update is made and the current mutator is returned.
+func (vh *VersionHistory) RollbackMutator(ctx context.Context, mutatorID uuid.UUID, version int) (*userstore.Mutator, error) {
+	target, err := vh.client.GetMutatorByVersion(ctx, mutatorID, version)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	current, err := vh.client.GetMutator(ctx, mutatorID)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	target.ID = current.ID
+	target.Version = current.Version
+	target.IsSystem = current.IsSystem
+
+	changes, err := DiffMutators(*current, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	updated, err := vh.client.UpdateMutator(ctx, mutatorID, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return updated, nil
+}
+
+// RollbackAccessPolicy restores the definition of an access policy at the specified version by
+// applying it as an update, which creates a new version. If the current version is already
+// equivalent, no update is made and the current access policy is returned.
+func (vh *VersionHistory) RollbackAccessPolicy(ctx context.Context, accessPolicyID uuid.UUID, version int) (*policy.AccessPolicy, error) {
+	target, err := vh.client.GetAccessPolicyByVersion(ctx, userstore.ResourceID{ID: accessPolicyID}, version)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	current, err := vh.client.GetAccessPolicy(ctx, userstore.ResourceID{ID: accessPolicyID})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	target.ID = current.ID
+	target.Version = current.Version
+	target.IsSystem = current.IsSystem
+	target.IsAutogenerated = current.IsAutogenerated
+
+	changes, err := DiffAccessPolicies(*current, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	updated, err := vh.client.UpdateAccessPolicy(ctx, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return updated, nil
+}
+
+// RollbackTransformer restores the definition of a transformer at the specified version by
+// applying it as an update, which creates a new version. If the current version is already
+// equivalent, no update is made and the current transformer is returned.
+func (vh *VersionHistory) RollbackTransformer(ctx context.Context, transformerID uuid.UUID, version int) (*policy.Transformer, error) {
+	target, err := vh.client.GetTransformerByVersion(ctx, userstore.ResourceID{ID: transformerID}, version)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	current, err := vh.client.GetTransformer(ctx, userstore.ResourceID{ID: transformerID})
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	target.ID = current.ID
+	target.Version = current.Version
+	target.IsSystem = current.IsSystem
+
+	changes, err := DiffTransformers(*current, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+
+	updated, err := vh.client.UpdateTransformer(ctx, *target)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return updated, nil
+}
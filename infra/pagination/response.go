@@ -1,5 +1,9 @@
 package pagination
 
+import (
+	"userclouds.com/infra/ucerr"
+)
+
 // ResponseFields represents pagination-specific fields present in every response.
 type ResponseFields struct {
 	HasNext bool   `json:"has_next"`
@@ -7,3 +11,21 @@ type ResponseFields struct {
 	HasPrev bool   `json:"has_prev"`
 	Prev    Cursor `json:"prev,omitempty"`
 }
+
+// ListAll calls a paginated list function, starting at CursorBegin, until every page has been read
+func ListAll[T any](list func(cursor Cursor) ([]T, ResponseFields, error)) ([]T, error) {
+	var all []T
+	cursor := CursorBegin
+	for {
+		data, fields, err := list(cursor)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		all = append(all, data...)
+		if !fields.HasNext {
+			break
+		}
+		cursor = fields.Next
+	}
+	return all, nil
+}
@@ -0,0 +1,532 @@
+package fakeidp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/selectorconfigparser"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// latestAccessor and latestMutator must be called with s.mu held
+
+func (s *Server) latestAccessor(id uuid.UUID) (userstore.Accessor, bool) {
+	versions := s.accessors[id]
+	if len(versions) == 0 {
+		return userstore.Accessor{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+func (s *Server) latestMutator(id uuid.UUID) (userstore.Mutator, bool) {
+	versions := s.mutators[id]
+	if len(versions) == 0 {
+		return userstore.Mutator{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// normalizeAccessor resolves the accessor's columns and purposes to fully specified resource IDs
+func (s *Server) normalizeAccessor(a *userstore.Accessor) error {
+	if a.Name == "" {
+		return ucerr.Friendlyf(nil, "accessor name must be specified")
+	}
+	if len(a.Columns) == 0 {
+		return ucerr.Friendlyf(nil, "accessor '%s' must have at least one column", a.Name)
+	}
+	if len(a.Purposes) == 0 {
+		return ucerr.Friendlyf(nil, "accessor '%s' must have at least one purpose", a.Name)
+	}
+	if err := validateSelector(a.SelectorConfig); err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	for i, oc := range a.Columns {
+		c, found := s.resolveColumn(oc.Column)
+		if !found {
+			return ucerr.Friendlyf(nil, "column %v not found", oc.Column)
+		}
+		a.Columns[i].Column = userstore.ResourceID{ID: c.ID, Name: c.Name}
+	}
+	for i, rid := range a.Purposes {
+		p, found := s.resolvePurpose(rid)
+		if !found {
+			return ucerr.Friendlyf(nil, "purpose %v not found", rid)
+		}
+		a.Purposes[i] = userstore.ResourceID{ID: p.ID, Name: p.Name}
+	}
+	if a.DataLifeCycleState == userstore.DataLifeCycleStateDefault {
+		a.DataLifeCycleState = userstore.DataLifeCycleStateLive
+	}
+
+	return nil
+}
+
+// normalizeMutator resolves the mutator's columns to fully specified resource IDs
+func (s *Server) normalizeMutator(m *userstore.Mutator) error {
+	if m.Name == "" {
+		return ucerr.Friendlyf(nil, "mutator name must be specified")
+	}
+	if len(m.Columns) == 0 && !m.IsSystem {
+		return ucerr.Friendlyf(nil, "mutator '%s' must have at least one column", m.Name)
+	}
+	if err := validateSelector(m.SelectorConfig); err != nil {
+		return ucerr.Wrap(err)
+	}
+
+	for i, ic := range m.Columns {
+		c, found := s.resolveColumn(ic.Column)
+		if !found {
+			return ucerr.Friendlyf(nil, "column %v not found", ic.Column)
+		}
+		m.Columns[i].Column = userstore.ResourceID{ID: c.ID, Name: c.Name}
+	}
+
+	return nil
+}
+
+func validateSelector(sc userstore.UserSelectorConfig) error {
+	if sc.MatchesAll() {
+		return nil
+	}
+	if err := selectorconfigparser.ParseWhereClause(sc.WhereClause); err != nil {
+		return ucerr.Wrap(err)
+	}
+	if _, err := parseSelector(sc.WhereClause); err != nil {
+		return ucerr.Wrap(err)
+	}
+	return nil
+}
+
+// versionParam returns the requested version, or -1 if the latest version was requested
+func versionParam(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return -1, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ucerr.Friendlyf(nil, "invalid %s '%s'", name, v)
+	}
+	return version, nil
+}
+
+func (s *Server) handleAccessors(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateAccessorRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		a := req.Accessor
+		if err := s.normalizeAccessor(&a); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		for existingID := range s.accessors {
+			existing, _ := s.latestAccessor(existingID)
+			if strings.EqualFold(existing.Name, a.Name) {
+				if a.ID.IsNil() {
+					a.ID = existing.ID
+				}
+				a.Version = existing.Version
+				fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, a), "accessor '%s' already exists", a.Name)
+				return
+			}
+		}
+		if a.ID.IsNil() {
+			a.ID = fakeserver.NewID()
+		}
+		a.Version = 0
+		s.accessors[a.ID] = []userstore.Accessor{a}
+		fakeserver.WriteJSON(w, http.StatusCreated, a)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var latest []userstore.Accessor
+		for accessorID := range s.accessors {
+			a, _ := s.latestAccessor(accessorID)
+			latest = append(latest, a)
+		}
+		if r.URL.Query().Get("versioned") != "true" {
+			fakeserver.WriteList(w, r, latest, func(a userstore.Accessor) uuid.UUID { return a.ID })
+			return
+		}
+		// paginate by accessor, returning every version of each accessor in the page
+		page, rf, err := fakeserver.Paginate(r, latest, func(a userstore.Accessor) uuid.UUID { return a.ID })
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		resp := idp.ListAccessorsResponse{Data: []userstore.Accessor{}, ResponseFields: rf}
+		for _, a := range page {
+			resp.Data = append(resp.Data, s.accessors[a.ID]...)
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, resp)
+
+	case r.Method == http.MethodGet:
+		version, err := versionParam(r, "accessor_version")
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		versions := s.accessors[id]
+		if len(versions) == 0 {
+			fakeserver.WriteNotFound(w, "accessor", id)
+			return
+		}
+		if version < 0 {
+			fakeserver.WriteJSON(w, http.StatusOK, versions[len(versions)-1])
+			return
+		}
+		for _, a := range versions {
+			if a.Version == version {
+				fakeserver.WriteJSON(w, http.StatusOK, a)
+				return
+			}
+		}
+		fakeserver.WriteError(w, http.StatusNotFound, "accessor %v version %d not found", id, version)
+
+	case r.Method == http.MethodPut:
+		existing, found := s.latestAccessor(id)
+		if !found {
+			fakeserver.WriteNotFound(w, "accessor", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system accessor %v cannot be modified", id)
+			return
+		}
+		var req idp.UpdateAccessorRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		a := req.Accessor
+		a.ID = id
+		if err := s.normalizeAccessor(&a); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		a.Version = existing.Version
+		if fakeserver.Identical(existing, a) {
+			fakeserver.WriteJSON(w, http.StatusOK, existing)
+			return
+		}
+		a.Version = existing.Version + 1
+		s.accessors[id] = append(s.accessors[id], a)
+		fakeserver.WriteJSON(w, http.StatusOK, a)
+
+	case r.Method == http.MethodDelete:
+		existing, found := s.latestAccessor(id)
+		if !found {
+			fakeserver.WriteNotFound(w, "accessor", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system accessor %v cannot be deleted", id)
+			return
+		}
+		delete(s.accessors, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleMutators(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateMutatorRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		m := req.Mutator
+		if err := s.normalizeMutator(&m); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		for existingID := range s.mutators {
+			existing, _ := s.latestMutator(existingID)
+			if strings.EqualFold(existing.Name, m.Name) {
+				if m.ID.IsNil() {
+					m.ID = existing.ID
+				}
+				m.Version = existing.Version
+				fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, m), "mutator '%s' already exists", m.Name)
+				return
+			}
+		}
+		if m.ID.IsNil() {
+			m.ID = fakeserver.NewID()
+		}
+		m.Version = 0
+		s.mutators[m.ID] = []userstore.Mutator{m}
+		fakeserver.WriteJSON(w, http.StatusCreated, m)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var latest []userstore.Mutator
+		for mutatorID := range s.mutators {
+			m, _ := s.latestMutator(mutatorID)
+			latest = append(latest, m)
+		}
+		if r.URL.Query().Get("versioned") != "true" {
+			fakeserver.WriteList(w, r, latest, func(m userstore.Mutator) uuid.UUID { return m.ID })
+			return
+		}
+		// paginate by mutator, returning every version of each mutator in the page
+		page, rf, err := fakeserver.Paginate(r, latest, func(m userstore.Mutator) uuid.UUID { return m.ID })
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		resp := idp.ListMutatorsResponse{Data: []userstore.Mutator{}, ResponseFields: rf}
+		for _, m := range page {
+			resp.Data = append(resp.Data, s.mutators[m.ID]...)
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, resp)
+
+	case r.Method == http.MethodGet:
+		version, err := versionParam(r, "mutator_version")
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		versions := s.mutators[id]
+		if len(versions) == 0 {
+			fakeserver.WriteNotFound(w, "mutator", id)
+			return
+		}
+		if version < 0 {
+			fakeserver.WriteJSON(w, http.StatusOK, versions[len(versions)-1])
+			return
+		}
+		for _, m := range versions {
+			if m.Version == version {
+				fakeserver.WriteJSON(w, http.StatusOK, m)
+				return
+			}
+		}
+		fakeserver.WriteError(w, http.StatusNotFound, "mutator %v version %d not found", id, version)
+
+	case r.Method == http.MethodPut:
+		existing, found := s.latestMutator(id)
+		if !found {
+			fakeserver.WriteNotFound(w, "mutator", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system mutator %v cannot be modified", id)
+			return
+		}
+		var req idp.UpdateMutatorRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		m := req.Mutator
+		m.ID = id
+		if err := s.normalizeMutator(&m); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		m.Version = existing.Version
+		if fakeserver.Identical(existing, m) {
+			fakeserver.WriteJSON(w, http.StatusOK, existing)
+			return
+		}
+		m.Version = existing.Version + 1
+		s.mutators[id] = append(s.mutators[id], m)
+		fakeserver.WriteJSON(w, http.StatusOK, m)
+
+	case r.Method == http.MethodDelete:
+		existing, found := s.latestMutator(id)
+		if !found {
+			fakeserver.WriteNotFound(w, "mutator", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system mutator %v cannot be deleted", id)
+			return
+		}
+		delete(s.mutators, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// selectUsers returns the users matching the selector, ordered by ID, and must be called with s.mu held
+func (s *Server) selectUsers(sc userstore.UserSelectorConfig, values userstore.UserSelectorValues) ([]*user, error) {
+	var match func(*user) (bool, error)
+	if sc.MatchesAll() {
+		match = func(*user) (bool, error) { return true, nil }
+	} else {
+		sel, err := parseSelector(sc.WhereClause)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if sel.placeholders != len(values) {
+			return nil, ucerr.Friendlyf(nil, "selector '%s' expects %d values, got %d", sc.WhereClause, sel.placeholders, len(values))
+		}
+		match = func(u *user) (bool, error) { return sel.matches(s.selectorColumnValue(u), values) }
+	}
+
+	var users []*user
+	for _, u := range s.users {
+		ok, err := match(u)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if ok {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].id.String() < users[j].id.String() })
+	return users, nil
+}
+
+// selectorColumnValue returns a function that looks up a user's value for a selector column
+func (s *Server) selectorColumnValue(u *user) func(name string) (interface{}, error) {
+	return func(name string) (interface{}, error) {
+		switch strings.ToLower(name) {
+		case "id":
+			return u.id.String(), nil
+		case "organization_id":
+			return u.organizationID.String(), nil
+		}
+		c, found := s.resolveColumn(userstore.ResourceID{Name: name})
+		if !found {
+			return nil, ucerr.Friendlyf(nil, "selector column '%s' not found", name)
+		}
+		if value, isSystem := systemValue(u, c.ID); isSystem {
+			return value, nil
+		}
+		return u.values[c.ID], nil
+	}
+}
+
+func (s *Server) handleExecuteAccessor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var req idp.ExecuteAccessorRequest
+	if !fakeserver.ReadJSON(w, r, &req) {
+		return
+	}
+
+	a, found := s.latestAccessor(req.AccessorID)
+	if !found {
+		fakeserver.WriteNotFound(w, "accessor", req.AccessorID)
+		return
+	}
+
+	// the fake doesn't retain soft-deleted data, so soft-deleted accessors never return any rows
+	var users []*user
+	if a.DataLifeCycleState.IsLive() {
+		var err error
+		if users, err = s.selectUsers(a.SelectorConfig, req.SelectorValues); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+	}
+
+	page, rf, err := fakeserver.Paginate(r, users, func(u *user) uuid.UUID { return u.id })
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var purposeIDs []uuid.UUID
+	for _, p := range a.Purposes {
+		purposeIDs = append(purposeIDs, p.ID)
+	}
+
+	resp := idp.ExecuteAccessorResponse{Data: []string{}, ResponseFields: rf}
+	for _, u := range page {
+		row := map[string]string{}
+		for _, oc := range a.Columns {
+			// values are only returned if the user consented to every one of the accessor's purposes,
+			// except for system columns, which don't track consent
+			value := ""
+			if v, isSystem := systemValue(u, oc.Column.ID); isSystem {
+				value = stringValue(v)
+			} else if u.hasPurposes(oc.Column.ID, purposeIDs) {
+				value = stringValue(u.values[oc.Column.ID])
+			}
+			row[oc.Column.Name] = value
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		resp.Data = append(resp.Data, string(b))
+	}
+
+	fakeserver.WriteJSON(w, http.StatusOK, resp)
+}
+
+// stringValue renders a stored value the way accessors return it
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return valueKey(v)
+}
+
+func (s *Server) handleExecuteMutator(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var req idp.ExecuteMutatorRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	m, found := s.latestMutator(req.MutatorID)
+	if !found {
+		fakeserver.WriteNotFound(w, "mutator", req.MutatorID)
+		return
+	}
+
+	users, err := s.selectUsers(m.SelectorConfig, req.SelectorValues)
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+
+	resp := idp.ExecuteMutatorResponse{UserIDs: []uuid.UUID{}}
+	for _, u := range users {
+		if err := s.applyMutation(u, m, req.RowData); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		resp.UserIDs = append(resp.UserIDs, u.id)
+	}
+
+	fakeserver.WriteJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,463 @@
+package fakeidp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// resolve* look up a resource by ID and/or name, and must be called with s.mu held
+
+func (s *Server) resolveDataType(rid userstore.ResourceID) (userstore.ColumnDataType, bool) {
+	for _, dt := range s.dataTypes {
+		if rid.EquivalentTo(userstore.ResourceID{ID: dt.ID, Name: dt.Name}) {
+			return dt, true
+		}
+	}
+	return userstore.ColumnDataType{}, false
+}
+
+func (s *Server) resolveColumn(rid userstore.ResourceID) (userstore.Column, bool) {
+	for _, c := range s.columns {
+		if rid.EquivalentTo(userstore.ResourceID{ID: c.ID, Name: c.Name}) {
+			return c, true
+		}
+	}
+	return userstore.Column{}, false
+}
+
+func (s *Server) resolvePurpose(rid userstore.ResourceID) (userstore.Purpose, bool) {
+	for _, p := range s.purposes {
+		if rid.EquivalentTo(userstore.ResourceID{ID: p.ID, Name: p.Name}) {
+			return p, true
+		}
+	}
+	return userstore.Purpose{}, false
+}
+
+func (s *Server) handleDataTypes(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateDataTypeRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		dt := req.DataType
+		if dt.Name == "" {
+			fakeserver.WriteError(w, http.StatusBadRequest, "data type name must be specified")
+			return
+		}
+		if existing, found := s.resolveDataType(userstore.ResourceID{Name: dt.Name}); found {
+			if dt.ID.IsNil() {
+				dt.ID = existing.ID
+			}
+			fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, dt), "data type '%s' already exists", dt.Name)
+			return
+		}
+		if dt.ID.IsNil() {
+			dt.ID = fakeserver.NewID()
+		}
+		s.dataTypes[dt.ID] = dt
+		fakeserver.WriteJSON(w, http.StatusCreated, dt)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var dts []userstore.ColumnDataType
+		for _, dt := range s.dataTypes {
+			dts = append(dts, dt)
+		}
+		fakeserver.WriteList(w, r, dts, func(dt userstore.ColumnDataType) uuid.UUID { return dt.ID })
+
+	case r.Method == http.MethodGet:
+		dt, found := s.dataTypes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "data type", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, dt)
+
+	case r.Method == http.MethodPut:
+		existing, found := s.dataTypes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "data type", id)
+			return
+		}
+		if existing.IsNative {
+			fakeserver.WriteError(w, http.StatusBadRequest, "native data type %v cannot be modified", id)
+			return
+		}
+		var req idp.UpdateDataTypeRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		req.DataType.ID = id
+		s.dataTypes[id] = req.DataType
+		fakeserver.WriteJSON(w, http.StatusOK, req.DataType)
+
+	case r.Method == http.MethodDelete:
+		dt, found := s.dataTypes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "data type", id)
+			return
+		}
+		if dt.IsNative {
+			fakeserver.WriteError(w, http.StatusBadRequest, "native data type %v cannot be deleted", id)
+			return
+		}
+		for _, c := range s.columns {
+			if c.DataType.ID == id {
+				fakeserver.WriteError(w, http.StatusConflict, "data type %v is in use by column '%s'", id, c.Name)
+				return
+			}
+		}
+		delete(s.dataTypes, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// normalizeColumn resolves the column's data type, returning false if it doesn't exist
+func (s *Server) normalizeColumn(c *userstore.Column) bool {
+	dt, found := s.resolveDataType(c.DataType)
+	if !found {
+		return false
+	}
+	c.DataType = userstore.ResourceID{ID: dt.ID, Name: dt.Name}
+	c.Type = dt.Name
+	return true
+}
+
+func (s *Server) handleColumns(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateColumnRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		c := req.Column
+		if c.Name == "" {
+			fakeserver.WriteError(w, http.StatusBadRequest, "column name must be specified")
+			return
+		}
+		if !s.normalizeColumn(&c) {
+			fakeserver.WriteError(w, http.StatusBadRequest, "data type %v not found", req.Column.DataType)
+			return
+		}
+		if existing, found := s.resolveColumn(userstore.ResourceID{Name: c.Name}); found {
+			if c.ID.IsNil() {
+				c.ID = existing.ID
+			}
+			fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, c), "column '%s' already exists", c.Name)
+			return
+		}
+		if c.ID.IsNil() {
+			c.ID = fakeserver.NewID()
+		}
+		s.columns[c.ID] = c
+		fakeserver.WriteJSON(w, http.StatusCreated, c)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var cs []userstore.Column
+		for _, c := range s.columns {
+			cs = append(cs, c)
+		}
+		fakeserver.WriteList(w, r, cs, func(c userstore.Column) uuid.UUID { return c.ID })
+
+	case r.Method == http.MethodGet:
+		c, found := s.columns[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "column", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, c)
+
+	case r.Method == http.MethodPut:
+		existing, found := s.columns[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "column", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system column %v cannot be modified", id)
+			return
+		}
+		var req idp.UpdateColumnRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		c := req.Column
+		c.ID = id
+		if !s.normalizeColumn(&c) {
+			fakeserver.WriteError(w, http.StatusBadRequest, "data type %v not found", req.Column.DataType)
+			return
+		}
+		if other, found := s.resolveColumn(userstore.ResourceID{Name: c.Name}); found && other.ID != id {
+			fakeserver.WriteError(w, http.StatusConflict, "column '%s' already exists", c.Name)
+			return
+		}
+		s.columns[id] = c
+		fakeserver.WriteJSON(w, http.StatusOK, c)
+
+	case r.Method == http.MethodDelete:
+		c, found := s.columns[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "column", id)
+			return
+		}
+		if c.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system column %v cannot be deleted", id)
+			return
+		}
+		for _, u := range s.users {
+			u.deleteColumn(c.ID)
+		}
+		for durationID, crd := range s.retention {
+			if crd.ColumnID == id {
+				delete(s.retention, durationID)
+			}
+		}
+		delete(s.columns, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handlePurposes(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreatePurposeRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		p := req.Purpose
+		if p.Name == "" {
+			fakeserver.WriteError(w, http.StatusBadRequest, "purpose name must be specified")
+			return
+		}
+		if existing, found := s.resolvePurpose(userstore.ResourceID{Name: p.Name}); found {
+			if p.ID.IsNil() {
+				p.ID = existing.ID
+			}
+			fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, p), "purpose '%s' already exists", p.Name)
+			return
+		}
+		if p.ID.IsNil() {
+			p.ID = fakeserver.NewID()
+		}
+		s.purposes[p.ID] = p
+		fakeserver.WriteJSON(w, http.StatusCreated, p)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var ps []userstore.Purpose
+		for _, p := range s.purposes {
+			ps = append(ps, p)
+		}
+		fakeserver.WriteList(w, r, ps, func(p userstore.Purpose) uuid.UUID { return p.ID })
+
+	case r.Method == http.MethodGet:
+		p, found := s.purposes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "purpose", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, p)
+
+	case r.Method == http.MethodPut:
+		existing, found := s.purposes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "purpose", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system purpose %v cannot be modified", id)
+			return
+		}
+		var req idp.UpdatePurposeRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		req.Purpose.ID = id
+		s.purposes[id] = req.Purpose
+		fakeserver.WriteJSON(w, http.StatusOK, req.Purpose)
+
+	case r.Method == http.MethodDelete:
+		p, found := s.purposes[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "purpose", id)
+			return
+		}
+		if p.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system purpose %v cannot be deleted", id)
+			return
+		}
+		for _, u := range s.users {
+			u.deletePurpose(id)
+		}
+		for durationID, crd := range s.retention {
+			if crd.PurposeID == id {
+				delete(s.retention, durationID)
+			}
+		}
+		delete(s.purposes, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleDatabases(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateDatabaseRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		db := req.Database
+		if db.Name == "" {
+			fakeserver.WriteError(w, http.StatusBadRequest, "database name must be specified")
+			return
+		}
+		for _, existing := range s.databases {
+			if strings.EqualFold(existing.Name, db.Name) {
+				fakeserver.WriteConflict(w, existing.ID, existing.EqualsIgnoringNilIDSchemasAndPassword(db), "database '%s' already exists", db.Name)
+				return
+			}
+		}
+		if db.ID.IsNil() {
+			db.ID = fakeserver.NewID()
+		}
+		s.databases[db.ID] = db
+		fakeserver.WriteJSON(w, http.StatusCreated, db)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var dbs []userstore.SQLShimDatabase
+		for _, db := range s.databases {
+			dbs = append(dbs, db)
+		}
+		fakeserver.WriteList(w, r, dbs, func(db userstore.SQLShimDatabase) uuid.UUID { return db.ID })
+
+	case r.Method == http.MethodGet:
+		db, found := s.databases[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "database", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, db)
+
+	case r.Method == http.MethodPut:
+		if _, found := s.databases[id]; !found {
+			fakeserver.WriteNotFound(w, "database", id)
+			return
+		}
+		var req idp.UpdateDatabaseRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		req.Database.ID = id
+		s.databases[id] = req.Database
+		fakeserver.WriteJSON(w, http.StatusOK, req.Database)
+
+	case r.Method == http.MethodDelete:
+		if _, found := s.databases[id]; !found {
+			fakeserver.WriteNotFound(w, "database", id)
+			return
+		}
+		delete(s.databases, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleObjectStores(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req idp.CreateObjectStoreRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		os := req.ObjectStore
+		if os.Name == "" {
+			fakeserver.WriteError(w, http.StatusBadRequest, "object store name must be specified")
+			return
+		}
+		for _, existing := range s.objectStores {
+			if strings.EqualFold(existing.Name, os.Name) {
+				if os.ID.IsNil() {
+					os.ID = existing.ID
+				}
+				fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, os), "object store '%s' already exists", os.Name)
+				return
+			}
+		}
+		if os.ID.IsNil() {
+			os.ID = fakeserver.NewID()
+		}
+		s.objectStores[os.ID] = os
+		fakeserver.WriteJSON(w, http.StatusCreated, os)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var oss []userstore.ShimObjectStore
+		for _, os := range s.objectStores {
+			oss = append(oss, os)
+		}
+		fakeserver.WriteList(w, r, oss, func(os userstore.ShimObjectStore) uuid.UUID { return os.ID })
+
+	case r.Method == http.MethodGet:
+		os, found := s.objectStores[id]
+		if !found {
+			fakeserver.WriteNotFound(w, "object store", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, os)
+
+	case r.Method == http.MethodPut:
+		if _, found := s.objectStores[id]; !found {
+			fakeserver.WriteNotFound(w, "object store", id)
+			return
+		}
+		var req idp.UpdateObjectStoreRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		req.ObjectStore.ID = id
+		s.objectStores[id] = req.ObjectStore
+		fakeserver.WriteJSON(w, http.StatusOK, req.ObjectStore)
+
+	case r.Method == http.MethodDelete:
+		if _, found := s.objectStores[id]; !found {
+			fakeserver.WriteNotFound(w, "object store", id)
+			return
+		}
+		delete(s.objectStores, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
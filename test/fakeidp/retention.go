@@ -0,0 +1,298 @@
+package fakeidp
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+const (
+	liveRetentionSegment        = "liveretentiondurations"
+	softDeletedRetentionSegment = "softdeletedretentiondurations"
+)
+
+func isRetentionSegment(segment string) bool {
+	return segment == liveRetentionSegment || segment == softDeletedRetentionSegment
+}
+
+// retentionScope identifies the level a retention duration applies to: the tenant (both IDs nil),
+// a purpose (only purposeID set), or a column (columnID set, with purposeID identifying the purpose)
+type retentionScope struct {
+	columnID  uuid.UUID
+	purposeID uuid.UUID
+}
+
+// maxRetentionDuration is reported in responses; the fake doesn't enforce a maximum
+var maxRetentionDuration = idp.RetentionDuration{Unit: idp.DurationUnitIndefinite}
+
+func defaultRetentionDuration(dlcs userstore.DataLifeCycleState) idp.RetentionDuration {
+	if dlcs.IsLive() {
+		return idp.RetentionDuration{Unit: idp.DurationUnitIndefinite}
+	}
+	return idp.RetentionDuration{Unit: idp.DurationUnitDay, Duration: 0}
+}
+
+// savedRetention returns the retention duration saved for exactly the specified scope, and must be called with s.mu held
+func (s *Server) savedRetention(dlcs userstore.DataLifeCycleState, scope retentionScope) (idp.ColumnRetentionDuration, bool) {
+	for _, crd := range s.retention {
+		if crd.DurationType == dlcs && crd.ColumnID == scope.columnID && crd.PurposeID == scope.purposeID {
+			return crd, true
+		}
+	}
+	return idp.ColumnRetentionDuration{}, false
+}
+
+// inheritedRetention returns the duration that applies to the scope if nothing is saved for it
+func (s *Server) inheritedRetention(dlcs userstore.DataLifeCycleState, scope retentionScope) idp.RetentionDuration {
+	switch {
+	case !scope.columnID.IsNil():
+		return s.effectiveRetention(dlcs, retentionScope{purposeID: scope.purposeID})
+	case !scope.purposeID.IsNil():
+		return s.effectiveRetention(dlcs, retentionScope{})
+	default:
+		return defaultRetentionDuration(dlcs)
+	}
+}
+
+func (s *Server) effectiveRetention(dlcs userstore.DataLifeCycleState, scope retentionScope) idp.RetentionDuration {
+	if crd, found := s.savedRetention(dlcs, scope); found {
+		return crd.Duration
+	}
+	return s.inheritedRetention(dlcs, scope)
+}
+
+// derivedRetention returns the saved or inherited retention duration for the scope, as the real API reports it
+func (s *Server) derivedRetention(dlcs userstore.DataLifeCycleState, scope retentionScope) idp.ColumnRetentionDuration {
+	inherited := s.inheritedRetention(dlcs, scope)
+
+	crd, found := s.savedRetention(dlcs, scope)
+	if !found {
+		crd = idp.ColumnRetentionDuration{
+			DurationType: dlcs,
+			ColumnID:     scope.columnID,
+			PurposeID:    scope.purposeID,
+			Duration:     inherited,
+			UseDefault:   true,
+		}
+	}
+	crd.DefaultDuration = &inherited
+
+	if p, found := s.purposes[scope.purposeID]; found {
+		name := p.Name
+		crd.PurposeName = &name
+	}
+
+	return crd
+}
+
+func (s *Server) handleRetention(w http.ResponseWriter, r *http.Request, scope retentionScope, segment string, rest []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dlcs := userstore.DataLifeCycleStateLive
+	if segment == softDeletedRetentionSegment {
+		dlcs = userstore.DataLifeCycleStateSoftDeleted
+	}
+
+	if !scope.purposeID.IsNil() {
+		if _, found := s.purposes[scope.purposeID]; !found {
+			fakeserver.WriteNotFound(w, "purpose", scope.purposeID)
+			return
+		}
+	}
+	if !scope.columnID.IsNil() {
+		if _, found := s.columns[scope.columnID]; !found {
+			fakeserver.WriteNotFound(w, "column", scope.columnID)
+			return
+		}
+	}
+
+	if len(rest) > 1 {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	if len(rest) == 1 {
+		durationID, err := uuid.FromString(rest[0])
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "invalid ID '%s'", rest[0])
+			return
+		}
+		s.handleSpecificRetention(w, r, dlcs, scope, durationID)
+		return
+	}
+
+	if !scope.columnID.IsNil() {
+		s.handleColumnRetention(w, r, dlcs, scope.columnID)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		fakeserver.WriteJSON(w, http.StatusOK, idp.ColumnRetentionDurationResponse{
+			MaxDuration:       maxRetentionDuration,
+			RetentionDuration: s.derivedRetention(dlcs, scope),
+		})
+
+	case http.MethodPost:
+		var req idp.UpdateColumnRetentionDurationRequest
+		if !fakeserver.ReadValidJSON(w, r, &req) {
+			return
+		}
+		if existing, found := s.savedRetention(dlcs, scope); found {
+			fakeserver.WriteConflict(w, existing.ID, false, "a retention duration already exists")
+			return
+		}
+		if !s.saveRetention(w, dlcs, scope, uuid.Nil, req.RetentionDuration) {
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, idp.ColumnRetentionDurationResponse{
+			MaxDuration:       maxRetentionDuration,
+			RetentionDuration: s.derivedRetention(dlcs, scope),
+		})
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// saveRetention inserts (if durationID is nil) or updates a retention duration, writing an error
+// response and returning false if the request is invalid
+func (s *Server) saveRetention(w http.ResponseWriter, dlcs userstore.DataLifeCycleState, scope retentionScope, durationID uuid.UUID, crd idp.ColumnRetentionDuration) bool {
+	if crd.UseDefault {
+		fakeserver.WriteError(w, http.StatusBadRequest, "UseDefault must be false when saving a retention duration")
+		return false
+	}
+	if crd.DurationType.GetConcrete() != dlcs {
+		fakeserver.WriteError(w, http.StatusBadRequest, "retention duration type '%s' does not match request path", crd.DurationType)
+		return false
+	}
+
+	saved := idp.ColumnRetentionDuration{
+		DurationType: dlcs,
+		ID:           durationID,
+		ColumnID:     scope.columnID,
+		PurposeID:    scope.purposeID,
+		Duration:     crd.Duration,
+	}
+	if durationID.IsNil() {
+		saved.ID = fakeserver.NewID()
+	} else {
+		saved.Version = s.retention[durationID].Version + 1
+	}
+	s.retention[saved.ID] = saved
+	return true
+}
+
+func (s *Server) handleSpecificRetention(w http.ResponseWriter, r *http.Request, dlcs userstore.DataLifeCycleState, scope retentionScope, durationID uuid.UUID) {
+	existing, found := s.retention[durationID]
+	if !found || existing.DurationType != dlcs || existing.ColumnID != scope.columnID ||
+		(scope.columnID.IsNil() && existing.PurposeID != scope.purposeID) {
+		fakeserver.WriteNotFound(w, "retention duration", durationID)
+		return
+	}
+	scope.purposeID = existing.PurposeID
+
+	switch r.Method {
+	case http.MethodGet:
+		fakeserver.WriteJSON(w, http.StatusOK, idp.ColumnRetentionDurationResponse{
+			MaxDuration:       maxRetentionDuration,
+			RetentionDuration: s.derivedRetention(dlcs, scope),
+		})
+
+	case http.MethodPut:
+		var req idp.UpdateColumnRetentionDurationRequest
+		if !fakeserver.ReadValidJSON(w, r, &req) {
+			return
+		}
+		if !s.saveRetention(w, dlcs, scope, durationID, req.RetentionDuration) {
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, idp.ColumnRetentionDurationResponse{
+			MaxDuration:       maxRetentionDuration,
+			RetentionDuration: s.derivedRetention(dlcs, scope),
+		})
+
+	case http.MethodDelete:
+		delete(s.retention, durationID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// columnRetentionResponse returns the derived retention durations for the column, one per purpose
+func (s *Server) columnRetentionResponse(dlcs userstore.DataLifeCycleState, columnID uuid.UUID) idp.ColumnRetentionDurationsResponse {
+	var purposes []userstore.Purpose
+	for _, p := range s.purposes {
+		purposes = append(purposes, p)
+	}
+	sort.Slice(purposes, func(i, j int) bool { return purposes[i].ID.String() < purposes[j].ID.String() })
+
+	resp := idp.ColumnRetentionDurationsResponse{
+		MaxDuration:        maxRetentionDuration,
+		RetentionDurations: []idp.ColumnRetentionDuration{},
+	}
+	for _, p := range purposes {
+		resp.RetentionDurations = append(resp.RetentionDurations, s.derivedRetention(dlcs, retentionScope{columnID: columnID, purposeID: p.ID}))
+	}
+	return resp
+}
+
+func (s *Server) handleColumnRetention(w http.ResponseWriter, r *http.Request, dlcs userstore.DataLifeCycleState, columnID uuid.UUID) {
+	switch r.Method {
+	case http.MethodGet:
+		fakeserver.WriteJSON(w, http.StatusOK, s.columnRetentionResponse(dlcs, columnID))
+
+	case http.MethodPost:
+		var req idp.UpdateColumnRetentionDurationsRequest
+		if !fakeserver.ReadValidJSON(w, r, &req) {
+			return
+		}
+		for _, crd := range req.RetentionDurations {
+			if crd.ColumnID != columnID {
+				fakeserver.WriteError(w, http.StatusBadRequest, "retention duration column %v does not match request path", crd.ColumnID)
+				return
+			}
+			if _, found := s.purposes[crd.PurposeID]; !found {
+				fakeserver.WriteNotFound(w, "purpose", crd.PurposeID)
+				return
+			}
+			if !crd.ID.IsNil() {
+				if existing, found := s.retention[crd.ID]; !found || existing.ColumnID != columnID {
+					fakeserver.WriteNotFound(w, "retention duration", crd.ID)
+					return
+				}
+			}
+		}
+
+		// IDs that are set are updated (or deleted if UseDefault is set); unset IDs are inserted
+		for _, crd := range req.RetentionDurations {
+			scope := retentionScope{columnID: columnID, purposeID: crd.PurposeID}
+			if !crd.ID.IsNil() && crd.UseDefault {
+				delete(s.retention, crd.ID)
+				continue
+			}
+			if crd.ID.IsNil() {
+				if _, found := s.savedRetention(dlcs, scope); found {
+					fakeserver.WriteError(w, http.StatusConflict, "a retention duration already exists for purpose %v", crd.PurposeID)
+					return
+				}
+			}
+			if !s.saveRetention(w, dlcs, scope, crd.ID, crd) {
+				return
+			}
+		}
+
+		fakeserver.WriteJSON(w, http.StatusOK, s.columnRetentionResponse(dlcs, columnID))
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,448 @@
+package fakeidp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+)
+
+// The fake evaluates a subset of the selector where clause grammar: comparisons of columns
+// against placeholders or literals (optionally with ANY), IS [NOT] NULL checks, AND, OR and
+// parentheses. Column operators like LOWER or DATE_PART are not supported.
+
+type tokenKind int
+
+const (
+	tokenColumn tokenKind = iota
+	tokenOperator
+	tokenAny
+	tokenPlaceholder
+	tokenLeftParen
+	tokenRightParen
+	tokenConjunction
+	tokenIs
+	tokenNot
+	tokenNull
+	tokenLiteral
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+}
+
+var tokenPatterns = []struct {
+	kind tokenKind
+	re   *regexp.Regexp
+}{
+	{tokenColumn, regexp.MustCompile(`^\{[a-zA-Z0-9_-]+\}(->>'[a-zA-Z0-9_-]+')?`)},
+	{tokenOperator, regexp.MustCompile(`^(<=|>=|!=|=|<|>|(?i:ILIKE|LIKE)\b)`)},
+	{tokenAny, regexp.MustCompile(`^(?i:ANY)\b`)},
+	{tokenConjunction, regexp.MustCompile(`^(?i:AND|OR)\b`)},
+	{tokenIs, regexp.MustCompile(`^(?i:IS)\b`)},
+	{tokenNot, regexp.MustCompile(`^(?i:NOT)\b`)},
+	{tokenNull, regexp.MustCompile(`^(?i:NULL)\b`)},
+	{tokenPlaceholder, regexp.MustCompile(`^\?`)},
+	{tokenLeftParen, regexp.MustCompile(`^\(`)},
+	{tokenRightParen, regexp.MustCompile(`^\)`)},
+	{tokenLiteral, regexp.MustCompile(`^('([^']|'')*'|(?i:TRUE|FALSE)\b|[-+]?[0-9]+)(::[A-Za-z]+)?`)},
+}
+
+func tokenize(clause string) ([]token, error) {
+	var tokens []token
+	rest := strings.TrimSpace(clause)
+	for rest != "" {
+		matched := false
+		for _, tp := range tokenPatterns {
+			m := tp.re.FindString(rest)
+			if m == "" {
+				continue
+			}
+			t := token{kind: tp.kind, text: m}
+			if tp.kind == tokenLiteral {
+				t.value = literalValue(m)
+			}
+			tokens = append(tokens, t)
+			rest = strings.TrimSpace(rest[len(m):])
+			matched = true
+			break
+		}
+		if !matched {
+			return nil, ucerr.Friendlyf(nil, "unsupported selector syntax at '%s'", rest)
+		}
+	}
+	return tokens, nil
+}
+
+func literalValue(text string) interface{} {
+	if strings.HasPrefix(text, "'") {
+		return strings.ReplaceAll(text[1:strings.LastIndex(text, "'")], "''", "'")
+	}
+
+	if i := strings.Index(text, "::"); i >= 0 {
+		text = text[:i]
+	}
+	if strings.EqualFold(text, "true") {
+		return true
+	}
+	if strings.EqualFold(text, "false") {
+		return false
+	}
+	i, _ := strconv.Atoi(text)
+	return float64(i)
+}
+
+// operand is either a column reference, a placeholder, or a literal
+type operand struct {
+	column      string
+	field       string
+	placeholder int // index into the selector values, or -1
+	literal     interface{}
+}
+
+type condition struct {
+	// for comparisons and null checks
+	left     operand
+	operator string
+	any      bool
+	right    operand
+	isNull   bool
+	notNull  bool
+	children []*condition
+	or       bool
+}
+
+type selector struct {
+	root         *condition
+	placeholders int
+}
+
+type selectorParser struct {
+	tokens       []token
+	pos          int
+	placeholders int
+}
+
+func parseSelector(clause string) (*selector, error) {
+	tokens, err := tokenize(clause)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	p := &selectorParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, ucerr.Friendlyf(nil, "unexpected '%s' in selector '%s'", p.tokens[p.pos].text, clause)
+	}
+
+	return &selector{root: root, placeholders: p.placeholders}, nil
+}
+
+func (p *selectorParser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *selectorParser) expect(kind tokenKind, what string) (*token, error) {
+	t := p.peek()
+	if t == nil || t.kind != kind {
+		return nil, ucerr.Friendlyf(nil, "expected %s in selector", what)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *selectorParser) parseOr() (*condition, error) {
+	return p.parseJunction("OR", p.parseAnd)
+}
+
+func (p *selectorParser) parseAnd() (*condition, error) {
+	return p.parseJunction("AND", p.parseTerm)
+}
+
+func (p *selectorParser) parseJunction(conjunction string, next func() (*condition, error)) (*condition, error) {
+	first, err := next()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	children := []*condition{first}
+	for t := p.peek(); t != nil && t.kind == tokenConjunction && strings.EqualFold(t.text, conjunction); t = p.peek() {
+		p.pos++
+		c, err := next()
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		children = append(children, c)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &condition{children: children, or: conjunction == "OR"}, nil
+}
+
+func (p *selectorParser) parseTerm() (*condition, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, ucerr.Friendlyf(nil, "unexpected end of selector")
+	}
+
+	if t.kind == tokenLeftParen {
+		p.pos++
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if _, err := p.expect(tokenRightParen, "')'"); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return c, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+
+	if t := p.peek(); t != nil && t.kind == tokenIs {
+		p.pos++
+		c := &condition{left: left}
+		if t := p.peek(); t != nil && t.kind == tokenNot {
+			p.pos++
+			c.notNull = true
+		} else {
+			c.isNull = true
+		}
+		if _, err := p.expect(tokenNull, "NULL"); err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		return c, nil
+	}
+
+	op, err := p.expect(tokenOperator, "a comparison operator")
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	c := &condition{left: left, operator: strings.ToUpper(strings.TrimSpace(op.text))}
+
+	if t := p.peek(); t != nil && t.kind == tokenAny {
+		p.pos++
+		c.any = true
+	}
+
+	if c.right, err = p.parseOperand(); err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return c, nil
+}
+
+func (p *selectorParser) parseOperand() (operand, error) {
+	t := p.peek()
+	if t == nil {
+		return operand{}, ucerr.Friendlyf(nil, "unexpected end of selector")
+	}
+
+	switch t.kind {
+	case tokenColumn:
+		p.pos++
+		name := strings.TrimSuffix(strings.TrimPrefix(t.text, "{"), "}")
+		field := ""
+		if i := strings.Index(t.text, "}->>'"); i >= 0 {
+			name = t.text[1:i]
+			field = strings.TrimSuffix(t.text[i+len("}->>'"):], "'")
+		}
+		return operand{column: name, field: field, placeholder: -1}, nil
+	case tokenPlaceholder:
+		p.pos++
+		o := operand{placeholder: p.placeholders}
+		p.placeholders++
+		return o, nil
+	case tokenLeftParen:
+		// "(?)" is used with ANY
+		p.pos++
+		if _, err := p.expect(tokenPlaceholder, "'?'"); err != nil {
+			return operand{}, ucerr.Wrap(err)
+		}
+		if _, err := p.expect(tokenRightParen, "')'"); err != nil {
+			return operand{}, ucerr.Wrap(err)
+		}
+		o := operand{placeholder: p.placeholders}
+		p.placeholders++
+		return o, nil
+	case tokenLiteral:
+		p.pos++
+		return operand{literal: t.value, placeholder: -1}, nil
+	}
+
+	return operand{}, ucerr.Friendlyf(nil, "unexpected '%s' in selector", t.text)
+}
+
+func (s *selector) matches(columnValue func(name string) (interface{}, error), values userstore.UserSelectorValues) (bool, error) {
+	return s.root.matches(columnValue, values)
+}
+
+func (o operand) resolve(columnValue func(name string) (interface{}, error), values userstore.UserSelectorValues) (interface{}, error) {
+	switch {
+	case o.column != "":
+		v, err := columnValue(o.column)
+		if err != nil {
+			return nil, ucerr.Wrap(err)
+		}
+		if o.field != "" {
+			if m, ok := v.(map[string]interface{}); ok {
+				return m[o.field], nil
+			}
+			return nil, nil
+		}
+		return v, nil
+	case o.placeholder >= 0:
+		return values[o.placeholder], nil
+	default:
+		return o.literal, nil
+	}
+}
+
+func (c *condition) matches(columnValue func(name string) (interface{}, error), values userstore.UserSelectorValues) (bool, error) {
+	if len(c.children) > 0 {
+		for _, child := range c.children {
+			ok, err := child.matches(columnValue, values)
+			if err != nil {
+				return false, ucerr.Wrap(err)
+			}
+			if ok == c.or {
+				return ok, nil
+			}
+		}
+		return !c.or, nil
+	}
+
+	left, err := c.left.resolve(columnValue, values)
+	if err != nil {
+		return false, ucerr.Wrap(err)
+	}
+	if c.isNull || c.notNull {
+		return (left == nil) == c.isNull, nil
+	}
+
+	right, err := c.right.resolve(columnValue, values)
+	if err != nil {
+		return false, ucerr.Wrap(err)
+	}
+
+	// ANY compares against each element of the right side; array column values match if any element does
+	rights := []interface{}{right}
+	if c.any {
+		if rights, err = toSlice(right); err != nil {
+			return false, ucerr.Wrap(err)
+		}
+	}
+	lefts := []interface{}{left}
+	if arr, ok := left.([]interface{}); ok {
+		lefts = arr
+	}
+
+	for _, l := range lefts {
+		for _, r := range rights {
+			if l == nil || r == nil {
+				continue
+			}
+			if compare(l, c.operator, r) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func toSlice(v interface{}) ([]interface{}, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		return t, nil
+	case []string:
+		s := make([]interface{}, 0, len(t))
+		for _, e := range t {
+			s = append(s, e)
+		}
+		return s, nil
+	}
+	return nil, ucerr.Friendlyf(nil, "ANY requires an array value, got %T", v)
+}
+
+func compare(left interface{}, operator string, right interface{}) bool {
+	ls, rs := fmt.Sprintf("%v", left), fmt.Sprintf("%v", right)
+
+	switch operator {
+	case "LIKE":
+		return likePattern(rs, false).MatchString(ls)
+	case "ILIKE":
+		return likePattern(rs, true).MatchString(ls)
+	}
+
+	var cmp int
+	lf, lerr := strconv.ParseFloat(ls, 64)
+	rf, rerr := strconv.ParseFloat(rs, 64)
+	if lerr == nil && rerr == nil {
+		switch {
+		case lf < rf:
+			cmp = -1
+		case lf > rf:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(ls, rs)
+	}
+
+	switch operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// likePattern converts a SQL LIKE pattern into an anchored regular expression
+func likePattern(pattern string, caseInsensitive bool) *regexp.Regexp {
+	var b strings.Builder
+	if caseInsensitive {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,191 @@
+// Package fakeidp provides an in-memory fake of the userstore and IDP APIs used by idp.Client,
+// suitable for exercising userstore flows in tests without a UserClouds tenant.
+package fakeidp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// Server is an in-memory fake of the userstore and IDP APIs. It implements the routes in
+// idp/paths for users, columns, data types, purposes, accessors, mutators, retention
+// durations, databases and object stores. Access policies are not evaluated, and accessor
+// values are returned without applying transformers.
+type Server struct {
+	mu sync.Mutex
+
+	dataTypes    map[uuid.UUID]userstore.ColumnDataType
+	columns      map[uuid.UUID]userstore.Column
+	purposes     map[uuid.UUID]userstore.Purpose
+	accessors    map[uuid.UUID][]userstore.Accessor
+	mutators     map[uuid.UUID][]userstore.Mutator
+	databases    map[uuid.UUID]userstore.SQLShimDatabase
+	objectStores map[uuid.UUID]userstore.ShimObjectStore
+	users        map[uuid.UUID]*user
+	retention    map[uuid.UUID]idp.ColumnRetentionDuration
+	oidcIssuers  []string
+
+	mux        *http.ServeMux
+	httpServer *httptest.Server
+}
+
+// New returns a started fake server, which should be closed by the caller once it is no longer
+// needed. Like a new tenant, it has the native data types and the system purposes and columns.
+func New() *Server {
+	s := &Server{
+		dataTypes:    map[uuid.UUID]userstore.ColumnDataType{},
+		columns:      map[uuid.UUID]userstore.Column{},
+		purposes:     map[uuid.UUID]userstore.Purpose{},
+		accessors:    map[uuid.UUID][]userstore.Accessor{},
+		mutators:     map[uuid.UUID][]userstore.Mutator{},
+		databases:    map[uuid.UUID]userstore.SQLShimDatabase{},
+		objectStores: map[uuid.UUID]userstore.ShimObjectStore{},
+		users:        map[uuid.UUID]*user{},
+		retention:    map[uuid.UUID]idp.ColumnRetentionDuration{},
+		mux:          http.NewServeMux(),
+	}
+
+	for _, dt := range datatype.Natives {
+		s.dataTypes[dt.ID] = userstore.ColumnDataType{
+			ID:          dt.ID,
+			Name:        dt.Name,
+			Description: dt.Name,
+			IsNative:    true,
+		}
+	}
+
+	s.seedSystemResources()
+
+	s.mux.HandleFunc(paths.CreateUser, s.handleUsers)
+	s.mux.HandleFunc(paths.CreateUser+"/", s.handleUser)
+	s.mux.HandleFunc(paths.CreateUserWithMutatorPath, s.handleCreateUserWithMutator)
+	s.mux.HandleFunc(paths.GetConsentedPurposesForUserPath, s.handleConsentedPurposes)
+	s.mux.HandleFunc(paths.ExecuteAccessorPath, s.handleExecuteAccessor)
+	s.mux.HandleFunc(paths.ExecuteMutatorPath, s.handleExecuteMutator)
+	s.mux.HandleFunc(paths.ExternalOIDCIssuersPath, s.handleOIDCIssuers)
+	s.mux.HandleFunc(paths.BaseConfigPath+"/", s.handleConfig)
+
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+// ServeHTTP implements http.Handler, so that the fake can also be mounted in another server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Handle registers an additional handler on the fake server, e.g. to serve tokenizer routes
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// URL returns the base URL of the fake server
+func (s *Server) URL() string {
+	return s.httpServer.URL
+}
+
+// Close shuts down the fake server
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// Client returns an idp.Client configured to talk to the fake server
+func (s *Server) Client(opts ...idp.Option) (*idp.Client, error) {
+	opts = append([]idp.Option{idp.JSONClient(jsonclient.HeaderAuth("AccessToken fakeidp"))}, opts...)
+	c, err := idp.NewClient(s.URL(), opts...)
+	if err != nil {
+		return nil, ucerr.Wrap(err)
+	}
+	return c, nil
+}
+
+// handleConfig routes the userstore configuration APIs, which all live under BaseConfigPath
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, paths.BaseConfigPath+"/")
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+
+	// retention durations can be addressed at the tenant, purpose or column level
+	if len(parts) >= 1 && isRetentionSegment(parts[0]) {
+		s.handleRetention(w, r, retentionScope{}, parts[0], parts[1:])
+		return
+	}
+	if len(parts) >= 3 && isRetentionSegment(parts[2]) {
+		id, err := uuid.FromString(parts[1])
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "invalid ID '%s'", parts[1])
+			return
+		}
+		switch parts[0] {
+		case "purposes":
+			s.handleRetention(w, r, retentionScope{purposeID: id}, parts[2], parts[3:])
+			return
+		case "columns":
+			s.handleRetention(w, r, retentionScope{columnID: id}, parts[2], parts[3:])
+			return
+		}
+	}
+
+	if len(parts) > 2 {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	id := uuid.Nil
+	if len(parts) == 2 {
+		var err error
+		if id, err = uuid.FromString(parts[1]); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "invalid ID '%s'", parts[1])
+			return
+		}
+	}
+
+	switch parts[0] {
+	case "datatypes":
+		s.handleDataTypes(w, r, id)
+	case "columns":
+		s.handleColumns(w, r, id)
+	case "purposes":
+		s.handlePurposes(w, r, id)
+	case "accessors":
+		s.handleAccessors(w, r, id)
+	case "mutators":
+		s.handleMutators(w, r, id)
+	case "databases":
+		s.handleDatabases(w, r, id)
+	case "objectstores":
+		s.handleObjectStores(w, r, id)
+	default:
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+	}
+}
+
+func (s *Server) handleOIDCIssuers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		fakeserver.WriteJSON(w, http.StatusOK, s.oidcIssuers)
+	case http.MethodPut:
+		var issuers []string
+		if !fakeserver.ReadJSON(w, r, &issuers) {
+			return
+		}
+		s.oidcIssuers = issuers
+		fakeserver.WriteJSON(w, http.StatusOK, s.oidcIssuers)
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,169 @@
+package fakeidp_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/assert"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/test/fakeidp"
+)
+
+func newClient(t *testing.T) *idp.Client {
+	t.Helper()
+	s := fakeidp.New()
+	t.Cleanup(s.Close)
+	client, err := s.Client()
+	assert.NoErr(t, err)
+	return client
+}
+
+func TestSystemResources(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t)
+
+	purposes, err := client.ListPurposes(ctx)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(purposes.Data), 1)
+	assert.Equal(t, purposes.Data[0].Name, "operational")
+	assert.True(t, purposes.Data[0].IsSystem)
+
+	columns, err := client.ListColumns(ctx)
+	assert.NoErr(t, err)
+	names := map[string]bool{}
+	for _, c := range columns.Data {
+		assert.True(t, c.IsSystem)
+		names[c.Name] = true
+	}
+	assert.Equal(t, names, map[string]bool{"id": true, "created": true, "updated": true, "organization_id": true})
+
+	_, err = client.UpdateColumn(ctx, fakeidp.IDColumn.ID, userstore.Column{Name: "id", DataType: datatype.String})
+	assert.NotNil(t, err)
+}
+
+func TestMutatorAndAccessor(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t)
+
+	_, err := client.CreateColumn(ctx, userstore.Column{Name: "email", DataType: datatype.Email, IndexType: userstore.ColumnIndexTypeIndexed})
+	assert.NoErr(t, err)
+
+	mutator, err := client.CreateMutator(ctx, userstore.Mutator{
+		Name:           "UpdateEmail",
+		SelectorConfig: userstore.UserSelectorConfig{WhereClause: "{id} = ?"},
+		Columns:        []userstore.ColumnInputConfig{{Column: userstore.ResourceID{Name: "email"}, Normalizer: userstore.ResourceID{ID: policy.TransformerPassthrough.ID}}},
+		AccessPolicy:   userstore.ResourceID{ID: policy.AccessPolicyAllowAll.ID},
+	})
+	assert.NoErr(t, err)
+
+	accessor, err := client.CreateAccessor(ctx, userstore.Accessor{
+		Name:           "GetEmail",
+		SelectorConfig: userstore.UserSelectorConfig{WhereClause: "{id} = ?"},
+		Purposes:       []userstore.ResourceID{{Name: "operational"}},
+		Columns: []userstore.ColumnOutputConfig{
+			{Column: userstore.ResourceID{Name: "id"}, Transformer: userstore.ResourceID{ID: policy.TransformerPassthrough.ID}},
+			{Column: userstore.ResourceID{Name: "email"}, Transformer: userstore.ResourceID{ID: policy.TransformerPassthrough.ID}},
+		},
+		AccessPolicy: userstore.ResourceID{ID: policy.AccessPolicyAllowAll.ID},
+	})
+	assert.NoErr(t, err)
+
+	userID, err := client.CreateUserWithMutator(ctx, mutator.ID, policy.ClientContext{}, map[string]idp.ValueAndPurposes{
+		"email": {Value: "me@example.com", PurposeAdditions: []userstore.ResourceID{{Name: "operational"}}},
+	})
+	assert.NoErr(t, err)
+
+	resp, err := client.ExecuteAccessor(ctx, accessor.ID, policy.ClientContext{}, userstore.UserSelectorValues{userID})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(resp.Data), 1)
+	var row map[string]string
+	assert.NoErr(t, json.Unmarshal([]byte(resp.Data[0]), &row))
+	assert.Equal(t, row, map[string]string{"id": userID.String(), "email": "me@example.com"})
+
+	// system columns can't be written
+	_, err = client.CreateUserWithMutator(ctx, mutator.ID, policy.ClientContext{}, map[string]idp.ValueAndPurposes{
+		"email": {Value: "me@example.com"},
+		"id":    {Value: uuid.Must(uuid.NewV4()).String()},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestUniqueIDRequired(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t)
+
+	dt, err := client.CreateDataType(ctx, userstore.ColumnDataType{
+		Name:        "pet",
+		Description: "a pet",
+		CompositeAttributes: userstore.CompositeAttributes{
+			IncludeID: true,
+			Fields:    []userstore.CompositeField{{DataType: datatype.String, Name: "Name", Required: true}},
+		},
+	})
+	assert.NoErr(t, err)
+	_, err = client.CreateColumn(ctx, userstore.Column{
+		Name:        "pets",
+		DataType:    userstore.ResourceID{ID: dt.ID},
+		IsArray:     true,
+		IndexType:   userstore.ColumnIndexTypeNone,
+		Constraints: userstore.ColumnConstraints{UniqueIDRequired: true},
+	})
+	assert.NoErr(t, err)
+
+	userID, err := client.CreateUser(ctx, userstore.Record{"pets": []interface{}{map[string]interface{}{"name": "rex"}}})
+	assert.NoErr(t, err)
+	assert.NotEqual(t, userID, uuid.Nil)
+
+	mutator, err := client.CreateMutator(ctx, userstore.Mutator{
+		Name:           "AddPets",
+		SelectorConfig: userstore.UserSelectorConfig{WhereClause: "{id} = ?"},
+		Columns:        []userstore.ColumnInputConfig{{Column: userstore.ResourceID{Name: "pets"}, Normalizer: userstore.ResourceID{ID: policy.TransformerPassthrough.ID}}},
+		AccessPolicy:   userstore.ResourceID{ID: policy.AccessPolicyAllowAll.ID},
+	})
+	assert.NoErr(t, err)
+	_, err = client.ExecuteMutator(ctx, mutator.ID, policy.ClientContext{}, userstore.UserSelectorValues{userID}, map[string]idp.ValueAndPurposes{
+		"pets": {ValueAdditions: []interface{}{map[string]interface{}{"name": "tom"}}},
+	})
+	assert.NoErr(t, err)
+
+	user, err := client.GetUser(ctx, userID)
+	assert.NoErr(t, err)
+	var pets []map[string]string
+	assert.NoErr(t, datatype.DecodeAccessorValue(user.Profile["pets"], &pets))
+	assert.Equal(t, len(pets), 2)
+	for _, pet := range pets {
+		_, err := uuid.FromString(pet["id"])
+		assert.NoErr(t, err)
+	}
+	assert.NotEqual(t, pets[0]["id"], pets[1]["id"])
+}
+
+func TestPagination(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t)
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		_, err := client.CreatePurpose(ctx, userstore.Purpose{Name: name, Description: name})
+		assert.NoErr(t, err)
+	}
+
+	var pages int
+	purposes, err := pagination.ListAll(func(cursor pagination.Cursor) ([]userstore.Purpose, pagination.ResponseFields, error) {
+		pages++
+		resp, err := client.ListPurposes(ctx, idp.Pagination(pagination.StartingAfter(cursor), pagination.Limit(2)))
+		if err != nil {
+			return nil, pagination.ResponseFields{}, err
+		}
+		return resp.Data, resp.ResponseFields, nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(purposes), 6)
+	assert.Equal(t, pages, 3)
+}
@@ -0,0 +1,104 @@
+package fakeidp
+
+import (
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// The IDs of the system resources seeded by New. Names match a real tenant's, but IDs are only
+// stable within the fake, so tests should refer to system resources by name where they can.
+var (
+	// OperationalPurpose is the system purpose for the basic operation of the site
+	OperationalPurpose = userstore.ResourceID{ID: uuid.Must(uuid.FromString("4a8cd1d2-7f36-4c8a-8d0e-5c3a8d9e1a01")), Name: "operational"}
+
+	// IDColumn is the system column holding the user's ID
+	IDColumn = userstore.ResourceID{ID: uuid.Must(uuid.FromString("4a8cd1d2-7f36-4c8a-8d0e-5c3a8d9e1a02")), Name: "id"}
+
+	// CreatedColumn is the system column holding the time the user was created
+	CreatedColumn = userstore.ResourceID{ID: uuid.Must(uuid.FromString("4a8cd1d2-7f36-4c8a-8d0e-5c3a8d9e1a03")), Name: "created"}
+
+	// UpdatedColumn is the system column holding the time the user was last updated
+	UpdatedColumn = userstore.ResourceID{ID: uuid.Must(uuid.FromString("4a8cd1d2-7f36-4c8a-8d0e-5c3a8d9e1a04")), Name: "updated"}
+
+	// OrganizationIDColumn is the system column holding the ID of the user's organization
+	OrganizationIDColumn = userstore.ResourceID{ID: uuid.Must(uuid.FromString("4a8cd1d2-7f36-4c8a-8d0e-5c3a8d9e1a05")), Name: "organization_id"}
+)
+
+// seedSystemResources adds the system purposes and columns that every tenant has
+func (s *Server) seedSystemResources() {
+	s.purposes[OperationalPurpose.ID] = userstore.Purpose{
+		ID:          OperationalPurpose.ID,
+		Name:        OperationalPurpose.Name,
+		Description: "Purpose is used for basic operation of the site",
+		IsSystem:    true,
+	}
+
+	for _, sc := range []struct {
+		column   userstore.ResourceID
+		dataType userstore.ResourceID
+	}{
+		{IDColumn, datatype.UUID},
+		{CreatedColumn, datatype.Timestamp},
+		{UpdatedColumn, datatype.Timestamp},
+		{OrganizationIDColumn, datatype.UUID},
+	} {
+		s.columns[sc.column.ID] = userstore.Column{
+			ID:        sc.column.ID,
+			Name:      sc.column.Name,
+			DataType:  sc.dataType,
+			Type:      sc.dataType.Name,
+			IndexType: userstore.ColumnIndexTypeIndexed,
+			IsSystem:  true,
+		}
+	}
+}
+
+// systemValue returns a user's value for a system column, or false if the column isn't one
+func systemValue(u *user, columnID uuid.UUID) (interface{}, bool) {
+	switch columnID {
+	case IDColumn.ID:
+		return u.id.String(), true
+	case CreatedColumn.ID:
+		return u.created.Format(timestampLayout), true
+	case UpdatedColumn.ID:
+		return u.updated.Format(timestampLayout), true
+	case OrganizationIDColumn.ID:
+		return u.organizationID.String(), true
+	}
+	return nil, false
+}
+
+// timestampLayout is the format accessors return timestamps in
+const timestampLayout = "2006-01-02 15:04:05.999999-07"
+
+// checkWritable returns an error if the column can't be written to, because it's a system column
+func checkWritable(c userstore.Column) error {
+	if c.IsSystem {
+		return ucerr.Friendlyf(nil, "system column '%s' cannot be modified", c.Name)
+	}
+	return nil
+}
+
+// assignCompositeIDs sets a new ID on each composite value that doesn't have one, for columns that
+// require unique IDs
+func assignCompositeIDs(c userstore.Column, value interface{}) {
+	if !c.Constraints.UniqueIDRequired {
+		return
+	}
+
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok {
+		values = list
+	}
+	for _, v := range values {
+		if m, ok := v.(map[string]interface{}); ok {
+			if id, _ := m["id"].(string); id == "" {
+				m["id"] = fakeserver.NewID().String()
+			}
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package fakeidp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/namespace/region"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// user holds a user's column values and consented purposes, keyed by column ID so that
+// renaming a column doesn't affect stored data
+type user struct {
+	id             uuid.UUID
+	organizationID uuid.UUID
+	region         region.DataRegion
+	created        time.Time
+	updated        time.Time
+	values         map[uuid.UUID]interface{}
+	purposes       map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func newUser(id uuid.UUID, organizationID uuid.UUID, dataRegion region.DataRegion) *user {
+	now := time.Now().UTC()
+	return &user{
+		id:             id,
+		organizationID: organizationID,
+		region:         dataRegion,
+		created:        now,
+		updated:        now,
+		values:         map[uuid.UUID]interface{}{},
+		purposes:       map[uuid.UUID]map[uuid.UUID]bool{},
+	}
+}
+
+func (u *user) deleteColumn(columnID uuid.UUID) {
+	delete(u.values, columnID)
+	delete(u.purposes, columnID)
+}
+
+func (u *user) deletePurpose(purposeID uuid.UUID) {
+	for _, purposes := range u.purposes {
+		delete(purposes, purposeID)
+	}
+}
+
+func (u *user) hasPurposes(columnID uuid.UUID, purposeIDs []uuid.UUID) bool {
+	for _, purposeID := range purposeIDs {
+		if !u.purposes[columnID][purposeID] {
+			return false
+		}
+	}
+	return true
+}
+
+// profile must be called with s.mu held
+func (s *Server) profile(u *user) userstore.Record {
+	profile := userstore.Record{}
+	for columnID, value := range u.values {
+		if c, found := s.columns[columnID]; found {
+			profile[c.Name] = value
+		}
+	}
+	return profile
+}
+
+func (s *Server) userResponse(u *user) idp.UserResponse {
+	return idp.UserResponse{
+		ID:             u.id,
+		UpdatedAt:      u.updated.Unix(),
+		Profile:        s.profile(u),
+		OrganizationID: u.organizationID,
+	}
+}
+
+// setProfile sets the user's values for each column named in the profile, and must be called with s.mu held
+func (s *Server) setProfile(u *user, profile userstore.Record) error {
+	for name, value := range profile {
+		c, found := s.resolveColumn(userstore.ResourceID{Name: name})
+		if !found {
+			return ucerr.Friendlyf(nil, "column '%s' not found", name)
+		}
+		if err := checkWritable(c); err != nil {
+			return ucerr.Wrap(err)
+		}
+		if value == nil {
+			u.deleteColumn(c.ID)
+		} else {
+			assignCompositeIDs(c, value)
+			u.values[c.ID] = value
+		}
+	}
+	u.updated = time.Now().UTC()
+	return nil
+}
+
+// handleUsers serves the collection of users in the IDP API
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		var req idp.CreateUserAndAuthnRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		id := req.ID
+		if id.IsNil() {
+			id = fakeserver.NewID()
+		} else if _, found := s.users[id]; found {
+			fakeserver.WriteConflict(w, id, false, "user %v already exists", id)
+			return
+		}
+		u := newUser(id, req.OrganizationID, req.DataRegion)
+		if err := s.setProfile(u, req.Profile); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		s.users[id] = u
+		fakeserver.WriteJSON(w, http.StatusOK, s.userResponse(u))
+
+	case http.MethodGet:
+		var organizationID uuid.UUID
+		if v := r.URL.Query().Get("organization_id"); v != "" {
+			var err error
+			if organizationID, err = uuid.FromString(v); err != nil {
+				fakeserver.WriteError(w, http.StatusBadRequest, "invalid organization_id '%s'", v)
+				return
+			}
+		}
+		var users []idp.UserResponse
+		for _, u := range s.users {
+			if organizationID.IsNil() || u.organizationID == organizationID {
+				users = append(users, s.userResponse(u))
+			}
+		}
+		fakeserver.WriteList(w, r, users, func(u idp.UserResponse) uuid.UUID { return u.ID })
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// handleUser serves a single user in the IDP API
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := uuid.FromString(strings.TrimPrefix(r.URL.Path, paths.CreateUser+"/"))
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "invalid user ID in path '%s'", r.URL.Path)
+		return
+	}
+	u, found := s.users[id]
+	if !found {
+		fakeserver.WriteNotFound(w, "user", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		fakeserver.WriteJSON(w, http.StatusOK, s.userResponse(u))
+
+	case http.MethodPut:
+		var req idp.UpdateUserRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		if err := s.setProfile(u, req.Profile); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, s.userResponse(u))
+
+	case http.MethodDelete:
+		delete(s.users, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleCreateUserWithMutator(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var req idp.CreateUserWithMutatorRequest
+	if !fakeserver.ReadJSON(w, r, &req) {
+		return
+	}
+
+	m, found := s.latestMutator(req.MutatorID)
+	if !found {
+		fakeserver.WriteNotFound(w, "mutator", req.MutatorID)
+		return
+	}
+
+	id := req.ID
+	if id.IsNil() {
+		id = fakeserver.NewID()
+	} else if _, found := s.users[id]; found {
+		fakeserver.WriteConflict(w, id, false, "user %v already exists", id)
+		return
+	}
+
+	u := newUser(id, req.OrganizationID, req.DataRegion)
+	if err := s.applyMutation(u, m, req.RowData); err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+	s.users[id] = u
+
+	fakeserver.WriteJSON(w, http.StatusOK, id)
+}
+
+func (s *Server) handleConsentedPurposes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var req idp.GetConsentedPurposesForUserRequest
+	if !fakeserver.ReadJSON(w, r, &req) {
+		return
+	}
+
+	u, found := s.users[req.UserID]
+	if !found {
+		fakeserver.WriteNotFound(w, "user", req.UserID)
+		return
+	}
+
+	resp := idp.GetConsentedPurposesForUserResponse{Data: []idp.ColumnConsentedPurposes{}}
+	for _, rid := range req.Columns {
+		c, found := s.resolveColumn(rid)
+		if !found {
+			fakeserver.WriteError(w, http.StatusBadRequest, "column %v not found", rid)
+			return
+		}
+
+		ccp := idp.ColumnConsentedPurposes{
+			Column:            userstore.ResourceID{ID: c.ID, Name: c.Name},
+			ConsentedPurposes: []userstore.ResourceID{},
+		}
+		for purposeID := range u.purposes[c.ID] {
+			if p, found := s.purposes[purposeID]; found {
+				ccp.ConsentedPurposes = append(ccp.ConsentedPurposes, userstore.ResourceID{ID: p.ID, Name: p.Name})
+			}
+		}
+		sort.Slice(ccp.ConsentedPurposes, func(i, j int) bool {
+			return ccp.ConsentedPurposes[i].Name < ccp.ConsentedPurposes[j].Name
+		})
+		resp.Data = append(resp.Data, ccp)
+	}
+
+	fakeserver.WriteJSON(w, http.StatusOK, resp)
+}
+
+// applyMutation applies mutator row data to a user, and must be called with s.mu held. As with
+// the real API, row data must be specified for every one of the mutator's columns.
+func (s *Server) applyMutation(u *user, m userstore.Mutator, rowData map[string]idp.ValueAndPurposes) error {
+	seen := map[string]bool{}
+	for _, ic := range m.Columns {
+		c, found := s.resolveColumn(ic.Column)
+		if !found {
+			return ucerr.Friendlyf(nil, "column %v not found", ic.Column)
+		}
+
+		vp, found := rowData[c.Name]
+		if !found {
+			return ucerr.Friendlyf(nil, "row data is missing a value for column '%s'", c.Name)
+		}
+		seen[c.Name] = true
+
+		if err := s.applyValue(u, c, vp); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	for name := range rowData {
+		if !seen[name] {
+			return ucerr.Friendlyf(nil, "column '%s' is not one of the columns of mutator '%s'", name, m.Name)
+		}
+	}
+
+	u.updated = time.Now().UTC()
+	return nil
+}
+
+func (s *Server) applyValue(u *user, c userstore.Column, vp idp.ValueAndPurposes) error {
+	if vp.Value != idp.MutatorColumnCurrentValue {
+		if err := checkWritable(c); err != nil {
+			return ucerr.Wrap(err)
+		}
+	}
+
+	switch vp.Value {
+	case idp.MutatorColumnCurrentValue:
+	case idp.MutatorColumnDefaultValue:
+		if c.DefaultValue != "" {
+			u.values[c.ID] = c.DefaultValue
+		} else {
+			u.deleteColumn(c.ID)
+		}
+	case nil:
+		if vp.ValueAdditions == nil && vp.ValueDeletions == nil {
+			u.deleteColumn(c.ID)
+			break
+		}
+		if !c.IsArray {
+			return ucerr.Friendlyf(nil, "value additions and deletions are only supported for array column '%s'", c.Name)
+		}
+		assignCompositeIDs(c, vp.ValueAdditions)
+		values, err := applyArrayChanges(u.values[c.ID], vp.ValueAdditions, vp.ValueDeletions)
+		if err != nil {
+			return ucerr.Wrap(err)
+		}
+		u.values[c.ID] = values
+	default:
+		if _, isArray := vp.Value.([]interface{}); isArray != c.IsArray {
+			return ucerr.Friendlyf(nil, "value for column '%s' has the wrong shape (array expected: %v)", c.Name, c.IsArray)
+		}
+		assignCompositeIDs(c, vp.Value)
+		u.values[c.ID] = vp.Value
+	}
+
+	if _, hasValue := u.values[c.ID]; !hasValue {
+		return nil
+	}
+
+	if u.purposes[c.ID] == nil {
+		u.purposes[c.ID] = map[uuid.UUID]bool{}
+	}
+	for _, rid := range vp.PurposeAdditions {
+		p, found := s.resolvePurpose(rid)
+		if !found {
+			return ucerr.Friendlyf(nil, "purpose %v not found", rid)
+		}
+		u.purposes[c.ID][p.ID] = true
+	}
+	for _, rid := range vp.PurposeDeletions {
+		p, found := s.resolvePurpose(rid)
+		if !found {
+			return ucerr.Friendlyf(nil, "purpose %v not found", rid)
+		}
+		delete(u.purposes[c.ID], p.ID)
+	}
+
+	return nil
+}
+
+func applyArrayChanges(current interface{}, additions interface{}, deletions interface{}) ([]interface{}, error) {
+	values, _ := current.([]interface{})
+
+	if deletions != nil {
+		toDelete, ok := deletions.([]interface{})
+		if !ok {
+			return nil, ucerr.Friendlyf(nil, "value deletions must be an array")
+		}
+		var kept []interface{}
+		for _, v := range values {
+			deleted := false
+			for _, d := range toDelete {
+				if valueKey(v) == valueKey(d) {
+					deleted = true
+					break
+				}
+			}
+			if !deleted {
+				kept = append(kept, v)
+			}
+		}
+		values = kept
+	}
+
+	if additions != nil {
+		toAdd, ok := additions.([]interface{})
+		if !ok {
+			return nil, ucerr.Friendlyf(nil, "value additions must be an array")
+		}
+		values = append(values, toAdd...)
+	}
+
+	return values, nil
+}
+
+// valueKey returns a comparable string form of a decoded JSON value
+func valueKey(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
@@ -0,0 +1,448 @@
+package faketokenizer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/tokenizer"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// resolvePolicy, resolveTemplate and resolveTransformer must be called with s.mu held. They find
+// the latest version of a resource by ID if one is specified, and otherwise by name.
+
+func (s *Server) resolvePolicy(rid userstore.ResourceID) (policy.AccessPolicy, bool) {
+	if !rid.ID.IsNil() {
+		ap, found := latest(s.policies[rid.ID])
+		return ap, found && (rid.Name == "" || strings.EqualFold(rid.Name, ap.Name))
+	}
+	for _, versions := range s.policies {
+		if ap, found := latest(versions); found && rid.Name != "" && strings.EqualFold(rid.Name, ap.Name) {
+			return ap, true
+		}
+	}
+	return policy.AccessPolicy{}, false
+}
+
+func (s *Server) resolveTemplate(rid userstore.ResourceID) (policy.AccessPolicyTemplate, bool) {
+	if !rid.ID.IsNil() {
+		apt, found := latest(s.templates[rid.ID])
+		return apt, found && (rid.Name == "" || strings.EqualFold(rid.Name, apt.Name))
+	}
+	for _, versions := range s.templates {
+		if apt, found := latest(versions); found && rid.Name != "" && strings.EqualFold(rid.Name, apt.Name) {
+			return apt, true
+		}
+	}
+	return policy.AccessPolicyTemplate{}, false
+}
+
+// storeResolver implements simulator.Resolver for the resources stored in the fake, and is only
+// used while s.mu is held
+type storeResolver struct {
+	s *Server
+}
+
+// GetAccessPolicy implements simulator.Resolver
+func (sr storeResolver) GetAccessPolicy(ctx context.Context, accessPolicyRID userstore.ResourceID) (*policy.AccessPolicy, error) {
+	ap, found := sr.s.resolvePolicy(accessPolicyRID)
+	if !found {
+		return nil, ucerr.Friendlyf(nil, "access policy %v not found", accessPolicyRID)
+	}
+	return &ap, nil
+}
+
+// GetAccessPolicyTemplate implements simulator.Resolver
+func (sr storeResolver) GetAccessPolicyTemplate(ctx context.Context, accessPolicyTemplateRID userstore.ResourceID) (*policy.AccessPolicyTemplate, error) {
+	apt, found := sr.s.resolveTemplate(accessPolicyTemplateRID)
+	if !found {
+		return nil, ucerr.Friendlyf(nil, "access policy template %v not found", accessPolicyTemplateRID)
+	}
+	return &apt, nil
+}
+
+// evaluate runs the configured Evaluator, and must be called with s.mu held
+func (s *Server) evaluate(ctx context.Context, ap policy.AccessPolicy, apc policy.AccessPolicyContext) (bool, error) {
+	allowed, err := s.options.evaluator(ctx, ap, apc, storeResolver{s: s})
+	if err != nil {
+		return false, ucerr.Wrap(err)
+	}
+	return allowed, nil
+}
+
+// normalizePolicy resolves the policy's components to fully specified resource IDs
+func (s *Server) normalizePolicy(ap *policy.AccessPolicy) error {
+	for i, c := range ap.Components {
+		if (c.Policy == nil) == (c.Template == nil) {
+			return ucerr.Friendlyf(nil, "component %d of access policy '%s' must have either a policy or a template, but not both", i, ap.Name)
+		}
+
+		if c.Policy != nil {
+			if c.TemplateParameters != "" {
+				return ucerr.Friendlyf(nil, "component %d of access policy '%s' can't have template parameters", i, ap.Name)
+			}
+			p, found := s.resolvePolicy(*c.Policy)
+			if !found {
+				return ucerr.Friendlyf(nil, "access policy %v not found", *c.Policy)
+			}
+			ap.Components[i].Policy = &userstore.ResourceID{ID: p.ID, Name: p.Name}
+			continue
+		}
+
+		if c.TemplateParameters != "" {
+			params := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(c.TemplateParameters), &params); err != nil {
+				return ucerr.Friendlyf(nil, "template parameters of component %d of access policy '%s' must be a JSON object", i, ap.Name)
+			}
+		}
+		apt, found := s.resolveTemplate(*c.Template)
+		if !found {
+			return ucerr.Friendlyf(nil, "access policy template %v not found", *c.Template)
+		}
+		ap.Components[i].Template = &userstore.ResourceID{ID: apt.ID, Name: apt.Name}
+	}
+	return nil
+}
+
+func (s *Server) handleAccessPolicies(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourcePath(r, paths.BaseAccessPolicyPath)
+	if !ok {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versionOf := func(ap policy.AccessPolicy) int { return ap.Version }
+	idOf := func(ap policy.AccessPolicy) uuid.UUID { return ap.ID }
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req tokenizer.CreateAccessPolicyRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.AccessPolicy) {
+			return
+		}
+		ap := req.AccessPolicy
+		if err := s.normalizePolicy(&ap); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		for _, versions := range s.policies {
+			existing, _ := latest(versions)
+			if strings.EqualFold(existing.Name, ap.Name) || existing.ID == ap.ID {
+				fakeserver.WriteConflict(w, existing.ID, existing.EqualsIgnoringNilID(ap), "access policy '%s' already exists", existing.Name)
+				return
+			}
+		}
+		if ap.ID.IsNil() {
+			ap.ID = fakeserver.NewID()
+		}
+		ap.Version = 0
+		ap.IsSystem = false
+		s.policies[ap.ID] = []policy.AccessPolicy{ap}
+		fakeserver.WriteJSON(w, http.StatusCreated, ap)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		version, err := versionParam(r, "policy_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		name := r.URL.Query().Get("policy_name")
+		versioned := r.URL.Query().Get("versioned") == "true"
+
+		var matches []policy.AccessPolicy
+		for _, versions := range s.policies {
+			switch {
+			case name != "":
+				if ap, found := findVersion(versions, version, versionOf); found && strings.EqualFold(ap.Name, name) {
+					matches = append(matches, ap)
+				}
+			case versioned:
+				matches = append(matches, versions...)
+			default:
+				ap, _ := latest(versions)
+				matches = append(matches, ap)
+			}
+		}
+		fakeserver.WriteList(w, r, matches, idOf)
+
+	case r.Method == http.MethodGet:
+		version, err := versionParam(r, "policy_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		ap, found := findVersion(s.policies[id], version, versionOf)
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, ap)
+
+	case r.Method == http.MethodPut:
+		existing, found := latest(s.policies[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system access policy %v cannot be modified", id)
+			return
+		}
+		var req tokenizer.UpdateAccessPolicyRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.AccessPolicy) {
+			return
+		}
+		ap := req.AccessPolicy
+		ap.ID = id
+		if err := s.normalizePolicy(&ap); err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		ap.Version = existing.Version
+		ap.IsSystem = false
+		if fakeserver.Identical(existing, ap) {
+			fakeserver.WriteJSON(w, http.StatusOK, existing)
+			return
+		}
+		ap.Version = existing.Version + 1
+		s.policies[id] = append(s.policies[id], ap)
+		fakeserver.WriteJSON(w, http.StatusOK, ap)
+
+	case r.Method == http.MethodDelete:
+		version, err := versionParam(r, "policy_version", true)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		existing, found := latest(s.policies[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system access policy %v cannot be deleted", id)
+			return
+		}
+		remaining, deleted := deleteVersion(s.policies[id], version, versionOf)
+		if !deleted {
+			fakeserver.WriteError(w, http.StatusNotFound, "access policy %v version %d not found", id, version)
+			return
+		}
+		if len(remaining) == 0 {
+			delete(s.policies, id)
+		} else {
+			s.policies[id] = remaining
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleAccessPolicyTemplates(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourcePath(r, paths.BaseAccessPolicyTemplatePath)
+	if !ok {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versionOf := func(apt policy.AccessPolicyTemplate) int { return apt.Version }
+	idOf := func(apt policy.AccessPolicyTemplate) uuid.UUID { return apt.ID }
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req tokenizer.CreateAccessPolicyTemplateRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.AccessPolicyTemplate) {
+			return
+		}
+		apt := req.AccessPolicyTemplate
+		for _, versions := range s.templates {
+			existing, _ := latest(versions)
+			if strings.EqualFold(existing.Name, apt.Name) || existing.ID == apt.ID {
+				fakeserver.WriteConflict(w, existing.ID, existing.EqualsIgnoringNilID(apt), "access policy template '%s' already exists", existing.Name)
+				return
+			}
+		}
+		if apt.ID.IsNil() {
+			apt.ID = fakeserver.NewID()
+		}
+		apt.Version = 0
+		apt.IsSystem = false
+		s.templates[apt.ID] = []policy.AccessPolicyTemplate{apt}
+		fakeserver.WriteJSON(w, http.StatusCreated, apt)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		version, err := versionParam(r, "template_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		name := r.URL.Query().Get("template_name")
+		versioned := r.URL.Query().Get("versioned") == "true"
+
+		var matches []policy.AccessPolicyTemplate
+		for _, versions := range s.templates {
+			switch {
+			case name != "":
+				if apt, found := findVersion(versions, version, versionOf); found && strings.EqualFold(apt.Name, name) {
+					matches = append(matches, apt)
+				}
+			case versioned:
+				matches = append(matches, versions...)
+			default:
+				apt, _ := latest(versions)
+				matches = append(matches, apt)
+			}
+		}
+		fakeserver.WriteList(w, r, matches, idOf)
+
+	case r.Method == http.MethodGet:
+		version, err := versionParam(r, "template_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		apt, found := findVersion(s.templates[id], version, versionOf)
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy template", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, apt)
+
+	case r.Method == http.MethodPut:
+		existing, found := latest(s.templates[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy template", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system access policy template %v cannot be modified", id)
+			return
+		}
+		var req tokenizer.UpdateAccessPolicyTemplateRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.AccessPolicyTemplate) {
+			return
+		}
+		apt := req.AccessPolicyTemplate
+		apt.ID = id
+		apt.Version = existing.Version
+		apt.IsSystem = false
+		if fakeserver.Identical(existing, apt) {
+			fakeserver.WriteJSON(w, http.StatusOK, existing)
+			return
+		}
+		apt.Version = existing.Version + 1
+		s.templates[id] = append(s.templates[id], apt)
+		fakeserver.WriteJSON(w, http.StatusOK, apt)
+
+	case r.Method == http.MethodDelete:
+		version, err := versionParam(r, "template_version", true)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		existing, found := latest(s.templates[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "access policy template", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system access policy template %v cannot be deleted", id)
+			return
+		}
+		remaining, deleted := deleteVersion(s.templates[id], version, versionOf)
+		if !deleted {
+			fakeserver.WriteError(w, http.StatusNotFound, "access policy template %v version %d not found", id, version)
+			return
+		}
+		if len(remaining) == 0 {
+			delete(s.templates, id)
+		} else {
+			s.templates[id] = remaining
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleTestAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.TestAccessPolicyRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ap := req.AccessPolicy
+	if err := s.normalizePolicy(&ap); err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+	allowed, err := s.evaluate(r.Context(), ap, req.Context)
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, tokenizer.TestAccessPolicyResponse{Allowed: allowed})
+}
+
+// handleTestAccessPolicyTemplate evaluates a template that is already stored in the fake, since
+// template functions can't be run
+func (s *Server) handleTestAccessPolicyTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.TestAccessPolicyTemplateRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apt, found := s.resolveTemplate(userstore.ResourceID{ID: req.AccessPolicyTemplate.ID, Name: req.AccessPolicyTemplate.Name})
+	if !found {
+		fakeserver.WriteError(w, http.StatusBadRequest, "access policy template '%s' must be created before it can be tested", req.AccessPolicyTemplate.Name)
+		return
+	}
+
+	ap := policy.AccessPolicy{
+		Name:       "test",
+		PolicyType: policy.PolicyTypeCompositeAnd,
+		Components: []policy.AccessPolicyComponent{{
+			Template:           &userstore.ResourceID{ID: apt.ID, Name: apt.Name},
+			TemplateParameters: req.Params,
+		}},
+	}
+	allowed, err := s.evaluate(r.Context(), ap, req.Context)
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, tokenizer.TestAccessPolicyResponse{Allowed: allowed})
+}
@@ -0,0 +1,84 @@
+package faketokenizer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/infra/ucerr"
+)
+
+// resourcePath splits the path below base into an optional ID
+func resourcePath(r *http.Request, base string) (uuid.UUID, bool) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, base), "/")
+	if rest == "" {
+		return uuid.Nil, true
+	}
+	id, err := uuid.FromString(rest)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// versionParam returns the requested version, or -1 if the latest version was requested. If all
+// is true, "all" is accepted and returned as -2.
+func versionParam(r *http.Request, name string, all bool) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return -1, nil
+	}
+	if all && v == "all" {
+		return -2, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ucerr.Friendlyf(nil, "invalid %s '%s'", name, v)
+	}
+	return version, nil
+}
+
+// latest returns the last of a resource's versions
+func latest[T any](versions []T) (T, bool) {
+	if len(versions) == 0 {
+		var zero T
+		return zero, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// findVersion returns the requested version of a resource, or its latest version if version is negative
+func findVersion[T any](versions []T, version int, versionOf func(T) int) (T, bool) {
+	if version < 0 {
+		return latest(versions)
+	}
+	for _, v := range versions {
+		if versionOf(v) == version {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// deleteVersion removes a version, or every version if version is -2, returning the remaining
+// versions and whether anything was deleted
+func deleteVersion[T any](versions []T, version int, versionOf func(T) int) ([]T, bool) {
+	if version == -2 {
+		return nil, len(versions) > 0
+	}
+	if version < 0 {
+		if len(versions) == 0 {
+			return versions, false
+		}
+		return versions[:len(versions)-1], true
+	}
+	for i, v := range versions {
+		if versionOf(v) == version {
+			return append(append([]T{}, versions[:i]...), versions[i+1:]...), true
+		}
+	}
+	return versions, false
+}
@@ -0,0 +1,201 @@
+// Package faketokenizer provides an in-memory fake of the tokenizer APIs used by
+// idp.TokenizerClient, suitable for exercising token flows in tests without a UserClouds tenant.
+package faketokenizer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp"
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/policy/simulator"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/idp/userstore/datatype"
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/ucdb"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/fakeidp"
+)
+
+// Evaluator decides whether an access policy grants access in a context. resolver looks up the
+// policies and templates stored in the fake, which components of ap may reference. Evaluators are
+// called while the fake is locked, so they must not call the fake server.
+type Evaluator func(ctx context.Context, ap policy.AccessPolicy, apc policy.AccessPolicyContext, resolver simulator.Resolver) (bool, error)
+
+// SimulatorEvaluator returns an Evaluator that evaluates policies with simulator.Simulator, so
+// templates other than the built-in AllowAll, DenyAll and CheckAttribute need a Go implementation
+// passed with simulator.WithTemplate
+func SimulatorEvaluator(opts ...simulator.Option) Evaluator {
+	sim := simulator.NewSimulator(opts...)
+	return func(ctx context.Context, ap policy.AccessPolicy, apc policy.AccessPolicyContext, resolver simulator.Resolver) (bool, error) {
+		decision, err := sim.Evaluate(ctx, ap, apc, simulator.WithResolver(resolver))
+		if err != nil {
+			return false, ucerr.Wrap(err)
+		}
+		return decision.Allowed, nil
+	}
+}
+
+type options struct {
+	evaluator Evaluator
+}
+
+// Option makes Server extensible
+type Option interface {
+	apply(*options)
+}
+
+type optFunc func(*options)
+
+func (o optFunc) apply(opts *options) {
+	o(opts)
+}
+
+// WithEvaluator returns an Option that sets how access policies are evaluated, which defaults to
+// SimulatorEvaluator with no options
+func WithEvaluator(evaluator Evaluator) Option {
+	return optFunc(func(opts *options) {
+		opts.evaluator = evaluator
+	})
+}
+
+// Server is an in-memory fake of the tokenizer APIs. It implements the routes in idp/paths for
+// tokens, access policies, access policy templates, transformers and secrets. Tokens are created
+// with the Go implementations of the system transformers (see policy.Transformer.ApplyLocal), and
+// access policies are evaluated with an Evaluator rather than by running template functions.
+// Access policy thresholds are not enforced, and lists are paginated in ID order.
+type Server struct {
+	mu sync.Mutex
+
+	tokens       map[string]*token
+	policies     map[uuid.UUID][]policy.AccessPolicy
+	templates    map[uuid.UUID][]policy.AccessPolicyTemplate
+	transformers map[uuid.UUID][]policy.Transformer
+	secrets      map[uuid.UUID]policy.Secret
+
+	options options
+
+	mux        *http.ServeMux
+	httpServer *httptest.Server
+}
+
+// New returns a started fake server with the system access policies, templates and transformers,
+// which should be closed by the caller once it is no longer needed
+func New(opts ...Option) *Server {
+	options := options{evaluator: SimulatorEvaluator()}
+	for _, opt := range opts {
+		opt.apply(&options)
+	}
+
+	s := &Server{
+		tokens:       map[string]*token{},
+		policies:     map[uuid.UUID][]policy.AccessPolicy{},
+		templates:    map[uuid.UUID][]policy.AccessPolicyTemplate{},
+		transformers: map[uuid.UUID][]policy.Transformer{},
+		secrets:      map[uuid.UUID]policy.Secret{},
+		options:      options,
+		mux:          http.NewServeMux(),
+	}
+	s.addSystemResources()
+
+	s.mux.HandleFunc(paths.BaseTokenPath, s.handleTokens)
+	s.mux.HandleFunc(paths.ResolveToken, s.handleResolveTokens)
+	s.mux.HandleFunc(paths.InspectToken, s.handleInspectToken)
+	s.mux.HandleFunc(paths.LookupToken, s.handleLookupTokens)
+	s.mux.HandleFunc(paths.LookupOrCreateTokens, s.handleLookupOrCreateTokens)
+	s.mux.HandleFunc(paths.TestAccessPolicy, s.handleTestAccessPolicy)
+	s.mux.HandleFunc(paths.TestAccessPolicyTemplate, s.handleTestAccessPolicyTemplate)
+	s.mux.HandleFunc(paths.TestTransformer, s.handleTestTransformer)
+	s.mux.HandleFunc(paths.BaseAccessPolicyPath, s.handleAccessPolicies)
+	s.mux.HandleFunc(paths.BaseAccessPolicyPath+"/", s.handleAccessPolicies)
+	s.mux.HandleFunc(paths.BaseAccessPolicyTemplatePath, s.handleAccessPolicyTemplates)
+	s.mux.HandleFunc(paths.BaseAccessPolicyTemplatePath+"/", s.handleAccessPolicyTemplates)
+	s.mux.HandleFunc(paths.BaseTransformerPath, s.handleTransformers)
+	s.mux.HandleFunc(paths.BaseTransformerPath+"/", s.handleTransformers)
+	s.mux.HandleFunc(paths.BaseSecretPath, s.handleSecrets)
+	s.mux.HandleFunc(paths.BaseSecretPath+"/", s.handleSecrets)
+
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+// addSystemResources adds the system access policies, templates and transformers, using the
+// names the server gives them
+func (s *Server) addSystemResources() {
+	for _, ap := range []policy.AccessPolicy{
+		{ID: policy.AccessPolicyAllowAll.ID, Name: "AllowAll", Description: "This policy allows all access.", Components: []policy.AccessPolicyComponent{{Template: &userstore.ResourceID{ID: policy.AccessPolicyTemplateAllowAll.ID}}}},
+		{ID: policy.AccessPolicyDenyAll.ID, Name: "DenyAll", Description: "This policy denies all access.", Components: []policy.AccessPolicyComponent{{Template: &userstore.ResourceID{ID: policy.AccessPolicyTemplateDenyAll.ID}}}},
+	} {
+		ap.PolicyType = policy.PolicyTypeCompositeAnd
+		ap.IsSystem = true
+		s.policies[ap.ID] = []policy.AccessPolicy{ap}
+	}
+
+	for _, apt := range []policy.AccessPolicyTemplate{
+		{SystemAttributeBaseModel: ucdb.NewSystemAttributeBaseWithID(policy.AccessPolicyTemplateAllowAll.ID), Name: "AllowAll", Function: "function policy(context, params) {\n\treturn true;\n}"},
+		{SystemAttributeBaseModel: ucdb.NewSystemAttributeBaseWithID(policy.AccessPolicyTemplateDenyAll.ID), Name: "DenyAll", Function: "function policy(context, params) {\n\treturn false;\n}"},
+		{SystemAttributeBaseModel: ucdb.NewSystemAttributeBaseWithID(policy.AccessPolicyTemplateCheckAttribute.ID), Name: "CheckAttribute", Function: "function policy(context, params) {\n\treturn checkAttribute(context, params);\n}"},
+	} {
+		apt.IsSystem = true
+		s.templates[apt.ID] = []policy.AccessPolicyTemplate{apt}
+	}
+
+	for _, st := range []struct {
+		transformer policy.Transformer
+		input       userstore.ResourceID
+		output      userstore.ResourceID
+	}{
+		{policy.TransformerUUID, datatype.String, datatype.UUID},
+		{withName(policy.TransformerEmail, "EmailToID"), datatype.Email, datatype.Email},
+		{withName(policy.TransformerFullName, "FullNameToID"), datatype.String, datatype.String},
+		{withName(policy.TransformerSSN, "SSNToID"), datatype.SSN, datatype.SSN},
+		{withName(policy.TransformerCreditCard, "CreditCardToID"), datatype.String, datatype.String},
+		{policy.TransformerPassthrough, datatype.String, datatype.String},
+	} {
+		tf := st.transformer
+		tf.InputDataType = st.input
+		tf.OutputDataType = st.output
+		tf.IsSystem = true
+		if tf.Function == "" {
+			tf.Function = "function transform(data, params) {\n\treturn data;\n}"
+		}
+		s.transformers[tf.ID] = []policy.Transformer{tf}
+	}
+}
+
+func withName(tf policy.Transformer, name string) policy.Transformer {
+	tf.Name = name
+	return tf
+}
+
+// ServeHTTP implements http.Handler, so that the fake can also be mounted in another server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Mount serves the tokenizer routes from a fake IDP server, so that an idp.Client created with
+// fakeidp.Server.Client can use its embedded TokenizerClient
+func (s *Server) Mount(f *fakeidp.Server) {
+	f.Handle(paths.TokenizerBasePath+"/", s)
+}
+
+// URL returns the base URL of the fake server
+func (s *Server) URL() string {
+	return s.httpServer.URL
+}
+
+// Close shuts down the fake server
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// Client returns an idp.TokenizerClient configured to talk to the fake server
+func (s *Server) Client(opts ...idp.Option) *idp.TokenizerClient {
+	opts = append([]idp.Option{idp.JSONClient(jsonclient.HeaderAuth("AccessToken faketokenizer"))}, opts...)
+	return idp.NewTokenizerClient(s.URL(), opts...)
+}
@@ -0,0 +1,357 @@
+package faketokenizer
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/tokenizer"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+// maxTokenAttempts is how many times a token is regenerated if it collides with an existing one
+const maxTokenAttempts = 10
+
+// token is a stored token along with the data it resolves to. The AccessPolicy and Transformer of
+// its InspectTokenResponse are refreshed with their latest versions when the token is inspected.
+type token struct {
+	tokenizer.InspectTokenResponse
+	data string
+}
+
+// tokenError is an error that should be returned with a specific status code
+type tokenError struct {
+	status int
+	err    error
+}
+
+func newTokenError(status int, format string, args ...interface{}) *tokenError {
+	return &tokenError{status: status, err: ucerr.Friendlyf(nil, format, args...)}
+}
+
+func (te *tokenError) write(w http.ResponseWriter) {
+	fakeserver.WriteError(w, te.status, "%s", ucerr.UserFriendlyMessage(te.err))
+}
+
+// resolveTokenResources resolves the transformer and access policy of a token, and must be called with s.mu held
+func (s *Server) resolveTokenResources(transformerRID userstore.ResourceID, accessPolicyRID userstore.ResourceID) (policy.Transformer, policy.AccessPolicy, *tokenError) {
+	tf, found := s.resolveTransformer(transformerRID)
+	if !found {
+		return tf, policy.AccessPolicy{}, newTokenError(http.StatusNotFound, "transformer %v not found", transformerRID)
+	}
+	ap, found := s.resolvePolicy(accessPolicyRID)
+	if !found {
+		return tf, ap, newTokenError(http.StatusNotFound, "access policy %v not found", accessPolicyRID)
+	}
+	return tf, ap, nil
+}
+
+// findTokens returns the existing tokens for data, and must be called with s.mu held
+func (s *Server) findTokens(data string, tf policy.Transformer, ap policy.AccessPolicy) []string {
+	var tokens []string
+	for value, t := range s.tokens {
+		if t.data == data && t.Transformer.ID == tf.ID && t.AccessPolicy.ID == ap.ID {
+			tokens = append(tokens, value)
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// createToken creates a token, or returns an existing one if the transformer has
+// ReuseExistingToken set, and must be called with s.mu held
+func (s *Server) createToken(data string, tf policy.Transformer, ap policy.AccessPolicy) (string, *tokenError) {
+	if tf.TransformType != policy.TransformTypeTokenizeByValue && tf.TransformType != policy.TransformTypeTokenizeByReference {
+		return "", newTokenError(http.StatusBadRequest, "transformer '%s' is of type %v, which can't create tokens", tf.Name, tf.TransformType)
+	}
+
+	if tf.ReuseExistingToken {
+		if existing := s.findTokens(data, tf, ap); len(existing) > 0 {
+			return existing[0], nil
+		}
+	}
+
+	// tokens by value are derived from the data where a Go implementation of the transformer
+	// exists, while tokens by reference are always opaque
+	var value string
+	for attempt := 0; attempt < maxTokenAttempts; attempt++ {
+		value = fakeserver.NewID().String()
+		if tf.TransformType == policy.TransformTypeTokenizeByValue && tf.HasLocalImplementation() {
+			v, err := tf.ApplyLocal(data, "")
+			if err != nil {
+				return "", &tokenError{status: http.StatusBadRequest, err: ucerr.Wrap(err)}
+			}
+			value = v
+		}
+		if _, found := s.tokens[value]; !found {
+			break
+		}
+	}
+	if _, found := s.tokens[value]; found {
+		return "", newTokenError(http.StatusConflict, "could not generate a unique token for transformer '%s'", tf.Name)
+	}
+
+	now := time.Now().UTC()
+	s.tokens[value] = &token{
+		InspectTokenResponse: tokenizer.InspectTokenResponse{
+			Token:        value,
+			ID:           fakeserver.NewID(),
+			Created:      now,
+			Updated:      now,
+			AccessPolicy: ap,
+			Transformer:  tf,
+		},
+		data: data,
+	}
+	return value, nil
+}
+
+// accessPolicyContext returns the context an access policy is evaluated in for a request
+func accessPolicyContext(r *http.Request, action policy.Action, clientContext policy.ClientContext, purposes []userstore.ResourceID) policy.AccessPolicyContext {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	purposeNames := []string{}
+	for _, p := range purposes {
+		if p.Name != "" {
+			purposeNames = append(purposeNames, p.Name)
+		} else {
+			purposeNames = append(purposeNames, p.ID.String())
+		}
+	}
+
+	if clientContext == nil {
+		clientContext = policy.ClientContext{}
+	}
+	return policy.AccessPolicyContext{
+		Server: policy.ServerContext{
+			IPAddress:    ip,
+			Action:       action,
+			PurposeNames: purposeNames,
+		},
+		Client: clientContext,
+	}
+}
+
+// allowed evaluates the current version of a token's access policy, and must be called with s.mu
+// held. Tokens whose policy has been deleted are never allowed.
+func (s *Server) allowed(r *http.Request, t *token, apc policy.AccessPolicyContext) (bool, *tokenError) {
+	ap, found := latest(s.policies[t.AccessPolicy.ID])
+	if !found {
+		return false, nil
+	}
+	allowed, err := s.evaluate(r.Context(), ap, apc)
+	if err != nil {
+		return false, &tokenError{status: http.StatusBadRequest, err: ucerr.Wrap(err)}
+	}
+	return allowed, nil
+}
+
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != paths.BaseTokenPath {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req tokenizer.CreateTokenRequest
+		if !fakeserver.ReadValidJSON(w, r, &req) {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		tf, ap, te := s.resolveTokenResources(req.TransformerRID, req.AccessPolicyRID)
+		if te != nil {
+			te.write(w)
+			return
+		}
+		value, te := s.createToken(req.Data, tf, ap)
+		if te != nil {
+			te.write(w)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, tokenizer.CreateTokenResponse{Token: value})
+
+	case http.MethodDelete:
+		value := r.URL.Query().Get("token")
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if _, found := s.tokens[value]; !found {
+			fakeserver.WriteError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		delete(s.tokens, value)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// handleResolveTokens returns an empty value for each token whose access policy denies access
+func (s *Server) handleResolveTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.ResolveTokensRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apc := accessPolicyContext(r, policy.ActionResolve, req.Context, req.Purposes)
+	resp := make([]tokenizer.ResolveTokenResponse, 0, len(req.Tokens))
+	for _, value := range req.Tokens {
+		t, found := s.tokens[value]
+		if !found {
+			fakeserver.WriteError(w, http.StatusNotFound, "token '%s' not found", value)
+			return
+		}
+		allowed, te := s.allowed(r, t, apc)
+		if te != nil {
+			te.write(w)
+			return
+		}
+
+		res := tokenizer.ResolveTokenResponse{Token: value}
+		if allowed {
+			res.Data = t.data
+		}
+		resp = append(resp, res)
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleInspectToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.InspectTokenRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, found := s.tokens[req.Token]
+	if !found {
+		fakeserver.WriteError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	allowed, te := s.allowed(r, t, accessPolicyContext(r, policy.ActionInspect, nil, nil))
+	if te != nil {
+		te.write(w)
+		return
+	}
+	if !allowed {
+		fakeserver.WriteError(w, http.StatusForbidden, "access denied by access policy")
+		return
+	}
+
+	resp := t.InspectTokenResponse
+	if ap, found := latest(s.policies[resp.AccessPolicy.ID]); found {
+		resp.AccessPolicy = ap
+	}
+	if tf, found := latest(s.transformers[resp.Transformer.ID]); found {
+		resp.Transformer = tf
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleLookupTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.LookupTokensRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf, ap, te := s.resolveTokenResources(req.TransformerRID, req.AccessPolicyRID)
+	if te != nil {
+		te.write(w)
+		return
+	}
+	tokens := s.findTokens(req.Data, tf, ap)
+	if tokens == nil {
+		tokens = []string{}
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, tokenizer.LookupTokensResponse{Tokens: tokens})
+}
+
+// handleLookupOrCreateTokens fails the whole request if any item fails, as the server does
+func (s *Server) handleLookupOrCreateTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.LookupOrCreateTokensRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// resolve everything before creating anything, so a failed request has no effect
+	transformers := make([]policy.Transformer, len(req.Data))
+	policies := make([]policy.AccessPolicy, len(req.Data))
+	for i := range req.Data {
+		tf, ap, te := s.resolveTokenResources(req.TransformerRIDs[i], req.AccessPolicyRIDs[i])
+		if te != nil {
+			te.write(w)
+			return
+		}
+		if tf.TransformType != policy.TransformTypeTokenizeByValue && tf.TransformType != policy.TransformTypeTokenizeByReference {
+			fakeserver.WriteError(w, http.StatusBadRequest, "transformer '%s' is of type %v, which can't create tokens", tf.Name, tf.TransformType)
+			return
+		}
+		if tf.TransformType == policy.TransformTypeTokenizeByValue && tf.HasLocalImplementation() {
+			if _, err := tf.ApplyLocal(req.Data[i], ""); err != nil {
+				fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+				return
+			}
+		}
+		transformers[i], policies[i] = tf, ap
+	}
+
+	tokens := make([]string, 0, len(req.Data))
+	for i, data := range req.Data {
+		if existing := s.findTokens(data, transformers[i], policies[i]); len(existing) > 0 {
+			tokens = append(tokens, existing[0])
+			continue
+		}
+		value, te := s.createToken(data, transformers[i], policies[i])
+		if te != nil {
+			te.write(w)
+			return
+		}
+		tokens = append(tokens, value)
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, tokenizer.LookupOrCreateTokensResponse{Tokens: tokens})
+}
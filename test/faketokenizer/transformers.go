@@ -0,0 +1,226 @@
+package faketokenizer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/idp/paths"
+	"userclouds.com/idp/policy"
+	"userclouds.com/idp/tokenizer"
+	"userclouds.com/idp/userstore"
+	"userclouds.com/infra/ucerr"
+	"userclouds.com/test/internal/fakeserver"
+)
+
+func (s *Server) resolveTransformer(rid userstore.ResourceID) (policy.Transformer, bool) {
+	if !rid.ID.IsNil() {
+		tf, found := latest(s.transformers[rid.ID])
+		return tf, found && (rid.Name == "" || strings.EqualFold(rid.Name, tf.Name))
+	}
+	for _, versions := range s.transformers {
+		if tf, found := latest(versions); found && rid.Name != "" && strings.EqualFold(rid.Name, tf.Name) {
+			return tf, true
+		}
+	}
+	return policy.Transformer{}, false
+}
+
+func (s *Server) handleTransformers(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourcePath(r, paths.BaseTransformerPath)
+	if !ok {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versionOf := func(tf policy.Transformer) int { return tf.Version }
+	idOf := func(tf policy.Transformer) uuid.UUID { return tf.ID }
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req tokenizer.CreateTransformerRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.Transformer) {
+			return
+		}
+		tf := req.Transformer
+		for _, versions := range s.transformers {
+			existing, _ := latest(versions)
+			if strings.EqualFold(existing.Name, tf.Name) || existing.ID == tf.ID {
+				if tf.ID.IsNil() {
+					tf.ID = existing.ID
+				}
+				tf.Version = existing.Version
+				tf.IsSystem = existing.IsSystem
+				fakeserver.WriteConflict(w, existing.ID, fakeserver.Identical(existing, tf), "transformer '%s' already exists", existing.Name)
+				return
+			}
+		}
+		if tf.ID.IsNil() {
+			tf.ID = fakeserver.NewID()
+		}
+		tf.Version = 0
+		tf.IsSystem = false
+		s.transformers[tf.ID] = []policy.Transformer{tf}
+		fakeserver.WriteJSON(w, http.StatusCreated, tf)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		version, err := versionParam(r, "transformer_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		name := r.URL.Query().Get("transformer_name")
+
+		var matches []policy.Transformer
+		for _, versions := range s.transformers {
+			if name == "" {
+				tf, _ := latest(versions)
+				matches = append(matches, tf)
+			} else if tf, found := findVersion(versions, version, versionOf); found && strings.EqualFold(tf.Name, name) {
+				matches = append(matches, tf)
+			}
+		}
+		fakeserver.WriteList(w, r, matches, idOf)
+
+	case r.Method == http.MethodGet:
+		version, err := versionParam(r, "transformer_version", false)
+		if err != nil {
+			fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+			return
+		}
+		tf, found := findVersion(s.transformers[id], version, versionOf)
+		if !found {
+			fakeserver.WriteNotFound(w, "transformer", id)
+			return
+		}
+		fakeserver.WriteJSON(w, http.StatusOK, tf)
+
+	case r.Method == http.MethodPut:
+		existing, found := latest(s.transformers[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "transformer", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system transformer %v cannot be modified", id)
+			return
+		}
+		var req tokenizer.UpdateTransformerRequest
+		if !fakeserver.ReadJSON(w, r, &req) || !fakeserver.Validate(w, req.Transformer) {
+			return
+		}
+		tf := req.Transformer
+		tf.ID = id
+		tf.Version = existing.Version
+		tf.IsSystem = false
+		if fakeserver.Identical(existing, tf) {
+			fakeserver.WriteJSON(w, http.StatusOK, existing)
+			return
+		}
+		tf.Version = existing.Version + 1
+		s.transformers[id] = append(s.transformers[id], tf)
+		fakeserver.WriteJSON(w, http.StatusOK, tf)
+
+	case r.Method == http.MethodDelete:
+		existing, found := latest(s.transformers[id])
+		if !found {
+			fakeserver.WriteNotFound(w, "transformer", id)
+			return
+		}
+		if existing.IsSystem {
+			fakeserver.WriteError(w, http.StatusBadRequest, "system transformer %v cannot be deleted", id)
+			return
+		}
+		delete(s.transformers, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
+
+// handleTestTransformer runs a transformer with its Go implementation, so only the system
+// transformers and passthrough transformers can be tested
+func (s *Server) handleTestTransformer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeserver.WriteMethodNotAllowed(w, r)
+		return
+	}
+
+	var req tokenizer.TestTransformerRequest
+	if !fakeserver.ReadValidJSON(w, r, &req) {
+		return
+	}
+
+	value, err := req.Transformer.ApplyLocal(req.Data, "")
+	if err != nil {
+		fakeserver.WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return
+	}
+	fakeserver.WriteJSON(w, http.StatusOK, tokenizer.TestTransformerResponse{Value: value})
+}
+
+// handleSecrets stores secrets, which may share a name to represent versions of the same secret
+func (s *Server) handleSecrets(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourcePath(r, paths.BaseSecretPath)
+	if !ok {
+		fakeserver.WriteError(w, http.StatusNotFound, "path '%s' not found", r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && id.IsNil():
+		var req tokenizer.CreateSecretRequest
+		if !fakeserver.ReadJSON(w, r, &req) {
+			return
+		}
+		secret := req.Secret
+		if secret.ID.IsNil() {
+			secret.ID = fakeserver.NewID()
+		}
+		if secret.Name == "" || len(secret.Name) > 128 {
+			fakeserver.WriteError(w, http.StatusBadRequest, "secret name length has to be between 1 and 128 (length: %d)", len(secret.Name))
+			return
+		}
+		if _, found := s.secrets[secret.ID]; found {
+			fakeserver.WriteConflict(w, secret.ID, false, "secret %v already exists", secret.ID)
+			return
+		}
+
+		// keep creation times strictly increasing so that versions are ordered even within a clock tick
+		secret.Created = time.Now().UnixMicro()
+		for _, existing := range s.secrets {
+			if existing.Created >= secret.Created {
+				secret.Created = existing.Created + 1
+			}
+		}
+		s.secrets[secret.ID] = secret
+		fakeserver.WriteJSON(w, http.StatusCreated, secret)
+
+	case r.Method == http.MethodGet && id.IsNil():
+		var secrets []policy.Secret
+		for _, secret := range s.secrets {
+			secrets = append(secrets, secret)
+		}
+		fakeserver.WriteList(w, r, secrets, func(secret policy.Secret) uuid.UUID { return secret.ID })
+
+	case r.Method == http.MethodDelete && !id.IsNil():
+		if _, found := s.secrets[id]; !found {
+			fakeserver.WriteNotFound(w, "secret", id)
+			return
+		}
+		delete(s.secrets, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeserver.WriteMethodNotAllowed(w, r)
+	}
+}
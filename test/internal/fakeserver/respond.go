@@ -0,0 +1,192 @@
+// Package fakeserver contains the request and response helpers shared by the fake servers in test,
+// so that they return errors and paginated lists in the same shape as the real APIs
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gofrs/uuid"
+
+	"userclouds.com/infra/jsonclient"
+	"userclouds.com/infra/pagination"
+	"userclouds.com/infra/ucerr"
+)
+
+// errorResponse mirrors the JSON error bodies returned by the real APIs
+type errorResponse struct {
+	Error          string `json:"error"`
+	HTTPStatusCode int    `json:"http_status_code"`
+}
+
+// conflictResponse mirrors the structured error returned when creating a resource that already exists,
+// which jsonclient.CreateIfNotExists relies on
+type conflictResponse struct {
+	Error          jsonclient.SDKStructuredError `json:"error"`
+	HTTPStatusCode int                           `json:"http_status_code"`
+}
+
+// WriteJSON writes body as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteError writes an error response with the given status
+func WriteError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	WriteJSON(w, status, errorResponse{Error: fmt.Sprintf(format, args...), HTTPStatusCode: status})
+}
+
+// WriteConflict writes the error returned when a resource with the given ID already exists
+func WriteConflict(w http.ResponseWriter, id uuid.UUID, identical bool, format string, args ...interface{}) {
+	WriteJSON(w, http.StatusConflict, conflictResponse{
+		Error: jsonclient.SDKStructuredError{
+			Error:     fmt.Sprintf(format, args...),
+			ID:        id,
+			Identical: identical,
+		},
+		HTTPStatusCode: http.StatusConflict,
+	})
+}
+
+// WriteNotFound writes the error returned when a resource doesn't exist
+func WriteNotFound(w http.ResponseWriter, kind string, id uuid.UUID) {
+	WriteError(w, http.StatusNotFound, "%s %v not found", kind, id)
+}
+
+// WriteMethodNotAllowed writes the error returned for an unsupported method
+func WriteMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusMethodNotAllowed, "method %s not allowed for %s", r.Method, r.URL.Path)
+}
+
+// ReadJSON decodes the request body into v, writing a bad request error and returning false if it can't
+func ReadJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		WriteError(w, http.StatusBadRequest, "could not parse request body: %v", err)
+		return false
+	}
+	return true
+}
+
+// Validateable is implemented by the generated Validate methods on request types
+type Validateable interface {
+	Validate() error
+}
+
+// ReadValidJSON decodes the request body into v and validates it, writing a bad request error and
+// returning false if either fails
+func ReadValidJSON(w http.ResponseWriter, r *http.Request, v Validateable) bool {
+	return ReadJSON(w, r, v) && Validate(w, v)
+}
+
+// Validate writes a bad request error and returns false if v isn't valid
+func Validate(w http.ResponseWriter, v Validateable) bool {
+	if err := v.Validate(); err != nil {
+		WriteError(w, http.StatusBadRequest, "%s", ucerr.UserFriendlyMessage(err))
+		return false
+	}
+	return true
+}
+
+// NewID returns a new random ID for a resource
+func NewID() uuid.UUID {
+	return uuid.Must(uuid.NewV4())
+}
+
+func idCursor(id uuid.UUID) pagination.Cursor {
+	return pagination.Cursor("id:" + id.String())
+}
+
+// Paginate returns the page of items (ordered by ID) requested by the request's pagination query
+// parameters. Items that share an ID, like the versions of a resource, are kept on the same page,
+// since the cursors only identify an ID.
+func Paginate[T any](r *http.Request, items []T, idOf func(T) uuid.UUID) ([]T, pagination.ResponseFields, error) {
+	var rf pagination.ResponseFields
+
+	pager, err := pagination.NewPaginatorFromRequest(r)
+	if err != nil {
+		return nil, rf, ucerr.Wrap(err)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return idOf(items[i]).String() < idOf(items[j]).String()
+	})
+
+	cursorID := ""
+	if c := pager.GetCursor(); c != pagination.CursorBegin && c != pagination.CursorEnd {
+		if len(c) < 3 || c[:3] != "id:" {
+			return nil, rf, ucerr.Errorf("unsupported cursor '%s'", c)
+		}
+		cursorID = string(c[3:])
+	}
+
+	limit := pager.GetLimit()
+	var start, end int
+	if pager.IsForward() {
+		start = sort.Search(len(items), func(i int) bool { return idOf(items[i]).String() > cursorID })
+		end = start + limit
+		if end > len(items) {
+			end = len(items)
+		}
+		for end > start && end < len(items) && idOf(items[end]) == idOf(items[end-1]) {
+			end++
+		}
+	} else {
+		end = len(items)
+		if cursorID != "" {
+			end = sort.Search(len(items), func(i int) bool { return idOf(items[i]).String() >= cursorID })
+		}
+		start = end - limit
+		if start < 0 {
+			start = 0
+		}
+		for start < end && start > 0 && idOf(items[start-1]) == idOf(items[start]) {
+			start--
+		}
+	}
+
+	page := items[start:end]
+	if len(page) > 0 {
+		rf.HasPrev = start > 0
+		rf.Prev = idCursor(idOf(page[0]))
+		rf.HasNext = end < len(items)
+		rf.Next = idCursor(idOf(page[len(page)-1]))
+	}
+
+	return page, rf, nil
+}
+
+// ListResponse has the same shape as the List*Response types in idp
+type ListResponse[T any] struct {
+	Data []T `json:"data"`
+	pagination.ResponseFields
+}
+
+// WriteList writes the requested page of items in the same shape as the List*Response types in idp
+func WriteList[T any](w http.ResponseWriter, r *http.Request, items []T, idOf func(T) uuid.UUID) {
+	page, rf, err := Paginate(r, items, idOf)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if page == nil {
+		page = []T{}
+	}
+	WriteJSON(w, http.StatusOK, ListResponse[T]{Data: page, ResponseFields: rf})
+}
+
+// Identical returns true if two resources serialize to the same JSON
+func Identical(a interface{}, b interface{}) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ab) == string(bb)
+}